@@ -20,6 +20,7 @@ import (
 	"github.com/nalej/monitoring/internal/pkg/metrics-collector/server"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/nalej/monitoring/pkg/provider/query"
 	"github.com/rs/zerolog/log"
@@ -50,6 +51,12 @@ func init() {
 	runCmd.PersistentFlags().StringVar(&config.Kubeconfig, "kubeconfig", kubeconfigpath, "Kubernetes config file")
 	runCmd.PersistentFlags().BoolVar(&config.InCluster, "in-cluster", false, "Running inside Kubernetes cluster (--kubeconfig is ignored)")
 
+	runCmd.Flags().StringVar(&config.ServerCertPath, "serverCertPath", "", "Server cert path; serve plain text if empty")
+	runCmd.Flags().StringVar(&config.ClientCACertPath, "clientCACertPath", "", "CA certificate path to verify client certificates; clients are not verified if empty")
+	runCmd.Flags().StringSliceVar(&config.QuerySubjects, "querySubjects", nil, "Client certificate subjects (common or distinguished name) allowed to execute queries; any client if empty")
+	runCmd.Flags().IntVar(&config.QueryParallelism, "queryParallelism", 4, "Maximum number of concurrent queries for a single request")
+	runCmd.Flags().DurationVar(&config.QueryTimeout, "queryTimeout", 10*time.Second, "Deadline for all queries of a single request")
+
 	// Configuration for the various retrieval backends - see pkg/provider/query/*/config.go
 	config.QueryProviders = make(query.ProviderConfigs, query.Registry.NumEntries())
 	for queryProviderType, configFunc := range query.Registry {
@@ -17,7 +17,9 @@
 package commands
 
 import (
+	"github.com/nalej/monitoring/internal/pkg/lifecycle"
 	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server/remotewrite"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
@@ -38,11 +40,20 @@ var runCmd = &cobra.Command{
 func init() {
 	runCmd.Flags().IntVar(&config.GrpcPort, "grpcport", 8420, "GrpcPort for Monitoring API")
 	runCmd.Flags().IntVar(&config.HttpPort, "httpport", 8421, "GrpcPort for Monitoring API")
-	runCmd.PersistentFlags().BoolVar(&config.UseTLS, "useTLS", true, "Use TLS to connect to application cluster")
+	runCmd.PersistentFlags().BoolVar(&config.UseTLS, "useTLS", true, "Use mutual TLS with the monitoring manager and the HTTP gateway")
 	runCmd.PersistentFlags().BoolVar(&config.SkipServerCertValidation, "skipServerCertValidation", false, "Don't validate TLS certificates")
 	runCmd.PersistentFlags().StringVar(&config.CACertPath, "caCertPath", "", "Alternative certificate path to use for validation")
 	runCmd.PersistentFlags().StringVar(&config.ClientCertPath, "clientCertPath", "", "Client cert path")
+	runCmd.PersistentFlags().StringVar(&config.ServerCertPath, "serverCertPath", "", "Server cert path for the gRPC API")
 	runCmd.PersistentFlags().StringVar(&config.MonitoringManagerAddress, "monitoringManagerAddress", "", "Address of the monitoring manager service")
+	runCmd.PersistentFlags().StringVar(&config.AuthKeySetPath, "authKeySetPath", "", "JSON Web Key Set file to verify bearer JWTs")
+	runCmd.PersistentFlags().StringVar(&config.AuthTokensPath, "authTokensPath", "", "JSON file with static API tokens")
+	runCmd.PersistentFlags().StringVar(&config.AuthOrganizationClaim, "authOrganizationClaim", "organizationID", "JWT claim with the organization of the token")
+	runCmd.PersistentFlags().StringVar(&config.RemoteWriteTargetsPath, "remoteWriteTargetsPath", "", "JSON file with the remote write targets of organizations")
+	runCmd.PersistentFlags().DurationVar(&config.RemoteWriteInterval, "remoteWriteInterval", remotewrite.DefaultInterval, "Interval between remote write pushes")
+	runCmd.PersistentFlags().IntVar(&config.RemoteWriteQueueSize, "remoteWriteQueueSize", remotewrite.DefaultQueueSize, "Maximum pending remote write requests per target")
+	runCmd.PersistentFlags().IntVar(&config.RemoteWriteMaxRetries, "remoteWriteMaxRetries", remotewrite.DefaultMaxRetries, "Retries of a failed remote write request")
+	runCmd.PersistentFlags().DurationVar(&config.ShutdownTimeout, "shutdownTimeout", lifecycle.DefaultShutdownTimeout, "Time to drain in-flight requests on shutdown")
 	rootCmd.AddCommand(runCmd)
 }
 
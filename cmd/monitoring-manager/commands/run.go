@@ -17,7 +17,12 @@
 package commands
 
 import (
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/nalej/monitoring/internal/pkg/lifecycle"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/clients"
 	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/server"
+	"github.com/nalej/monitoring/internal/pkg/refresh"
+	"github.com/nalej/monitoring/internal/pkg/usage"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"time"
@@ -37,6 +42,7 @@ var runCmd = &cobra.Command{
 
 func init() {
 	runCmd.Flags().IntVar(&config.Port, "port", 8423, "GrpcPort for Monitoring Manager gRPC API")
+	runCmd.Flags().IntVar(&config.MetricsPort, "metricsPort", 8424, "Port for the Prometheus metrics of the Monitoring Manager; disabled if 0")
 	runCmd.PersistentFlags().StringVar(&config.SystemModelAddress, "systemModelAddress", "localhost:8800", "System Model address (host:port)")
 	runCmd.PersistentFlags().StringVar(&config.EdgeInventoryProxyAddress, "edgeInventoryProxyAddress", "localhost:5544", "Edge Inventory Proxy address (host:port)")
 	runCmd.PersistentFlags().StringVar(&config.AppClusterPrefix, "appClusterPrefix", "appcluster", "Prefix for application cluster hostnames")
@@ -45,7 +51,27 @@ func init() {
 	runCmd.PersistentFlags().BoolVar(&config.SkipServerCertValidation, "skipServerCertValidation", false, "Don't validate TLS certificates")
 	runCmd.PersistentFlags().StringVar(&config.CACertPath, "caCertPath", "", "Alternative certificate path to use for validation")
 	runCmd.PersistentFlags().StringVar(&config.ClientCertPath, "clientCertPath", "", "Client cert path")
+	runCmd.PersistentFlags().StringVar(&config.ServerCertPath, "serverCertPath", "", "Server cert path; serve plain text if empty")
+	runCmd.PersistentFlags().StringVar(&config.ClientCACertPath, "clientCACertPath", "", "CA certificate path to verify client certificates; clients are not verified if empty")
+	runCmd.PersistentFlags().DurationVar(&config.AppClusterIdleTimeout, "appClusterIdleTimeout", clients.DefaultIdleTimeout, "Time unused application cluster connections are kept open")
+	runCmd.PersistentFlags().DurationVar(&config.AppClusterKeepalive, "appClusterKeepalive", clients.DefaultKeepalive, "Time between pings on active application cluster connections")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterHostnameTTL, "clusterHostnameTTL", time.Minute, "TTL of the cached cluster hostnames")
+	runCmd.PersistentFlags().IntVar(&config.ClusterBreakerFailures, "clusterBreakerFailures", breaker.DefaultFailureThreshold, "Consecutive failures that stop the requests to an application cluster")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterBreakerOpenTimeout, "clusterBreakerOpenTimeout", breaker.DefaultOpenTimeout, "Time requests to a failing application cluster are stopped before probing it again")
+	runCmd.PersistentFlags().IntVar(&config.ClusterReadAttempts, "clusterReadAttempts", breaker.DefaultRetry().Attempts, "Maximum attempts of a read from an unreachable application cluster")
+	runCmd.PersistentFlags().DurationVar(&config.CollectionInterval, "collectionInterval", 0, "Time between background collections of the stats of every cluster; only collected on request if 0")
+	runCmd.PersistentFlags().IntVar(&config.CollectionParallelism, "collectionParallelism", server.DefaultCollectionParallelism, "Number of clusters collected at once in the background")
+	runCmd.PersistentFlags().DurationVar(&config.CollectionJitter, "collectionJitter", 10*time.Second, "Maximum random delay of the background collection of each cluster")
+	runCmd.PersistentFlags().StringVar(&config.UsageStorePath, "usageStorePath", "", "File of the usage history store; usage is not recorded if empty")
+	runCmd.PersistentFlags().DurationVar(&config.UsageSampleInterval, "usageSampleInterval", server.DefaultUsageSampleInterval, "Time between samples of the usage of every organization")
+	runCmd.PersistentFlags().DurationVar(&config.UsageHourlyRetention, "usageHourlyRetention", usage.DefaultHourlyRetention, "Time usage is kept by hour before it is rolled up by day")
+	runCmd.PersistentFlags().DurationVar(&config.UsageRetention, "usageRetention", usage.DefaultRetention, "Time usage is kept")
+	runCmd.PersistentFlags().StringVar(&config.PricingPath, "pricingPath", "", "JSON file with the prices of the resource usage; costs are not reported if empty")
 	runCmd.PersistentFlags().DurationVar(&config.CacheTTL, "cacheTTL", time.Minute, "TTL duration for the stats cache (ex: 10s, 5m). Defaults to 1m (1 minute).")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterSummaryCacheTTL, "clusterSummaryCacheTTL", 30*time.Second, "TTL duration for the cluster summary cache")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterStatsCacheTTL, "clusterStatsCacheTTL", 30*time.Second, "TTL duration for the cluster statistics cache")
+	runCmd.PersistentFlags().DurationVar(&config.CacheMaxStale, "cacheMaxStale", refresh.DefaultMaxStale, "Time expired cache entries are served while they are refreshed")
+	runCmd.PersistentFlags().DurationVar(&config.ShutdownTimeout, "shutdownTimeout", lifecycle.DefaultShutdownTimeout, "Time to drain in-flight requests on shutdown")
 	rootCmd.AddCommand(runCmd)
 }
 
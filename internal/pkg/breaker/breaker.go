@@ -0,0 +1,329 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Circuit breakers and retries for the calls to remote services
+
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultFailureThreshold is the number of consecutive failures that opens a breaker
+	DefaultFailureThreshold = 5
+	// DefaultOpenTimeout is the time an open breaker rejects calls before probing
+	DefaultOpenTimeout = 30 * time.Second
+)
+
+// State of a circuit breaker
+type State int
+
+const (
+	// Closed breakers let every call through
+	Closed State = iota
+	// HalfOpen breakers let a single probe through
+	HalfOpen
+	// Open breakers reject every call
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// Status is a snapshot of a breaker
+type Status struct {
+	Name                string
+	State               State
+	ConsecutiveFailures int
+	// Time the breaker last opened; zero if it never did
+	OpenedAt time.Time
+	// Last failure; empty if there was none
+	LastError string
+}
+
+// Breaker stops calling a remote service after a number of consecutive
+// failures. Once open, calls are rejected until the open timeout expires;
+// then a single probe is let through, which closes the breaker if it
+// succeeds or opens it again if it fails.
+type Breaker struct {
+	name             string
+	failureThreshold int
+	openTimeout      time.Duration
+	now              func() time.Time
+
+	lock      sync.Mutex
+	state     State
+	failures  int
+	openedAt  time.Time
+	lastError string
+	// Whether the probe of a half-open breaker is in progress
+	probing bool
+}
+
+// NewBreaker creates a closed breaker that opens after failureThreshold
+// consecutive failures and probes after openTimeout.
+func NewBreaker(name string, failureThreshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		now:              time.Now,
+	}
+}
+
+// Allow returns an error if the call must not be made. Allowed calls must
+// report their outcome with Success, Failure or Release.
+func (b *Breaker) Allow() derrors.Error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Open:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return derrors.NewUnavailableError(fmt.Sprintf("circuit breaker of %s is open", b.name))
+		}
+		b.setState(HalfOpen)
+	case HalfOpen:
+		if b.probing {
+			return derrors.NewUnavailableError(fmt.Sprintf("circuit breaker of %s is half-open and probing", b.name))
+		}
+	}
+	b.probing = b.state == HalfOpen
+	return nil
+}
+
+// Rejecting returns whether calls are being rejected right now, so callers
+// can tell the service was skipped rather than failed
+func (b *Breaker) Rejecting() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Open:
+		return b.now().Sub(b.openedAt) < b.openTimeout
+	case HalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+// Success reports a call that reached the remote service
+func (b *Breaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != Closed {
+		b.setState(Closed)
+	}
+}
+
+// Failure reports a call that could not reach the remote service
+func (b *Breaker) Failure(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.lastError = err.Error()
+	b.probing = false
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.failureThreshold) {
+		b.openedAt = b.now()
+		b.setState(Open)
+	}
+}
+
+// Release reports a call whose outcome says nothing about the remote
+// service, like one cancelled by the caller
+func (b *Breaker) Release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+}
+
+// Status returns the current state of the breaker
+func (b *Breaker) Status() Status {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return Status{
+		Name:                b.name,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		OpenedAt:            b.openedAt,
+		LastError:           b.lastError,
+	}
+}
+
+// setState changes the state, must be called with the lock held
+func (b *Breaker) setState(state State) {
+	log.Info().Str("breaker", b.name).Str("from", b.state.String()).Str("to", state.String()).
+		Int("failures", b.failures).Str("lastError", b.lastError).Msg("circuit breaker state changed")
+	b.state = state
+}
+
+// Call executes an idempotent call through the breaker, retrying the
+// failures with a jittered exponential backoff. Only errors that show the
+// remote service could not be reached count as failures.
+func (b *Breaker) Call(ctx context.Context, retry Retry, call func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if derr := b.Allow(); derr != nil {
+			// The breaker opened with our own failures, report those
+			if err != nil {
+				return err
+			}
+			return derr
+		}
+
+		err = call(ctx)
+		switch {
+		case err == nil:
+			b.Success()
+			return nil
+		case ctx.Err() != nil:
+			b.Release()
+			return err
+		case !IsUnreachable(err):
+			b.Success()
+			return err
+		}
+		b.Failure(err)
+
+		if attempt+1 >= retry.Attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retry.backoff(attempt)):
+		}
+	}
+}
+
+// IsUnreachable returns whether a gRPC error shows the remote service could
+// not be reached or could not answer in time
+func IsUnreachable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// Retry policy of the idempotent calls
+type Retry struct {
+	// Attempts is the maximum number of calls, including the first one
+	Attempts int
+	// Backoff is the maximum wait before the first retry. It doubles on
+	// every retry up to MaxBackoff, and the actual wait is random up to it.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry retries once after up to 100ms
+func DefaultRetry() Retry {
+	return Retry{
+		Attempts:   2,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+}
+
+// backoff returns the wait before retrying a failed attempt
+func (r Retry) backoff(attempt int) time.Duration {
+	backoff := r.Backoff << uint(attempt)
+	if backoff > r.MaxBackoff || backoff <= 0 {
+		backoff = r.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// Full jitter, so callers failing at once don't retry at once
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// Registry creates and keeps the breakers of a set of remote services
+type Registry struct {
+	failureThreshold int
+	openTimeout      time.Duration
+
+	lock     sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewRegistry creates a registry of breakers with the given settings
+func NewRegistry(failureThreshold int, openTimeout time.Duration) *Registry {
+	return &Registry{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		breakers:         make(map[string]*Breaker),
+	}
+}
+
+// Get returns the breaker of a remote service, creating it if needed
+func (r *Registry) Get(name string) *Breaker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	breaker, found := r.breakers[name]
+	if !found {
+		breaker = NewBreaker(name, r.failureThreshold, r.openTimeout)
+		r.breakers[name] = breaker
+	}
+	return breaker
+}
+
+// Statuses returns the status of every breaker, sorted by name
+func (r *Registry) Statuses() []Status {
+	r.lock.Lock()
+	breakers := make([]*Breaker, 0, len(r.breakers))
+	for _, breaker := range r.breakers {
+		breakers = append(breakers, breaker)
+	}
+	r.lock.Unlock()
+
+	statuses := make([]Status, 0, len(breakers))
+	for _, breaker := range breakers {
+		statuses = append(statuses, breaker.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Circuit breaker tests
+
+package breaker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("circuit breaker", func() {
+
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	noRetry := Retry{Attempts: 1}
+
+	var now time.Time
+	var breaker *Breaker
+
+	ginkgo.BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		breaker = NewBreaker("cluster-1", 3, time.Minute)
+		breaker.now = func() time.Time { return now }
+	})
+
+	fail := func() error {
+		return breaker.Call(context.Background(), noRetry, func(ctx context.Context) error {
+			return unavailable
+		})
+	}
+
+	succeed := func() error {
+		return breaker.Call(context.Background(), noRetry, func(ctx context.Context) error {
+			return nil
+		})
+	}
+
+	ginkgo.It("should open after consecutive failures", func() {
+		gomega.Expect(fail()).To(gomega.Equal(unavailable))
+		gomega.Expect(fail()).To(gomega.Equal(unavailable))
+		gomega.Expect(succeed()).To(gomega.Succeed())
+		gomega.Expect(breaker.Status().State).To(gomega.Equal(Closed))
+
+		for i := 0; i < 3; i++ {
+			gomega.Expect(fail()).To(gomega.Equal(unavailable))
+		}
+		gomega.Expect(breaker.Rejecting()).To(gomega.BeTrue())
+		status := breaker.Status()
+		gomega.Expect(status.State).To(gomega.Equal(Open))
+		gomega.Expect(status.ConsecutiveFailures).To(gomega.Equal(3))
+		gomega.Expect(status.OpenedAt).To(gomega.Equal(now))
+		gomega.Expect(status.LastError).To(gomega.ContainSubstring("connection refused"))
+
+		called := false
+		err := breaker.Call(context.Background(), noRetry, func(ctx context.Context) error {
+			called = true
+			return nil
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(called).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should let a single probe through once the open timeout expires", func() {
+		for i := 0; i < 3; i++ {
+			_ = fail()
+		}
+		now = now.Add(time.Minute)
+
+		gomega.Expect(breaker.Rejecting()).To(gomega.BeFalse())
+		gomega.Expect(breaker.Allow()).To(gomega.Succeed())
+		gomega.Expect(breaker.Status().State).To(gomega.Equal(HalfOpen))
+		gomega.Expect(breaker.Rejecting()).To(gomega.BeTrue())
+		gomega.Expect(breaker.Allow()).ToNot(gomega.Succeed())
+
+		// A failed probe opens the breaker again
+		breaker.Failure(unavailable)
+		gomega.Expect(breaker.Status().State).To(gomega.Equal(Open))
+		gomega.Expect(breaker.Status().OpenedAt).To(gomega.Equal(now))
+		gomega.Expect(breaker.Allow()).ToNot(gomega.Succeed())
+
+		// A successful one closes it
+		now = now.Add(time.Minute)
+		gomega.Expect(succeed()).To(gomega.Succeed())
+		gomega.Expect(breaker.Status().State).To(gomega.Equal(Closed))
+		gomega.Expect(breaker.Status().ConsecutiveFailures).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should not count errors of a reachable service", func() {
+		invalid := status.Error(codes.InvalidArgument, "bad query")
+		for i := 0; i < 5; i++ {
+			err := breaker.Call(context.Background(), noRetry, func(ctx context.Context) error {
+				return invalid
+			})
+			gomega.Expect(err).To(gomega.Equal(invalid))
+		}
+		gomega.Expect(breaker.Status().State).To(gomega.Equal(Closed))
+		gomega.Expect(breaker.Status().ConsecutiveFailures).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should not count calls cancelled by the caller", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for i := 0; i < 5; i++ {
+			err := breaker.Call(ctx, noRetry, func(ctx context.Context) error {
+				return status.Error(codes.Canceled, ctx.Err().Error())
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		}
+		gomega.Expect(breaker.Status().ConsecutiveFailures).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should retry unreachable services", func() {
+		calls := 0
+		retry := Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+		err := breaker.Call(context.Background(), retry, func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return unavailable
+			}
+			return nil
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(calls).To(gomega.Equal(3))
+		gomega.Expect(breaker.Status().State).To(gomega.Equal(Closed))
+	})
+
+	ginkgo.It("should stop retrying when the breaker opens", func() {
+		calls := 0
+		retry := Retry{Attempts: 10, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		err := breaker.Call(context.Background(), retry, func(ctx context.Context) error {
+			calls++
+			return unavailable
+		})
+		gomega.Expect(err).To(gomega.Equal(unavailable))
+		gomega.Expect(calls).To(gomega.Equal(3))
+	})
+
+	ginkgo.It("should not retry other errors", func() {
+		calls := 0
+		retry := Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		err := breaker.Call(context.Background(), retry, func(ctx context.Context) error {
+			calls++
+			return errors.New("not a gRPC error")
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(calls).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should keep the jittered backoff within bounds", func() {
+		retry := Retry{Attempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+		for i := 0; i < 100; i++ {
+			gomega.Expect(retry.backoff(0)).To(gomega.BeNumerically("<=", 10*time.Millisecond))
+			gomega.Expect(retry.backoff(2)).To(gomega.BeNumerically("<=", 40*time.Millisecond))
+			gomega.Expect(retry.backoff(10)).To(gomega.BeNumerically("<=", 50*time.Millisecond))
+			gomega.Expect(retry.backoff(10)).To(gomega.BeNumerically(">=", 0))
+		}
+	})
+
+	ginkgo.It("should list the breakers of a registry", func() {
+		registry := NewRegistry(1, time.Minute)
+		gomega.Expect(registry.Get("b")).To(gomega.BeIdenticalTo(registry.Get("b")))
+		registry.Get("a").Failure(unavailable)
+
+		statuses := registry.Statuses()
+		gomega.Expect(statuses).To(gomega.HaveLen(2))
+		gomega.Expect(statuses[0].Name).To(gomega.Equal("a"))
+		gomega.Expect(statuses[0].State).To(gomega.Equal(Open))
+		gomega.Expect(statuses[1].State).To(gomega.Equal(Closed))
+	})
+})
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Authorization of gRPC methods by client certificate subject
+
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// SubjectAuthorizer restricts gRPC methods to clients presenting a verified
+// certificate with an authorized subject. Methods without restrictions are
+// available to every client the transport accepts.
+type SubjectAuthorizer struct {
+	// Authorized subjects by full method name
+	rules map[string]map[string]bool
+}
+
+// NewSubjectAuthorizer creates an authorizer without restrictions
+func NewSubjectAuthorizer() *SubjectAuthorizer {
+	return &SubjectAuthorizer{
+		rules: map[string]map[string]bool{},
+	}
+}
+
+// Restrict a method, in the /package.Service/Method form, to the given
+// subjects. A subject matches either the common name or the complete
+// distinguished name of the client certificate.
+func (a *SubjectAuthorizer) Restrict(fullMethod string, subjects ...string) {
+	authorized, found := a.rules[fullMethod]
+	if !found {
+		authorized = map[string]bool{}
+		a.rules[fullMethod] = authorized
+	}
+	for _, subject := range subjects {
+		authorized[subject] = true
+	}
+}
+
+// Validate checks every restricted method is served by a gRPC server, so a
+// misspelled method name fails at startup instead of leaving the method
+// unrestricted.
+func (a *SubjectAuthorizer) Validate(services map[string]grpc.ServiceInfo) derrors.Error {
+	served := map[string]bool{}
+	for serviceName, info := range services {
+		for _, method := range info.Methods {
+			served[fmt.Sprintf("/%s/%s", serviceName, method.Name)] = true
+		}
+	}
+	for fullMethod := range a.rules {
+		if !served[fullMethod] {
+			return derrors.NewInvalidArgumentError("restricted method is not served").WithParams(fullMethod)
+		}
+	}
+	return nil
+}
+
+// Authorize checks the client of a request may call a method
+func (a *SubjectAuthorizer) Authorize(ctx context.Context, fullMethod string) derrors.Error {
+	authorized, found := a.rules[fullMethod]
+	if !found {
+		return nil
+	}
+
+	cert := verifiedClientCertificate(ctx)
+	if cert == nil {
+		return derrors.NewUnauthenticatedError("verified client certificate required").WithParams(fullMethod)
+	}
+	if authorized[cert.Subject.CommonName] || authorized[cert.Subject.String()] {
+		return nil
+	}
+
+	log.Warn().Str("method", fullMethod).Str("subject", cert.Subject.String()).Msg("unauthorized client")
+	return derrors.NewPermissionDeniedError("client not authorized").WithParams(fullMethod, cert.Subject.String())
+}
+
+// UnaryServerInterceptor authorizes every request before it is handled
+func (a *SubjectAuthorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if derr := a.Authorize(ctx, info.FullMethod); derr != nil {
+			return nil, conversions.ToGRPCError(derr)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// verifiedClientCertificate returns the client certificate of a request if
+// it was verified against the client CAs of the server, or nil.
+func verifiedClientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
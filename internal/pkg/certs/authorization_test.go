@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Subject authorization tests
+
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+const queryMethod = "/monitoring.MetricsCollector/Query"
+
+// clientContext creates a request context from a client with a verified certificate
+func clientContext(subject pkix.Name) context.Context {
+	cert := &x509.Certificate{Subject: subject}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			},
+		},
+	})
+}
+
+var _ = ginkgo.Describe("subject authorizer", func() {
+
+	var authorizer *SubjectAuthorizer
+
+	ginkgo.BeforeEach(func() {
+		authorizer = NewSubjectAuthorizer()
+		authorizer.Restrict(queryMethod, "monitoring-manager", "CN=admin,O=Nalej")
+	})
+
+	ginkgo.It("should allow unrestricted methods to anyone", func() {
+		gomega.Expect(authorizer.Authorize(context.Background(), "/monitoring.MetricsCollector/GetClusterSummary")).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should require a verified certificate", func() {
+		gomega.Expect(authorizer.Authorize(context.Background(), queryMethod)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should authorize by common or distinguished name", func() {
+		ctx := clientContext(pkix.Name{CommonName: "monitoring-manager"})
+		gomega.Expect(authorizer.Authorize(ctx, queryMethod)).To(gomega.Succeed())
+
+		ctx = clientContext(pkix.Name{CommonName: "admin", Organization: []string{"Nalej"}})
+		gomega.Expect(authorizer.Authorize(ctx, queryMethod)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should deny other subjects", func() {
+		ctx := clientContext(pkix.Name{CommonName: "app-cluster-user"})
+		gomega.Expect(authorizer.Authorize(ctx, queryMethod)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should only validate methods served by the server", func() {
+		server := grpc.NewServer()
+		grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+
+		served := NewSubjectAuthorizer()
+		served.Restrict("/grpc.health.v1.Health/Check", "monitoring-manager")
+		gomega.Expect(served.Validate(server.GetServiceInfo())).To(gomega.Succeed())
+
+		gomega.Expect(authorizer.Validate(server.GetServiceInfo())).ToNot(gomega.Succeed())
+	})
+})
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// TLS configuration for servers and clients from certificate files
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Certificate and key file names inside a certificate directory, as
+	// mounted from a Kubernetes TLS secret
+	certFile = "tls.crt"
+	keyFile  = "tls.key"
+)
+
+// LoadKeyPair loads the certificate and key from a certificate directory
+func LoadKeyPair(certPath string) (tls.Certificate, derrors.Error) {
+	log.Debug().Str("certPath", certPath).Msg("loading certificate")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, certFile), filepath.Join(certPath, keyFile))
+	if err != nil {
+		return tls.Certificate{}, derrors.NewInternalError("error loading certificate", err).WithParams(certPath)
+	}
+	return cert, nil
+}
+
+// LoadCertPool creates a pool with the CA certificates of a PEM file
+func LoadCertPool(caCertPath string) (*x509.CertPool, derrors.Error) {
+	log.Debug().Str("caCertPath", caCertPath).Msg("loading ca certificate")
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, derrors.NewInternalError("error loading ca certificate", err).WithParams(caCertPath)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, derrors.NewInternalError(fmt.Sprintf("cannot add ca certificate from %s to the pool", caCertPath))
+	}
+	return pool, nil
+}
+
+// ClientTLSConfig creates the TLS configuration to connect to serverName.
+// The server is verified with the CA in caCertPath, or the system CAs if
+// empty. A client certificate is presented when clientCertPath is set.
+func ClientTLSConfig(serverName string, caCertPath string, clientCertPath string, skipServerCertValidation bool) (*tls.Config, derrors.Error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+	}
+
+	if caCertPath != "" {
+		rootCAs, derr := LoadCertPool(caCertPath)
+		if derr != nil {
+			return nil, derr
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if clientCertPath != "" {
+		clientCert, derr := LoadKeyPair(clientCertPath)
+		if derr != nil {
+			return nil, derr
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if skipServerCertValidation {
+		log.Debug().Msg("skipping server cert validation")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
+
+// ServerTLSConfig creates the TLS configuration of a server with the
+// certificate in serverCertPath. When clientCACertPath is set, clients
+// must present a certificate signed by that CA.
+func ServerTLSConfig(serverCertPath string, clientCACertPath string) (*tls.Config, derrors.Error) {
+	serverCert, derr := LoadKeyPair(serverCertPath)
+	if derr != nil {
+		return nil, derr
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	}
+
+	if clientCACertPath != "" {
+		clientCAs, derr := LoadCertPool(clientCACertPath)
+		if derr != nil {
+			return nil, derr
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// ServerName returns the name a client should verify for a server
+// certificate: its first DNS name, or the common name if it has none.
+func ServerName(cert tls.Certificate) (string, derrors.Error) {
+	if len(cert.Certificate) == 0 {
+		return "", derrors.NewInvalidArgumentError("empty certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", derrors.NewInvalidArgumentError("cannot parse certificate", err)
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0], nil
+	}
+	return leaf.Subject.CommonName, nil
+}
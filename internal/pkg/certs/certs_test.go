@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// TLS configuration tests
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// writeSelfSigned writes a self-signed certificate and key to dir, which
+// can be used both as certificate directory and as CA file.
+func writeSelfSigned(dir string, commonName string, dnsNames ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	gomega.Expect(err).To(gomega.Succeed())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	gomega.Expect(ioutil.WriteFile(filepath.Join(dir, certFile), certPEM, 0600)).To(gomega.Succeed())
+	gomega.Expect(ioutil.WriteFile(filepath.Join(dir, keyFile), keyPEM, 0600)).To(gomega.Succeed())
+}
+
+var _ = ginkgo.Describe("certs", func() {
+
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "certs")
+		gomega.Expect(err).To(gomega.Succeed())
+		writeSelfSigned(dir, "monitoring", "monitoring.nalej", "localhost")
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	ginkgo.It("should create a server configuration verifying clients", func() {
+		config, err := ServerTLSConfig(dir, filepath.Join(dir, certFile))
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(config.Certificates).To(gomega.HaveLen(1))
+		gomega.Expect(config.ClientAuth).To(gomega.Equal(tls.RequireAndVerifyClientCert))
+		gomega.Expect(config.ClientCAs).ToNot(gomega.BeNil())
+	})
+
+	ginkgo.It("should not verify clients without a client CA", func() {
+		config, err := ServerTLSConfig(dir, "")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(config.ClientAuth).To(gomega.Equal(tls.NoClientCert))
+	})
+
+	ginkgo.It("should create a client configuration with a client certificate", func() {
+		config, err := ClientTLSConfig("monitoring.nalej", filepath.Join(dir, certFile), dir, false)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(config.ServerName).To(gomega.Equal("monitoring.nalej"))
+		gomega.Expect(config.RootCAs).ToNot(gomega.BeNil())
+		gomega.Expect(config.Certificates).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should fail on missing certificates", func() {
+		_, err := ServerTLSConfig(filepath.Join(dir, "missing"), "")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, err = ClientTLSConfig("monitoring.nalej", filepath.Join(dir, "missing.crt"), "", false)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should return the server name of a certificate", func() {
+		cert, err := LoadKeyPair(dir)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(ServerName(cert)).To(gomega.Equal("monitoring.nalej"))
+	})
+})
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Pricing of the resource usage and allocation of its cost
+
+package cost
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/monitoring/internal/pkg/usage"
+)
+
+// DaysPerMonth is the length of the month of the storage prices
+const DaysPerMonth = 30
+
+// Prices of the resources of a cluster
+type Prices struct {
+	// Price of a millicore used for an hour, normalized by the conversion factor of the cluster
+	MillicoreHour float64 `json:"millicore_hour"`
+	// Price of a GB (2^30 bytes) of memory used for an hour
+	MemoryGbHour float64 `json:"memory_gb_hour"`
+	// Price of a GB (2^30 bytes) of storage used for a month of 30 days
+	StorageGbMonth float64 `json:"storage_gb_month"`
+	// Cost of the cluster per hour regardless of its usage, split between
+	// the service instances that used it by their share of its usage
+	BaseHour float64 `json:"base_hour"`
+}
+
+func (p Prices) validate() bool {
+	return p.MillicoreHour >= 0 && p.MemoryGbHour >= 0 && p.StorageGbMonth >= 0 && p.BaseHour >= 0
+}
+
+// Pricing has the default prices, and those of the clusters priced differently
+type Pricing struct {
+	Currency string            `json:"currency"`
+	Default  Prices            `json:"default"`
+	Clusters map[string]Prices `json:"clusters,omitempty"`
+}
+
+// LoadPricing reads a JSON file with the pricing
+func LoadPricing(path string) (*Pricing, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot read pricing file", err).WithParams(path)
+	}
+
+	pricing := &Pricing{}
+	if err := json.Unmarshal(content, pricing); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid pricing file", err).WithParams(path)
+	}
+	if pricing.Currency == "" {
+		return nil, derrors.NewInvalidArgumentError("pricing needs a currency").WithParams(path)
+	}
+	if !pricing.Default.validate() {
+		return nil, derrors.NewInvalidArgumentError("prices cannot be negative").WithParams(path, "default")
+	}
+	for clusterId, prices := range pricing.Clusters {
+		if !prices.validate() {
+			return nil, derrors.NewInvalidArgumentError("prices cannot be negative").WithParams(path, clusterId)
+		}
+	}
+	return pricing, nil
+}
+
+// Prices returns the prices of a cluster
+func (p *Pricing) Prices(clusterId string) Prices {
+	if prices, found := p.Clusters[clusterId]; found {
+		return prices
+	}
+	return p.Default
+}
+
+// Cost of a service instance, or of a group of them
+type Cost struct {
+	AppInstanceId            string
+	AppInstanceName          string
+	ServiceGroupInstanceId   string
+	ServiceGroupInstanceName string
+	ServiceInstanceId        string
+	ServiceInstanceName      string
+	CpuCost                  float64
+	MemoryCost               float64
+	StorageCost              float64
+	BaseCost                 float64
+}
+
+// Total returns the cost of every resource and the base cost
+func (c *Cost) Total() float64 {
+	return c.CpuCost + c.MemoryCost + c.StorageCost + c.BaseCost
+}
+
+// Add adds the cost of another service instance or group
+func (c *Cost) Add(other *Cost) {
+	c.CpuCost += other.CpuCost
+	c.MemoryCost += other.MemoryCost
+	c.StorageCost += other.StorageCost
+	c.BaseCost += other.BaseCost
+}
+
+// Allocation is the cost of the service instances of an organization over a period
+type Allocation struct {
+	// Cost of every service instance, sorted by app instance and service instance
+	ServiceInstances []*Cost
+	// Base cost of the clusters nothing used during the period, by cluster
+	Unallocated map[string]float64
+}
+
+// Allocate prices the usage of the service instances of an organization on
+// each of its clusters over a period of some hours. The base cost of each
+// cluster is split between the service instances by their share of its
+// usage cost or, if its usage is free, of its CPU usage.
+func Allocate(pricing *Pricing, clusterIds []string, totals []*usage.Total, hours float64) *Allocation {
+	byCluster := make(map[string][]*usage.Total, len(clusterIds))
+	for _, clusterId := range clusterIds {
+		byCluster[clusterId] = nil
+	}
+	for _, total := range totals {
+		byCluster[total.ClusterId] = append(byCluster[total.ClusterId], total)
+	}
+
+	allocation := &Allocation{Unallocated: make(map[string]float64)}
+	costs := make(map[string]*Cost)
+	for clusterId, clusterTotals := range byCluster {
+		prices := pricing.Prices(clusterId)
+		clusterCosts := make([]*Cost, 0, len(clusterTotals))
+		usageCost := 0.0
+		cpuUsage := 0.0
+		for _, total := range clusterTotals {
+			cost := &Cost{
+				CpuCost:     total.CpuCoreHours() * 1000 * prices.MillicoreHour,
+				MemoryCost:  total.MemoryGbHours() * prices.MemoryGbHour,
+				StorageCost: total.StorageGbDays() / DaysPerMonth * prices.StorageGbMonth,
+			}
+			clusterCosts = append(clusterCosts, cost)
+			usageCost += cost.Total()
+			cpuUsage += total.CpuCoreSeconds
+		}
+
+		baseCost := prices.BaseHour * hours
+		for ix, total := range clusterTotals {
+			switch {
+			case usageCost > 0:
+				clusterCosts[ix].BaseCost = baseCost * (clusterCosts[ix].Total() / usageCost)
+			case cpuUsage > 0:
+				clusterCosts[ix].BaseCost = baseCost * (total.CpuCoreSeconds / cpuUsage)
+			}
+			id := total.AppInstanceId + "/" + total.ServiceInstanceId
+			cost, found := costs[id]
+			if !found {
+				cost = &Cost{
+					AppInstanceId:     total.AppInstanceId,
+					ServiceInstanceId: total.ServiceInstanceId,
+				}
+				costs[id] = cost
+			}
+			cost.AppInstanceName = total.AppInstanceName
+			cost.ServiceGroupInstanceId = total.ServiceGroupInstanceId
+			cost.ServiceGroupInstanceName = total.ServiceGroupInstanceName
+			cost.ServiceInstanceName = total.ServiceInstanceName
+			cost.Add(clusterCosts[ix])
+		}
+		if usageCost <= 0 && cpuUsage <= 0 && baseCost > 0 {
+			allocation.Unallocated[clusterId] = baseCost
+		}
+	}
+
+	allocation.ServiceInstances = make([]*Cost, 0, len(costs))
+	for _, cost := range costs {
+		allocation.ServiceInstances = append(allocation.ServiceInstances, cost)
+	}
+	sort.Slice(allocation.ServiceInstances, func(i, j int) bool {
+		a, b := allocation.ServiceInstances[i], allocation.ServiceInstances[j]
+		if a.AppInstanceId != b.AppInstanceId {
+			return a.AppInstanceId < b.AppInstanceId
+		}
+		return a.ServiceInstanceId < b.ServiceInstanceId
+	})
+	return allocation
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cost allocation tests
+
+package cost
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/nalej/monitoring/internal/pkg/usage"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("cost", func() {
+
+	pricing := &Pricing{
+		Currency: "EUR",
+		Default:  Prices{MillicoreHour: 0.001, MemoryGbHour: 0.5, StorageGbMonth: 3, BaseHour: 10},
+		Clusters: map[string]Prices{
+			"cluster-2": {MillicoreHour: 0.002},
+		},
+	}
+
+	// total of a service instance that used some cores and GB of memory and storage for an hour
+	total := func(clusterId string, appInstanceId string, serviceInstanceId string, cores float64, memoryGb float64, storageGb float64) *usage.Total {
+		hour := time.Hour.Seconds()
+		return &usage.Total{
+			ClusterId:          clusterId,
+			AppInstanceId:      appInstanceId,
+			ServiceInstanceId:  serviceInstanceId,
+			CpuCoreSeconds:     cores * hour,
+			MemoryByteSeconds:  memoryGb * usage.GB * hour,
+			StorageByteSeconds: storageGb * usage.GB * hour,
+		}
+	}
+
+	ginkgo.It("should price the usage with the prices of each cluster", func() {
+		allocation := Allocate(pricing, nil, []*usage.Total{
+			total("cluster-1", "app-1", "service-1", 1, 2, 720),
+			total("cluster-2", "app-1", "service-1", 1, 2, 0),
+		}, 1)
+		gomega.Expect(allocation.ServiceInstances).To(gomega.HaveLen(1))
+		cost := allocation.ServiceInstances[0]
+		gomega.Expect(cost.CpuCost).To(gomega.BeNumerically("~", 1+2, 1e-9))
+		gomega.Expect(cost.MemoryCost).To(gomega.BeNumerically("~", 1, 1e-9))
+		// 720GB for an hour is 1GB for a month
+		gomega.Expect(cost.StorageCost).To(gomega.BeNumerically("~", 3, 1e-9))
+		// Only cluster-1 has a base cost
+		gomega.Expect(cost.BaseCost).To(gomega.BeNumerically("~", 10, 1e-9))
+		gomega.Expect(cost.Total()).To(gomega.BeNumerically("~", 17, 1e-9))
+		gomega.Expect(allocation.Unallocated).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should split the base cost by usage share", func() {
+		allocation := Allocate(pricing, []string{"cluster-1", "cluster-3"}, []*usage.Total{
+			total("cluster-1", "app-2", "service-2", 3, 0, 0),
+			total("cluster-1", "app-1", "service-1", 1, 0, 0),
+		}, 2)
+		gomega.Expect(allocation.ServiceInstances).To(gomega.HaveLen(2))
+		gomega.Expect(allocation.ServiceInstances[0].ServiceInstanceId).To(gomega.Equal("service-1"))
+		gomega.Expect(allocation.ServiceInstances[0].BaseCost).To(gomega.BeNumerically("~", 5, 1e-9))
+		gomega.Expect(allocation.ServiceInstances[1].BaseCost).To(gomega.BeNumerically("~", 15, 1e-9))
+		// Nothing used cluster-3
+		gomega.Expect(allocation.Unallocated).To(gomega.Equal(map[string]float64{"cluster-3": 20}))
+	})
+
+	ginkgo.It("should split the base cost of free usage by CPU share", func() {
+		free := &Pricing{Currency: "EUR", Default: Prices{BaseHour: 1}}
+		allocation := Allocate(free, nil, []*usage.Total{
+			total("cluster-1", "app-1", "service-1", 1, 0, 0),
+			total("cluster-1", "app-1", "service-2", 3, 0, 0),
+		}, 1)
+		gomega.Expect(allocation.ServiceInstances[0].Total()).To(gomega.BeNumerically("~", 0.25, 1e-9))
+		gomega.Expect(allocation.ServiceInstances[1].Total()).To(gomega.BeNumerically("~", 0.75, 1e-9))
+	})
+
+	ginkgo.It("should load the pricing from a file", func() {
+		file, err := ioutil.TempFile("", "pricing")
+		gomega.Expect(err).To(gomega.Succeed())
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(`{"currency": "EUR", "default": {"millicore_hour": 0.001}, "clusters": {"cluster-2": {"base_hour": 1}}}`)
+		gomega.Expect(err).To(gomega.Succeed())
+		loaded, derr := LoadPricing(file.Name())
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(loaded.Prices("cluster-1").MillicoreHour).To(gomega.Equal(0.001))
+		gomega.Expect(loaded.Prices("cluster-2")).To(gomega.Equal(Prices{BaseHour: 1}))
+
+		gomega.Expect(ioutil.WriteFile(file.Name(), []byte(`{"currency": "EUR", "default": {"memory_gb_hour": -1}}`), 0600)).To(gomega.Succeed())
+		_, derr = LoadPricing(file.Name())
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+})
@@ -20,11 +20,14 @@ package entities
 
 import (
 	"os"
+	"strings"
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-monitoring-go"
 
 	"github.com/rs/zerolog/log"
+
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
@@ -33,6 +36,11 @@ const (
 	emptyClusterId      = "cluster_id cannot be empty"
 	badOrganizationId   = "invalid organization_id"
 	badClusterId        = "invalid cluster_id"
+	badPageSize         = "page_size cannot be negative"
+	badLabelKey         = "invalid label key"
+	badLabelValue       = "invalid label value"
+	badUsagePeriod      = "from_timestamp must be positive and before to_timestamp"
+	badAggregationLevel = "invalid group_by level"
 )
 
 // This is an interface with the methods that are indentical for all requests,
@@ -88,5 +96,77 @@ func ValidateOrganizationApplicationStatsRequest(request *grpc_monitoring_go.Org
 	if request.OrganizationId == "" {
 		return derrors.NewInvalidArgumentError(emptyOrganizationId)
 	}
+	for _, level := range request.GroupBy {
+		if _, found := grpc_monitoring_go.AggregationLevel_name[int32(level)]; !found {
+			return derrors.NewInvalidArgumentError(badAggregationLevel).WithParams(level)
+		}
+	}
+	return nil
+}
+
+func ValidateOrganizationClusterSummaryRequest(request *grpc_monitoring_go.OrganizationClusterSummaryRequest) derrors.Error {
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	return nil
+}
+
+func ValidateOrganizationQueryRequest(request *grpc_monitoring_go.OrganizationQueryRequest) derrors.Error {
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if request.Query == "" {
+		return derrors.NewInvalidArgumentError(emptyQueryString)
+	}
+	return nil
+}
+
+func ValidateUsageReportRequest(request *grpc_monitoring_go.UsageReportRequest) derrors.Error {
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if request.FromTimestamp <= 0 || request.FromTimestamp >= request.ToTimestamp {
+		return derrors.NewInvalidArgumentError(badUsagePeriod)
+	}
+	return nil
+}
+
+func ValidateCostReportRequest(request *grpc_monitoring_go.CostReportRequest) derrors.Error {
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if request.FromTimestamp <= 0 || request.FromTimestamp >= request.ToTimestamp {
+		return derrors.NewInvalidArgumentError(badUsagePeriod)
+	}
+	return nil
+}
+
+func ValidateContainerStatsRequest(request *grpc_monitoring_go.ContainerStatsRequest) derrors.Error {
+	if request.GetPageSize() < 0 {
+		return derrors.NewInvalidArgumentError(badPageSize)
+	}
+	// Labels and instance ids select pods with a Kubernetes label selector
+	for key, value := range request.GetLabels() {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return derrors.NewInvalidArgumentError(badLabelKey).WithParams(key, strings.Join(errs, "; "))
+		}
+		derr := validateLabelValue(value)
+		if derr != nil {
+			return derr
+		}
+	}
+	for _, id := range []string{request.GetAppInstanceId(), request.GetServiceGroupInstanceId(), request.GetServiceInstanceId()} {
+		derr := validateLabelValue(id)
+		if derr != nil {
+			return derr
+		}
+	}
+	return nil
+}
+
+func validateLabelValue(value string) derrors.Error {
+	if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+		return derrors.NewInvalidArgumentError(badLabelValue).WithParams(value, strings.Join(errs, "; "))
+	}
 	return nil
 }
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Health checking of gRPC servers based on their dependencies
+
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultInterval is the time between probes used by the servers
+	DefaultInterval = 10 * time.Second
+	// DefaultTimeout is the maximum duration of a probe used by the servers
+	DefaultTimeout = 5 * time.Second
+)
+
+// Names of the gRPC services reported by the health service
+const (
+	MetricsCollectorService  = "monitoring.MetricsCollector"
+	MonitoringManagerService = "monitoring.MonitoringManager"
+	AssetMonitoringService   = "monitoring.AssetMonitoring"
+	MonitoringApiService     = "monitoring.MonitoringApi"
+)
+
+// Check probes a single dependency, returning an error when it can't be used
+type Check func(ctx context.Context) error
+
+// Dependency is a named check of something a service relies on
+type Dependency struct {
+	Name  string
+	Check Check
+}
+
+// Checker implements the standard grpc.health.v1 service. It periodically
+// probes the dependencies of each registered service and reports it as
+// serving only when all of them succeed. The overall server status (empty
+// service name) is serving only when all services are.
+type Checker struct {
+	server *health.Server
+	// Time between probes
+	interval time.Duration
+	// Maximum duration of a single probe
+	timeout time.Duration
+
+	lock sync.Mutex
+	// Dependencies by service name
+	services map[string][]Dependency
+	// Last probe failure by service name; nil when serving
+	failures map[string]error
+}
+
+// NewChecker creates a health checker probing every interval, with each probe limited to timeout.
+func NewChecker(interval time.Duration, timeout time.Duration) *Checker {
+	server := health.NewServer()
+	// Not serving until the first probe completes
+	server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	return &Checker{
+		server:   server,
+		interval: interval,
+		timeout:  timeout,
+		services: map[string][]Dependency{},
+		failures: map[string]error{},
+	}
+}
+
+// AddService adds a service with the dependencies that determine its status.
+// A service without dependencies is serving as long as the checker runs.
+func (c *Checker) AddService(service string, dependencies ...Dependency) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.services[service] = append(c.services[service], dependencies...)
+	c.server.SetServingStatus(service, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+}
+
+// Register the health service on a gRPC server
+func (c *Checker) Register(server *grpc.Server) {
+	grpc_health_v1.RegisterHealthServer(server, c.server)
+}
+
+// Run probes the dependencies until the context is cancelled, after which
+// all services are reported as not serving.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			c.server.Shutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll probes the dependencies of all services once and updates their status.
+func (c *Checker) CheckAll(ctx context.Context) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Probe every dependency once, even when shared between services
+	results := map[string]error{}
+	for _, dependencies := range c.services {
+		for _, dependency := range dependencies {
+			if _, found := results[dependency.Name]; found {
+				continue
+			}
+			results[dependency.Name] = c.probe(ctx, dependency)
+		}
+	}
+
+	overall := grpc_health_v1.HealthCheckResponse_SERVING
+	for service, dependencies := range c.services {
+		var failure error
+		for _, dependency := range dependencies {
+			if err := results[dependency.Name]; err != nil {
+				failure = fmt.Errorf("%s: %v", dependency.Name, err)
+				break
+			}
+		}
+
+		status := grpc_health_v1.HealthCheckResponse_SERVING
+		if failure != nil {
+			status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+			overall = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+
+		// Only log changes to avoid flooding the log on every probe
+		previous, known := c.failures[service]
+		if !known || (previous == nil) != (failure == nil) {
+			log.Info().Str("service", service).Str("status", status.String()).Err(failure).Msg("health status changed")
+		}
+		c.failures[service] = failure
+		c.server.SetServingStatus(service, status)
+	}
+	c.server.SetServingStatus("", overall)
+}
+
+// Status returns the last probe failure of a service, or nil if it is serving.
+func (c *Checker) Status(service string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	failure, found := c.failures[service]
+	if !found {
+		return fmt.Errorf("service %s not checked", service)
+	}
+	return failure
+}
+
+func (c *Checker) probe(ctx context.Context, dependency Dependency) error {
+	probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	err := dependency.Check(probeCtx)
+	if err != nil {
+		log.Debug().Str("dependency", dependency.Name).Err(err).Msg("dependency check failed")
+	}
+	return err
+}
+
+// ConnectionCheck checks the server on the other side of a gRPC client
+// connection answers. It calls the health service, which the server answers
+// even if only as unimplemented, so an idle connection is connected and a
+// server that is down fails the check. A connection that is (re)connecting
+// is given until the probe deadline to become ready.
+func ConnectionCheck(conn *grpc.ClientConn) Check {
+	client := grpc_health_v1.NewHealthClient(conn)
+	return func(ctx context.Context) error {
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+			return fmt.Errorf("connection to %s: %v", conn.Target(), err)
+		}
+		return nil
+	}
+}
+
+// RemoteCheck checks a service through the health service of the server on
+// the other side of a gRPC client connection.
+func RemoteCheck(conn *grpc.ClientConn, service string) Check {
+	client := grpc_health_v1.NewHealthClient(conn)
+	return func(ctx context.Context) error {
+		response, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if response.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("%s reports %s", conn.Target(), response.GetStatus())
+		}
+		return nil
+	}
+}
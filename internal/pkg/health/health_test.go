@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Health checker tests
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var _ = ginkgo.Describe("health checker", func() {
+
+	var failing error
+	var checker *Checker
+
+	status := func(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		res, err := checker.server.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+		gomega.Expect(err).To(gomega.Succeed())
+		return res.GetStatus()
+	}
+
+	ginkgo.BeforeEach(func() {
+		failing = nil
+		healthy := Dependency{Name: "healthy", Check: func(ctx context.Context) error { return nil }}
+		flaky := Dependency{Name: "flaky", Check: func(ctx context.Context) error { return failing }}
+
+		checker = NewChecker(time.Minute, time.Second)
+		checker.AddService("first", healthy)
+		checker.AddService("second", healthy, flaky)
+	})
+
+	ginkgo.It("should not serve before the first check", func() {
+		gomega.Expect(status("")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+		gomega.Expect(status("first")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+	})
+
+	ginkgo.It("should serve when all dependencies are available", func() {
+		checker.CheckAll(context.Background())
+		gomega.Expect(status("")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+		gomega.Expect(status("first")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+		gomega.Expect(status("second")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+		gomega.Expect(checker.Status("second")).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should report only the services of a failing dependency", func() {
+		failing = errors.New("unreachable")
+		checker.CheckAll(context.Background())
+		gomega.Expect(status("")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+		gomega.Expect(status("first")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+		gomega.Expect(status("second")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+		gomega.Expect(checker.Status("second")).To(gomega.MatchError("flaky: unreachable"))
+
+		failing = nil
+		checker.CheckAll(context.Background())
+		gomega.Expect(status("second")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+	})
+
+	ginkgo.It("should stop serving when stopped", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		checker.Run(ctx)
+		gomega.Expect(status("first")).To(gomega.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING))
+	})
+})
+
+var _ = ginkgo.Describe("connection check", func() {
+
+	check := func(address string) error {
+		conn, err := grpc.Dial(address, grpc.WithInsecure())
+		gomega.Expect(err).To(gomega.Succeed())
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		return ConnectionCheck(conn)(ctx)
+	}
+
+	serve := func(register func(server *grpc.Server)) (string, func()) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+		server := grpc.NewServer()
+		register(server)
+		go server.Serve(listener)
+		return listener.Addr().String(), server.Stop
+	}
+
+	ginkgo.It("should fail when nothing listens", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+		address := listener.Addr().String()
+		gomega.Expect(listener.Close()).To(gomega.Succeed())
+		gomega.Expect(check(address)).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should succeed when the server answers", func() {
+		address, stop := serve(func(server *grpc.Server) {})
+		defer stop()
+		// Without a health service
+		gomega.Expect(check(address)).To(gomega.Succeed())
+
+		address, stop = serve(NewChecker(time.Minute, time.Second).Register)
+		defer stop()
+		gomega.Expect(check(address)).To(gomega.Succeed())
+	})
+})
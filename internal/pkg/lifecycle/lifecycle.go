@@ -0,0 +1,239 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Lifecycle of the servers and connections of a service
+
+package lifecycle
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// DefaultShutdownTimeout is the time given to servers to drain on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Lifecycle starts the servers and background tasks of a service and stops
+// them on a termination signal or when one of them fails. On shutdown the
+// servers stop accepting requests and are drained under a deadline, letting
+// in-flight requests complete. The context of the lifecycle is then
+// cancelled, stopping the background tasks and any request still running,
+// after which connections are closed.
+type Lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Maximum time to drain all servers
+	shutdownTimeout time.Duration
+	// Errors of servers that stopped unexpectedly
+	errChan chan error
+
+	lock sync.Mutex
+	// Functions draining the servers, in start order
+	stoppers []stopper
+	// Connections closed after the servers are stopped
+	closers []closer
+	// Background tasks to wait for on shutdown
+	tasks sync.WaitGroup
+}
+
+type stopper struct {
+	name string
+	stop func(ctx context.Context)
+}
+
+type closer struct {
+	name   string
+	closer io.Closer
+}
+
+// New creates a lifecycle draining its servers within shutdownTimeout.
+func New(shutdownTimeout time.Duration) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		ctx:             ctx,
+		cancel:          cancel,
+		shutdownTimeout: shutdownTimeout,
+		errChan:         make(chan error, 1),
+	}
+}
+
+// Context is cancelled once the servers are drained, or the drain deadline passed
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// UnaryServerInterceptor cancels the context of the requests still running
+// when the lifecycle context is cancelled, so requests that outlive the drain
+// deadline stop fanning out.
+func (l *Lifecycle) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-l.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
+
+// ServeGRPC starts serving a gRPC server on a listener. On shutdown the
+// server is stopped gracefully, or forcefully when the deadline passes.
+func (l *Lifecycle) ServeGRPC(name string, server *grpc.Server, listener net.Listener) {
+	l.addStopper(name, func(ctx context.Context) {
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			log.Warn().Str("server", name).Msg("deadline exceeded draining server; stopping")
+			l.cancel()
+			server.Stop()
+		}
+	})
+
+	log.Info().Str("server", name).Str("address", listener.Addr().String()).Msg("Launching gRPC server")
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Error().Str("server", name).Err(err).Msg("failed to serve grpc")
+			l.fail(err)
+		}
+		log.Info().Str("server", name).Msg("closed grpc server")
+	}()
+}
+
+// ServeHTTP starts serving an HTTP server on a listener. On shutdown the
+// server is shut down gracefully, or closed when the deadline passes.
+func (l *Lifecycle) ServeHTTP(name string, server *http.Server, listener net.Listener) {
+	l.addStopper(name, func(ctx context.Context) {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warn().Str("server", name).Err(err).Msg("failed draining server; closing")
+			l.cancel()
+			_ = server.Close()
+		}
+	})
+
+	log.Info().Str("server", name).Str("address", listener.Addr().String()).Msg("Launching HTTP server")
+	go func() {
+		err := server.Serve(listener)
+		if err == http.ErrServerClosed {
+			log.Info().Str("server", name).Msg("closed http server")
+		} else if err != nil {
+			log.Error().Str("server", name).Err(err).Msg("failed to serve http")
+			l.fail(err)
+		}
+	}()
+}
+
+// Go runs a background task with the context of the lifecycle. Shutdown
+// waits for the task to return after draining the servers and cancelling
+// the context.
+func (l *Lifecycle) Go(name string, task func(ctx context.Context)) {
+	l.tasks.Add(1)
+	go func() {
+		defer l.tasks.Done()
+		task(l.ctx)
+		log.Debug().Str("task", name).Msg("background task finished")
+	}()
+}
+
+// AddCloser adds a connection to close once all servers are stopped
+func (l *Lifecycle) AddCloser(name string, c io.Closer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closers = append(l.closers, closer{name: name, closer: c})
+}
+
+// Wait blocks until a termination signal is received or a server fails,
+// and then shuts down. The error of the failing server is returned.
+func (l *Lifecycle) Wait() derrors.Error {
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigterm)
+
+	var derr derrors.Error
+	select {
+	case sig := <-sigterm:
+		log.Info().Str("signal", sig.String()).Msg("Gracefully shutting down")
+	case err := <-l.errChan:
+		// We've already logged the error
+		derr = derrors.NewInternalError("server failed", err)
+	}
+
+	l.Shutdown()
+	return derr
+}
+
+// Shutdown drains the servers in reverse start order under the shutdown
+// deadline, then cancels the lifecycle context, waits for the background
+// tasks and closes the connections.
+func (l *Lifecycle) Shutdown() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.shutdownTimeout)
+	defer cancel()
+
+	for i := len(l.stoppers) - 1; i >= 0; i-- {
+		log.Debug().Str("server", l.stoppers[i].name).Msg("stopping server")
+		l.stoppers[i].stop(ctx)
+	}
+	l.stoppers = nil
+
+	l.cancel()
+	l.tasks.Wait()
+
+	for i := len(l.closers) - 1; i >= 0; i-- {
+		if err := l.closers[i].closer.Close(); err != nil {
+			log.Warn().Str("connection", l.closers[i].name).Err(err).Msg("failed closing connection")
+		}
+	}
+	l.closers = nil
+}
+
+func (l *Lifecycle) addStopper(name string, stop func(ctx context.Context)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stoppers = append(l.stoppers, stopper{name: name, stop: stop})
+}
+
+// fail reports an unexpected server error; only the first one is kept
+func (l *Lifecycle) fail(err error) {
+	select {
+	case l.errChan <- err:
+	default:
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Lifecycle tests
+
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+)
+
+type fakeCloser struct {
+	closed bool
+}
+
+func (c *fakeCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+var _ = ginkgo.Describe("lifecycle", func() {
+
+	ginkgo.It("should cancel the requests still running after the servers are drained", func() {
+		service := New(time.Second)
+		interceptor := service.UnaryServerInterceptor()
+
+		started := make(chan struct{})
+		result := make(chan error, 1)
+		go func() {
+			_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				close(started)
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+			result <- err
+		}()
+
+		<-started
+		service.Shutdown()
+		gomega.Eventually(result).Should(gomega.Receive(gomega.Equal(context.Canceled)))
+	})
+
+	ginkgo.It("should let in-flight requests complete before cancelling the context", func() {
+		service := New(5 * time.Second)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+
+		started := make(chan struct{})
+		service.ServeHTTP("test", &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			if service.Context().Err() != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})}, listener)
+
+		result := make(chan int, 1)
+		go func() {
+			response, err := http.Get("http://" + listener.Addr().String())
+			if err != nil {
+				result <- 0
+				return
+			}
+			_ = response.Body.Close()
+			result <- response.StatusCode
+		}()
+
+		<-started
+		service.Shutdown()
+		gomega.Eventually(result).Should(gomega.Receive(gomega.Equal(http.StatusOK)))
+	})
+
+	ginkgo.It("should cancel the context when the drain deadline passes", func() {
+		service := New(100 * time.Millisecond)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+
+		started := make(chan struct{})
+		service.ServeHTTP("test", &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-service.Context().Done()
+		})}, listener)
+		go func() {
+			response, err := http.Get("http://" + listener.Addr().String())
+			if err == nil {
+				_ = response.Body.Close()
+			}
+		}()
+
+		<-started
+		start := time.Now()
+		service.Shutdown()
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+		gomega.Expect(service.Context().Err()).To(gomega.Equal(context.Canceled))
+	})
+
+	ginkgo.It("should stop servers and tasks before closing connections", func() {
+		service := New(time.Second)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+		service.ServeHTTP("test", &http.Server{Handler: http.NotFoundHandler()}, listener)
+
+		taskDone := false
+		service.Go("task", func(ctx context.Context) {
+			<-ctx.Done()
+			taskDone = true
+		})
+
+		conn := &fakeCloser{}
+		service.AddCloser("conn", conn)
+
+		service.Shutdown()
+		gomega.Expect(taskDone).To(gomega.BeTrue())
+		gomega.Expect(conn.closed).To(gomega.BeTrue())
+		gomega.Expect(service.Context().Err()).To(gomega.Equal(context.Canceled))
+
+		_, err = http.Get("http://" + listener.Addr().String())
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -21,6 +21,7 @@ package server
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/monitoring/pkg/provider/query"
@@ -36,9 +37,19 @@ type Config struct {
 	Kubeconfig string
 	// Running inside Kubernetes cluster
 	InCluster bool
+	// Directory with the certificate of the gRPC server. The server uses plain text if empty.
+	ServerCertPath string
+	// CA that signs the certificates clients must present. Clients are not verified if empty.
+	ClientCACertPath string
+	// Client certificate subjects allowed to execute queries. Any client can if empty.
+	QuerySubjects []string
 
 	// Retrieval backends
 	QueryProviders query.ProviderConfigs
+	// Maximum number of concurrent queries for a single request
+	QueryParallelism int
+	// Deadline for all queries of a single request
+	QueryTimeout time.Duration
 }
 
 // Validate the configuration.
@@ -47,6 +58,20 @@ func (conf *Config) Validate() derrors.Error {
 		return derrors.NewInvalidArgumentError("port must be specified")
 	}
 
+	if conf.ClientCACertPath != "" && conf.ServerCertPath == "" {
+		return derrors.NewInvalidArgumentError("clientCACertPath requires serverCertPath")
+	}
+	if len(conf.QuerySubjects) > 0 && conf.ClientCACertPath == "" {
+		return derrors.NewInvalidArgumentError("querySubjects requires clientCACertPath")
+	}
+
+	if conf.QueryParallelism <= 0 {
+		return derrors.NewInvalidArgumentError("query parallelism must be positive")
+	}
+	if conf.QueryTimeout <= 0 {
+		return derrors.NewInvalidArgumentError("query timeout must be positive")
+	}
+
 	// Retrieval backends validation
 	for _, queryConfig := range conf.QueryProviders {
 		derr := queryConfig.Validate()
@@ -81,6 +106,9 @@ func (conf *Config) Print() {
 	log.Info().Int("port", conf.Port).Msg("gRPC port")
 	log.Info().Str("file", conf.Kubeconfig).Bool("in-cluster", conf.InCluster).Msg("kubeconfig")
 
+	log.Info().Str("cert", conf.ServerCertPath).Str("clientCA", conf.ClientCACertPath).Strs("querySubjects", conf.QuerySubjects).Msg("TLS parameters")
+	log.Info().Int("parallelism", conf.QueryParallelism).Str("timeout", conf.QueryTimeout.String()).Msg("queries")
+
 	// Retrieval backends
 	for _, queryConfig := range conf.QueryProviders {
 		queryConfig.Print(log.Info())
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Container stats filters and pagination
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/nalej/monitoring/pkg/utils"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	// kube-state-metrics series with the labels of each pod
+	kubePodLabelsMetric = "kube_pod_labels"
+	// kube-state-metrics uses pod instead of pod_name
+	kubePodLabelsPod = "pod"
+	// kube-state-metrics prefixes pod labels with label_
+	kubePodLabelsPrefix = "label_"
+)
+
+// Characters not allowed in Prometheus label names, replaced by
+// kube-state-metrics with an underscore
+var invalidLabelNameChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// nalejPodRequirement selects the pods of Nalej services
+var nalejPodRequirement = func() labels.Requirement {
+	requirement, err := labels.NewRequirement(utils.NalejPodLabelServiceInstanceId, selection.Exists, nil)
+	if err != nil {
+		panic(err)
+	}
+	return *requirement
+}()
+
+// ContainerStatsFilter translates the filters of a ContainerStatsRequest into
+// PromQL label matchers and a Kubernetes label selector, so only the requested
+// containers are retrieved instead of filtering the complete list afterwards.
+type ContainerStatsFilter struct {
+	namespace string
+	image     string
+	// Nalej and user labels the pod must have
+	podLabels map[string]string
+}
+
+// NewContainerStatsFilter creates a filter from a request. A nil request selects every container.
+func NewContainerStatsFilter(request *grpc_monitoring_go.ContainerStatsRequest) *ContainerStatsFilter {
+	podLabels := make(map[string]string, len(request.GetLabels())+3)
+	for key, value := range request.GetLabels() {
+		podLabels[key] = value
+	}
+	if request.GetAppInstanceId() != "" {
+		podLabels[utils.NalejPodLabelAppInstanceId] = request.GetAppInstanceId()
+	}
+	if request.GetServiceGroupInstanceId() != "" {
+		podLabels[utils.NalejPodLabelServiceGroupInstanceId] = request.GetServiceGroupInstanceId()
+	}
+	if request.GetServiceInstanceId() != "" {
+		podLabels[utils.NalejPodLabelServiceInstanceId] = request.GetServiceInstanceId()
+	}
+
+	return &ContainerStatsFilter{
+		namespace: request.GetNamespace(),
+		image:     request.GetImage(),
+		podLabels: podLabels,
+	}
+}
+
+// ContainerQuery returns the query for a metric labelled by namespace, pod and container.
+func (f *ContainerStatsFilter) ContainerQuery(metricName string) string {
+	matchers := make([]string, 0, 2)
+	if f.namespace != "" {
+		matchers = append(matchers, labelMatcher(utils.NalejMetricsNamespace, f.namespace))
+	}
+	if f.image != "" {
+		matchers = append(matchers, labelMatcher(utils.NalejMetricsImage, f.image))
+	}
+	return f.withPodLabels(selector(metricName, matchers))
+}
+
+// PodQuery returns the query for a metric labelled by namespace and pod only.
+// The image filter does not apply; those metrics are only used for the
+// containers selected by ContainerQuery.
+func (f *ContainerStatsFilter) PodQuery(metricName string) string {
+	matchers := make([]string, 0, 1)
+	if f.namespace != "" {
+		matchers = append(matchers, labelMatcher(utils.NalejMetricsNamespace, f.namespace))
+	}
+	return f.withPodLabels(selector(metricName, matchers))
+}
+
+// LabelSelector returns the Kubernetes label selector for the pods of the
+// selected containers. Only pods of Nalej services are selected. The pod
+// labels must have been validated with the request.
+func (f *ContainerStatsFilter) LabelSelector() string {
+	return labels.SelectorFromValidatedSet(labels.Set(f.podLabels)).Add(nalejPodRequirement).String()
+}
+
+// withPodLabels joins a query with the pod labels from kube-state-metrics, so
+// the Nalej identifiers and user labels are matched by Prometheus. The pod
+// label series has value 1, so the values of the original query are kept.
+func (f *ContainerStatsFilter) withPodLabels(q string) string {
+	if len(f.podLabels) == 0 {
+		return q
+	}
+
+	matchers := make([]string, 0, len(f.podLabels))
+	if f.namespace != "" {
+		matchers = append(matchers, labelMatcher(utils.NalejMetricsNamespace, f.namespace))
+	}
+	for _, key := range f.podLabelKeys() {
+		matchers = append(matchers, labelMatcher(kubePodLabelName(key), f.podLabels[key]))
+	}
+
+	podLabels := fmt.Sprintf(`max by (%s, %s) (label_replace(%s, "%s", "$1", "%s", "(.+)"))`,
+		utils.NalejMetricsNamespace, utils.NalejMetricsPod,
+		selector(kubePodLabelsMetric, matchers),
+		utils.NalejMetricsPod, kubePodLabelsPod)
+
+	return fmt.Sprintf("%s * on(%s, %s) group_left() %s", q, utils.NalejMetricsNamespace, utils.NalejMetricsPod, podLabels)
+}
+
+// podLabelKeys returns the pod label names sorted, so generated queries are stable.
+func (f *ContainerStatsFilter) podLabelKeys() []string {
+	keys := make([]string, 0, len(f.podLabels))
+	for key := range f.podLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func selector(metricName string, matchers []string) string {
+	if len(matchers) == 0 {
+		return metricName
+	}
+	return fmt.Sprintf("%s{%s}", metricName, strings.Join(matchers, ","))
+}
+
+// labelMatcher creates an equality matcher with a properly escaped value.
+func labelMatcher(name, value string) string {
+	return fmt.Sprintf("%s=%s", name, strconv.Quote(value))
+}
+
+// kubePodLabelName converts a Kubernetes pod label into the name of the label
+// on the kube_pod_labels series.
+func kubePodLabelName(key string) string {
+	return kubePodLabelsPrefix + invalidLabelNameChars.ReplaceAllString(key, "_")
+}
+
+// containerStatsKey is the sort key of a container, also used as page token.
+func containerStatsKey(stats *grpc_monitoring_go.ContainerStats) string {
+	return strings.Join([]string{stats.GetNamespace(), stats.GetPod(), stats.GetContainer()}, "/")
+}
+
+// PaginateContainerStats sorts the container stats and returns the page
+// following pageToken, together with the token for the next page. The token
+// is empty on the last page. A page size of 0 returns all remaining stats.
+func PaginateContainerStats(stats []*grpc_monitoring_go.ContainerStats, pageSize int32, pageToken string) ([]*grpc_monitoring_go.ContainerStats, string, derrors.Error) {
+	sort.Slice(stats, func(i, j int) bool {
+		return containerStatsKey(stats[i]) < containerStatsKey(stats[j])
+	})
+
+	start := 0
+	if pageToken != "" {
+		lastKey, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, "", derrors.NewInvalidArgumentError("invalid page token", err)
+		}
+		// First container after the last one of the previous page. Using
+		// the key instead of an offset keeps pages consistent when
+		// containers come and go between requests.
+		start = sort.Search(len(stats), func(i int) bool {
+			return containerStatsKey(stats[i]) > string(lastKey)
+		})
+	}
+
+	end := len(stats)
+	if pageSize > 0 && start+int(pageSize) < end {
+		end = start + int(pageSize)
+	}
+
+	page := stats[start:end]
+	nextPageToken := ""
+	if end < len(stats) && len(page) > 0 {
+		nextPageToken = base64.RawURLEncoding.EncodeToString([]byte(containerStatsKey(page[len(page)-1])))
+	}
+
+	return page, nextPageToken, nil
+}
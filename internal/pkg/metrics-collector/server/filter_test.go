@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Container stats filter tests
+
+package server
+
+import (
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("container stats filter", func() {
+
+	ginkgo.Context("NewContainerStatsFilter", func() {
+		ginkgo.It("should not change queries without filters", func() {
+			filter := NewContainerStatsFilter(nil)
+			gomega.Expect(filter.ContainerQuery(CpuQuery)).To(gomega.Equal(CpuQuery))
+			gomega.Expect(filter.PodQuery(NetworkReceiveQuery)).To(gomega.Equal(NetworkReceiveQuery))
+			gomega.Expect(filter.LabelSelector()).To(gomega.Equal("nalej-service-instance-id"))
+		})
+
+		ginkgo.It("should push namespace and image into the label matchers", func() {
+			filter := NewContainerStatsFilter(&grpc_monitoring_go.ContainerStatsRequest{
+				Namespace: "ns-1",
+				Image:     "nginx:1.17",
+			})
+			gomega.Expect(filter.ContainerQuery(CpuQuery)).To(gomega.Equal(
+				`nalej_servinst_cpu_core{namespace="ns-1",image="nginx:1.17"}`))
+			gomega.Expect(filter.PodQuery(NetworkReceiveQuery)).To(gomega.Equal(
+				`nalej_servinst_network_receive_byte{namespace="ns-1"}`))
+		})
+
+		ginkgo.It("should join with the pod labels", func() {
+			filter := NewContainerStatsFilter(&grpc_monitoring_go.ContainerStatsRequest{
+				AppInstanceId: "app-1",
+				Labels:        map[string]string{"app.kubernetes.io/tier": "front-end"},
+			})
+			gomega.Expect(filter.ContainerQuery(MemoryQuery)).To(gomega.Equal(
+				`nalej_servinst_memory_byte * on(namespace, pod_name) group_left() ` +
+					`max by (namespace, pod_name) (label_replace(kube_pod_labels{label_app_kubernetes_io_tier="front-end",label_nalej_app_instance_id="app-1"}, "pod_name", "$1", "pod", "(.+)"))`))
+			gomega.Expect(filter.LabelSelector()).To(gomega.Equal(
+				`app.kubernetes.io/tier=front-end,nalej-app-instance-id=app-1,nalej-service-instance-id`))
+		})
+
+		ginkgo.It("should escape the values of the label matchers", func() {
+			filter := NewContainerStatsFilter(&grpc_monitoring_go.ContainerStatsRequest{Image: `registry/"web"\\latest`})
+			gomega.Expect(filter.ContainerQuery(CpuQuery)).To(gomega.Equal(
+				`nalej_servinst_cpu_core{image="registry/\"web\"\\\\latest"}`))
+		})
+	})
+
+	ginkgo.Context("PaginateContainerStats", func() {
+		newStats := func() []*grpc_monitoring_go.ContainerStats {
+			return []*grpc_monitoring_go.ContainerStats{
+				{Namespace: "b", Pod: "p1", Container: "c1"},
+				{Namespace: "a", Pod: "p2", Container: "c1"},
+				{Namespace: "a", Pod: "p1", Container: "c2"},
+				{Namespace: "a", Pod: "p1", Container: "c1"},
+			}
+		}
+
+		ginkgo.It("should return everything without page size", func() {
+			page, token, err := PaginateContainerStats(newStats(), 0, "")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(page).To(gomega.HaveLen(4))
+			gomega.Expect(page[0].Container).To(gomega.Equal("c1"))
+			gomega.Expect(page[3].Namespace).To(gomega.Equal("b"))
+			gomega.Expect(token).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should walk through all pages", func() {
+			page, token, err := PaginateContainerStats(newStats(), 3, "")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(page).To(gomega.HaveLen(3))
+			gomega.Expect(token).ToNot(gomega.BeEmpty())
+
+			page, token, err = PaginateContainerStats(newStats(), 3, token)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(page).To(gomega.HaveLen(1))
+			gomega.Expect(page[0].Namespace).To(gomega.Equal("b"))
+			gomega.Expect(token).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should reject an invalid page token", func() {
+			_, _, err := PaginateContainerStats(newStats(), 3, "not a token!")
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	})
+})
@@ -142,3 +142,26 @@ func (h *Handler) GetContainerStats(ctx context.Context, _ *grpc_common_go.Empty
 		Msg("GetContainerStats response")
 	return response, nil
 }
+
+// ListContainerStats retrieves the stats of the containers matching the request filters, one page at a time
+func (h *Handler) ListContainerStats(ctx context.Context, request *grpc_monitoring_go.ContainerStatsRequest) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	log.Debug().Interface("request", request).Msg("received ListContainerStats request")
+
+	// Validate
+	derr := entities.ValidateContainerStatsRequest(request)
+	if derr != nil {
+		log.Error().Str("err", derr.DebugReport()).Err(derr).Msg("invalid request")
+		return nil, derr
+	}
+
+	response, err := h.manager.ListContainerStats(ctx, request)
+	if err != nil {
+		log.Error().Str("err", conversions.ToDerror(err).DebugReport()).Err(err).Msg("error executing ListContainerStats")
+		return nil, err
+	}
+	log.Debug().
+		Int("containers", len(response.GetContainerStats())).
+		Str("next_page_token", response.GetNextPageToken()).
+		Msg("ListContainerStats response")
+	return response, nil
+}
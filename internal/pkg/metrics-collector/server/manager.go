@@ -24,6 +24,7 @@ import (
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/monitoring/internal/pkg/metrics-collector"
 	"github.com/nalej/monitoring/pkg/provider/query/prometheus"
+	"regexp"
 	"strconv"
 	"time"
 
@@ -46,17 +47,41 @@ const (
 	CpuQuery     = "nalej_servinst_cpu_core"
 	MemoryQuery  = "nalej_servinst_memory_byte"
 	StorageQuery = "nalej_servinst_storage_byte"
+
+	// Network series are per second and per pod, as all containers in a
+	// pod share the same network namespace
+	NetworkReceiveQuery      = "nalej_servinst_network_receive_byte"
+	NetworkTransmitQuery     = "nalej_servinst_network_transmit_byte"
+	NetworkReceiveDropQuery  = "nalej_servinst_network_receive_drop"
+	NetworkTransmitDropQuery = "nalej_servinst_network_transmit_drop"
 )
 
+// NetworkQueries lists the per-pod network series added to the container stats
+var NetworkQueries = []string{
+	NetworkReceiveQuery,
+	NetworkTransmitQuery,
+	NetworkReceiveDropQuery,
+	NetworkTransmitDropQuery,
+}
+
+// excludedContainers are the containers the recording rules leave out with
+// container_name!~"zt-.+|POD" (see prometheus.prometheusrules.yaml): the
+// network sidecars and the pod sandbox, which are not part of the service
+var excludedContainers = regexp.MustCompile("^(?:zt-.+|POD)$")
+
 // Manager structure with the required clients for roles operations.
 type Manager struct {
 	k8sClient        *kubernetes.Clientset
 	providers        query.Providers
 	featureProviders map[query.ProviderFeature]query.Provider
+	// Maximum number of concurrent template queries for a single request
+	queryParallelism int
+	// Deadline shared by all template queries of a single request
+	queryTimeout time.Duration
 }
 
 // NewManager creates a new query manager.
-func NewManager(providers query.Providers, k8sClient *kubernetes.Clientset) (Manager, derrors.Error) {
+func NewManager(providers query.Providers, k8sClient *kubernetes.Clientset, queryParallelism int, queryTimeout time.Duration) (Manager, derrors.Error) {
 	// Check providers for specific features
 	// NOTE: this only gives us the last provider with a certain feature,
 	// but at least we have one we can use
@@ -71,12 +96,15 @@ func NewManager(providers query.Providers, k8sClient *kubernetes.Clientset) (Man
 		k8sClient:        k8sClient,
 		providers:        providers,
 		featureProviders: featureProviders,
+		queryParallelism: queryParallelism,
+		queryTimeout:     queryTimeout,
 	}
 
 	return manager, nil
 }
 
-// GetClusterSummary retrieves a summary of high level cluster resource availability
+// GetClusterSummary retrieves a summary of high level cluster resource availability. Templates that fail are
+// reported in the errors of the summary; only when all of them fail an error is returned.
 func (m *Manager) GetClusterSummary(ctx context.Context, request *grpc_monitoring_go.ClusterSummaryRequest) (*grpc_monitoring_go.ClusterSummary, error) {
 	// Get right provider
 	provider, found := m.featureProviders[query.FeatureSystemStats]
@@ -84,44 +112,61 @@ func (m *Manager) GetClusterSummary(ctx context.Context, request *grpc_monitorin
 		return nil, derrors.NewUnavailableError("no query provider for system statistics")
 	}
 
-	vars := &query.TemplateVars{
+	vars := query.TemplateVars{
 		AvgSeconds: request.GetRangeMinutes() * 60,
 	}
 
 	// Create result
 	res := &grpc_monitoring_go.ClusterSummary{
-		OrganizationId: request.GetOrganizationId(),
-		ClusterId:      request.GetClusterId(),
+		OrganizationId:     request.GetOrganizationId(),
+		ClusterId:          request.GetClusterId(),
+		CpuMillicores:      &grpc_monitoring_go.ClusterStat{},
+		MemoryBytes:        &grpc_monitoring_go.ClusterStat{},
+		StorageBytes:       &grpc_monitoring_go.ClusterStat{},
+		UsableStorageBytes: &grpc_monitoring_go.ClusterStat{},
+		// Network figures are rates rather than total/available pairs
+		Network: &grpc_monitoring_go.ClusterNetworkStat{},
 	}
 
 	// Create mapping to fill
-	resultMap := map[query.TemplateName]**grpc_monitoring_go.ClusterStat{
-		query.TemplateName_CPU:           &res.CpuMillicores,
-		query.TemplateName_Memory:        &res.MemoryBytes,
-		query.TemplateName_Storage:       &res.StorageBytes,
-		query.TemplateName_UsableStorage: &res.UsableStorageBytes,
+	resultMap := map[query.TemplateName]*grpc_monitoring_go.ClusterStat{
+		query.TemplateName_CPU:           res.CpuMillicores,
+		query.TemplateName_Memory:        res.MemoryBytes,
+		query.TemplateName_Storage:       res.StorageBytes,
+		query.TemplateName_UsableStorage: res.UsableStorageBytes,
+	}
+	networkMap := map[query.TemplateName]*int64{
+		query.TemplateName_NetworkReceive:       &res.Network.ReceiveBytePerSec,
+		query.TemplateName_NetworkTransmit:      &res.Network.TransmitBytePerSec,
+		query.TemplateName_NetworkReceiveDrops:  &res.Network.ReceiveDropPerSec,
+		query.TemplateName_NetworkTransmitDrops: &res.Network.TransmitDropPerSec,
 	}
 
+	requests := make([]*templateRequest, 0, 2*len(resultMap)+len(networkMap))
 	for name, stat := range resultMap {
-		available, derr := provider.ExecuteTemplate(ctx, name+query.TemplateName_Available, vars)
-		if derr != nil {
-			return nil, derr
-		}
-		total, derr := provider.ExecuteTemplate(ctx, name+query.TemplateName_Total, vars)
-		if derr != nil {
-			return nil, derr
+		for templateName, valPtr := range map[query.TemplateName]*int64{
+			name + query.TemplateName_Available: &stat.Available,
+			name + query.TemplateName_Total:     &stat.Total,
+		} {
+			requests = append(requests, &templateRequest{key: templateName.String(), name: templateName, vars: vars, value: valPtr})
 		}
+	}
+	for name, valPtr := range networkMap {
+		requests = append(requests, &templateRequest{key: name.String(), name: name, vars: vars, value: valPtr})
+	}
 
-		*stat = &grpc_monitoring_go.ClusterStat{
-			Total:     total,
-			Available: available,
-		}
+	queryCtx, cancel := m.queryContext(ctx)
+	defer cancel()
+	res.Errors = executeTemplates(queryCtx, provider, requests, m.queryParallelism)
+	if len(res.Errors) == len(requests) {
+		return nil, templateResultError("unable to retrieve any cluster summary value", res.Errors)
 	}
 
 	return res, nil
 }
 
-// GetClusterStats retrieves statistics on cluster with respect to platform resources
+// GetClusterStats retrieves statistics on cluster with respect to platform resources. Templates that fail are
+// reported in the errors of the statistics; only when all of them fail an error is returned.
 func (m *Manager) GetClusterStats(ctx context.Context, request *grpc_monitoring_go.ClusterStatsRequest) (*grpc_monitoring_go.ClusterStats, error) {
 	// Get right provider
 	provider, found := m.featureProviders[query.FeaturePlatformStats]
@@ -129,18 +174,14 @@ func (m *Manager) GetClusterStats(ctx context.Context, request *grpc_monitoring_
 		return nil, derrors.NewUnavailableError("no query provider for platform statistics")
 	}
 
-	vars := &query.TemplateVars{
-		AvgSeconds: request.GetRangeMinutes() * 60,
-	}
-
 	// If no specific fields are requested, get all
 	fields := request.GetFields()
 	if len(fields) == 0 {
 		fields = metrics_collector.AllGRPCStatsFields()
 	}
 
-	// TODO: parallel queries
 	var stats = map[int32]*grpc_monitoring_go.PlatformStat{}
+	requests := make([]*templateRequest, 0, len(fields)*len(query.CounterMap))
 	for _, field := range fields {
 		stat := &grpc_monitoring_go.PlatformStat{}
 
@@ -152,7 +193,7 @@ func (m *Manager) GetClusterStats(ctx context.Context, request *grpc_monitoring_
 			query.MetricRunning: &stat.Running, // gauge
 		}
 
-		vars.MetricName = metrics_collector.GRPCStatsFieldToMetric(field)
+		metricName := metrics_collector.GRPCStatsFieldToMetric(field)
 		for counter, valPtr := range resultMap {
 			// Determine template based on value type (counter, gauge)
 			templateName, derr := query.GetPlatformTemplateName(counter)
@@ -160,27 +201,47 @@ func (m *Manager) GetClusterStats(ctx context.Context, request *grpc_monitoring_
 				return nil, derr
 			}
 
-			vars.StatName = counter.String()
-			val, derr := provider.ExecuteTemplate(ctx, templateName, vars)
-			if derr != nil {
-				return nil, derr
-			}
-			*valPtr = val
+			requests = append(requests, &templateRequest{
+				key:  metricName + "_" + counter.String(),
+				name: templateName,
+				vars: query.TemplateVars{
+					AvgSeconds: request.GetRangeMinutes() * 60,
+					MetricName: metricName,
+					StatName:   counter.String(),
+				},
+				value: valPtr,
+			})
 		}
 
 		stats[int32(field)] = stat
 	}
 
+	queryCtx, cancel := m.queryContext(ctx)
+	defer cancel()
+	errors := executeTemplates(queryCtx, provider, requests, m.queryParallelism)
+	if len(errors) == len(requests) {
+		return nil, templateResultError("unable to retrieve any cluster statistic", errors)
+	}
+
 	// Create result
 	res := &grpc_monitoring_go.ClusterStats{
 		OrganizationId: request.GetOrganizationId(),
 		ClusterId:      request.GetClusterId(),
 		Stats:          stats,
+		Errors:         errors,
 	}
 
 	return res, nil
 }
 
+// queryContext creates the context shared by all queries of a request
+func (m *Manager) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, m.queryTimeout)
+}
+
 // Query executes a query directly on the monitoring storage backend
 func (m *Manager) Query(ctx context.Context, request *grpc_monitoring_go.QueryRequest) (*grpc_monitoring_go.QueryResponse, error) {
 	// Validate we have the right request type for the backend
@@ -227,6 +288,39 @@ func (m *Manager) Query(ctx context.Context, request *grpc_monitoring_go.QueryRe
 
 // GetContainerStats retrieves an array of stats for each application instance container deployed and running
 func (m *Manager) GetContainerStats(ctx context.Context, _ *grpc_common_go.Empty) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	containerStats, err := m.getContainerStats(ctx, NewContainerStatsFilter(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	containerStatsResponse := &grpc_monitoring_go.ContainerStatsResponse{
+		ContainerStats: containerStats,
+	}
+	return containerStatsResponse, nil
+}
+
+// ListContainerStats retrieves the stats of the application instance containers matching the request filters,
+// one page at a time
+func (m *Manager) ListContainerStats(ctx context.Context, request *grpc_monitoring_go.ContainerStatsRequest) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	containerStats, err := m.getContainerStats(ctx, NewContainerStatsFilter(request))
+	if err != nil {
+		return nil, err
+	}
+
+	page, nextPageToken, derr := PaginateContainerStats(containerStats, request.GetPageSize(), request.GetPageToken())
+	if derr != nil {
+		return nil, derr
+	}
+
+	containerStatsResponse := &grpc_monitoring_go.ContainerStatsResponse{
+		ContainerStats: page,
+		NextPageToken:  nextPageToken,
+	}
+	return containerStatsResponse, nil
+}
+
+// getContainerStats retrieves the stats of the containers selected by filter
+func (m *Manager) getContainerStats(ctx context.Context, filter *ContainerStatsFilter) ([]*grpc_monitoring_go.ContainerStats, error) {
 	// Validate we have the right request type for the backend
 	providerType := prometheus.ProviderType
 	provider, found := m.providers[providerType]
@@ -241,9 +335,14 @@ func (m *Manager) GetContainerStats(ctx context.Context, _ *grpc_common_go.Empty
 	queryTime := time.Now()
 
 	// Gather stats from Prometheus
-	cpuStatsFuture := getCpuStats(queryTime, ctx, provider, translator)
-	memoryStatsFuture := getMemoryStats(queryTime, ctx, provider, translator)
-	storageStatsFuture := getStorageStats(queryTime, ctx, provider, translator)
+	cpuStatsFuture := getCpuStats(filter, queryTime, ctx, provider, translator)
+	memoryStatsFuture := getMemoryStats(filter, queryTime, ctx, provider, translator)
+	storageStatsFuture := getStorageStats(filter, queryTime, ctx, provider, translator)
+
+	networkStatsFutures := make(map[string]chan *grpc_monitoring_go.QueryResponse, len(NetworkQueries))
+	for _, networkQuery := range NetworkQueries {
+		networkStatsFutures[networkQuery] = getNetworkStats(filter, networkQuery, queryTime, ctx, provider, translator)
+	}
 
 	cpuStats := <-cpuStatsFuture
 	memoryStats := <-memoryStatsFuture
@@ -267,67 +366,93 @@ func (m *Manager) GetContainerStats(ctx context.Context, _ *grpc_common_go.Empty
 		mapQueryResultsByNamespacePodContainerMetric(StorageQuery, storageStats, statsMapByNamespacePodContainerMetric)
 	}
 
-	// Map the pods to reduce the k8s queries
-	podMapByNamespacePodName := make(map[string]map[string]*corev1.Pod, len(statsMapByNamespacePodContainerMetric))
-	for namespaceName := range statsMapByNamespacePodContainerMetric {
-		podList, err := m.k8sClient.CoreV1().Pods(namespaceName).List(metav1.ListOptions{LabelSelector: utils.NalejPodLabelServiceInstanceId})
-		if err != nil {
-			log.Error().
-				Str("namespace", namespaceName).
-				Msg("could not get pods from the namespace")
+	// Network stats are only labelled by namespace and pod
+	networkStatsMapByNamespacePodMetric := make(map[string]map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue, 0)
+	for networkQuery, networkStatsFuture := range networkStatsFutures {
+		networkStats := <-networkStatsFuture
+		if networkStats == nil {
+			log.Warn().Msg(networkQuery + " stats could not be retrieved and will not be aggregated")
 			continue
 		}
-		podMapByPodName := make(map[string]*corev1.Pod, podList.Size())
-		for ix, pod := range podList.Items {
-			podMapByPodName[pod.Name] = &podList.Items[ix]
-		}
-		podMapByNamespacePodName[namespaceName] = podMapByPodName
+		mapQueryResultsByNamespacePodMetric(networkQuery, networkStats, networkStatsMapByNamespacePodMetric)
+	}
+
+	// Every container of the selected pods is reported, so the pods are
+	// listed from Kubernetes instead of taken from the metrics
+	podList, err := m.k8sClient.CoreV1().Pods(filter.namespace).List(metav1.ListOptions{LabelSelector: filter.LabelSelector()})
+	if err != nil {
+		return nil, derrors.NewUnavailableError("could not list the pods of the containers", err)
 	}
 
-	log.Debug().
-		Interface("statsMapByNamespacePodContainerMetric", statsMapByNamespacePodContainerMetric).
-		Interface("podMapByNamespacePodName", podMapByNamespacePodName).
-		Msg("trace")
-	// Compose the response object
+	return composeContainerStats(filter, podList.Items, statsMapByNamespacePodContainerMetric, networkStatsMapByNamespacePodMetric, queryTime), nil
+}
+
+// composeContainerStats joins the metrics of the containers with their pods.
+// Containers without metrics are reported as well, without usage: those that
+// never started (e.g., waiting on ImagePullBackOff) are the most likely to be
+// failing. Completed pods and the containers the recording rules exclude are
+// not reported.
+func composeContainerStats(
+	filter *ContainerStatsFilter,
+	pods []corev1.Pod,
+	statsMapByNamespacePodContainerMetric map[string]map[string]map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue,
+	networkStatsMapByNamespacePodMetric map[string]map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue,
+	now time.Time,
+) []*grpc_monitoring_go.ContainerStats {
 	containerStats := make([]*grpc_monitoring_go.ContainerStats, 0)
-	for namespaceName, podContainerMetric := range statsMapByNamespacePodContainerMetric {
-		for podName, containerMetric := range podContainerMetric {
-			pod, found := podMapByNamespacePodName[namespaceName][podName]
-			if !found {
-				log.Error().
-					Str("namespace", namespaceName).
-					Str("pod", podName).
-					Msg("could not find pod info. The stats will not be included")
+	for ix := range pods {
+		pod := &pods[ix]
+		if pod.Status.Phase == corev1.PodSucceeded {
+			continue
+		}
+		networkReported := false
+		for _, container := range pod.Spec.Containers {
+			if excludedContainers.MatchString(container.Name) {
 				continue
 			}
-			for containerName, metric := range containerMetric {
-				cpuMillicore, _ := strconv.ParseFloat(metric[CpuQuery].Value[0].Value, 64)
-				memoryByte, _ := strconv.ParseFloat(metric[MemoryQuery].Value[0].Value, 64)
-				storageByte, _ := strconv.ParseFloat(metric[StorageQuery].Value[0].Value, 64)
-				stats := grpc_monitoring_go.ContainerStats{
-					Namespace:                namespaceName,
-					Pod:                      podName,
-					Container:                containerName,
-					Image:                    metric[CpuQuery].Metric[utils.NalejMetricsImage],
-					AppInstanceId:            pod.Labels[utils.NalejPodLabelAppInstanceId],
-					AppInstanceName:          pod.Labels[utils.NalejPodLabelAppName],
-					ServiceGroupInstanceId:   pod.Labels[utils.NalejPodLabelServiceGroupInstanceId],
-					ServiceGroupInstanceName: pod.Labels[utils.NalejPodLabelServiceGroupName],
-					ServiceInstanceId:        pod.Labels[utils.NalejPodLabelServiceInstanceId],
-					ServiceInstanceName:      pod.Labels[utils.NalejPodLabelServiceName],
-					CpuMillicore:             cpuMillicore,
-					MemoryByte:               memoryByte,
-					StorageByte:              storageByte,
+			metric, measured := statsMapByNamespacePodContainerMetric[pod.Namespace][pod.Name][container.Name]
+			image := container.Image
+			if measured {
+				if metricImage := getMetricImage(metric); metricImage != "" {
+					image = metricImage
 				}
-				containerStats = append(containerStats, &stats)
+			} else if filter.image != "" && filter.image != image {
+				// The metrics were already filtered by image
+				continue
+			}
+
+			stats := grpc_monitoring_go.ContainerStats{
+				Namespace:                pod.Namespace,
+				Pod:                      pod.Name,
+				Container:                container.Name,
+				Image:                    image,
+				AppInstanceId:            pod.Labels[utils.NalejPodLabelAppInstanceId],
+				AppInstanceName:          pod.Labels[utils.NalejPodLabelAppName],
+				ServiceGroupInstanceId:   pod.Labels[utils.NalejPodLabelServiceGroupInstanceId],
+				ServiceGroupInstanceName: pod.Labels[utils.NalejPodLabelServiceGroupName],
+				ServiceInstanceId:        pod.Labels[utils.NalejPodLabelServiceInstanceId],
+				ServiceInstanceName:      pod.Labels[utils.NalejPodLabelServiceName],
+				CpuMillicore:             getMetricValue(metric, CpuQuery),
+				MemoryByte:               getMetricValue(metric, MemoryQuery),
+				StorageByte:              getMetricValue(metric, StorageQuery),
 			}
+			// The pod network is reported once, on its first reported
+			// container, so aggregations over containers don't count it twice
+			if !networkReported {
+				networkReported = true
+				networkMetric := networkStatsMapByNamespacePodMetric[pod.Namespace][pod.Name]
+				stats.NetworkReceiveBytePerSec = getMetricValue(networkMetric, NetworkReceiveQuery)
+				stats.NetworkTransmitBytePerSec = getMetricValue(networkMetric, NetworkTransmitQuery)
+				stats.NetworkReceiveDropPerSec = getMetricValue(networkMetric, NetworkReceiveDropQuery)
+				stats.NetworkTransmitDropPerSec = getMetricValue(networkMetric, NetworkTransmitDropQuery)
+			}
+			setContainerResources(&stats, pod)
+			setContainerStatus(&stats, pod, now)
+			containerStats = append(containerStats, &stats)
 		}
 	}
 
-	containerStatsResponse := &grpc_monitoring_go.ContainerStatsResponse{
-		ContainerStats: containerStats,
-	}
-	return containerStatsResponse, nil
+	return containerStats
 }
 
 // mapQueryResultsByNamespacePodContainerMetric iterates over the stats query response and map the results in a tree which first
@@ -358,21 +483,72 @@ func mapQueryResultsByNamespacePodContainerMetric(metricName string, results *gr
 	}
 }
 
-func getCpuStats(queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
+// mapQueryResultsByNamespacePodMetric iterates over a pod level query response and maps the results in a tree
+// with the namespace name, the pod name and the metric name as layers.
+func mapQueryResultsByNamespacePodMetric(metricName string, results *grpc_monitoring_go.QueryResponse, statsMap map[string]map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue) {
+	for _, result := range results.GetPrometheusResult().GetResult() {
+		namespaceName := result.Metric[utils.NalejMetricsNamespace]
+		podMetrics, exists := statsMap[namespaceName]
+		if !exists {
+			podMetrics = make(map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue, 0)
+			statsMap[namespaceName] = podMetrics
+		}
+
+		podName := result.Metric[utils.NalejMetricsPod]
+		metrics, exists := podMetrics[podName]
+		if !exists {
+			metrics = make(map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue, 0)
+			podMetrics[podName] = metrics
+		}
+		metrics[metricName] = result
+	}
+}
+
+// getMetricValue returns the latest value of a metric, or 0 if the metric was not retrieved.
+func getMetricValue(metrics map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue, metricName string) float64 {
+	result, found := metrics[metricName]
+	if !found || len(result.GetValue()) == 0 {
+		return 0
+	}
+	value, err := strconv.ParseFloat(result.GetValue()[0].GetValue(), 64)
+	if err != nil {
+		log.Warn().Str("metric", metricName).Str("value", result.GetValue()[0].GetValue()).Msg("invalid metric value")
+		return 0
+	}
+	return value
+}
+
+// getMetricImage returns the container image from the labels of whichever container metric is available.
+func getMetricImage(metrics map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue) string {
+	for _, metricName := range []string{CpuQuery, MemoryQuery, StorageQuery} {
+		if result, found := metrics[metricName]; found {
+			return result.Metric[utils.NalejMetricsImage]
+		}
+	}
+	return ""
+}
+
+func getCpuStats(filter *ContainerStatsFilter, queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
+	future := make(chan *grpc_monitoring_go.QueryResponse)
+	go launchQuery(filter.ContainerQuery(CpuQuery), queryTime, provider, ctx, translator, future)
+	return future
+}
+
+func getMemoryStats(filter *ContainerStatsFilter, queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
 	future := make(chan *grpc_monitoring_go.QueryResponse)
-	go launchQuery(CpuQuery, queryTime, provider, ctx, translator, future)
+	go launchQuery(filter.ContainerQuery(MemoryQuery), queryTime, provider, ctx, translator, future)
 	return future
 }
 
-func getMemoryStats(queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
+func getStorageStats(filter *ContainerStatsFilter, queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
 	future := make(chan *grpc_monitoring_go.QueryResponse)
-	go launchQuery(MemoryQuery, queryTime, provider, ctx, translator, future)
+	go launchQuery(filter.ContainerQuery(StorageQuery), queryTime, provider, ctx, translator, future)
 	return future
 }
 
-func getStorageStats(queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
+func getNetworkStats(filter *ContainerStatsFilter, metricName string, queryTime time.Time, ctx context.Context, provider query.Provider, translator translators.TranslatorFunc) chan *grpc_monitoring_go.QueryResponse {
 	future := make(chan *grpc_monitoring_go.QueryResponse)
-	go launchQuery(StorageQuery, queryTime, provider, ctx, translator, future)
+	go launchQuery(filter.PodQuery(metricName), queryTime, provider, ctx, translator, future)
 	return future
 }
 
@@ -63,6 +63,12 @@ var _ = ginkgo.Describe("retrieve_manager", func() {
 					Total:     13,
 					Available: 15,
 				},
+				Network: &grpc_monitoring_go.ClusterNetworkStat{
+					ReceiveBytePerSec:  45,
+					TransmitBytePerSec: 47,
+					ReceiveDropPerSec:  49,
+					TransmitDropPerSec: 51,
+				},
 			}
 			gomega.Expect(manager.GetClusterSummary(context.Background(), request)).To(gomega.Equal(result))
 		})
@@ -93,9 +99,42 @@ var _ = ginkgo.Describe("retrieve_manager", func() {
 					Total:     14,
 					Available: 16,
 				},
+				Network: &grpc_monitoring_go.ClusterNetworkStat{
+					ReceiveBytePerSec:  46,
+					TransmitBytePerSec: 48,
+					ReceiveDropPerSec:  50,
+					TransmitDropPerSec: 52,
+				},
 			}
 			gomega.Expect(manager.GetClusterSummary(context.Background(), request)).To(gomega.Equal(result))
 		})
+		ginkgo.It("should return a partial cluster summary", func() {
+			request := &grpc_monitoring_go.ClusterSummaryRequest{
+				OrganizationId: OrganizationId,
+				ClusterId:      ClusterId,
+				RangeMinutes:   5,
+			}
+
+			result, err := manager.GetClusterSummary(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result.CpuMillicores.Total).To(gomega.Equal(int64(53)))
+			gomega.Expect(result.MemoryBytes.Total).To(gomega.BeZero())
+			gomega.Expect(result.Errors).To(gomega.HaveLen(11))
+			gomega.Expect(result.Errors).ToNot(gomega.HaveKey("cpu_total"))
+			gomega.Expect(result.Errors).To(gomega.HaveKey("cpu_available"))
+			gomega.Expect(result.Errors).To(gomega.HaveKey("networkreceive"))
+		})
+
+		ginkgo.It("should fail when no value can be retrieved", func() {
+			request := &grpc_monitoring_go.ClusterSummaryRequest{
+				OrganizationId: OrganizationId,
+				ClusterId:      ClusterId,
+				RangeMinutes:   7,
+			}
+
+			_, err := manager.GetClusterSummary(context.Background(), request)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
 	})
 
 	ginkgo.Context("GetClusterStats", func() {
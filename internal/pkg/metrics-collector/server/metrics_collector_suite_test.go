@@ -17,6 +17,7 @@
 package server
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -34,6 +35,7 @@ import (
 	"github.com/onsi/gomega"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/test/bufconn"
 )
 
@@ -46,6 +48,7 @@ var listener *bufconn.Listener
 var grpcServer *grpc.Server
 
 var client grpc_monitoring_go.MetricsCollectorClient
+var healthClient grpc_health_v1.HealthClient
 
 var manager Manager
 
@@ -83,6 +86,9 @@ func beforeSuiteIntegrationTests() {
 		Port:      8423,
 		InCluster: true, // We won't actually connect to K8s, but this passes validation
 
+		QueryParallelism: 4,
+		QueryTimeout:     10 * time.Second,
+
 		QueryProviders: query.ProviderConfigs{
 			prometheus.ProviderType: prometheusConfig,
 		},
@@ -93,13 +99,14 @@ func beforeSuiteIntegrationTests() {
 
 	errChan := make(chan error, 1)
 	listener = test.GetDefaultListener()
-	grpcServer, derr = service.startRetrieve(listener, errChan)
+	grpcServer, derr = service.startRetrieve(context.Background(), listener, errChan)
 	gomega.Expect(derr).To(gomega.Succeed())
 
 	conn, err := test.GetConn(*listener)
 	gomega.Expect(err).To(gomega.Succeed())
 
 	client = grpc_monitoring_go.NewMetricsCollectorClient(conn)
+	healthClient = grpc_health_v1.NewHealthClient(conn)
 }
 
 func beforeSuiteRetrieveManager() {
@@ -124,6 +131,8 @@ func beforeSuiteRetrieveManager() {
 		query.TemplateName_CPU + query.TemplateName_Total: {
 			query.TemplateVars{AvgSeconds: 0}:   1,
 			query.TemplateVars{AvgSeconds: 600}: 2,
+			// Only value for a 5 minute range, to test partial results
+			query.TemplateVars{AvgSeconds: 300}: 53,
 		},
 		query.TemplateName_CPU + query.TemplateName_Available: {
 			query.TemplateVars{AvgSeconds: 0}:   3,
@@ -153,6 +162,22 @@ func beforeSuiteRetrieveManager() {
 			query.TemplateVars{AvgSeconds: 0}:   15,
 			query.TemplateVars{AvgSeconds: 600}: 16,
 		},
+		query.TemplateName_NetworkReceive: {
+			query.TemplateVars{AvgSeconds: 0}:   45,
+			query.TemplateVars{AvgSeconds: 600}: 46,
+		},
+		query.TemplateName_NetworkTransmit: {
+			query.TemplateVars{AvgSeconds: 0}:   47,
+			query.TemplateVars{AvgSeconds: 600}: 48,
+		},
+		query.TemplateName_NetworkReceiveDrops: {
+			query.TemplateVars{AvgSeconds: 0}:   49,
+			query.TemplateVars{AvgSeconds: 600}: 50,
+		},
+		query.TemplateName_NetworkTransmitDrops: {
+			query.TemplateVars{AvgSeconds: 0}:   51,
+			query.TemplateVars{AvgSeconds: 600}: 52,
+		},
 
 		query.TemplateName_PlatformStatsCounter: {
 			query.TemplateVars{AvgSeconds: 0, MetricName: "services", StatName: "created"}:    13,
@@ -200,7 +225,7 @@ func beforeSuiteRetrieveManager() {
 		provider.ProviderType(): provider,
 	}
 
-	manager, derr = NewManager(providers, nil)
+	manager, derr = NewManager(providers, nil, 4, time.Second)
 	gomega.Expect(derr).To(gomega.Succeed())
 
 	/* Insert fake provider */
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Container resource requests, limits and utilization
+
+package server
+
+import (
+	"github.com/nalej/grpc-monitoring-go"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CpuQuery is recorded as cores / 1000 (see the application-stats rules in
+// prometheus.prometheusrules.yaml); this converts it to millicores.
+const cpuQueryMillicoresFactor = 1000 * 1000
+
+// setContainerResources fills in the requests and limits of a container from
+// its pod spec, together with the utilization of the measured usage against
+// them. Utilization is left at 0 when no request or limit is set.
+func setContainerResources(stats *grpc_monitoring_go.ContainerStats, pod *corev1.Pod) {
+	container := findContainer(pod, stats.GetContainer())
+	if container == nil {
+		return
+	}
+
+	requests := container.Resources.Requests
+	limits := container.Resources.Limits
+
+	stats.CpuRequestMillicore = float64(requests.Cpu().MilliValue())
+	stats.CpuLimitMillicore = float64(limits.Cpu().MilliValue())
+	stats.MemoryRequestByte = float64(requests.Memory().Value())
+	stats.MemoryLimitByte = float64(limits.Memory().Value())
+
+	cpuUsageMillicore := stats.GetCpuMillicore() * cpuQueryMillicoresFactor
+	stats.CpuRequestUtilization = utilization(cpuUsageMillicore, stats.CpuRequestMillicore)
+	stats.CpuLimitUtilization = utilization(cpuUsageMillicore, stats.CpuLimitMillicore)
+	stats.MemoryRequestUtilization = utilization(stats.GetMemoryByte(), stats.MemoryRequestByte)
+	stats.MemoryLimitUtilization = utilization(stats.GetMemoryByte(), stats.MemoryLimitByte)
+}
+
+func findContainer(pod *corev1.Pod, containerName string) *corev1.Container {
+	for ix, container := range pod.Spec.Containers {
+		if container.Name == containerName {
+			return &pod.Spec.Containers[ix]
+		}
+	}
+	return nil
+}
+
+func utilization(usage float64, reference float64) float64 {
+	if reference <= 0 {
+		return 0
+	}
+	return usage / reference
+}
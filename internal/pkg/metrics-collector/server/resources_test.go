@@ -0,0 +1,80 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Container resources tests
+
+package server
+
+import (
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = ginkgo.Describe("container resources", func() {
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("500m"),
+							corev1.ResourceMemory: resource.MustParse("256Mi"),
+						},
+						Limits: corev1.ResourceList{
+							corev1.ResourceCPU: resource.MustParse("1"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ginkgo.It("should set requests, limits and utilization", func() {
+		stats := &grpc_monitoring_go.ContainerStats{
+			Container:    "app",
+			CpuMillicore: 0.00025, // 250 millicores
+			MemoryByte:   128 * 1024 * 1024,
+		}
+		setContainerResources(stats, pod)
+
+		gomega.Expect(stats.CpuRequestMillicore).To(gomega.Equal(float64(500)))
+		gomega.Expect(stats.CpuLimitMillicore).To(gomega.Equal(float64(1000)))
+		gomega.Expect(stats.MemoryRequestByte).To(gomega.Equal(float64(256 * 1024 * 1024)))
+		gomega.Expect(stats.MemoryLimitByte).To(gomega.BeZero())
+
+		gomega.Expect(stats.CpuRequestUtilization).To(gomega.BeNumerically("~", 0.5))
+		gomega.Expect(stats.CpuLimitUtilization).To(gomega.BeNumerically("~", 0.25))
+		gomega.Expect(stats.MemoryRequestUtilization).To(gomega.BeNumerically("~", 0.5))
+		gomega.Expect(stats.MemoryLimitUtilization).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should ignore unknown containers", func() {
+		stats := &grpc_monitoring_go.ContainerStats{
+			Container:    "sidecar",
+			CpuMillicore: 0.00025,
+		}
+		setContainerResources(stats, pod)
+		gomega.Expect(stats.CpuRequestMillicore).To(gomega.BeZero())
+		gomega.Expect(stats.CpuRequestUtilization).To(gomega.BeZero())
+	})
+})
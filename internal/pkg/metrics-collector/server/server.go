@@ -17,6 +17,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -29,13 +30,20 @@ import (
 
 	"github.com/nalej/grpc-monitoring-go"
 
+	"github.com/nalej/monitoring/internal/pkg/certs"
+	"github.com/nalej/monitoring/internal/pkg/health"
 	"github.com/nalej/monitoring/pkg/provider/query"
 
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
+// Full name of the query method, which can be restricted by client
+// certificate. It is validated against the registered services on startup.
+const queryMethod = "/" + health.MetricsCollectorService + "/Query"
+
 // Service with configuration and gRPC server
 type Service struct {
 	Configuration *Config
@@ -66,7 +74,10 @@ func (s *Service) Run() derrors.Error {
 		return derrors.NewUnavailableError("failed to listen", err)
 	}
 
-	grpcServer, derr := s.startRetrieve(grpcListener, errChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	grpcServer, derr := s.startRetrieve(ctx, grpcListener, errChan)
 	if derr != nil {
 		return derr
 	}
@@ -88,8 +99,9 @@ func (s *Service) Run() derrors.Error {
 	return nil
 }
 
-// startRetrieve Initializes and start the retrieval/query API. This starts the gRPC server.
-func (s *Service) startRetrieve(grpcListener net.Listener, errChan chan<- error) (*grpc.Server, derrors.Error) {
+// startRetrieve Initializes and start the retrieval/query API. This starts the gRPC server
+// and the health checks of the query providers, which run until ctx is cancelled.
+func (s *Service) startRetrieve(ctx context.Context, grpcListener net.Listener, errChan chan<- error) (*grpc.Server, derrors.Error) {
 	// Create query providers
 	queryProviders := query.Providers{}
 	for queryProviderType, queryProviderConfig := range s.Configuration.QueryProviders {
@@ -108,7 +120,7 @@ func (s *Service) startRetrieve(grpcListener net.Listener, errChan chan<- error)
 	}
 
 	// Create manager and handler for gRPC endpoints
-	retrieveManager, derr := NewManager(queryProviders, k8sClient)
+	retrieveManager, derr := NewManager(queryProviders, k8sClient, s.Configuration.QueryParallelism, s.Configuration.QueryTimeout)
 	if derr != nil {
 		return nil, derr
 	}
@@ -118,8 +130,23 @@ func (s *Service) startRetrieve(grpcListener net.Listener, errChan chan<- error)
 	}
 
 	// Create server and register handler
-	grpcServer := grpc.NewServer()
+	options, authorizer, derr := s.serverOptions()
+	if derr != nil {
+		return nil, derr
+	}
+	grpcServer := grpc.NewServer(options...)
 	grpc_monitoring_go.RegisterMetricsCollectorServer(grpcServer, retrieveHandler)
+	if authorizer != nil {
+		if derr := authorizer.Validate(grpcServer.GetServiceInfo()); derr != nil {
+			return nil, derr
+		}
+	}
+
+	// The collector is healthy when all its query providers are
+	checker := health.NewChecker(health.DefaultInterval, health.DefaultTimeout)
+	checker.AddService(health.MetricsCollectorService, providerDependencies(queryProviders)...)
+	checker.Register(grpcServer)
+	go checker.Run(ctx)
 
 	// Start gRPC server
 	reflection.Register(grpcServer)
@@ -135,6 +162,49 @@ func (s *Service) startRetrieve(grpcListener net.Listener, errChan chan<- error)
 	return grpcServer, nil
 }
 
+// serverOptions returns the TLS credentials and authorization of the gRPC
+// server, and the authorizer if methods are restricted
+func (s *Service) serverOptions() ([]grpc.ServerOption, *certs.SubjectAuthorizer, derrors.Error) {
+	if s.Configuration.ServerCertPath == "" {
+		return nil, nil, nil
+	}
+
+	tlsConfig, derr := certs.ServerTLSConfig(s.Configuration.ServerCertPath, s.Configuration.ClientCACertPath)
+	if derr != nil {
+		return nil, nil, derr
+	}
+	options := []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}
+
+	// Queries run arbitrary expressions on the backends, so they can be
+	// restricted to management plane clients
+	if len(s.Configuration.QuerySubjects) == 0 {
+		return options, nil, nil
+	}
+	authorizer := certs.NewSubjectAuthorizer()
+	authorizer.Restrict(queryMethod, s.Configuration.QuerySubjects...)
+	options = append(options, grpc.UnaryInterceptor(authorizer.UnaryServerInterceptor()))
+
+	return options, authorizer, nil
+}
+
+// providerDependencies creates the health check dependencies on the query providers
+func providerDependencies(providers query.Providers) []health.Dependency {
+	dependencies := make([]health.Dependency, 0, len(providers))
+	for providerType, provider := range providers {
+		provider := provider
+		dependencies = append(dependencies, health.Dependency{
+			Name: providerType.String(),
+			Check: func(ctx context.Context) error {
+				if derr := provider.Ping(ctx); derr != nil {
+					return derr
+				}
+				return nil
+			},
+		})
+	}
+	return dependencies
+}
+
 // Create a new kubernetes Client using deployment inside the cluster.
 //  params:
 //   internal true if the Client is deployed inside the cluster.
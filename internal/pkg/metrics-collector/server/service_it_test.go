@@ -24,12 +24,15 @@ import (
 	"context"
 
 	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/monitoring/internal/pkg/health"
 	"github.com/nalej/monitoring/pkg/utils"
 
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 
 	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // NOTE: We don't check exact results as we current do not populate
@@ -165,4 +168,17 @@ var _ = ginkgo.Describe("integration tests", func() {
 			gomega.Expect(err).To(gomega.Succeed())
 		})
 	})
+
+	ginkgo.Context("Health", func() {
+		ginkgo.It("should report the collector as serving", func() {
+			check := func() grpc_health_v1.HealthCheckResponse_ServingStatus {
+				res, err := healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{
+					Service: health.MetricsCollectorService,
+				})
+				gomega.Expect(err).To(gomega.Succeed())
+				return res.GetStatus()
+			}
+			gomega.Eventually(check).Should(gomega.Equal(grpc_health_v1.HealthCheckResponse_SERVING))
+		})
+	})
 })
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Container health signals from the pod status
+
+package server
+
+import (
+	"time"
+
+	"github.com/nalej/grpc-monitoring-go"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// recentTerminationPeriod is the time a container that runs again is still
+// reported with the reason it last terminated. Older terminations are
+// considered recovered.
+const recentTerminationPeriod = time.Hour
+
+// setContainerStatus fills in the restart count, the reason the container
+// last terminated (e.g., OOMKilled, Error) and the reason it is currently
+// waiting (e.g., CrashLoopBackOff, ImagePullBackOff), if any. The last
+// termination is only reported while the container is not running, or for
+// recentTerminationPeriod after it restarted.
+func setContainerStatus(stats *grpc_monitoring_go.ContainerStats, pod *corev1.Pod, now time.Time) {
+	status := findContainerStatus(pod, stats.GetContainer())
+	if status == nil {
+		return
+	}
+
+	stats.RestartCount = status.RestartCount
+	if terminated := status.State.Terminated; terminated != nil {
+		stats.LastTerminationReason = terminated.Reason
+	} else if terminated := status.LastTerminationState.Terminated; terminated != nil {
+		if status.State.Running == nil || now.Sub(terminated.FinishedAt.Time) < recentTerminationPeriod {
+			stats.LastTerminationReason = terminated.Reason
+		}
+	}
+	if waiting := status.State.Waiting; waiting != nil {
+		stats.WaitingReason = waiting.Reason
+	}
+}
+
+func findContainerStatus(pod *corev1.Pod, containerName string) *corev1.ContainerStatus {
+	for ix, status := range pod.Status.ContainerStatuses {
+		if status.Name == containerName {
+			return &pod.Status.ContainerStatuses[ix]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Container status tests
+
+package server
+
+import (
+	"time"
+
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = ginkgo.Describe("container status", func() {
+
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(now.Add(-time.Minute))}}
+	waiting := func(reason string) corev1.ContainerState {
+		return corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}
+	}
+	terminated := func(reason string, ago time.Duration) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: reason, FinishedAt: metav1.NewTime(now.Add(-ago))}}
+	}
+
+	table.DescribeTable("should report restarts, termination and waiting reasons",
+		func(status corev1.ContainerStatus, restarts int32, terminationReason string, waitingReason string) {
+			status.Name = "app"
+			pod := &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{status}}}
+			stats := &grpc_monitoring_go.ContainerStats{Container: "app"}
+			setContainerStatus(stats, pod, now)
+
+			gomega.Expect(stats.RestartCount).To(gomega.Equal(restarts))
+			gomega.Expect(stats.LastTerminationReason).To(gomega.Equal(terminationReason))
+			gomega.Expect(stats.WaitingReason).To(gomega.Equal(waitingReason))
+		},
+		table.Entry("healthy", corev1.ContainerStatus{State: running}, int32(0), "", ""),
+		table.Entry("crash looping",
+			corev1.ContainerStatus{RestartCount: 4, State: waiting("CrashLoopBackOff"), LastTerminationState: terminated("OOMKilled", 2*time.Hour)},
+			int32(4), "OOMKilled", "CrashLoopBackOff"),
+		table.Entry("running after a recent crash",
+			corev1.ContainerStatus{RestartCount: 1, State: running, LastTerminationState: terminated("Error", 10*time.Minute)},
+			int32(1), "Error", ""),
+		table.Entry("running long after a crash",
+			corev1.ContainerStatus{RestartCount: 1, State: running, LastTerminationState: terminated("OOMKilled", 2*time.Hour)},
+			int32(1), "", ""),
+		table.Entry("never started", corev1.ContainerStatus{State: waiting("ImagePullBackOff")}, int32(0), "", "ImagePullBackOff"),
+		table.Entry("terminated without restart",
+			corev1.ContainerStatus{State: terminated("Error", 5*time.Hour), LastTerminationState: terminated("OOMKilled", 6*time.Hour)},
+			int32(0), "Error", ""),
+	)
+
+	ginkgo.It("should ignore unknown containers", func() {
+		pod := &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "app", RestartCount: 4, State: waiting("CrashLoopBackOff")},
+		}}}
+		stats := &grpc_monitoring_go.ContainerStats{Container: "sidecar"}
+		setContainerStatus(stats, pod, now)
+		gomega.Expect(stats.RestartCount).To(gomega.BeZero())
+		gomega.Expect(stats.WaitingReason).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should report the containers without metrics", func() {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns-1", Name: "web-1", Labels: map[string]string{"nalej-service-instance-id": "service-1"}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Image: "web:1"},
+				{Name: "proxy", Image: "proxy:1"},
+			}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", State: running},
+				{Name: "proxy", State: waiting("ImagePullBackOff")},
+			}},
+		}
+		completed := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns-1", Name: "job-1"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "job", Image: "job:1"}}},
+			Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+		}
+		metrics := map[string]map[string]map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue{
+			"ns-1": {"web-1": {"app": {CpuQuery: {
+				Metric: map[string]string{"image": "docker.io/web:1"},
+				Value:  []*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue_Value{{Value: "0.0002"}},
+			}}}},
+		}
+
+		stats := composeContainerStats(NewContainerStatsFilter(nil), []corev1.Pod{pod, completed}, metrics, nil, now)
+		gomega.Expect(stats).To(gomega.HaveLen(2))
+		gomega.Expect(stats[0].Container).To(gomega.Equal("app"))
+		gomega.Expect(stats[0].Image).To(gomega.Equal("docker.io/web:1"))
+		gomega.Expect(stats[0].CpuMillicore).To(gomega.Equal(0.0002))
+		gomega.Expect(stats[1].Container).To(gomega.Equal("proxy"))
+		gomega.Expect(stats[1].ServiceInstanceId).To(gomega.Equal("service-1"))
+		gomega.Expect(stats[1].CpuMillicore).To(gomega.BeZero())
+		gomega.Expect(stats[1].WaitingReason).To(gomega.Equal("ImagePullBackOff"))
+
+		// Containers without metrics are filtered by the image of their spec
+		filter := NewContainerStatsFilter(&grpc_monitoring_go.ContainerStatsRequest{Image: "docker.io/web:1"})
+		stats = composeContainerStats(filter, []corev1.Pod{pod}, metrics, nil, now)
+		gomega.Expect(stats).To(gomega.HaveLen(1))
+		gomega.Expect(stats[0].Container).To(gomega.Equal("app"))
+	})
+
+	ginkgo.It("should skip the containers excluded by the recording rules", func() {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns-1", Name: "web-1"},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "zt-sidecar", Image: "zt:1"},
+				{Name: "POD", Image: "pause:1"},
+				{Name: "app", Image: "web:1"},
+				{Name: "proxy", Image: "proxy:1"},
+			}},
+		}
+		network := map[string]map[string]map[string]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue{
+			"ns-1": {"web-1": {NetworkReceiveQuery: {
+				Value: []*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue_Value{{Value: "100"}},
+			}}},
+		}
+
+		stats := composeContainerStats(NewContainerStatsFilter(nil), []corev1.Pod{pod}, nil, network, now)
+		gomega.Expect(stats).To(gomega.HaveLen(2))
+		gomega.Expect(stats[0].Container).To(gomega.Equal("app"))
+		gomega.Expect(stats[0].NetworkReceiveBytePerSec).To(gomega.Equal(100.0))
+		gomega.Expect(stats[1].Container).To(gomega.Equal("proxy"))
+		gomega.Expect(stats[1].NetworkReceiveBytePerSec).To(gomega.BeZero())
+	})
+})
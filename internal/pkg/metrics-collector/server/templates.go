@@ -0,0 +1,96 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Bounded parallel execution of query templates
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/monitoring/pkg/provider/query"
+	"github.com/rs/zerolog/log"
+)
+
+// templateRequest is a single template execution and the value it fills in
+type templateRequest struct {
+	// Key used to report a failure of this template
+	key   string
+	name  query.TemplateName
+	vars  query.TemplateVars
+	value *int64
+}
+
+// executeTemplates executes the template requests with at most parallelism
+// queries at the same time, all sharing the deadline of ctx. The values of
+// failed requests are left untouched; their errors are returned by key. The
+// returned map is nil when every request succeeded.
+func executeTemplates(ctx context.Context, provider query.Provider, requests []*templateRequest, parallelism int) map[string]string {
+	if parallelism <= 0 {
+		parallelism = len(requests)
+	}
+
+	var errors map[string]string
+	var errorsLock sync.Mutex
+	var wg sync.WaitGroup
+
+	// Semaphore limiting the number of concurrent queries
+	slots := make(chan struct{}, parallelism)
+
+	for _, request := range requests {
+		wg.Add(1)
+		go func(request *templateRequest) {
+			defer wg.Done()
+
+			var derr derrors.Error
+			select {
+			case slots <- struct{}{}:
+				var val int64
+				val, derr = provider.ExecuteTemplate(ctx, request.name, &request.vars)
+				<-slots
+				if derr == nil {
+					*request.value = val
+					return
+				}
+			case <-ctx.Done():
+				derr = derrors.NewDeadlineExceededError("template not executed", ctx.Err())
+			}
+
+			log.Warn().Str("key", request.key).Str("template", request.name.String()).Err(derr).Msg("failed executing template")
+			errorsLock.Lock()
+			if errors == nil {
+				errors = make(map[string]string)
+			}
+			errors[request.key] = derr.Error()
+			errorsLock.Unlock()
+		}(request)
+	}
+
+	wg.Wait()
+	return errors
+}
+
+// templateResultError creates the error for a template execution in which
+// every request failed, so there is no partial result to return.
+func templateResultError(msg string, errors map[string]string) derrors.Error {
+	params := make([]interface{}, 0, len(errors))
+	for key, err := range errors {
+		params = append(params, key+": "+err)
+	}
+	return derrors.NewUnavailableError(msg).WithParams(params...)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Bearer token authentication of organization requests
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Metadata key of the authorization header, as forwarded by the gateway
+	authorizationMetadata = "authorization"
+	bearerPrefix          = "bearer "
+	// Claim used to identify a JWT in the usage log if it has no jti
+	subjectClaim = "sub"
+	tokenIdClaim = "jti"
+)
+
+// StaticToken is an API token from the tokens file
+type StaticToken struct {
+	// Name of the token, used in the usage log
+	Name string `json:"name"`
+	// Organization the token gives access to
+	OrganizationId string `json:"organization_id"`
+	// Secret value sent as bearer token
+	Token string `json:"token"`
+}
+
+// Identity of an authenticated request
+type Identity struct {
+	// Token name, or JWT id or subject
+	Name           string
+	OrganizationId string
+}
+
+// Authenticator validates bearer tokens, either JWTs signed by a key of a
+// key set or static API tokens, and checks they belong to the requested
+// organization.
+type Authenticator struct {
+	keySet *KeySet
+	// Name of the JWT claim with the organization
+	organizationClaim string
+	// Static tokens by the hash of their value, so lookups don't
+	// depend on how much of a guessed token matches
+	tokens map[[sha256.Size]byte]*StaticToken
+}
+
+// NewAuthenticator creates an authenticator from a JSON Web Key Set file
+// and a static tokens file; either of them can be empty.
+func NewAuthenticator(keySetPath string, tokensPath string, organizationClaim string) (*Authenticator, derrors.Error) {
+	a := &Authenticator{
+		organizationClaim: organizationClaim,
+		tokens:            map[[sha256.Size]byte]*StaticToken{},
+	}
+
+	if keySetPath != "" {
+		keySet, derr := LoadKeySet(keySetPath)
+		if derr != nil {
+			return nil, derr
+		}
+		a.keySet = keySet
+	}
+
+	if tokensPath != "" {
+		tokens, derr := LoadStaticTokens(tokensPath)
+		if derr != nil {
+			return nil, derr
+		}
+		for _, token := range tokens {
+			a.tokens[sha256.Sum256([]byte(token.Token))] = token
+		}
+	}
+
+	return a, nil
+}
+
+// LoadStaticTokens reads a JSON file with a list of static tokens
+func LoadStaticTokens(path string) ([]*StaticToken, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot read tokens file", err).WithParams(path)
+	}
+
+	var tokens []*StaticToken
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid tokens file", err).WithParams(path)
+	}
+	for _, token := range tokens {
+		if token.Name == "" || token.OrganizationId == "" || token.Token == "" {
+			return nil, derrors.NewInvalidArgumentError("tokens need a name, organization_id and token").WithParams(path, token.Name)
+		}
+	}
+	return tokens, nil
+}
+
+// Authorize authenticates the bearer token of a request and checks it
+// gives access to an organization. Every authorized use is logged with
+// the token name.
+func (a *Authenticator) Authorize(ctx context.Context, organizationId string) (*Identity, derrors.Error) {
+	token, derr := bearerToken(ctx)
+	if derr != nil {
+		return nil, derr
+	}
+
+	identity, derr := a.authenticate(token)
+	if derr != nil {
+		return nil, derr
+	}
+
+	if identity.OrganizationId != organizationId {
+		log.Warn().Str("token", identity.Name).Str("token_organization_id", identity.OrganizationId).
+			Str("organization_id", organizationId).Msg("token used for another organization")
+		return nil, derrors.NewPermissionDeniedError("token not valid for organization").WithParams(organizationId)
+	}
+
+	log.Info().Str("token", identity.Name).Str("organization_id", organizationId).Msg("authorized request")
+	return identity, nil
+}
+
+func (a *Authenticator) authenticate(token string) (*Identity, derrors.Error) {
+	if static, found := a.tokens[sha256.Sum256([]byte(token))]; found {
+		return &Identity{Name: static.Name, OrganizationId: static.OrganizationId}, nil
+	}
+
+	// Static tokens are opaque; only tokens with JWT structure are verified
+	if a.keySet == nil || strings.Count(token, ".") != 2 {
+		return nil, derrors.NewUnauthenticatedError("invalid token")
+	}
+
+	claims, derr := a.keySet.Verify(token, time.Now())
+	if derr != nil {
+		return nil, derr
+	}
+
+	organizationId, _ := claims[a.organizationClaim].(string)
+	if organizationId == "" {
+		return nil, derrors.NewUnauthenticatedError("token without organization").WithParams(a.organizationClaim)
+	}
+
+	name, _ := claims[tokenIdClaim].(string)
+	if name == "" {
+		name, _ = claims[subjectClaim].(string)
+	}
+
+	return &Identity{Name: name, OrganizationId: organizationId}, nil
+}
+
+// bearerToken returns the bearer token of the authorization metadata
+func bearerToken(ctx context.Context) (string, derrors.Error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", derrors.NewUnauthenticatedError("authorization required")
+	}
+
+	for _, value := range md.Get(authorizationMetadata) {
+		if len(value) > len(bearerPrefix) && strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+			return strings.TrimSpace(value[len(bearerPrefix):]), nil
+		}
+	}
+	return "", derrors.NewUnauthenticatedError("bearer token required")
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Bearer token authentication tests
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const secret = "not-a-real-secret"
+
+func encodeSegment(value interface{}) string {
+	raw, err := json.Marshal(value)
+	gomega.Expect(err).To(gomega.Succeed())
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// signedToken creates a token with the given claims
+func signedToken(alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	options := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		options = options.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, options)
+	gomega.Expect(err).To(gomega.Succeed())
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	gomega.Expect(err).To(gomega.Succeed())
+	return token
+}
+
+// hs256Token creates a token signed with the test secret
+func hs256Token(claims map[string]interface{}) string {
+	return signedToken(jose.HS256, []byte(secret), "hmac", claims)
+}
+
+// requestContext creates an incoming request context with an authorization header
+func requestContext(authorization string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(authorizationMetadata, authorization))
+}
+
+var _ = ginkgo.Describe("authenticator", func() {
+
+	var dir string
+	var authenticator *Authenticator
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "auth")
+		gomega.Expect(err).To(gomega.Succeed())
+
+		keySet := fmt.Sprintf(`{"keys": [{"kid": "hmac", "kty": "oct", "k": "%s"}]}`,
+			base64.RawURLEncoding.EncodeToString([]byte(secret)))
+		gomega.Expect(ioutil.WriteFile(filepath.Join(dir, "jwks.json"), []byte(keySet), 0600)).To(gomega.Succeed())
+
+		tokens := `[{"name": "customer-prometheus", "organization_id": "org-1", "token": "static-token-1"}]`
+		gomega.Expect(ioutil.WriteFile(filepath.Join(dir, "tokens.json"), []byte(tokens), 0600)).To(gomega.Succeed())
+
+		var derr derrors.Error
+		authenticator, derr = NewAuthenticator(filepath.Join(dir, "jwks.json"), filepath.Join(dir, "tokens.json"), "organizationID")
+		gomega.Expect(derr).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	ginkgo.It("should require a bearer token", func() {
+		_, derr := authenticator.Authorize(context.Background(), "org-1")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+
+		_, derr = authenticator.Authorize(requestContext("Basic dXNlcjpwYXNz"), "org-1")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should accept a static token for its organization", func() {
+		identity, derr := authenticator.Authorize(requestContext("Bearer static-token-1"), "org-1")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(identity.Name).To(gomega.Equal("customer-prometheus"))
+
+		_, derr = authenticator.Authorize(requestContext("Bearer static-token-1"), "org-2")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+
+		_, derr = authenticator.Authorize(requestContext("Bearer static-token-2"), "org-1")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should accept a valid JWT for its organization", func() {
+		token := hs256Token(map[string]interface{}{
+			"jti":            "token-1",
+			"organizationID": "org-1",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		})
+		identity, derr := authenticator.Authorize(requestContext("Bearer "+token), "org-1")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(identity.Name).To(gomega.Equal("token-1"))
+
+		_, derr = authenticator.Authorize(requestContext("Bearer "+token), "org-2")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should reject expired and tampered JWTs", func() {
+		expired := hs256Token(map[string]interface{}{
+			"organizationID": "org-1",
+			"exp":            time.Now().Add(-time.Hour).Unix(),
+		})
+		_, derr := authenticator.Authorize(requestContext("Bearer "+expired), "org-1")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+
+		valid := hs256Token(map[string]interface{}{"organizationID": "org-1"})
+		tampered := valid[:len(valid)-2] + "AA"
+		_, derr = authenticator.Authorize(requestContext("Bearer "+tampered), "org-1")
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+})
+
+var _ = ginkgo.Describe("key set", func() {
+
+	ginkgo.It("should verify ES256 tokens", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		gomega.Expect(err).To(gomega.Succeed())
+
+		jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey}}})
+		gomega.Expect(err).To(gomega.Succeed())
+		keySet, derr := ParseKeySet(jwks)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		token := signedToken(jose.ES256, key, "", map[string]interface{}{"sub": "user-1"})
+		claims, derr := keySet.Verify(token, time.Now())
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(claims).To(gomega.HaveKeyWithValue("sub", "user-1"))
+	})
+
+	ginkgo.It("should reject tokens that are not valid yet", func() {
+		keySet, derr := ParseKeySet([]byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`))
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		token := signedToken(jose.HS256, []byte("secret"), "", map[string]interface{}{
+			"sub": "user-1",
+			"nbf": time.Now().Add(time.Hour).Unix(),
+		})
+		_, derr = keySet.Verify(token, time.Now())
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should not accept a token algorithm different from the key", func() {
+		keySet, derr := ParseKeySet([]byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`))
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		token := encodeSegment(map[string]string{"alg": "none"}) + "." + encodeSegment(map[string]string{"sub": "user-1"}) + "."
+		_, derr = keySet.Verify(token, time.Now())
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+})
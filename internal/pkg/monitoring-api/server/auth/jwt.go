@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// JSON Web Token verification against a JSON Web Key Set
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/nalej/derrors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// KeySet verifies JSON Web Tokens signed with one of its keys
+type KeySet struct {
+	keys jose.JSONWebKeySet
+}
+
+// LoadKeySet reads a JSON Web Key Set file
+func LoadKeySet(path string) (*KeySet, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot read key set", err).WithParams(path)
+	}
+	return ParseKeySet(content)
+}
+
+// ParseKeySet parses a JSON Web Key Set with RSA, P-256 EC or symmetric
+// keys. Keys without algorithm get RS256, ES256 or HS256 by their type.
+func ParseKeySet(content []byte) (*KeySet, derrors.Error) {
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid key set", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, derrors.NewInvalidArgumentError("key set without keys")
+	}
+
+	for i := range set.Keys {
+		key := &set.Keys[i]
+		// Only the public part of asymmetric keys is needed
+		if _, symmetric := key.Key.([]byte); !symmetric && !key.IsPublic() {
+			*key = key.Public()
+		}
+		alg, derr := keyAlgorithm(key)
+		if derr != nil {
+			return nil, derr.WithParams(key.KeyID)
+		}
+		if key.Algorithm == "" {
+			key.Algorithm = alg
+		}
+	}
+
+	return &KeySet{keys: set}, nil
+}
+
+// keyAlgorithm returns the signature algorithm supported for a key
+func keyAlgorithm(key *jose.JSONWebKey) (string, derrors.Error) {
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		return string(jose.RS256), nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", derrors.NewInvalidArgumentError("unsupported curve").WithParams(k.Curve.Params().Name)
+		}
+		return string(jose.ES256), nil
+	case []byte:
+		if len(k) == 0 {
+			return "", derrors.NewInvalidArgumentError("invalid symmetric key")
+		}
+		return string(jose.HS256), nil
+	}
+	return "", derrors.NewInvalidArgumentError("unsupported key type")
+}
+
+// Verify checks the signature and validity period of a token at the given
+// time and returns its claims.
+func (s *KeySet) Verify(token string, now time.Time) (map[string]interface{}, derrors.Error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, derrors.NewUnauthenticatedError("malformed token", err)
+	}
+	if len(parsed.Headers) != 1 {
+		return nil, derrors.NewUnauthenticatedError("malformed token")
+	}
+	header := parsed.Headers[0]
+
+	key, derr := s.key(header.KeyID)
+	if derr != nil {
+		return nil, derr
+	}
+	// The algorithm comes from the key, never only from the token, so a
+	// public key can't be used as an HMAC secret
+	if header.Algorithm != key.Algorithm {
+		return nil, derrors.NewUnauthenticatedError("unexpected token algorithm").WithParams(header.Algorithm)
+	}
+
+	var standard jwt.Claims
+	claims := map[string]interface{}{}
+	if err := parsed.Claims(key.Key, &standard, &claims); err != nil {
+		return nil, derrors.NewUnauthenticatedError("invalid token signature", err)
+	}
+	if err := standard.ValidateWithLeeway(jwt.Expected{Time: now}, 0); err != nil {
+		return nil, derrors.NewUnauthenticatedError("invalid token", err)
+	}
+
+	return claims, nil
+}
+
+// key returns the key a token was signed with. Tokens without key id
+// are accepted when the set has a single key.
+func (s *KeySet) key(kid string) (*jose.JSONWebKey, derrors.Error) {
+	if kid == "" && len(s.keys.Keys) == 1 {
+		return &s.keys.Keys[0], nil
+	}
+	if keys := s.keys.Key(kid); len(keys) > 0 {
+		return &keys[0], nil
+	}
+	return nil, derrors.NewUnauthenticatedError("unknown token key").WithParams(kid)
+}
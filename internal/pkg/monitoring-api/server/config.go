@@ -19,6 +19,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/nalej/derrors"
 	"github.com/nalej/monitoring/version"
 	"github.com/rs/zerolog/log"
@@ -40,8 +42,26 @@ type Config struct {
 	CACertPath string
 	// ClientCertPath Client Cert Path.
 	ClientCertPath string
+	// ServerCertPath is the directory with the certificate of the gRPC server, required with TLS.
+	ServerCertPath string
 	// MonitoringManagerAddress is the address to the monitoring manager service
 	MonitoringManagerAddress string
+	// AuthKeySetPath is the JSON Web Key Set verifying bearer JWTs.
+	AuthKeySetPath string
+	// AuthTokensPath is the JSON file with static API tokens.
+	AuthTokensPath string
+	// AuthOrganizationClaim is the JWT claim with the organization of the token.
+	AuthOrganizationClaim string
+	// RemoteWriteTargetsPath is the JSON file with the remote write targets; empty disables the push.
+	RemoteWriteTargetsPath string
+	// RemoteWriteInterval is the time between pushes to each target.
+	RemoteWriteInterval time.Duration
+	// RemoteWriteQueueSize is the maximum number of pending requests per target.
+	RemoteWriteQueueSize int
+	// RemoteWriteMaxRetries is the number of retries of a failed request.
+	RemoteWriteMaxRetries int
+	// ShutdownTimeout is the time given to drain in-flight requests on shutdown.
+	ShutdownTimeout time.Duration
 }
 
 // Validate the configuration.
@@ -58,9 +78,29 @@ func (conf *Config) Validate() derrors.Error {
 	if conf.ClientCertPath == "" {
 		return derrors.NewInvalidArgumentError("clientCertPath is required")
 	}
+	if conf.UseTLS && conf.ServerCertPath == "" {
+		return derrors.NewInvalidArgumentError("serverCertPath is required with TLS")
+	}
 	if conf.MonitoringManagerAddress == "" {
 		return derrors.NewInvalidArgumentError("monitoringManagerAddress is required")
 	}
+	if conf.AuthKeySetPath != "" && conf.AuthOrganizationClaim == "" {
+		return derrors.NewInvalidArgumentError("authOrganizationClaim is required with authKeySetPath")
+	}
+	if conf.RemoteWriteTargetsPath != "" {
+		if conf.RemoteWriteInterval <= 0 {
+			return derrors.NewInvalidArgumentError("remoteWriteInterval must be positive")
+		}
+		if conf.RemoteWriteQueueSize <= 0 {
+			return derrors.NewInvalidArgumentError("remoteWriteQueueSize must be positive")
+		}
+		if conf.RemoteWriteMaxRetries < 0 {
+			return derrors.NewInvalidArgumentError("remoteWriteMaxRetries cannot be negative")
+		}
+	}
+	if conf.ShutdownTimeout <= 0 {
+		return derrors.NewInvalidArgumentError("shutdownTimeout must be positive")
+	}
 	return nil
 }
 
@@ -69,6 +109,21 @@ func (conf *Config) Print() {
 	log.Info().Str("app", version.AppVersion).Str("commit", version.Commit).Msg("version")
 	log.Info().Int("port", conf.GrpcPort).Msg("gRPC port")
 	log.Info().Int("port", conf.HttpPort).Msg("HTTP port")
-	log.Info().Bool("tls", conf.UseTLS).Bool("skipServerCertValidation", conf.SkipServerCertValidation).Str("cert", conf.CACertPath).Str("cert", conf.ClientCertPath).Msg("TLS parameters")
+	log.Info().Bool("tls", conf.UseTLS).Bool("skipServerCertValidation", conf.SkipServerCertValidation).Str("cert", conf.CACertPath).Str("cert", conf.ClientCertPath).Str("serverCert", conf.ServerCertPath).Msg("TLS parameters")
 	log.Info().Str("MonitoringManagerAddress", conf.MonitoringManagerAddress).Msg("address of the  monitoring manager service")
+	if conf.AuthEnabled() {
+		log.Info().Str("keySet", conf.AuthKeySetPath).Str("tokens", conf.AuthTokensPath).Str("organizationClaim", conf.AuthOrganizationClaim).Msg("authentication")
+	} else {
+		log.Warn().Msg("authentication disabled; any client can retrieve the metrics of any organization")
+	}
+	if conf.RemoteWriteTargetsPath != "" {
+		log.Info().Str("targets", conf.RemoteWriteTargetsPath).Str("interval", conf.RemoteWriteInterval.String()).
+			Int("queueSize", conf.RemoteWriteQueueSize).Int("maxRetries", conf.RemoteWriteMaxRetries).Msg("remote write")
+	}
+	log.Info().Str("timeout", conf.ShutdownTimeout.String()).Msg("shutdown")
+}
+
+// AuthEnabled returns whether organization requests require a bearer token
+func (conf *Config) AuthEnabled() bool {
+	return conf.AuthKeySetPath != "" || conf.AuthTokensPath != ""
 }
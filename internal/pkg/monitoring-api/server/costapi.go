@@ -0,0 +1,251 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cost allocation reports of an organization in JSON and CSV
+
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server/auth"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// CostAPIPrefix is the path of the cost reports of every organization:
+	// /costs/<organization_id>?from=<time>&to=<time>&level=<level>&format=<json|csv>
+	CostAPIPrefix  = "/costs/"
+	csvContentType = "text/csv"
+)
+
+// Levels of aggregation of the cost reports
+const (
+	levelServiceInstance      = "service_instance"
+	levelServiceGroupInstance = "service_group_instance"
+	levelAppInstance          = "app_instance"
+	levelOrganization         = "organization"
+)
+
+// costColumns are the columns of the CSV reports
+var costColumns = []string{
+	"organization_id", "app_instance_id", "app_instance_name", "service_group_instance_id", "service_group_instance_name",
+	"service_instance_id", "service_instance_name", "currency", "cpu_cost", "memory_cost", "storage_cost", "base_cost", "cost",
+}
+
+// CostAPI serves the cost of the resource usage of an organization over a
+// period, by service instance, service group instance, app instance or in
+// total, as JSON or CSV. The period defaults to the current month.
+type CostAPI struct {
+	manager *Manager
+	// Authenticator of organization requests; nil if authentication is disabled
+	authenticator *auth.Authenticator
+	now           func() time.Time
+}
+
+// NewCostAPI creates the cost report handler
+func NewCostAPI(manager *Manager, authenticator *auth.Authenticator) *CostAPI {
+	return &CostAPI{manager: manager, authenticator: authenticator, now: time.Now}
+}
+
+// costReport is the JSON cost report
+type costReport struct {
+	OrganizationId  string     `json:"organization_id"`
+	From            int64      `json:"from"`
+	To              int64      `json:"to"`
+	Currency        string     `json:"currency"`
+	Level           string     `json:"level"`
+	Costs           []*costRow `json:"costs"`
+	UnallocatedCost float64    `json:"unallocated_cost"`
+}
+
+func (a *CostAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	organizationId := strings.TrimPrefix(r.URL.Path, CostAPIPrefix)
+	if organizationId == "" || strings.Contains(organizationId, "/") {
+		http.Error(w, "unknown path", http.StatusNotFound)
+		return
+	}
+	request := &apiRequest{organizationId: organizationId, params: r.URL.Query()}
+
+	level := request.param("level")
+	if level == "" {
+		level = levelServiceInstance
+	}
+	format := request.param("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), csvContentType) {
+		format = "csv"
+	}
+	report, apiErr := a.report(r, request, level, format)
+	if apiErr != nil {
+		log.Debug().Str("path", r.URL.Path).Str("error", apiErr.message).Msg("cost report request failed")
+		http.Error(w, apiErr.message, apiErr.status)
+		return
+	}
+
+	rows := costRows(report, level)
+	if format == "csv" {
+		w.Header().Set("Content-Type", csvContentType)
+		writer := csv.NewWriter(w)
+		_ = writer.Write(costColumns)
+		for _, row := range rows {
+			_ = writer.Write(row.record())
+		}
+		writer.Flush()
+		return
+	}
+
+	body, err := json.Marshal(&costReport{
+		OrganizationId:  report.OrganizationId,
+		From:            report.FromTimestamp,
+		To:              report.ToTimestamp,
+		Currency:        report.Currency,
+		Level:           level,
+		Costs:           rows,
+		UnallocatedCost: report.UnallocatedCost,
+	})
+	if err != nil {
+		http.Error(w, "failed encoding cost report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// report validates a request and retrieves its cost report
+func (a *CostAPI) report(r *http.Request, request *apiRequest, level string, format string) (*grpc_monitoring_go.CostReport, *apiError) {
+	switch level {
+	case levelServiceInstance, levelServiceGroupInstance, levelAppInstance, levelOrganization:
+	default:
+		return nil, badData("invalid level %q", level)
+	}
+	if format != "" && format != "json" && format != "csv" {
+		return nil, badData("invalid format %q", format)
+	}
+
+	now := a.now().UTC()
+	to, apiErr := timeParam(request, "to", now)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	from, apiErr := timeParam(request, "from", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	apiErr = authorizeRequest(a.authenticator, r, request.organizationId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), monitoringTimeout)
+	defer cancel()
+	report, err := a.manager.GetMonitoringClient().GetCostReport(ctx, &grpc_monitoring_go.CostReportRequest{
+		OrganizationId: request.organizationId,
+		FromTimestamp:  from.Unix(),
+		ToTimestamp:    to.Unix(),
+		AppInstanceId:  request.params["app_instance_id"],
+	})
+	if err != nil {
+		return nil, grpcAPIError(err)
+	}
+	return report, nil
+}
+
+// costRow is the cost of a service instance, service group instance, app instance or organization
+type costRow struct {
+	OrganizationId           string  `json:"organization_id"`
+	AppInstanceId            string  `json:"app_instance_id,omitempty"`
+	AppInstanceName          string  `json:"app_instance_name,omitempty"`
+	ServiceGroupInstanceId   string  `json:"service_group_instance_id,omitempty"`
+	ServiceGroupInstanceName string  `json:"service_group_instance_name,omitempty"`
+	ServiceInstanceId        string  `json:"service_instance_id,omitempty"`
+	ServiceInstanceName      string  `json:"service_instance_name,omitempty"`
+	Currency                 string  `json:"currency"`
+	CpuCost                  float64 `json:"cpu_cost"`
+	MemoryCost               float64 `json:"memory_cost"`
+	StorageCost              float64 `json:"storage_cost"`
+	BaseCost                 float64 `json:"base_cost"`
+	Cost                     float64 `json:"cost"`
+}
+
+// record returns the CSV record of a row, in the order of costColumns
+func (r *costRow) record() []string {
+	return []string{
+		csvText(r.OrganizationId), csvText(r.AppInstanceId), csvText(r.AppInstanceName),
+		csvText(r.ServiceGroupInstanceId), csvText(r.ServiceGroupInstanceName), csvText(r.ServiceInstanceId),
+		csvText(r.ServiceInstanceName), csvText(r.Currency), formatCost(r.CpuCost), formatCost(r.MemoryCost),
+		formatCost(r.StorageCost), formatCost(r.BaseCost), formatCost(r.Cost),
+	}
+}
+
+// csvText prefixes the text that spreadsheets would evaluate as a formula
+// with a quote, so names can't inject formulas into the reports.
+func csvText(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
+
+// costRows returns the costs of a report at a level
+func costRows(report *grpc_monitoring_go.CostReport, level string) []*costRow {
+	var costs []*grpc_monitoring_go.ResourceCost
+	switch level {
+	case levelServiceInstance:
+		costs = report.ServiceInstances
+	case levelServiceGroupInstance:
+		costs = report.ServiceGroupInstances
+	case levelAppInstance:
+		costs = report.AppInstances
+	default:
+		costs = []*grpc_monitoring_go.ResourceCost{report.Total}
+	}
+
+	rows := make([]*costRow, 0, len(costs))
+	for _, cost := range costs {
+		rows = append(rows, &costRow{
+			OrganizationId:           report.OrganizationId,
+			AppInstanceId:            cost.GetAppInstanceId(),
+			AppInstanceName:          cost.GetAppInstanceName(),
+			ServiceGroupInstanceId:   cost.GetServiceGroupInstanceId(),
+			ServiceGroupInstanceName: cost.GetServiceGroupInstanceName(),
+			ServiceInstanceId:        cost.GetServiceInstanceId(),
+			ServiceInstanceName:      cost.GetServiceInstanceName(),
+			Currency:                 report.Currency,
+			CpuCost:                  cost.GetCpuCost(),
+			MemoryCost:               cost.GetMemoryCost(),
+			StorageCost:              cost.GetStorageCost(),
+			BaseCost:                 cost.GetBaseCost(),
+			Cost:                     cost.GetCost(),
+		})
+	}
+	return rows
+}
+
+func formatCost(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cost API tests
+
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+)
+
+// fakeCostClient answers every cost report request with the same report
+type fakeCostClient struct {
+	grpc_monitoring_go.MonitoringManagerClient
+	request *grpc_monitoring_go.CostReportRequest
+	report  *grpc_monitoring_go.CostReport
+}
+
+func (c *fakeCostClient) GetCostReport(_ context.Context, in *grpc_monitoring_go.CostReportRequest, _ ...grpc.CallOption) (*grpc_monitoring_go.CostReport, error) {
+	c.request = in
+	return c.report, nil
+}
+
+var _ = ginkgo.Describe("Cost API", func() {
+
+	var client *fakeCostClient
+	var api *CostAPI
+
+	ginkgo.BeforeEach(func() {
+		web := &grpc_monitoring_go.ResourceCost{
+			AppInstanceId:       "app-1",
+			AppInstanceName:     "shop, online",
+			ServiceInstanceId:   "service-1",
+			ServiceInstanceName: "web",
+			CpuCost:             1.5,
+			BaseCost:            0.25,
+			Cost:                1.75,
+		}
+		client = &fakeCostClient{report: &grpc_monitoring_go.CostReport{
+			OrganizationId:   "org-1",
+			FromTimestamp:    1569888000,
+			ToTimestamp:      1572566400,
+			Currency:         "EUR",
+			ServiceInstances: []*grpc_monitoring_go.ResourceCost{web},
+			AppInstances:     []*grpc_monitoring_go.ResourceCost{{AppInstanceId: "app-1", AppInstanceName: "shop, online", Cost: 1.75}},
+			Total:            &grpc_monitoring_go.ResourceCost{Cost: 1.75},
+			UnallocatedCost:  3,
+		}}
+		var monitoringClient grpc_monitoring_go.MonitoringManagerClient = client
+		manager, derr := NewManager(&monitoringClient)
+		gomega.Expect(derr).To(gomega.Succeed())
+		api = NewCostAPI(manager, nil)
+		api.now = func() time.Time { return time.Date(2019, 10, 15, 12, 0, 0, 0, time.UTC) }
+	})
+
+	get := func(path string, accept string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		api.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	ginkgo.It("should report the costs of the current month in JSON", func() {
+		response := get("/costs/org-1?app_instance_id=app-1", "")
+		gomega.Expect(response.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(response.Header().Get("Content-Type")).To(gomega.Equal("application/json"))
+
+		gomega.Expect(client.request.OrganizationId).To(gomega.Equal("org-1"))
+		gomega.Expect(client.request.AppInstanceId).To(gomega.Equal([]string{"app-1"}))
+		gomega.Expect(client.request.FromTimestamp).To(gomega.Equal(time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC).Unix()))
+		gomega.Expect(client.request.ToTimestamp).To(gomega.Equal(api.now().Unix()))
+
+		report := &costReport{}
+		gomega.Expect(json.Unmarshal(response.Body.Bytes(), report)).To(gomega.Succeed())
+		gomega.Expect(report.Level).To(gomega.Equal(levelServiceInstance))
+		gomega.Expect(report.UnallocatedCost).To(gomega.Equal(3.0))
+		gomega.Expect(report.Costs).To(gomega.HaveLen(1))
+		gomega.Expect(report.Costs[0].ServiceInstanceName).To(gomega.Equal("web"))
+		gomega.Expect(report.Costs[0].Currency).To(gomega.Equal("EUR"))
+		gomega.Expect(report.Costs[0].Cost).To(gomega.Equal(1.75))
+	})
+
+	ginkgo.It("should report the costs of a level in CSV", func() {
+		response := get("/costs/org-1?level=app_instance&from=1569888000&to=2019-11-01T00:00:00Z", "text/csv")
+		gomega.Expect(response.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(response.Header().Get("Content-Type")).To(gomega.Equal("text/csv"))
+		gomega.Expect(client.request.FromTimestamp).To(gomega.Equal(int64(1569888000)))
+		gomega.Expect(client.request.ToTimestamp).To(gomega.Equal(int64(1572566400)))
+
+		records, err := csv.NewReader(response.Body).ReadAll()
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(records).To(gomega.HaveLen(2))
+		gomega.Expect(records[0]).To(gomega.Equal(costColumns))
+		gomega.Expect(records[1][1:3]).To(gomega.Equal([]string{"app-1", "shop, online"}))
+		gomega.Expect(records[1][len(costColumns)-1]).To(gomega.Equal("1.75"))
+
+		response = get("/costs/org-1?level=organization&format=csv", "")
+		records, err = csv.NewReader(response.Body).ReadAll()
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(records).To(gomega.HaveLen(2))
+		gomega.Expect(records[1][0]).To(gomega.Equal("org-1"))
+	})
+
+	ginkgo.It("should not write formulas in CSV", func() {
+		client.report.AppInstances[0].AppInstanceName = "=HYPERLINK(\"http://example.com\")"
+		client.report.AppInstances[0].ServiceGroupInstanceName = "@SUM(A1)"
+		response := get("/costs/org-1?level=app_instance&format=csv", "")
+		records, err := csv.NewReader(response.Body).ReadAll()
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(records[1][2]).To(gomega.Equal("'=HYPERLINK(\"http://example.com\")"))
+		gomega.Expect(records[1][4]).To(gomega.Equal("'@SUM(A1)"))
+		gomega.Expect(records[1][len(costColumns)-1]).To(gomega.Equal("1.75"))
+
+		// Not in JSON
+		response = get("/costs/org-1?level=app_instance", "")
+		report := &costReport{}
+		gomega.Expect(json.Unmarshal(response.Body.Bytes(), report)).To(gomega.Succeed())
+		gomega.Expect(report.Costs[0].AppInstanceName).To(gomega.Equal("=HYPERLINK(\"http://example.com\")"))
+	})
+
+	ginkgo.It("should reject invalid requests", func() {
+		gomega.Expect(get("/costs/org-1?level=cluster", "").Code).To(gomega.Equal(http.StatusBadRequest))
+		gomega.Expect(get("/costs/org-1?from=yesterday", "").Code).To(gomega.Equal(http.StatusBadRequest))
+		gomega.Expect(get("/costs/", "").Code).To(gomega.Equal(http.StatusNotFound))
+		gomega.Expect(client.request).To(gomega.BeNil())
+	})
+})
@@ -0,0 +1,346 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Prometheus exposition of organization application stats
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-monitoring-go"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys with the Accept header: as forwarded by the HTTP gateway,
+// or as sent by gRPC clients
+var acceptMetadata = []string{"grpcgateway-accept", "accept"}
+
+// Labels identifying the service instance of each series
+const (
+	labelAppInstanceId            = "appinstid"
+	labelAppInstanceName          = "appinstname"
+	labelServiceGroupInstanceId   = "servgroupinstid"
+	labelServiceGroupInstanceName = "servgroupinstname"
+	labelServiceInstanceId        = "servinstid"
+	labelServiceInstanceName      = "servinstname"
+)
+
+// Labels identifying the container of each series, when aggregated by container
+const (
+	labelNamespace = "namespace"
+	labelPod       = "pod"
+	labelContainer = "container"
+)
+
+// Cluster series report whether the stats of each cluster are included
+const (
+	clusterUpMetric     = "nalej_cluster_up"
+	clusterStatusMetric = "nalej_cluster_status"
+	labelClusterName    = "cluster_name"
+	labelClusterStatus  = "status"
+)
+
+// Status of a cluster in the cluster series
+const (
+	clusterStatusQueried = "queried"
+	clusterStatusFailed  = "failed"
+	clusterStatusSkipped = "skipped"
+)
+
+// Every status of a cluster, each with its own status series
+var clusterStatuses = []string{clusterStatusQueried, clusterStatusFailed, clusterStatusSkipped}
+
+// The CPU of the stats is recorded as cores / 1000 (see the application-stats
+// rules in prometheus.prometheusrules.yaml); this converts it to cores.
+const cpuStatCoresFactor = 1000
+
+// serviceInstanceMetric is a series exposed for every service instance
+type serviceInstanceMetric struct {
+	name  string
+	help  string
+	value func(stats *grpc_monitoring_go.OrganizationApplicationStats) float64
+}
+
+var serviceInstanceMetrics = []serviceInstanceMetric{
+	{
+		name: "nalej_servinst_cpu_core",
+		help: "CPU usage of the service instance in cores",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 {
+			return s.CpuMillicore * cpuStatCoresFactor
+		},
+	},
+	{
+		name:  "nalej_servinst_memory_byte",
+		help:  "Memory usage of the service instance in bytes",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return s.MemoryByte },
+	},
+	{
+		name:  "nalej_servinst_storage_byte",
+		help:  "Storage usage of the service instance in bytes",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return s.StorageByte },
+	},
+	{
+		name:  "nalej_servinst_network_receive_byte",
+		help:  "Bytes per second received by the service instance",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return s.NetworkReceiveBytePerSec },
+	},
+	{
+		name:  "nalej_servinst_network_transmit_byte",
+		help:  "Bytes per second transmitted by the service instance",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return s.NetworkTransmitBytePerSec },
+	},
+	{
+		name:  "nalej_servinst_network_receive_drop",
+		help:  "Received packets per second dropped for the service instance",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return s.NetworkReceiveDropPerSec },
+	},
+	{
+		name:  "nalej_servinst_network_transmit_drop",
+		help:  "Transmitted packets per second dropped for the service instance",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return s.NetworkTransmitDropPerSec },
+	},
+	{
+		name:  "nalej_servinst_container_count",
+		help:  "Number of containers of the service instance",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return float64(s.ContainerCount) },
+	},
+	{
+		name:  "nalej_servinst_restart_count",
+		help:  "Restarts of the containers of the service instance",
+		value: func(s *grpc_monitoring_go.OrganizationApplicationStats) float64 { return float64(s.RestartCount) },
+	},
+}
+
+// MetricFamilies creates the metric families with the stats of every
+// service instance of an organization, or of every group of the levels they
+// are aggregated by, keeping only the series selected by filter. A nil
+// filter selects every series.
+func MetricFamilies(stats *grpc_monitoring_go.OrganizationApplicationStatsResponse, filter *SeriesFilter) []*dto.MetricFamily {
+	groupLabels := newSeriesLabels(stats.GetGroupBy())
+	families := make([]*dto.MetricFamily, 0, len(serviceInstanceMetrics))
+	for _, metric := range serviceInstanceMetrics {
+		if !filter.IncludesMetric(metric.name) {
+			continue
+		}
+		family := &dto.MetricFamily{
+			Name:   proto.String(metric.name),
+			Help:   proto.String(metric.help),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: make([]*dto.Metric, 0, len(stats.GetServiceInstanceStats())),
+		}
+		for _, serviceStats := range stats.GetServiceInstanceStats() {
+			labels := groupLabels.of(serviceStats)
+			if !filter.Matches(metric.name, labels) {
+				continue
+			}
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label:       labels,
+				Gauge:       &dto.Gauge{Value: proto.Float64(metric.value(serviceStats))},
+				TimestampMs: proto.Int64(stats.GetTimestamp()),
+			})
+		}
+		// Families without series are not exposed, as the encoders reject them
+		if len(family.Metric) > 0 {
+			families = append(families, family)
+		}
+	}
+	for _, family := range clusterFamilies(stats, filter) {
+		if len(family.Metric) > 0 {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// clusterFamilies creates the series of every cluster of the organization.
+// nalej_cluster_up is 1 if its stats are included and 0 if it failed or was
+// skipped, so missing stats can be told apart from zero usage.
+// nalej_cluster_status has a series per status, 1 for the current one and 0
+// for the others, so the identity of the series doesn't change with it.
+func clusterFamilies(stats *grpc_monitoring_go.OrganizationApplicationStatsResponse, filter *SeriesFilter) []*dto.MetricFamily {
+	up := &dto.MetricFamily{
+		Name: proto.String(clusterUpMetric),
+		Help: proto.String("Whether the stats of the cluster are included: 1 if it was queried, 0 if it failed or was skipped"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	status := &dto.MetricFamily{
+		Name: proto.String(clusterStatusMetric),
+		Help: proto.String("Status of the query of the cluster stats: 1 for the current status, either queried, failed or skipped"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	includeUp := filter.IncludesMetric(clusterUpMetric)
+	includeStatus := filter.IncludesMetric(clusterStatusMetric)
+
+	for _, cluster := range stats.GetClusters() {
+		current := clusterStatusQueried
+		if cluster.GetSkipped() {
+			current = clusterStatusSkipped
+		} else if cluster.GetFailed() {
+			current = clusterStatusFailed
+		}
+		labels := []*dto.LabelPair{
+			labelPair(labelClusterId, cluster.GetClusterId()),
+			labelPair(labelClusterName, cluster.GetClusterName()),
+		}
+
+		if includeUp && filter.MatchesCluster(clusterUpMetric, labels) {
+			up.Metric = append(up.Metric, gaugeMetric(labels, boolValue(current == clusterStatusQueried), stats.GetTimestamp()))
+		}
+		if !includeStatus {
+			continue
+		}
+		for _, clusterStatus := range clusterStatuses {
+			labels := []*dto.LabelPair{labels[0], labels[1], labelPair(labelClusterStatus, clusterStatus)}
+			if filter.MatchesCluster(clusterStatusMetric, labels) {
+				status.Metric = append(status.Metric, gaugeMetric(labels, boolValue(current == clusterStatus), stats.GetTimestamp()))
+			}
+		}
+	}
+	return []*dto.MetricFamily{up, status}
+}
+
+// gaugeMetric creates a gauge series
+func gaugeMetric(labels []*dto.LabelPair, value float64, timestampMs int64) *dto.Metric {
+	return &dto.Metric{
+		Label:       labels,
+		Gauge:       &dto.Gauge{Value: proto.Float64(value)},
+		TimestampMs: proto.Int64(timestampMs),
+	}
+}
+
+// boolValue returns 1 for true and 0 for false
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// seriesLabels are the labels that identify the groups of the stats at the
+// levels they are aggregated by: those of every level of the application
+// hierarchy down to the finest one selected, and those of the cluster if
+// selected. Containers are told apart by their cluster.
+type seriesLabels struct {
+	appInstance          bool
+	serviceGroupInstance bool
+	serviceInstance      bool
+	container            bool
+	cluster              bool
+}
+
+// newSeriesLabels returns the labels of some aggregation levels, those of
+// the service instances if none
+func newSeriesLabels(levels []grpc_monitoring_go.AggregationLevel) seriesLabels {
+	if len(levels) == 0 {
+		levels = []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE}
+	}
+	var labels seriesLabels
+	for _, level := range levels {
+		switch level {
+		case grpc_monitoring_go.AggregationLevel_CONTAINER:
+			labels.container = true
+			labels.cluster = true
+			fallthrough
+		case grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE:
+			labels.serviceInstance = true
+			fallthrough
+		case grpc_monitoring_go.AggregationLevel_SERVICE_GROUP_INSTANCE:
+			labels.serviceGroupInstance = true
+			fallthrough
+		case grpc_monitoring_go.AggregationLevel_APP_INSTANCE:
+			labels.appInstance = true
+		case grpc_monitoring_go.AggregationLevel_CLUSTER:
+			labels.cluster = true
+		}
+	}
+	return labels
+}
+
+// of returns the labels of the stats of a group
+func (l seriesLabels) of(stats *grpc_monitoring_go.OrganizationApplicationStats) []*dto.LabelPair {
+	labels := make([]*dto.LabelPair, 0, 11)
+	if l.appInstance {
+		labels = append(labels,
+			labelPair(labelAppInstanceId, stats.GetAppInstanceId()),
+			labelPair(labelAppInstanceName, stats.GetAppInstanceName()))
+	}
+	if l.serviceGroupInstance {
+		labels = append(labels,
+			labelPair(labelServiceGroupInstanceId, stats.GetServiceGroupInstanceId()),
+			labelPair(labelServiceGroupInstanceName, stats.GetServiceGroupInstanceName()))
+	}
+	if l.serviceInstance {
+		labels = append(labels,
+			labelPair(labelServiceInstanceId, stats.GetServiceInstanceId()),
+			labelPair(labelServiceInstanceName, stats.GetServiceInstanceName()))
+	}
+	if l.container {
+		labels = append(labels,
+			labelPair(labelNamespace, stats.GetNamespace()),
+			labelPair(labelPod, stats.GetPod()),
+			labelPair(labelContainer, stats.GetContainer()))
+	}
+	if l.cluster {
+		labels = append(labels,
+			labelPair(labelClusterId, stats.GetClusterId()),
+			labelPair(labelClusterName, stats.GetClusterName()))
+	}
+	return labels
+}
+
+func labelPair(name string, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+// NegotiateFormat selects the exposition format from the Accept header of
+// a request: Prometheus text (the default), OpenMetrics or protobuf.
+func NegotiateFormat(ctx context.Context) expfmt.Format {
+	header := http.Header{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, key := range acceptMetadata {
+			for _, value := range md.Get(key) {
+				header.Add("Accept", value)
+			}
+		}
+	}
+	return expfmt.NegotiateIncludingOpenMetrics(header)
+}
+
+// EncodeMetricFamilies encodes metric families in an exposition format
+func EncodeMetricFamilies(families []*dto.MetricFamily, format expfmt.Format) ([]byte, derrors.Error) {
+	var buffer bytes.Buffer
+	encoder := expfmt.NewEncoder(&buffer, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return nil, derrors.NewInternalError("failed encoding metrics", err).WithParams(family.GetName())
+		}
+	}
+	// OpenMetrics requires a terminating # EOF
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return nil, derrors.NewInternalError("failed encoding metrics", err)
+		}
+	}
+	return buffer.Bytes(), nil
+}
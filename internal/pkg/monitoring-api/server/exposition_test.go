@@ -0,0 +1,172 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Exposition tests
+
+package server
+
+import (
+	"context"
+
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/metadata"
+)
+
+var _ = ginkgo.Describe("exposition", func() {
+
+	stats := &grpc_monitoring_go.OrganizationApplicationStatsResponse{
+		Timestamp: 1500000000000,
+		ServiceInstanceStats: []*grpc_monitoring_go.OrganizationApplicationStats{
+			{
+				AppInstanceId:       "app-1",
+				AppInstanceName:     `Sales & "Marketing" <prod>`,
+				ServiceInstanceId:   "service-1",
+				ServiceInstanceName: "web\\frontend",
+				CpuMillicore:        0.00025,
+				MemoryByte:          1024,
+			},
+		},
+	}
+
+	ginkgo.It("should create a gauge family per metric", func() {
+		families := MetricFamilies(stats, nil)
+		gomega.Expect(families).To(gomega.HaveLen(len(serviceInstanceMetrics)))
+		gomega.Expect(families[0].GetName()).To(gomega.Equal("nalej_servinst_cpu_core"))
+		gomega.Expect(families[0].GetMetric()).To(gomega.HaveLen(1))
+		gomega.Expect(families[0].GetMetric()[0].GetGauge().GetValue()).To(gomega.Equal(0.25))
+		gomega.Expect(families[0].GetMetric()[0].GetTimestampMs()).To(gomega.Equal(int64(1500000000000)))
+	})
+
+	ginkgo.It("should escape label values in the text format", func() {
+		response, derr := EncodeMetricFamilies(MetricFamilies(stats, nil), expfmt.FmtText)
+		gomega.Expect(derr).To(gomega.Succeed())
+		text := string(response)
+		gomega.Expect(text).To(gomega.ContainSubstring("# HELP nalej_servinst_memory_byte"))
+		gomega.Expect(text).To(gomega.ContainSubstring("# TYPE nalej_servinst_memory_byte gauge"))
+		gomega.Expect(text).To(gomega.ContainSubstring(`appinstname="Sales & \"Marketing\" <prod>"`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`servinstname="web\\frontend"`))
+		gomega.Expect(text).ToNot(gomega.ContainSubstring("&amp;"))
+	})
+
+	ginkgo.It("should negotiate the exposition format", func() {
+		gomega.Expect(NegotiateFormat(context.Background())).To(gomega.Equal(expfmt.FmtText))
+
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+			"grpcgateway-accept", "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5"))
+		format := NegotiateFormat(ctx)
+		gomega.Expect(format).To(gomega.Equal(expfmt.FmtOpenMetrics))
+
+		response, derr := EncodeMetricFamilies(MetricFamilies(stats, nil), format)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(string(response)).To(gomega.HaveSuffix("# EOF\n"))
+	})
+
+	ginkgo.It("should expose organizations without stats", func() {
+		empty := &grpc_monitoring_go.OrganizationApplicationStatsResponse{Timestamp: stats.Timestamp}
+		families := MetricFamilies(empty, nil)
+		gomega.Expect(families).To(gomega.BeEmpty())
+		for _, format := range []expfmt.Format{expfmt.FmtText, expfmt.FmtOpenMetrics, expfmt.FmtProtoDelim} {
+			_, derr := EncodeMetricFamilies(families, format)
+			gomega.Expect(derr).To(gomega.Succeed())
+		}
+
+		// Every cluster failed
+		empty.Clusters = []*grpc_monitoring_go.ClusterQueryStatus{{ClusterId: "cluster-1", ClusterName: "one", Failed: true}}
+		families = MetricFamilies(empty, nil)
+		gomega.Expect(families).To(gomega.HaveLen(2))
+		response, derr := EncodeMetricFamilies(families, expfmt.FmtText)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(string(response)).To(gomega.ContainSubstring(`nalej_cluster_up{cluster_id="cluster-1",cluster_name="one"} 0 1500000000000`))
+	})
+
+	ginkgo.It("should label the series with the aggregation levels", func() {
+		grouped := &grpc_monitoring_go.OrganizationApplicationStatsResponse{
+			Timestamp: stats.Timestamp,
+			GroupBy:   []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_APP_INSTANCE, grpc_monitoring_go.AggregationLevel_CLUSTER},
+			ServiceInstanceStats: []*grpc_monitoring_go.OrganizationApplicationStats{
+				{AppInstanceId: "app-1", AppInstanceName: "shop", ClusterId: "cluster-1", ClusterName: "one", CpuMillicore: 0.00025, ContainerCount: 3},
+			},
+		}
+		response, derr := EncodeMetricFamilies(MetricFamilies(grouped, nil), expfmt.FmtText)
+		gomega.Expect(derr).To(gomega.Succeed())
+		text := string(response)
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_servinst_cpu_core{appinstid="app-1",appinstname="shop",cluster_id="cluster-1",cluster_name="one"} 0.25 1500000000000`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_servinst_container_count{appinstid="app-1",appinstname="shop",cluster_id="cluster-1",cluster_name="one"} 3 1500000000000`))
+
+		grouped.GroupBy = []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_CONTAINER}
+		families := MetricFamilies(grouped, nil)
+		gomega.Expect(labelValues(families[0].GetMetric()[0].GetLabel())).To(gomega.HaveLen(11))
+
+		// Series above the app instances are not filtered by app instance
+		grouped.GroupBy = []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_ORGANIZATION}
+		filter, derr := NewSeriesFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{AppInstanceId: []string{"app-2"}})
+		gomega.Expect(derr).To(gomega.Succeed())
+		families = MetricFamilies(grouped, filter)
+		gomega.Expect(families).To(gomega.HaveLen(len(serviceInstanceMetrics)))
+		gomega.Expect(families[0].GetMetric()[0].GetLabel()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should report the status of every cluster", func() {
+		withClusters := &grpc_monitoring_go.OrganizationApplicationStatsResponse{
+			Timestamp:            stats.Timestamp,
+			ServiceInstanceStats: stats.ServiceInstanceStats,
+			Clusters: []*grpc_monitoring_go.ClusterQueryStatus{
+				{ClusterId: "cluster-1", ClusterName: "one"},
+				{ClusterId: "cluster-2", ClusterName: "two", Failed: true, Error: "cluster down"},
+				{ClusterId: "cluster-3", ClusterName: "three", Skipped: true},
+			},
+		}
+		families := MetricFamilies(withClusters, nil)
+		gomega.Expect(families).To(gomega.HaveLen(len(serviceInstanceMetrics) + 2))
+		response, derr := EncodeMetricFamilies(families, expfmt.FmtText)
+		gomega.Expect(derr).To(gomega.Succeed())
+		text := string(response)
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_up{cluster_id="cluster-1",cluster_name="one"} 1 1500000000000`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_up{cluster_id="cluster-2",cluster_name="two"} 0 1500000000000`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_up{cluster_id="cluster-3",cluster_name="three"} 0 1500000000000`))
+
+		// Every status has a series, so their identity doesn't change with the status
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_status{cluster_id="cluster-2",cluster_name="two",status="queried"} 0 1500000000000`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_status{cluster_id="cluster-2",cluster_name="two",status="failed"} 1 1500000000000`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_status{cluster_id="cluster-2",cluster_name="two",status="skipped"} 0 1500000000000`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`nalej_cluster_status{cluster_id="cluster-3",cluster_name="three",status="skipped"} 1 1500000000000`))
+
+		// Clusters hold every app instance, but are filtered by metric and selector
+		filter, derr := NewSeriesFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{AppInstanceId: []string{"app-2"}})
+		gomega.Expect(derr).To(gomega.Succeed())
+		families = MetricFamilies(withClusters, filter)
+		gomega.Expect(families).To(gomega.HaveLen(2))
+		gomega.Expect(families[0].GetMetric()).To(gomega.HaveLen(3))
+		gomega.Expect(families[1].GetMetric()).To(gomega.HaveLen(9))
+
+		filter, derr = NewSeriesFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{Match: []string{`nalej_cluster_up{cluster_id!="cluster-1"}`}})
+		gomega.Expect(derr).To(gomega.Succeed())
+		families = MetricFamilies(withClusters, filter)
+		gomega.Expect(families).To(gomega.HaveLen(1))
+		gomega.Expect(families[0].GetMetric()).To(gomega.HaveLen(2))
+
+		filter, derr = NewSeriesFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{Metric: []string{"nalej_servinst_cpu_core"}})
+		gomega.Expect(derr).To(gomega.Succeed())
+		families = MetricFamilies(withClusters, filter)
+		gomega.Expect(families).To(gomega.HaveLen(1))
+		gomega.Expect(families[0].GetName()).To(gomega.Equal("nalej_servinst_cpu_core"))
+	})
+})
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Filters of the series exposed on the metrics endpoint
+
+package server
+
+import (
+	"sort"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-monitoring-go"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// SeriesFilter selects the series returned by the metrics endpoint, from
+// the app_instance_id, metric and match[] parameters of a request. A series
+// must match every given parameter; any of the match[] selectors may match.
+type SeriesFilter struct {
+	appInstanceIds map[string]bool
+	metrics        map[string]bool
+	selectors      []Selector
+}
+
+// NewSeriesFilter creates the filter of a request. It is nil if the request has no filters.
+func NewSeriesFilter(request *grpc_monitoring_go.OrganizationApplicationStatsRequest) (*SeriesFilter, derrors.Error) {
+	if len(request.GetAppInstanceId()) == 0 && len(request.GetMetric()) == 0 && len(request.GetMatch()) == 0 {
+		return nil, nil
+	}
+
+	selectors, derr := ParseSelectors(request.GetMatch())
+	if derr != nil {
+		return nil, derr
+	}
+
+	return &SeriesFilter{
+		appInstanceIds: toSet(request.GetAppInstanceId()),
+		metrics:        toSet(request.GetMetric()),
+		selectors:      selectors,
+	}, nil
+}
+
+// AppInstanceIds returns the app instances containing every selected series,
+// so the monitoring manager only retrieves those. It is empty if the series
+// of any app instance may be selected.
+func (f *SeriesFilter) AppInstanceIds() []string {
+	if f == nil {
+		return nil
+	}
+
+	ids := f.appInstanceIds
+	if len(ids) == 0 && len(f.selectors) > 0 {
+		// Only usable if every selector is restricted to an app instance
+		ids = make(map[string]bool, len(f.selectors))
+		for _, selector := range f.selectors {
+			id, found := selector.EqualValue(labelAppInstanceId)
+			if !found {
+				return nil
+			}
+			ids[id] = true
+		}
+	}
+
+	result := make([]string, 0, len(ids))
+	for id := range ids {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// IncludesMetric checks whether any series of a metric may be selected, so
+// unwanted metric families are not built at all.
+func (f *SeriesFilter) IncludesMetric(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.metrics) > 0 && !f.metrics[name] {
+		return false
+	}
+	if len(f.selectors) == 0 {
+		return true
+	}
+	for _, selector := range f.selectors {
+		if value, found := selector.EqualValue(metricNameLabel); !found || value == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches checks whether a series is selected
+func (f *SeriesFilter) Matches(name string, labels []*dto.LabelPair) bool {
+	if f == nil {
+		return true
+	}
+
+	// Series aggregated above the app instances only hold the selected ones
+	values := labelValues(labels)
+	if appInstanceId, found := values[labelAppInstanceId]; found && len(f.appInstanceIds) > 0 && !f.appInstanceIds[appInstanceId] {
+		return false
+	}
+	return f.matches(name, values)
+}
+
+// MatchesCluster checks whether a cluster series is selected. Clusters hold
+// the stats of every app instance, so they are not filtered by app instance.
+func (f *SeriesFilter) MatchesCluster(name string, labels []*dto.LabelPair) bool {
+	if f == nil {
+		return true
+	}
+	return f.matches(name, labelValues(labels))
+}
+
+// matches checks the metric and match[] filters on a series
+func (f *SeriesFilter) matches(name string, values map[string]string) bool {
+	if len(f.metrics) > 0 && !f.metrics[name] {
+		return false
+	}
+	if len(f.selectors) == 0 {
+		return true
+	}
+	for _, selector := range f.selectors {
+		if selector.Matches(name, values) {
+			return true
+		}
+	}
+	return false
+}
+
+func labelValues(labels []*dto.LabelPair) map[string]string {
+	values := make(map[string]string, len(labels))
+	for _, label := range labels {
+		values[label.GetName()] = label.GetValue()
+	}
+	return values
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
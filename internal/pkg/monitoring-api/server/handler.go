@@ -19,18 +19,40 @@ package server
 import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/nalej/monitoring/internal/pkg/entities"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server/auth"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/net/context"
 	"google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// Metadata key with the age in seconds of the stats cached by the monitoring
+// manager, returned by the HTTP gateway as the Age header
+const ageMetadata = "age"
+
 type Handler struct {
 	manager *Manager
+	// Authenticator of organization requests; nil if authentication is disabled
+	authenticator *auth.Authenticator
 }
 
-func NewHandler(manager *Manager) (*Handler, derrors.Error) {
-	return &Handler{manager: manager}, nil
+func NewHandler(manager *Manager, authenticator *auth.Authenticator) (*Handler, derrors.Error) {
+	return &Handler{manager: manager, authenticator: authenticator}, nil
+}
+
+// authorize checks the request may access the organization, if authentication is enabled
+func (h *Handler) authorize(ctx context.Context, organizationId string) error {
+	if h.authenticator == nil {
+		return nil
+	}
+	_, derr := h.authenticator.Authorize(ctx, organizationId)
+	if derr != nil {
+		return conversions.ToGRPCError(derr)
+	}
+	return nil
 }
 
 func (h *Handler) Metrics(ctx context.Context, request *grpc_monitoring_go.OrganizationApplicationStatsRequest) (*httpbody.HttpBody, error) {
@@ -39,13 +61,40 @@ func (h *Handler) Metrics(ctx context.Context, request *grpc_monitoring_go.Organ
 	if derr != nil {
 		return nil, derr
 	}
+	if err := h.authorize(ctx, request.OrganizationId); err != nil {
+		return nil, err
+	}
+
+	filter, derr := NewSeriesFilter(request)
+	if derr != nil {
+		return nil, conversions.ToGRPCError(derr)
+	}
 
-	response, err := h.manager.Metrics(request.OrganizationId)
+	var header metadata.MD
+	families, err := h.manager.Metrics(ctx, request.OrganizationId, request.GroupBy, filter, grpc.Header(&header))
 	if err != nil {
 		return nil, err
 	}
+	forwardAge(ctx, header)
+
+	format := NegotiateFormat(ctx)
+	response, derr := EncodeMetricFamilies(families, format)
+	if derr != nil {
+		return nil, derr
+	}
 	return &httpbody.HttpBody{
-		ContentType: "text/plain; version=0.0.4",
+		ContentType: string(format),
 		Data:        response,
 	}, nil
 }
+
+// forwardAge returns the age of the stats received from the monitoring
+// manager, if any, in the response header.
+func forwardAge(ctx context.Context, header metadata.MD) {
+	age := header.Get(ageMetadata)
+	if len(age) == 0 {
+		return
+	}
+	// Only fails outside of a gRPC call, when there is nobody to tell
+	_ = grpc.SetHeader(ctx, metadata.Pairs(ageMetadata, age[0]))
+}
@@ -20,20 +20,13 @@ import (
 	"context"
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-monitoring-go"
-	"html/template"
-	"strings"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
 	"time"
 )
 
 const monitoringTimeout = time.Minute
 
-const prometheusExpositionTemplate = `
-# {{.Stats.ServiceInstanceName}}
-nalej_servinst_cpu_core{appinstid="{{.Stats.AppInstanceId}}",appinstname="{{.Stats.AppInstanceName}}",servgroupinstid="{{.Stats.ServiceGroupInstanceId}}",servgroupinstname="{{.Stats.ServiceGroupInstanceName}}",servinstid="{{.Stats.ServiceInstanceId}}",servinstname="{{.Stats.ServiceInstanceName}}"} {{printf "%f" .Stats.CpuMillicore}} {{.Timestamp}}
-nalej_servinst_memory_byte{appinstid="{{.Stats.AppInstanceId}}",appinstname="{{.Stats.AppInstanceName}}",servgroupinstid="{{.Stats.ServiceGroupInstanceId}}",servgroupinstname="{{.Stats.ServiceGroupInstanceName}}",servinstid="{{.Stats.ServiceInstanceId}}",servinstname="{{.Stats.ServiceInstanceName}}"} {{printf "%f" .Stats.MemoryByte}} {{.Timestamp}}
-nalej_servinst_storage_byte{appinstid="{{.Stats.AppInstanceId}}",appinstname="{{.Stats.AppInstanceName}}",servgroupinstid="{{.Stats.ServiceGroupInstanceId}}",servgroupinstname="{{.Stats.ServiceGroupInstanceName}}",servinstid="{{.Stats.ServiceInstanceId}}",servinstname="{{.Stats.ServiceInstanceName}}"} {{printf "%f" .Stats.StorageByte}} {{.Timestamp}}
-`
-
 type Manager struct {
 	monitoringClient *grpc_monitoring_go.MonitoringManagerClient
 }
@@ -46,31 +39,28 @@ func (m *Manager) GetMonitoringClient() grpc_monitoring_go.MonitoringManagerClie
 	return *m.monitoringClient
 }
 
-func (m *Manager) Metrics(organizationID string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), monitoringTimeout)
+// Metrics retrieves the metric families with the application stats of an
+// organization, aggregated by the given levels or by service instance if
+// none. Only the app instances the filter may select are requested to the
+// monitoring manager with the given call options.
+func (m *Manager) Metrics(ctx context.Context, organizationID string, groupBy []grpc_monitoring_go.AggregationLevel, filter *SeriesFilter, opts ...grpc.CallOption) ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(ctx, monitoringTimeout)
 	defer cancel()
-	stats, err := m.GetMonitoringClient().GetOrganizationApplicationStats(ctx, &grpc_monitoring_go.OrganizationApplicationStatsRequest{OrganizationId: organizationID})
+	stats, err := m.GetMonitoringClient().GetOrganizationApplicationStats(ctx, &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+		OrganizationId: organizationID,
+		AppInstanceId:  filter.AppInstanceIds(),
+		GroupBy:        groupBy,
+	}, opts...)
 	if err != nil {
 		return nil, err
 	}
-	tmpl := template.Must(template.New("prometheusExpositionTemplate").Parse(prometheusExpositionTemplate))
-	response := make([]string, len(stats.ServiceInstanceStats))
-	for i, serviceStats := range stats.ServiceInstanceStats {
-		var buffer strings.Builder
-		err := tmpl.Execute(&buffer, PrometheusExpositionObject{
-			Stats:     *serviceStats,
-			Timestamp: stats.Timestamp,
-		})
-		if err != nil {
-			return nil, err
-		}
-		response[i] = buffer.String()
-	}
 
-	return []byte(strings.Join(response, "\n")), nil
+	return MetricFamilies(stats, filter), nil
 }
 
-type PrometheusExpositionObject struct {
-	Stats     grpc_monitoring_go.OrganizationApplicationStats
-	Timestamp int64
+// Query executes a query on a cluster of an organization
+func (m *Manager) Query(ctx context.Context, request *grpc_monitoring_go.QueryRequest) (*grpc_monitoring_go.QueryResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, monitoringTimeout)
+	defer cancel()
+	return m.GetMonitoringClient().Query(ctx, request)
 }
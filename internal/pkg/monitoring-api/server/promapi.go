@@ -0,0 +1,604 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Subset of the Prometheus HTTP API used by Grafana, routing every query
+// to a cluster of an organization through the monitoring manager
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server/auth"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// PrometheusAPIPrefix is the path of the API of every organization:
+	// /prometheus/<organization_id>[/clusters/<cluster_id>]/api/v1/<endpoint>
+	PrometheusAPIPrefix = "/prometheus/"
+	// Label identifying the cluster of a series
+	labelClusterId = "cluster_id"
+)
+
+// Prometheus API error types
+const (
+	errorBadData     = "bad_data"
+	errorExecution   = "execution"
+	errorTimeout     = "timeout"
+	errorUnavailable = "unavailable"
+	errorNotFound    = "not_found"
+)
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// PrometheusAPI implements the query, query_range, labels, label values and
+// series endpoints of the Prometheus HTTP API, so Grafana can use
+// monitoring-api as a single data source for every cluster of an
+// organization. The cluster of a request is named in the URL path or in a
+// cluster_id matcher of its query or selectors, and the cluster_id label is
+// added to every series returned.
+type PrometheusAPI struct {
+	manager *Manager
+	// Authenticator of organization requests; nil if authentication is disabled
+	authenticator *auth.Authenticator
+}
+
+// NewPrometheusAPI creates the Prometheus API handler
+func NewPrometheusAPI(manager *Manager, authenticator *auth.Authenticator) *PrometheusAPI {
+	return &PrometheusAPI{manager: manager, authenticator: authenticator}
+}
+
+// apiResponse is the envelope of every Prometheus API response
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// queryData is the result of query and query_range requests
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+// apiSeries is a series of a vector or matrix result
+type apiSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value,omitempty"`
+	Values [][]interface{}   `json:"values,omitempty"`
+}
+
+type apiError struct {
+	errorType string
+	status    int
+	message   string
+}
+
+func badData(format string, args ...interface{}) *apiError {
+	return &apiError{errorType: errorBadData, status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// apiRequest is a request to an endpoint of the API of an organization
+type apiRequest struct {
+	organizationId string
+	// Cluster named in the path, if any
+	clusterId string
+	endpoint  string
+	params    map[string][]string
+}
+
+func (r *apiRequest) param(name string) string {
+	if values := r.params[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (a *PrometheusAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, apiErr := parseAPIRequest(r)
+	if apiErr == nil {
+		apiErr = authorizeRequest(a.authenticator, r, request.organizationId)
+	}
+	var data interface{}
+	if apiErr == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), monitoringTimeout)
+		defer cancel()
+		data, apiErr = a.execute(ctx, request)
+	}
+
+	if apiErr != nil {
+		log.Debug().Str("path", r.URL.Path).Str("errorType", apiErr.errorType).Str("error", apiErr.message).Msg("prometheus API request failed")
+		writeAPIResponse(w, apiErr.status, &apiResponse{Status: "error", ErrorType: apiErr.errorType, Error: apiErr.message})
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, &apiResponse{Status: "success", Data: data})
+}
+
+// parseAPIRequest parses the path and the parameters, from the URL or a form, of a request
+func parseAPIRequest(r *http.Request) (*apiRequest, *apiError) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return nil, &apiError{errorType: errorBadData, status: http.StatusMethodNotAllowed, message: "method not allowed"}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, badData("invalid parameters: %s", err)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, PrometheusAPIPrefix), "/")
+	request := &apiRequest{organizationId: parts[0], params: r.Form}
+	parts = parts[1:]
+	if len(parts) >= 2 && parts[0] == "clusters" {
+		request.clusterId = parts[1]
+		parts = parts[2:]
+	}
+	if request.organizationId == "" || len(parts) < 3 || parts[0] != "api" || parts[1] != "v1" {
+		return nil, &apiError{errorType: errorNotFound, status: http.StatusNotFound, message: "unknown path"}
+	}
+	request.endpoint = strings.Join(parts[2:], "/")
+	return request, nil
+}
+
+// authorizeRequest checks the bearer token of an HTTP request gives access to the organization. Requests are
+// not checked if the authenticator is nil, so the APIs using it are only served with authentication.
+func authorizeRequest(authenticator *auth.Authenticator, r *http.Request, organizationId string) *apiError {
+	if authenticator == nil {
+		return nil
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), metadata.Pairs("authorization", r.Header.Get("Authorization")))
+	if _, derr := authenticator.Authorize(ctx, organizationId); derr != nil {
+		return grpcAPIError(conversions.ToGRPCError(derr))
+	}
+	return nil
+}
+
+func (a *PrometheusAPI) execute(ctx context.Context, request *apiRequest) (interface{}, *apiError) {
+	switch {
+	case request.endpoint == "query":
+		return a.query(ctx, request)
+	case request.endpoint == "query_range":
+		return a.queryRange(ctx, request)
+	case request.endpoint == "labels":
+		return a.labels(ctx, request)
+	case request.endpoint == "series":
+		return a.series(ctx, request)
+	case strings.HasPrefix(request.endpoint, "label/") && strings.HasSuffix(request.endpoint, "/values"):
+		name := strings.TrimSuffix(strings.TrimPrefix(request.endpoint, "label/"), "/values")
+		return a.labelValues(ctx, request, name)
+	}
+	return nil, &apiError{errorType: errorNotFound, status: http.StatusNotFound, message: "unknown endpoint"}
+}
+
+func (a *PrometheusAPI) query(ctx context.Context, request *apiRequest) (interface{}, *apiError) {
+	at, apiErr := timeParam(request, "time", time.Now())
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	clusterId, queries, apiErr := routeQueries(request.clusterId, []string{request.param("query")})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	response, apiErr := a.runQuery(ctx, request.organizationId, clusterId, queries[0], &grpc_monitoring_go.QueryRequest_QueryRange{
+		Start: conversions.GRPCTime(at),
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return queryResult(response, clusterId), nil
+}
+
+func (a *PrometheusAPI) queryRange(ctx context.Context, request *apiRequest) (interface{}, *apiError) {
+	start, apiErr := timeParam(request, "start", time.Time{})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	end, apiErr := timeParam(request, "end", time.Time{})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	step, apiErr := durationParam(request, "step")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return nil, badData("start and end are required, with end not before start")
+	}
+	if step <= 0 {
+		return nil, badData("step must be a positive duration")
+	}
+	clusterId, queries, apiErr := routeQueries(request.clusterId, []string{request.param("query")})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	response, apiErr := a.runQuery(ctx, request.organizationId, clusterId, queries[0], &grpc_monitoring_go.QueryRequest_QueryRange{
+		Start: conversions.GRPCTime(start),
+		End:   conversions.GRPCTime(end),
+		Step:  float32(step.Seconds()),
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return queryResult(response, clusterId), nil
+}
+
+// labels returns the label names of the series selected by match[]. The
+// label names can only be found in the series themselves, so match[] is
+// required instead of retrieving every series of the cluster.
+func (a *PrometheusAPI) labels(ctx context.Context, request *apiRequest) (interface{}, *apiError) {
+	clusterId, selectors, apiErr := routeSelectors(request, "")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	names := map[string]bool{labelClusterId: true}
+	apiErr = a.forEachSeries(ctx, request, clusterId, selectors, func(labels map[string]string) {
+		for name := range labels {
+			names[name] = true
+		}
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return sortedKeys(names), nil
+}
+
+// labelValues returns the values of a label in the series selected by match[], or in every series
+func (a *PrometheusAPI) labelValues(ctx context.Context, request *apiRequest, name string) (interface{}, *apiError) {
+	if !labelNamePattern.MatchString(name) {
+		return nil, badData("invalid label name %q", name)
+	}
+	clusterId, selectors, apiErr := routeSelectors(request, fmt.Sprintf(`{%s!=""}`, name))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if name == labelClusterId {
+		return []string{clusterId}, nil
+	}
+
+	// Aggregate by the label, so only its values are transferred
+	queries := make([]string, 0, len(selectors))
+	for _, selector := range selectors {
+		queries = append(queries, fmt.Sprintf("count by (%s) (%s)", name, selector))
+	}
+	values := make(map[string]bool)
+	apiErr = a.forEachSeries(ctx, request, clusterId, queries, func(labels map[string]string) {
+		if value := labels[name]; value != "" {
+			values[value] = true
+		}
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return sortedKeys(values), nil
+}
+
+// series returns the label sets of the series selected by match[]
+func (a *PrometheusAPI) series(ctx context.Context, request *apiRequest) (interface{}, *apiError) {
+	clusterId, selectors, apiErr := routeSelectors(request, "")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	seriesByKey := make(map[string]map[string]string)
+	apiErr = a.forEachSeries(ctx, request, clusterId, selectors, func(labels map[string]string) {
+		labels = withClusterId(labels, clusterId)
+		seriesByKey[seriesKey(labels)] = labels
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	keys := make([]string, 0, len(seriesByKey))
+	for key := range seriesByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, seriesByKey[key])
+	}
+	return series, nil
+}
+
+// forEachSeries runs instant queries at the end of the requested range and
+// calls process with the labels of every series returned. The cluster
+// Prometheus API does not expose its series index through Query, so
+// metadata requests return the series present at that time.
+func (a *PrometheusAPI) forEachSeries(ctx context.Context, request *apiRequest, clusterId string, queries []string, process func(map[string]string)) *apiError {
+	at, apiErr := timeParam(request, "end", time.Now())
+	if apiErr != nil {
+		return apiErr
+	}
+	for _, q := range queries {
+		response, apiErr := a.runQuery(ctx, request.organizationId, clusterId, q, &grpc_monitoring_go.QueryRequest_QueryRange{
+			Start: conversions.GRPCTime(at),
+		})
+		if apiErr != nil {
+			return apiErr
+		}
+		for _, series := range response.GetPrometheusResult().GetResult() {
+			process(series.GetMetric())
+		}
+	}
+	return nil
+}
+
+func (a *PrometheusAPI) runQuery(ctx context.Context, organizationId string, clusterId string, q string, queryRange *grpc_monitoring_go.QueryRequest_QueryRange) (*grpc_monitoring_go.QueryResponse, *apiError) {
+	response, err := a.manager.Query(ctx, &grpc_monitoring_go.QueryRequest{
+		OrganizationId: organizationId,
+		ClusterId:      clusterId,
+		Type:           grpc_monitoring_go.QueryType_PROMETHEUS,
+		Query:          q,
+		Range:          queryRange,
+	})
+	if err != nil {
+		return nil, grpcAPIError(err)
+	}
+	return response, nil
+}
+
+// routeSelectors routes the match[] selectors of a metadata request.
+// Without match[], or for selectors only restricted to a cluster,
+// defaultSelector is used; if it is empty the request is rejected, so a
+// request never selects every series of a cluster.
+func routeSelectors(request *apiRequest, defaultSelector string) (string, []string, *apiError) {
+	matches := request.params["match[]"]
+	if len(matches) == 0 {
+		if defaultSelector == "" {
+			return "", nil, badData("no match[] parameter provided")
+		}
+		matches = []string{defaultSelector}
+	}
+
+	clusterId := request.clusterId
+	selectors := make([]string, 0, len(matches))
+	for _, match := range matches {
+		matchers, err := parser.ParseMetricSelector(match)
+		if err != nil {
+			return "", nil, badData("invalid match[] %q: %s", match, err.Error())
+		}
+		matchers, apiErr := routeMatchers(&clusterId, matchers)
+		if apiErr != nil {
+			return "", nil, apiErr
+		}
+		if len(matchers) > 0 {
+			selectors = append(selectors, (&parser.VectorSelector{LabelMatchers: matchers}).String())
+		} else if defaultSelector != "" {
+			selectors = append(selectors, defaultSelector)
+		} else {
+			return "", nil, badData("match[] must select series by a label other than %s", labelClusterId)
+		}
+	}
+	if clusterId == "" {
+		return "", nil, badData("no cluster: use a /clusters/<cluster_id> path or a %s matcher", labelClusterId)
+	}
+	return clusterId, selectors, nil
+}
+
+// routeQueries finds the cluster of a request, from its path or from the
+// cluster_id matchers of its queries, and removes those matchers.
+func routeQueries(pathClusterId string, queries []string) (string, []string, *apiError) {
+	clusterId := pathClusterId
+	routed := make([]string, 0, len(queries))
+	for _, q := range queries {
+		if strings.TrimSpace(q) == "" {
+			return "", nil, badData("empty query")
+		}
+		expr, err := parser.ParseExpr(q)
+		if err != nil {
+			return "", nil, badData("invalid query: %s", err.Error())
+		}
+
+		var apiErr *apiError
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			selector, ok := node.(*parser.VectorSelector)
+			if !ok || apiErr != nil {
+				return nil
+			}
+			selector.LabelMatchers, apiErr = routeMatchers(&clusterId, selector.LabelMatchers)
+			if apiErr == nil && len(selector.LabelMatchers) == 0 {
+				apiErr = badData("selectors must have a matcher other than %s", labelClusterId)
+			}
+			return nil
+		})
+		if apiErr != nil {
+			return "", nil, apiErr
+		}
+		routed = append(routed, expr.String())
+	}
+	if clusterId == "" {
+		return "", nil, badData("no cluster: use a /clusters/<cluster_id> path or a %s matcher", labelClusterId)
+	}
+	return clusterId, routed, nil
+}
+
+// routeMatchers removes the cluster_id matchers of a selector, as series in
+// the cluster Prometheus do not have that label, and sets the cluster they
+// select. Only equality matchers are supported, and every matcher of a
+// request must select the same cluster.
+func routeMatchers(clusterId *string, matchers []*labels.Matcher) ([]*labels.Matcher, *apiError) {
+	routed := make([]*labels.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		switch {
+		case matcher.Name != labelClusterId:
+			routed = append(routed, matcher)
+		case matcher.Type != labels.MatchEqual:
+			return nil, badData("only equality %s matchers are supported, got %s", labelClusterId, matcher.String())
+		case *clusterId != "" && matcher.Value != *clusterId:
+			return nil, badData("a request can only query one cluster, got %q and %q", *clusterId, matcher.Value)
+		default:
+			*clusterId = matcher.Value
+		}
+	}
+	return routed, nil
+}
+
+// queryResult converts a query response to the Prometheus API format,
+// adding the cluster label to every series
+func queryResult(response *grpc_monitoring_go.QueryResponse, clusterId string) *queryData {
+	result := response.GetPrometheusResult()
+	resultType := strings.ToLower(result.GetResultType().String())
+	switch result.GetResultType() {
+	case grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR:
+		vector := make([]*apiSeries, 0, len(result.GetResult()))
+		for _, series := range result.GetResult() {
+			sample := &apiSeries{Metric: withClusterId(series.GetMetric(), clusterId)}
+			if values := series.GetValue(); len(values) > 0 {
+				sample.Value = apiSample(values[0])
+			}
+			vector = append(vector, sample)
+		}
+		return &queryData{ResultType: resultType, Result: vector}
+	case grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX:
+		matrix := make([]*apiSeries, 0, len(result.GetResult()))
+		for _, series := range result.GetResult() {
+			samples := make([][]interface{}, 0, len(series.GetValue()))
+			for _, value := range series.GetValue() {
+				samples = append(samples, apiSample(value))
+			}
+			matrix = append(matrix, &apiSeries{Metric: withClusterId(series.GetMetric(), clusterId), Values: samples})
+		}
+		return &queryData{ResultType: resultType, Result: matrix}
+	}
+
+	// Scalars and strings have a single value
+	var sample []interface{}
+	if results := result.GetResult(); len(results) > 0 && len(results[0].GetValue()) > 0 {
+		sample = apiSample(results[0].GetValue()[0])
+	}
+	return &queryData{ResultType: resultType, Result: sample}
+}
+
+// apiSample is a [timestamp in seconds, value] pair
+func apiSample(value *grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue_Value) []interface{} {
+	return []interface{}{timestampSeconds(value.GetTimestamp()), value.GetValue()}
+}
+
+func timestampSeconds(ts *timestamp.Timestamp) float64 {
+	return float64(ts.GetSeconds()) + float64(ts.GetNanos())/1e9
+}
+
+func withClusterId(labels map[string]string, clusterId string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		result[name] = value
+	}
+	if _, found := result[labelClusterId]; !found {
+		result[labelClusterId] = clusterId
+	}
+	return result
+}
+
+// seriesKey identifies a label set
+func seriesKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timeParam parses a time as a Unix timestamp in seconds or in RFC 3339 format
+func timeParam(request *apiRequest, name string, defaultValue time.Time) (time.Time, *apiError) {
+	value := request.param(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, badData("invalid %s %q", name, value)
+}
+
+// durationParam parses a duration in seconds or in Prometheus format, e.g. 5m
+func durationParam(request *apiRequest, name string) (time.Duration, *apiError) {
+	value := request.param(name)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	if duration, err := model.ParseDuration(value); err == nil {
+		return time.Duration(duration), nil
+	}
+	return 0, badData("invalid %s %q", name, value)
+}
+
+// grpcAPIError converts the error of a gRPC call to a Prometheus API error
+func grpcAPIError(err error) *apiError {
+	st, _ := status.FromError(err)
+	apiErr := &apiError{errorType: errorExecution, status: http.StatusUnprocessableEntity, message: st.Message()}
+	switch st.Code() {
+	case codes.InvalidArgument:
+		apiErr.errorType, apiErr.status = errorBadData, http.StatusBadRequest
+	case codes.Unauthenticated:
+		apiErr.status = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		apiErr.status = http.StatusForbidden
+	case codes.DeadlineExceeded:
+		apiErr.errorType, apiErr.status = errorTimeout, http.StatusServiceUnavailable
+	case codes.Unavailable:
+		apiErr.errorType, apiErr.status = errorUnavailable, http.StatusServiceUnavailable
+	}
+	return apiErr
+}
+
+func writeAPIResponse(w http.ResponseWriter, statusCode int, response *apiResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		derr := derrors.NewInternalError("failed encoding prometheus API response", err)
+		log.Error().Str("err", derr.DebugReport()).Msg("prometheus API response")
+		http.Error(w, derr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+}
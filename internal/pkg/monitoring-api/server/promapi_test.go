@@ -0,0 +1,202 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Prometheus API tests
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+)
+
+// fakeMonitoringClient answers every query with the same response
+type fakeMonitoringClient struct {
+	grpc_monitoring_go.MonitoringManagerClient
+	requests []*grpc_monitoring_go.QueryRequest
+	response *grpc_monitoring_go.QueryResponse
+}
+
+func (c *fakeMonitoringClient) Query(_ context.Context, in *grpc_monitoring_go.QueryRequest, _ ...grpc.CallOption) (*grpc_monitoring_go.QueryResponse, error) {
+	c.requests = append(c.requests, in)
+	return c.response, nil
+}
+
+func prometheusResponse(resultType grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultType, results ...*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue) *grpc_monitoring_go.QueryResponse {
+	return &grpc_monitoring_go.QueryResponse{
+		Type: grpc_monitoring_go.QueryType_PROMETHEUS,
+		Result: &grpc_monitoring_go.QueryResponse_PrometheusResult{PrometheusResult: &grpc_monitoring_go.QueryResponse_PrometheusResponse{
+			ResultType: resultType,
+			Result:     results,
+		}},
+	}
+}
+
+var _ = ginkgo.Describe("Prometheus API", func() {
+
+	var client *fakeMonitoringClient
+	var api *PrometheusAPI
+
+	ginkgo.BeforeEach(func() {
+		client = &fakeMonitoringClient{
+			response: prometheusResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR,
+				&grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue{
+					Metric: map[string]string{"__name__": "up", "job": "node"},
+					Value: []*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue_Value{
+						{Timestamp: &timestamp.Timestamp{Seconds: 1500000000, Nanos: 500000000}, Value: "1"},
+					},
+				}),
+		}
+		var monitoringClient grpc_monitoring_go.MonitoringManagerClient = client
+		manager, derr := NewManager(&monitoringClient)
+		gomega.Expect(derr).To(gomega.Succeed())
+		api = NewPrometheusAPI(manager, nil)
+	})
+
+	get := func(path string) (int, *apiResponse) {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		response := &apiResponse{}
+		gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), response)).To(gomega.Succeed())
+		return recorder.Code, response
+	}
+
+	ginkgo.It("should route queries to the cluster in the path", func() {
+		code, response := get("/prometheus/org-1/clusters/cluster-1/api/v1/query?query=up&time=1500000000")
+		gomega.Expect(code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(response.Status).To(gomega.Equal("success"))
+
+		gomega.Expect(client.requests).To(gomega.HaveLen(1))
+		gomega.Expect(client.requests[0].OrganizationId).To(gomega.Equal("org-1"))
+		gomega.Expect(client.requests[0].ClusterId).To(gomega.Equal("cluster-1"))
+		gomega.Expect(client.requests[0].Query).To(gomega.Equal("up"))
+		gomega.Expect(client.requests[0].Range.GetStart().GetSeconds()).To(gomega.Equal(int64(1500000000)))
+
+		data := response.Data.(map[string]interface{})
+		gomega.Expect(data["resultType"]).To(gomega.Equal("vector"))
+		sample := data["result"].([]interface{})[0].(map[string]interface{})
+		gomega.Expect(sample["metric"]).To(gomega.HaveKeyWithValue("cluster_id", "cluster-1"))
+		gomega.Expect(sample["value"]).To(gomega.Equal([]interface{}{1500000000.5, "1"}))
+	})
+
+	ginkgo.It("should route queries with a cluster_id matcher", func() {
+		query := url.QueryEscape(`sum(rate(node_cpu{cluster_id="cluster-2", mode!="idle"}[5m]))`)
+		code, _ := get("/prometheus/org-1/api/v1/query?query=" + query)
+		gomega.Expect(code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(client.requests[0].ClusterId).To(gomega.Equal("cluster-2"))
+		gomega.Expect(client.requests[0].Query).To(gomega.Equal(`sum(rate(node_cpu{mode!="idle"}[5m]))`))
+	})
+
+	ginkgo.It("should reject queries without a single cluster", func() {
+		code, response := get("/prometheus/org-1/api/v1/query?query=up")
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+		gomega.Expect(response.ErrorType).To(gomega.Equal(errorBadData))
+
+		query := url.QueryEscape(`up{cluster_id="cluster-2"}`)
+		code, _ = get("/prometheus/org-1/clusters/cluster-1/api/v1/query?query=" + query)
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+		gomega.Expect(client.requests).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should execute range queries from a form", func() {
+		client.response = prometheusResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX)
+		form := url.Values{"query": {"up"}, "start": {"2017-07-14T02:40:00Z"}, "end": {"1500000600"}, "step": {"30s"}}
+		request := httptest.NewRequest(http.MethodPost, "/prometheus/org-1/clusters/cluster-1/api/v1/query_range", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(client.requests[0].Range.GetStart().GetSeconds()).To(gomega.Equal(int64(1500000000)))
+		gomega.Expect(client.requests[0].Range.GetEnd().GetSeconds()).To(gomega.Equal(int64(1500000600)))
+		gomega.Expect(client.requests[0].Range.GetStep()).To(gomega.Equal(float32(30)))
+	})
+
+	ginkgo.It("should retrieve label values by aggregating", func() {
+		code, response := get("/prometheus/org-1/clusters/cluster-1/api/v1/label/job/values")
+		gomega.Expect(code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(client.requests[0].Query).To(gomega.Equal(`count by (job) ({job!=""})`))
+		gomega.Expect(response.Data).To(gomega.Equal([]interface{}{"node"}))
+
+		_, response = get("/prometheus/org-1/clusters/cluster-1/api/v1/label/cluster_id/values")
+		gomega.Expect(response.Data).To(gomega.Equal([]interface{}{"cluster-1"}))
+	})
+
+	ginkgo.It("should retrieve label values of the selected series", func() {
+		_, response := get("/prometheus/org-1/api/v1/label/job/values?match[]=" + url.QueryEscape(`{cluster_id="cluster-1"}`))
+		gomega.Expect(client.requests[0].Query).To(gomega.Equal(`count by (job) ({job!=""})`))
+		gomega.Expect(response.Data).To(gomega.Equal([]interface{}{"node"}))
+
+		get("/prometheus/org-1/api/v1/label/job/values?match[]=" + url.QueryEscape(`up{cluster_id="cluster-1"}`))
+		gomega.Expect(client.requests[1].Query).To(gomega.Equal(`count by (job) ({__name__="up"})`))
+	})
+
+	ginkgo.It("should retrieve labels and series", func() {
+		_, response := get("/prometheus/org-1/api/v1/labels?match[]=" + url.QueryEscape(`up{cluster_id="cluster-1"}`))
+		gomega.Expect(client.requests[0].ClusterId).To(gomega.Equal("cluster-1"))
+		gomega.Expect(client.requests[0].Query).To(gomega.Equal(`{__name__="up"}`))
+		gomega.Expect(response.Data).To(gomega.Equal([]interface{}{"__name__", "cluster_id", "job"}))
+
+		_, response = get("/prometheus/org-1/clusters/cluster-1/api/v1/series?match[]=up&match[]=up")
+		gomega.Expect(response.Data).To(gomega.HaveLen(1))
+
+		code, _ := get("/prometheus/org-1/clusters/cluster-1/api/v1/series")
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("should not retrieve every series of a cluster", func() {
+		code, _ := get("/prometheus/org-1/clusters/cluster-1/api/v1/labels")
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+
+		code, _ = get("/prometheus/org-1/api/v1/series?match[]=" + url.QueryEscape(`{cluster_id="cluster-1"}`))
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+
+		query := url.QueryEscape(`count({cluster_id="cluster-1"})`)
+		code, _ = get("/prometheus/org-1/api/v1/query?query=" + query)
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+		gomega.Expect(client.requests).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should only remove cluster_id matchers from selectors", func() {
+		query := url.QueryEscape(`up{job="cluster_id=\"x\"", cluster_id="cluster-1"}`)
+		code, _ := get("/prometheus/org-1/api/v1/query?query=" + query)
+		gomega.Expect(code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(client.requests[0].ClusterId).To(gomega.Equal("cluster-1"))
+		gomega.Expect(client.requests[0].Query).To(gomega.Equal(`up{job="cluster_id=\"x\""}`))
+
+		query = url.QueryEscape(`up{cluster_id=~"cluster-.*"}`)
+		code, _ = get("/prometheus/org-1/api/v1/query?query=" + query)
+		gomega.Expect(code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("should not find unknown endpoints", func() {
+		code, response := get("/prometheus/org-1/clusters/cluster-1/api/v1/rules")
+		gomega.Expect(code).To(gomega.Equal(http.StatusNotFound))
+		gomega.Expect(response.Status).To(gomega.Equal("error"))
+	})
+})
@@ -0,0 +1,378 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Periodic push of organization stats to Prometheus remote write endpoints
+
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/nalej/derrors"
+	"github.com/nalej/monitoring/version"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultInterval   = time.Minute
+	DefaultQueueSize  = 10
+	DefaultMaxRetries = 5
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+	// Timeout of each request to a remote write endpoint
+	requestTimeout = 30 * time.Second
+	// Part of error responses included in the logs
+	maxErrorBodySize = 512
+	metricNameLabel  = "__name__"
+)
+
+// Target is a remote write endpoint receiving the stats of an organization
+type Target struct {
+	// Name of the target, used in the logs
+	Name           string `json:"name"`
+	OrganizationId string `json:"organization_id"`
+	URL            string `json:"url"`
+	// Optional bearer token of the requests
+	BearerToken string `json:"bearer_token,omitempty"`
+	// Additional request headers, e.g. the tenant of a multi-tenant TSDB
+	Headers map[string]string `json:"headers,omitempty"`
+	// Labels added to every series that doesn't have them
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// LoadTargets reads a JSON file with a list of targets
+func LoadTargets(path string) ([]*Target, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot read remote write targets file", err).WithParams(path)
+	}
+
+	var targets []*Target
+	if err := json.Unmarshal(content, &targets); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid remote write targets file", err).WithParams(path)
+	}
+	for _, target := range targets {
+		if target.Name == "" || target.OrganizationId == "" || target.URL == "" {
+			return nil, derrors.NewInvalidArgumentError("remote write targets need a name, organization_id and url").WithParams(path, target.Name)
+		}
+		endpoint, err := url.Parse(target.URL)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return nil, derrors.NewInvalidArgumentError("invalid remote write url", err).WithParams(path, target.Name)
+		}
+	}
+	return targets, nil
+}
+
+// Source retrieves the metric families of an organization
+type Source func(ctx context.Context, organizationId string) ([]*dto.MetricFamily, error)
+
+// Options of the push to every target
+type Options struct {
+	// Interval between stats retrievals
+	Interval time.Duration
+	// Maximum number of pending requests per target; the oldest one is
+	// dropped when a new one doesn't fit
+	QueueSize int
+	// Retries of a request failing with a recoverable error
+	MaxRetries int
+	// Backoff before the first retry, doubled on every retry up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// HTTP client of the requests
+	Client *http.Client
+}
+
+// DefaultOptions returns the options used unless configured otherwise
+func DefaultOptions() Options {
+	return Options{
+		Interval:   DefaultInterval,
+		QueueSize:  DefaultQueueSize,
+		MaxRetries: DefaultMaxRetries,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		Client:     http.DefaultClient,
+	}
+}
+
+// Writer periodically retrieves the stats of the organization of each
+// target and pushes them in the remote write format: snappy compressed
+// protocol buffers.
+type Writer struct {
+	targets []*Target
+	source  Source
+	options Options
+}
+
+// NewWriter creates a writer for a list of targets
+func NewWriter(targets []*Target, source Source, options Options) *Writer {
+	return &Writer{targets: targets, source: source, options: options}
+}
+
+// Run pushes the stats to every target until the context is done
+func (w *Writer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range w.targets {
+		// Stats are collected and sent independently, so a slow endpoint
+		// only delays its own requests
+		pending := newQueue(w.options.QueueSize)
+		wg.Add(2)
+		go func(target *Target) {
+			defer wg.Done()
+			w.collect(ctx, target, pending)
+		}(target)
+		go func(target *Target) {
+			defer wg.Done()
+			w.send(ctx, target, pending)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// collect queues the stats of the organization of a target on every interval
+func (w *Writer) collect(ctx context.Context, target *Target, pending *queue) {
+	ticker := time.NewTicker(w.options.Interval)
+	defer ticker.Stop()
+	for {
+		request, err := w.writeRequest(ctx, target)
+		if err != nil {
+			log.Error().Str("target", target.Name).Str("organization_id", target.OrganizationId).Err(err).Msg("cannot retrieve stats for remote write")
+		} else if pending.push(request) {
+			log.Warn().Str("target", target.Name).Msg("remote write queue full, dropped the oldest request")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Writer) writeRequest(ctx context.Context, target *Target) (*WriteRequest, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	families, err := w.source(ctx, target.OrganizationId)
+	if err != nil {
+		return nil, err
+	}
+	return &WriteRequest{Timeseries: TimeSeries(families, target.Labels, time.Now())}, nil
+}
+
+// send pushes the queued requests of a target
+func (w *Writer) send(ctx context.Context, target *Target, pending *queue) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-pending.requests:
+			if derr := w.sendWithRetries(ctx, target, request); derr != nil {
+				log.Error().Str("target", target.Name).Str("err", derr.DebugReport()).Msg("remote write request dropped")
+			}
+		}
+	}
+}
+
+// sendWithRetries pushes a request, retrying recoverable errors with
+// exponential backoff. As in Prometheus, server errors and throttling are
+// recoverable; other client errors are not.
+func (w *Writer) sendWithRetries(ctx context.Context, target *Target, request *WriteRequest) derrors.Error {
+	body, derr := Encode(request)
+	if derr != nil {
+		return derr
+	}
+
+	backoff := w.options.MinBackoff
+	for attempt := 0; ; attempt++ {
+		derr, recoverable := w.post(ctx, target, body)
+		if derr == nil || !recoverable || attempt >= w.options.MaxRetries {
+			return derr
+		}
+
+		log.Warn().Str("target", target.Name).Int("attempt", attempt+1).Str("backoff", backoff.String()).Msg(derr.Error())
+		select {
+		case <-ctx.Done():
+			return derrors.NewCanceledError("remote write canceled", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > w.options.MaxBackoff {
+			backoff = w.options.MaxBackoff
+		}
+	}
+}
+
+// post sends an encoded request, returning whether a failure can be retried
+func (w *Writer) post(ctx context.Context, target *Target, body []byte) (derrors.Error, bool) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return derrors.NewInvalidArgumentError("cannot create remote write request", err).WithParams(target.Name), false
+	}
+	request = request.WithContext(ctx)
+	for name, value := range target.Headers {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("User-Agent", "nalej-monitoring-api/"+version.AppVersion)
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if target.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+target.BearerToken)
+	}
+
+	response, err := w.options.Client.Do(request)
+	if err != nil {
+		return derrors.NewUnavailableError("remote write request failed", err).WithParams(target.Name), true
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		return nil, true
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBodySize))
+	derr := derrors.NewUnavailableError(fmt.Sprintf("remote write endpoint responded %s: %s", response.Status, bytes.TrimSpace(message))).WithParams(target.Name)
+	return derr, response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests
+}
+
+// TimeSeries converts metric families to remote write series, adding the
+// given labels to those series without them. Samples without timestamp
+// are taken at now.
+func TimeSeries(families []*dto.MetricFamily, extraLabels map[string]string, now time.Time) []*TimeSeries {
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	series := make([]*TimeSeries, 0)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			value, ok := metricValue(family.GetType(), metric)
+			if !ok {
+				continue
+			}
+			timestamp := metric.GetTimestampMs()
+			if timestamp == 0 {
+				timestamp = nowMs
+			}
+			series = append(series, &TimeSeries{
+				Labels:  seriesLabels(family.GetName(), metric.GetLabel(), extraLabels),
+				Samples: []*Sample{{Value: value, Timestamp: timestamp}},
+			})
+		}
+	}
+	return series
+}
+
+// metricValue returns the value of single value metrics; summaries and histograms are not exposed
+func metricValue(metricType dto.MetricType, metric *dto.Metric) (float64, bool) {
+	switch metricType {
+	case dto.MetricType_GAUGE:
+		return metric.GetGauge().GetValue(), true
+	case dto.MetricType_COUNTER:
+		return metric.GetCounter().GetValue(), true
+	case dto.MetricType_UNTYPED:
+		return metric.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
+
+func seriesLabels(name string, pairs []*dto.LabelPair, extraLabels map[string]string) []*Label {
+	values := make(map[string]string, len(pairs)+len(extraLabels)+1)
+	for labelName, value := range extraLabels {
+		values[labelName] = value
+	}
+	for _, pair := range pairs {
+		values[pair.GetName()] = pair.GetValue()
+	}
+	values[metricNameLabel] = name
+
+	labels := make([]*Label, 0, len(values))
+	for labelName, value := range values {
+		// Empty labels are the same as missing ones
+		if value != "" {
+			labels = append(labels, &Label{Name: labelName, Value: value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// Encode serializes and compresses a request
+func Encode(request *WriteRequest) ([]byte, derrors.Error) {
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot encode remote write request", err)
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// Decode reads the request sent to a remote write endpoint
+func Decode(r *http.Request) (*WriteRequest, derrors.Error) {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot read remote write request", err)
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid remote write compression", err)
+	}
+	request := &WriteRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid remote write request", err)
+	}
+	return request, nil
+}
+
+// queue is a bounded queue of write requests
+type queue struct {
+	requests chan *WriteRequest
+}
+
+func newQueue(size int) *queue {
+	return &queue{requests: make(chan *WriteRequest, size)}
+}
+
+// push adds a request, dropping the oldest one if the queue is full. It
+// returns whether a request was dropped.
+func (q *queue) push(request *WriteRequest) bool {
+	dropped := false
+	for {
+		select {
+		case q.requests <- request:
+			return dropped
+		default:
+		}
+		select {
+		case <-q.requests:
+			dropped = true
+		default:
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Remote write tests, against a local stand-in receiver
+
+package remotewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// receiver is a stand-in remote write endpoint answering with the given status codes, then 204
+type receiver struct {
+	sync.Mutex
+	statusCodes []int
+	requests    []*WriteRequest
+	headers     []http.Header
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	decoded, derr := Decode(request)
+	if derr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, decoded)
+	r.headers = append(r.headers, request.Header)
+	statusCode := http.StatusNoContent
+	if len(r.statusCodes) > 0 {
+		statusCode, r.statusCodes = r.statusCodes[0], r.statusCodes[1:]
+	}
+	w.WriteHeader(statusCode)
+}
+
+func (r *receiver) received() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.requests)
+}
+
+func testFamilies() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		{
+			Name: proto.String("nalej_servinst_cpu_core"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("servinstid"), Value: proto.String("service-1")},
+					{Name: proto.String("appinstid"), Value: proto.String("app-1")},
+					{Name: proto.String("appinstname"), Value: proto.String("")},
+				},
+				Gauge:       &dto.Gauge{Value: proto.Float64(250)},
+				TimestampMs: proto.Int64(1500000000000),
+			}},
+		},
+		{
+			Name:   proto.String("nalej_summary"),
+			Type:   dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{Summary: &dto.Summary{}}},
+		},
+	}
+}
+
+func testOptions() Options {
+	options := DefaultOptions()
+	options.Interval = 10 * time.Millisecond
+	options.MinBackoff = time.Millisecond
+	options.MaxBackoff = 5 * time.Millisecond
+	options.MaxRetries = 2
+	return options
+}
+
+var _ = ginkgo.Describe("remote write", func() {
+
+	var stub *receiver
+	var server *httptest.Server
+	var target *Target
+
+	ginkgo.BeforeEach(func() {
+		stub = &receiver{}
+		server = httptest.NewServer(stub)
+		target = &Target{
+			Name:           "test",
+			OrganizationId: "org-1",
+			URL:            server.URL,
+			BearerToken:    "secret",
+			Headers:        map[string]string{"X-Scope-OrgID": "tenant-1"},
+			Labels:         map[string]string{"source": "nalej", "appinstid": "ignored"},
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("should convert metric families to sorted series", func() {
+		series := TimeSeries(testFamilies(), target.Labels, time.Now())
+		gomega.Expect(series).To(gomega.HaveLen(1))
+		gomega.Expect(series[0].Labels).To(gomega.Equal([]*Label{
+			{Name: "__name__", Value: "nalej_servinst_cpu_core"},
+			{Name: "appinstid", Value: "app-1"},
+			{Name: "servinstid", Value: "service-1"},
+			{Name: "source", Value: "nalej"},
+		}))
+		gomega.Expect(series[0].Samples).To(gomega.Equal([]*Sample{{Value: 250, Timestamp: 1500000000000}}))
+	})
+
+	ginkgo.It("should periodically push the stats of the organization", func() {
+		organizations := make(chan string, 10)
+		source := func(_ context.Context, organizationId string) ([]*dto.MetricFamily, error) {
+			select {
+			case organizations <- organizationId:
+			default:
+			}
+			return testFamilies(), nil
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			NewWriter([]*Target{target}, source, testOptions()).Run(ctx)
+			close(done)
+		}()
+		gomega.Eventually(stub.received).Should(gomega.BeNumerically(">=", 2))
+		cancel()
+		gomega.Eventually(done).Should(gomega.BeClosed())
+
+		gomega.Expect(<-organizations).To(gomega.Equal("org-1"))
+		stub.Lock()
+		defer stub.Unlock()
+		gomega.Expect(stub.requests[0].Timeseries).To(gomega.HaveLen(1))
+		gomega.Expect(stub.headers[0].Get("Content-Encoding")).To(gomega.Equal("snappy"))
+		gomega.Expect(stub.headers[0].Get("Authorization")).To(gomega.Equal("Bearer secret"))
+		gomega.Expect(stub.headers[0].Get("X-Scope-OrgID")).To(gomega.Equal("tenant-1"))
+	})
+
+	ginkgo.It("should retry recoverable errors", func() {
+		stub.statusCodes = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+		writer := NewWriter([]*Target{target}, nil, testOptions())
+		derr := writer.sendWithRetries(context.Background(), target, &WriteRequest{Timeseries: TimeSeries(testFamilies(), nil, time.Now())})
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(stub.received()).To(gomega.Equal(3))
+	})
+
+	ginkgo.It("should give up after the maximum retries", func() {
+		stub.statusCodes = []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}
+		writer := NewWriter([]*Target{target}, nil, testOptions())
+		derr := writer.sendWithRetries(context.Background(), target, &WriteRequest{})
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+		gomega.Expect(stub.received()).To(gomega.Equal(3))
+	})
+
+	ginkgo.It("should not retry client errors", func() {
+		stub.statusCodes = []int{http.StatusBadRequest}
+		writer := NewWriter([]*Target{target}, nil, testOptions())
+		derr := writer.sendWithRetries(context.Background(), target, &WriteRequest{})
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+		gomega.Expect(stub.received()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should drop the oldest requests when the queue is full", func() {
+		pending := newQueue(2)
+		first, second, third := &WriteRequest{}, &WriteRequest{}, &WriteRequest{}
+		gomega.Expect(pending.push(first)).To(gomega.BeFalse())
+		gomega.Expect(pending.push(second)).To(gomega.BeFalse())
+		gomega.Expect(pending.push(third)).To(gomega.BeTrue())
+		gomega.Expect(<-pending.requests).To(gomega.BeIdenticalTo(second))
+		gomega.Expect(<-pending.requests).To(gomega.BeIdenticalTo(third))
+	})
+
+	ginkgo.It("should load and validate targets", func() {
+		file, err := ioutil.TempFile("", "targets")
+		gomega.Expect(err).To(gomega.Succeed())
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(`[{"name": "cortex", "organization_id": "org-1", "url": "https://cortex/api/v1/push"}]`)
+		gomega.Expect(err).To(gomega.Succeed())
+		targets, derr := LoadTargets(file.Name())
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(targets).To(gomega.HaveLen(1))
+		gomega.Expect(targets[0].OrganizationId).To(gomega.Equal("org-1"))
+
+		gomega.Expect(ioutil.WriteFile(file.Name(), []byte(`[{"name": "cortex", "organization_id": "org-1", "url": "ftp://cortex"}]`), 0600)).To(gomega.Succeed())
+		_, derr = LoadTargets(file.Name())
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+})
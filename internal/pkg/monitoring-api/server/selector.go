@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Prometheus series selectors, as used by match[] on federation endpoints
+
+package server
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Label with the metric name of a series
+const metricNameLabel = labels.MetricName
+
+// Selector selects the series matching all its label matchers
+type Selector []*labels.Matcher
+
+// Matches checks the labels of a series, including its metric name.
+// Missing labels have the empty value.
+func (s Selector) Matches(metricName string, values map[string]string) bool {
+	for _, matcher := range s {
+		value := values[matcher.Name]
+		if matcher.Name == metricNameLabel {
+			value = metricName
+		}
+		if !matcher.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualValue returns the value a label must be equal to, if the selector has such a matcher.
+func (s Selector) EqualValue(name string) (string, bool) {
+	for _, matcher := range s {
+		if matcher.Name == name && matcher.Type == labels.MatchEqual {
+			return matcher.Value, true
+		}
+	}
+	return "", false
+}
+
+// ParseSelector parses a series selector such as metric{label="value",other=~"re.*"}.
+func ParseSelector(input string) (Selector, derrors.Error) {
+	matchers, err := parser.ParseMetricSelector(input)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid selector", err).WithParams(input)
+	}
+
+	// As in Prometheus, a selector must not match every series
+	for _, matcher := range matchers {
+		if !matcher.Matches("") {
+			return matchers, nil
+		}
+	}
+	return nil, derrors.NewInvalidArgumentError("selector must contain at least one non-empty matcher").WithParams(input)
+}
+
+// ParseSelectors parses a list of selectors, as received in match[] parameters.
+func ParseSelectors(inputs []string) ([]Selector, derrors.Error) {
+	selectors := make([]Selector, 0, len(inputs))
+	for _, input := range inputs {
+		selector, derr := ParseSelector(input)
+		if derr != nil {
+			return nil, derr
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Series selector and filter tests
+
+package server
+
+import (
+	"github.com/nalej/grpc-monitoring-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("series selectors", func() {
+
+	ginkgo.Context("ParseSelector", func() {
+		ginkgo.It("should parse a metric name with label matchers", func() {
+			selector, derr := ParseSelector(`nalej_servinst_cpu_core{appinstid="app-1", servinstname=~'web.*',servgroupinstid!="g",}`)
+			gomega.Expect(derr).To(gomega.Succeed())
+			gomega.Expect(selector).To(gomega.HaveLen(4))
+			gomega.Expect(selector.Matches("nalej_servinst_cpu_core", map[string]string{
+				"appinstid": "app-1", "servinstname": "web-frontend"})).To(gomega.BeTrue())
+			gomega.Expect(selector.Matches("nalej_servinst_cpu_core", map[string]string{
+				"appinstid": "app-1", "servinstname": "api"})).To(gomega.BeFalse())
+			gomega.Expect(selector.Matches("nalej_servinst_memory_byte", map[string]string{
+				"appinstid": "app-1", "servinstname": "web"})).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should match the metric name by label", func() {
+			selector, derr := ParseSelector(`{__name__=~"nalej_servinst_network_.*"}`)
+			gomega.Expect(derr).To(gomega.Succeed())
+			gomega.Expect(selector.Matches("nalej_servinst_network_receive_byte", nil)).To(gomega.BeTrue())
+			gomega.Expect(selector.Matches("nalej_servinst_cpu_core", nil)).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should unescape label values", func() {
+			selector, derr := ParseSelector(`{servinstname="web\\frontend \"v2\""}`)
+			gomega.Expect(derr).To(gomega.Succeed())
+			value, found := selector.EqualValue("servinstname")
+			gomega.Expect(found).To(gomega.BeTrue())
+			gomega.Expect(value).To(gomega.Equal(`web\frontend "v2"`))
+		})
+
+		ginkgo.It("should reject invalid selectors", func() {
+			for _, input := range []string{``, `{}`, `{appinstid=""}`, `{appinstid="app-1"`, `{appinstid=app}`,
+				`{appinstid=~"("}`, `metric{appinstid}`, `metric other`} {
+				_, derr := ParseSelector(input)
+				gomega.Expect(derr).To(gomega.HaveOccurred(), input)
+			}
+		})
+	})
+
+	ginkgo.Context("SeriesFilter", func() {
+		stats := &grpc_monitoring_go.OrganizationApplicationStatsResponse{
+			ServiceInstanceStats: []*grpc_monitoring_go.OrganizationApplicationStats{
+				{AppInstanceId: "app-1", ServiceInstanceId: "service-1"},
+				{AppInstanceId: "app-2", ServiceInstanceId: "service-2"},
+			},
+		}
+
+		newFilter := func(request *grpc_monitoring_go.OrganizationApplicationStatsRequest) *SeriesFilter {
+			request.OrganizationId = "org"
+			filter, derr := NewSeriesFilter(request)
+			gomega.Expect(derr).To(gomega.Succeed())
+			return filter
+		}
+
+		ginkgo.It("should not filter requests without parameters", func() {
+			filter := newFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{})
+			gomega.Expect(filter).To(gomega.BeNil())
+			gomega.Expect(filter.AppInstanceIds()).To(gomega.BeEmpty())
+			gomega.Expect(MetricFamilies(stats, filter)).To(gomega.HaveLen(len(serviceInstanceMetrics)))
+		})
+
+		ginkgo.It("should filter by app instance and metric", func() {
+			filter := newFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				AppInstanceId: []string{"app-2"},
+				Metric:        []string{"nalej_servinst_memory_byte"},
+			})
+			gomega.Expect(filter.AppInstanceIds()).To(gomega.Equal([]string{"app-2"}))
+
+			families := MetricFamilies(stats, filter)
+			gomega.Expect(families).To(gomega.HaveLen(1))
+			gomega.Expect(families[0].GetName()).To(gomega.Equal("nalej_servinst_memory_byte"))
+			gomega.Expect(families[0].GetMetric()).To(gomega.HaveLen(1))
+		})
+
+		ginkgo.It("should push down app instances of every selector", func() {
+			filter := newFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				Match: []string{`{appinstid="app-2"}`, `nalej_servinst_cpu_core{appinstid="app-1"}`},
+			})
+			gomega.Expect(filter.AppInstanceIds()).To(gomega.Equal([]string{"app-1", "app-2"}))
+
+			families := MetricFamilies(stats, filter)
+			gomega.Expect(families).To(gomega.HaveLen(len(serviceInstanceMetrics)))
+			gomega.Expect(families[0].GetName()).To(gomega.Equal("nalej_servinst_cpu_core"))
+			gomega.Expect(families[0].GetMetric()).To(gomega.HaveLen(2))
+			gomega.Expect(families[1].GetMetric()).To(gomega.HaveLen(1))
+		})
+
+		ginkgo.It("should not push down selectors for any app instance", func() {
+			filter := newFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				Match: []string{`{appinstid="app-2"}`, `{servinstid=~"service-.*"}`},
+			})
+			gomega.Expect(filter.AppInstanceIds()).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should reject invalid selectors", func() {
+			_, derr := NewSeriesFilter(&grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: "org",
+				Match:          []string{`{appinstid=~"app-.*"`},
+			})
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+		})
+	})
+})
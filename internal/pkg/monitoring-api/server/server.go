@@ -25,9 +25,16 @@ import (
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/monitoring/internal/pkg/certs"
+	"github.com/nalej/monitoring/internal/pkg/health"
+	"github.com/nalej/monitoring/internal/pkg/lifecycle"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server/auth"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-api/server/remotewrite"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rs/zerolog/log"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -49,67 +56,239 @@ func NewService(conf *Config) (*Service, derrors.Error) {
 	}, nil
 }
 
-// Run the service, launch the REST service handler.
+// Run the service, launch the gRPC and REST service handlers and wait for termination.
 func (s *Service) Run() derrors.Error {
+	service := lifecycle.New(s.Configuration.ShutdownTimeout)
+
 	// Create clients
-	mmConn, err := grpc.Dial(s.Configuration.MonitoringManagerAddress, grpc.WithInsecure())
+	mmOption, derr := s.managerDialOption()
+	if derr != nil {
+		return derr
+	}
+	mmConn, err := grpc.Dial(s.Configuration.MonitoringManagerAddress, mmOption)
 	if err != nil {
 		return derrors.NewUnavailableError("cannot create connection with monitoring manager", err)
 	}
+	service.AddCloser("monitoring-manager", mmConn)
 	monitoringManagerClient := grpc_monitoring_go.NewMonitoringManagerClient(mmConn)
 
-	// Start listening
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.GrpcPort))
-	if err != nil {
-		return derrors.NewUnavailableError("failed to listen", err)
-	}
-
 	// Create managers and handler
 	manager, derr := NewManager(&monitoringManagerClient)
 	if derr != nil {
+		service.Shutdown()
 		return derr
 	}
-	handler, derr := NewHandler(manager)
+	var authenticator *auth.Authenticator
+	if s.Configuration.AuthEnabled() {
+		authenticator, derr = auth.NewAuthenticator(s.Configuration.AuthKeySetPath, s.Configuration.AuthTokensPath, s.Configuration.AuthOrganizationClaim)
+		if derr != nil {
+			service.Shutdown()
+			return derr
+		}
+	}
+	handler, derr := NewHandler(manager, authenticator)
 	if derr != nil {
+		service.Shutdown()
 		return derr
 	}
+	if s.Configuration.RemoteWriteTargetsPath != "" {
+		writer, derr := s.newRemoteWriter(manager)
+		if derr != nil {
+			service.Shutdown()
+			return derr
+		}
+		service.Go("remote-write", writer.Run)
+	}
+
+	// Server options; with TLS both the monitoring manager and the
+	// gateway connections are mutually authenticated
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(service.UnaryServerInterceptor())}
+	var gatewayOption = grpc.WithInsecure()
+	if s.Configuration.UseTLS {
+		serverCreds, gatewayCreds, derr := s.grpcCredentials()
+		if derr != nil {
+			service.Shutdown()
+			return derr
+		}
+		options = append(options, grpc.Creds(serverCreds))
+		gatewayOption = grpc.WithTransportCredentials(gatewayCreds)
+	}
 
-	go s.launchHttpServer()
+	// Start listening
+	grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.GrpcPort))
+	if err != nil {
+		service.Shutdown()
+		return derrors.NewUnavailableError("failed to listen", err)
+	}
+	httpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.HttpPort))
+	if err != nil {
+		_ = grpcListener.Close()
+		service.Shutdown()
+		return derrors.NewUnavailableError("failed to listen", err)
+	}
 
-	// Create grpcServer and register handler
-	grpcServer := grpc.NewServer()
+	// Create grpcServer and register handler. In-flight requests are
+	// drained on shutdown and only cancelled when the deadline passes.
+	grpcServer := grpc.NewServer(options...)
 	grpc_monitoring_go.RegisterMonitoringApiServer(grpcServer, handler)
 
+	// The API is healthy when the monitoring manager reports it is
+	checker := health.NewChecker(health.DefaultInterval, health.DefaultTimeout)
+	checker.AddService(health.MonitoringApiService, health.Dependency{
+		Name:  "monitoring-manager",
+		Check: health.RemoteCheck(mmConn, health.MonitoringManagerService),
+	})
+	checker.Register(grpcServer)
+	service.Go("health", checker.Run)
+
 	if s.Configuration.Debug {
 		log.Info().Msg("Enabling gRPC grpcServer reflection")
 		// Register reflection service on gRPC grpcServer.
 		reflection.Register(grpcServer)
 	}
-	log.Info().Int("port", s.Configuration.GrpcPort).Msg("Launching gRPC server")
-	if err := grpcServer.Serve(lis); err != nil {
-		return derrors.NewUnavailableError("failed to serve", err)
+	service.ServeGRPC("monitoring-api", grpcServer, grpcListener)
+
+	// The query API runs any query on the clusters of an organization, and
+	// the cost reports disclose its charges, so they are only served when
+	// requests are authenticated
+	var prometheusAPI *PrometheusAPI
+	var costAPI *CostAPI
+	if authenticator != nil {
+		prometheusAPI = NewPrometheusAPI(manager, authenticator)
+		costAPI = NewCostAPI(manager, authenticator)
+	} else {
+		log.Warn().Msg("authentication disabled; the Prometheus query API and the cost reports are not served")
+	}
+
+	// The gateway is started last so it is drained first on shutdown,
+	// while the gRPC server still answers its requests
+	httpServer, derr := s.newHttpServer(service, gatewayOption, prometheusAPI, costAPI)
+	if derr != nil {
+		_ = httpListener.Close()
+		service.Shutdown()
+		return derr
 	}
+	service.ServeHTTP("monitoring-api-gateway", httpServer, httpListener)
 
-	return nil
+	return service.Wait()
 }
 
-// launchHttpServer launches an http server as proxy of the gRPC server.
-func (s *Service) launchHttpServer() {
-	mux := runtime.NewServeMux()
+const (
+	federationMatchParam = "match[]"
+	matchParam           = "match"
+)
+
+// newHttpServer creates an http server as proxy of the gRPC server, also
+// serving the Prometheus API and the cost reports unless they are nil.
+func (s *Service) newHttpServer(service *lifecycle.Lifecycle, dialOption grpc.DialOption, prometheusAPI *PrometheusAPI, costAPI *CostAPI) (*http.Server, derrors.Error) {
+	mux := runtime.NewServeMux(runtime.WithOutgoingHeaderMatcher(outgoingHeader))
 	runtime.SetHTTPBodyMarshaler(mux)
-	httpAddress := fmt.Sprintf(":%d", s.Configuration.HttpPort)
 	grpcAddress := fmt.Sprintf(":%d", s.Configuration.GrpcPort)
-	httpServer := &http.Server{
-		Addr:    httpAddress,
-		Handler: mux,
+
+	conn, err := grpc.Dial(grpcAddress, dialOption)
+	if err != nil {
+		return nil, derrors.NewUnavailableError("cannot create connection with the gRPC server", err)
 	}
-	err := grpc_monitoring_go.RegisterMonitoringApiHandlerFromEndpoint(context.Background(), mux, grpcAddress, []grpc.DialOption{grpc.WithInsecure()})
+	service.AddCloser("monitoring-api", conn)
+
+	err = grpc_monitoring_go.RegisterMonitoringApiHandler(context.Background(), mux, conn)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to start monitoring API handler")
+		return nil, derrors.NewInternalError("failed to register monitoring API handler", err)
+	}
+
+	handler := http.NewServeMux()
+	if prometheusAPI != nil {
+		handler.Handle(PrometheusAPIPrefix, prometheusAPI)
+	}
+	if costAPI != nil {
+		handler.Handle(CostAPIPrefix, costAPI)
+	}
+	handler.Handle("/", federationParams(mux))
+
+	return &http.Server{
+		Handler: handler,
+	}, nil
+}
+
+// outgoingHeader returns the age of cached stats as the standard Age header
+// and the rest of the gRPC response metadata with the default gateway prefix.
+func outgoingHeader(key string) (string, bool) {
+	if key == ageMetadata {
+		return "Age", true
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// federationParams renames the match[] parameters of Prometheus federation
+// requests to match, the field the HTTP gateway maps them to.
+func federationParams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if matches, found := query[federationMatchParam]; found {
+			query[matchParam] = append(query[matchParam], matches...)
+			delete(query, federationMatchParam)
+			r.URL.RawQuery = query.Encode()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newRemoteWriter creates the writer pushing the stats of organizations to their remote write targets
+func (s *Service) newRemoteWriter(manager *Manager) (*remotewrite.Writer, derrors.Error) {
+	targets, derr := remotewrite.LoadTargets(s.Configuration.RemoteWriteTargetsPath)
+	if derr != nil {
+		return nil, derr
+	}
+
+	options := remotewrite.DefaultOptions()
+	options.Interval = s.Configuration.RemoteWriteInterval
+	options.QueueSize = s.Configuration.RemoteWriteQueueSize
+	options.MaxRetries = s.Configuration.RemoteWriteMaxRetries
+	source := func(ctx context.Context, organizationId string) ([]*dto.MetricFamily, error) {
+		return manager.Metrics(ctx, organizationId, nil, nil)
+	}
+
+	log.Info().Int("targets", len(targets)).Msg("pushing stats to remote write targets")
+	return remotewrite.NewWriter(targets, source, options), nil
+}
+
+// managerDialOption returns the credentials to connect to the monitoring
+// manager: the client certificate, verifying the manager with the CA.
+func (s *Service) managerDialOption() (grpc.DialOption, derrors.Error) {
+	if !s.Configuration.UseTLS {
+		return grpc.WithInsecure(), nil
 	}
-	log.Info().Str("address", httpAddress).Msg("HTTP Listening")
-	err = httpServer.ListenAndServe()
+
+	host, _, err := net.SplitHostPort(s.Configuration.MonitoringManagerAddress)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to start serving HTTP API")
+		return nil, derrors.NewInvalidArgumentError("invalid monitoring manager address", err)
+	}
+	tlsConfig, derr := certs.ClientTLSConfig(host, s.Configuration.CACertPath, s.Configuration.ClientCertPath, s.Configuration.SkipServerCertValidation)
+	if derr != nil {
+		return nil, derr
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+// grpcCredentials returns the credentials of the gRPC server, which
+// requires client certificates signed by the CA, and the credentials the
+// HTTP gateway uses to connect to it.
+func (s *Service) grpcCredentials() (credentials.TransportCredentials, credentials.TransportCredentials, derrors.Error) {
+	serverConfig, derr := certs.ServerTLSConfig(s.Configuration.ServerCertPath, s.Configuration.CACertPath)
+	if derr != nil {
+		return nil, nil, derr
+	}
+
+	// The gateway connects through the local port, so it verifies the
+	// name in the server certificate instead of the address
+	serverName, derr := certs.ServerName(serverConfig.Certificates[0])
+	if derr != nil {
+		return nil, nil, derr
+	}
+	gatewayConfig, derr := certs.ClientTLSConfig(serverName, s.Configuration.CACertPath, s.Configuration.ClientCertPath, false)
+	if derr != nil {
+		return nil, nil, derr
 	}
+
+	return credentials.NewTLS(serverConfig), credentials.NewTLS(gatewayConfig), nil
 }
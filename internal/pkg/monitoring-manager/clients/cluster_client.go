@@ -29,6 +29,8 @@ import (
 
 	"github.com/nalej/grpc-app-cluster-api-go"
 
+	"github.com/nalej/monitoring/internal/pkg/certs"
+
 	"github.com/rs/zerolog/log"
 
 	"google.golang.org/grpc"
@@ -49,10 +51,10 @@ type AppClusterConnectParams struct {
 	SkipServerCertValidation bool
 }
 
-// TODO: If we want to test this, we can create a client factory and implement
-// one that creates stub clients
-func NewMetricsCollectorClient(address string, params *AppClusterConnectParams) (*MetricsCollectorClient, derrors.Error) {
-	var options []grpc.DialOption
+// NewMetricsCollectorClient dials the app-cluster-api of an address. Clients
+// are usually obtained through a CollectorClientFactory instead.
+func NewMetricsCollectorClient(address string, params *AppClusterConnectParams, extraOptions ...grpc.DialOption) (*MetricsCollectorClient, derrors.Error) {
+	options := append([]grpc.DialOption{}, extraOptions...)
 	var hostname string
 
 	log.Debug().Str("address", address).Interface("params", params).Msg("creating app cluster client")
@@ -62,7 +64,6 @@ func NewMetricsCollectorClient(address string, params *AppClusterConnectParams)
 	}
 
 	if params.UseTLS {
-		rootCAs := x509.NewCertPool()
 		splitHostname := strings.Split(address, ":")
 		// TODO the hostname retrieved from clusters will be without : so this split code is about to die
 		if len(splitHostname) > 0 {
@@ -71,42 +72,10 @@ func NewMetricsCollectorClient(address string, params *AppClusterConnectParams)
 			return nil, derrors.NewInvalidArgumentError("server address incorrectly set")
 		}
 
-		tlsConfig := &tls.Config{
-			ServerName: hostname,
-		}
-
-		if params.CACertPath != "" {
-			log.Debug().Str("serverCertPath", params.CACertPath).Msg("loading server certificate")
-			serverCert, err := ioutil.ReadFile(params.CACertPath)
-			log.Debug().Interface("serverCert", serverCert).Msg("ca certificate")
-			if err != nil {
-				return nil, derrors.NewInternalError("Error loading server certificate")
-			}
-			added := rootCAs.AppendCertsFromPEM(serverCert)
-			if !added {
-				return nil, derrors.NewInternalError("cannot add server certificate to the pool")
-			}
-			log.Debug().Interface("rootCAs", rootCAs).Msg("root cas added")
-			tlsConfig.RootCAs = rootCAs
-		}
-
-		if params.ClientCertPath != "" {
-			log.Debug().Str("clientCertPath", params.ClientCertPath).Msg("loading client certificate")
-			clientCert, err := tls.LoadX509KeyPair(fmt.Sprintf("%s/tls.crt", params.ClientCertPath), fmt.Sprintf("%s/tls.key", params.ClientCertPath))
-			if err != nil {
-				log.Error().Str("error", err.Error()).Msg("Error loading client certificate")
-				return nil, derrors.NewInternalError("Error loading client certificate")
-			}
-
-			tlsConfig.Certificates = []tls.Certificate{clientCert}
-			tlsConfig.BuildNameToCertificate()
-		}
-
 		log.Debug().Str("address", hostname).Bool("useTLS", params.UseTLS).Str("serverCertPath", params.CACertPath).Bool("skipServerCertValidation", params.SkipServerCertValidation).Msg("creating secure connection")
-
-		if params.SkipServerCertValidation {
-			log.Debug().Msg("skipping server cert validation")
-			tlsConfig.InsecureSkipVerify = true
+		tlsConfig, derr := certs.ClientTLSConfig(hostname, params.CACertPath, params.ClientCertPath, params.SkipServerCertValidation)
+		if derr != nil {
+			return nil, derr
 		}
 
 		creds := credentials.NewTLS(tlsConfig)
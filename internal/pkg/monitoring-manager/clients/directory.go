@@ -0,0 +1,151 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Directory of the organizations and clusters of the platform
+
+package clients
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-organization-go"
+)
+
+// ClusterDirectory retrieves organizations and their clusters
+type ClusterDirectory interface {
+	ListOrganizations(ctx context.Context) ([]*grpc_organization_go.Organization, derrors.Error)
+	GetOrganization(ctx context.Context, organizationId string) (*grpc_organization_go.Organization, derrors.Error)
+	ListClusters(ctx context.Context, organizationId string) (*grpc_infrastructure_go.ClusterList, derrors.Error)
+	GetCluster(ctx context.Context, organizationId string, clusterId string) (*grpc_infrastructure_go.Cluster, derrors.Error)
+}
+
+// SystemModelDirectory is the directory kept by the system model
+type SystemModelDirectory struct {
+	clustersClient      grpc_infrastructure_go.ClustersClient
+	organizationsClient grpc_organization_go.OrganizationsClient
+}
+
+// NewSystemModelDirectory creates a directory using system model clients
+func NewSystemModelDirectory(clustersClient grpc_infrastructure_go.ClustersClient, organizationsClient grpc_organization_go.OrganizationsClient) *SystemModelDirectory {
+	return &SystemModelDirectory{clustersClient: clustersClient, organizationsClient: organizationsClient}
+}
+
+func (d *SystemModelDirectory) ListOrganizations(ctx context.Context) ([]*grpc_organization_go.Organization, derrors.Error) {
+	organizationList, err := d.organizationsClient.ListOrganizations(ctx, &grpc_common_go.Empty{})
+	if err != nil {
+		return nil, derrors.NewFailedPreconditionError("could not get organization list", err)
+	}
+	return organizationList.GetOrganizations(), nil
+}
+
+func (d *SystemModelDirectory) GetOrganization(ctx context.Context, organizationId string) (*grpc_organization_go.Organization, derrors.Error) {
+	organization, err := d.organizationsClient.GetOrganization(ctx, &grpc_organization_go.OrganizationId{OrganizationId: organizationId})
+	if err != nil {
+		return nil, derrors.NewFailedPreconditionError("could not get organization", err)
+	}
+	return organization, nil
+}
+
+func (d *SystemModelDirectory) ListClusters(ctx context.Context, organizationId string) (*grpc_infrastructure_go.ClusterList, derrors.Error) {
+	clusterList, err := d.clustersClient.ListClusters(ctx, &grpc_organization_go.OrganizationId{OrganizationId: organizationId})
+	if err != nil {
+		return nil, derrors.NewFailedPreconditionError("could not get cluster list", err)
+	}
+	return clusterList, nil
+}
+
+func (d *SystemModelDirectory) GetCluster(ctx context.Context, organizationId string, clusterId string) (*grpc_infrastructure_go.Cluster, derrors.Error) {
+	cluster, err := d.clustersClient.GetCluster(ctx, &grpc_infrastructure_go.ClusterId{
+		OrganizationId: organizationId,
+		ClusterId:      clusterId,
+	})
+	if err != nil || cluster == nil {
+		return nil, derrors.NewUnavailableError("unable to retrieve cluster", err)
+	}
+	return cluster, nil
+}
+
+// MemoryDirectory is a directory kept in memory, for tests
+type MemoryDirectory struct {
+	lock          sync.Mutex
+	organizations map[string]*grpc_organization_go.Organization
+	clusters      map[string][]*grpc_infrastructure_go.Cluster
+}
+
+// NewMemoryDirectory creates an empty directory
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{
+		organizations: make(map[string]*grpc_organization_go.Organization),
+		clusters:      make(map[string][]*grpc_infrastructure_go.Cluster),
+	}
+}
+
+// AddOrganization adds an organization with its clusters
+func (d *MemoryDirectory) AddOrganization(organization *grpc_organization_go.Organization, clusters ...*grpc_infrastructure_go.Cluster) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.organizations[organization.OrganizationId] = organization
+	d.clusters[organization.OrganizationId] = append(d.clusters[organization.OrganizationId], clusters...)
+}
+
+// ListOrganizations returns the organizations sorted by id
+func (d *MemoryDirectory) ListOrganizations(_ context.Context) ([]*grpc_organization_go.Organization, derrors.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	organizations := make([]*grpc_organization_go.Organization, 0, len(d.organizations))
+	for _, organization := range d.organizations {
+		organizations = append(organizations, organization)
+	}
+	sort.Slice(organizations, func(i, j int) bool {
+		return organizations[i].OrganizationId < organizations[j].OrganizationId
+	})
+	return organizations, nil
+}
+
+func (d *MemoryDirectory) GetOrganization(_ context.Context, organizationId string) (*grpc_organization_go.Organization, derrors.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	organization, found := d.organizations[organizationId]
+	if !found {
+		return nil, derrors.NewNotFoundError("organization not found").WithParams(organizationId)
+	}
+	return organization, nil
+}
+
+func (d *MemoryDirectory) ListClusters(_ context.Context, organizationId string) (*grpc_infrastructure_go.ClusterList, derrors.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, found := d.organizations[organizationId]; !found {
+		return nil, derrors.NewNotFoundError("organization not found").WithParams(organizationId)
+	}
+	return &grpc_infrastructure_go.ClusterList{Clusters: append([]*grpc_infrastructure_go.Cluster{}, d.clusters[organizationId]...)}, nil
+}
+
+func (d *MemoryDirectory) GetCluster(_ context.Context, organizationId string, clusterId string) (*grpc_infrastructure_go.Cluster, derrors.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, cluster := range d.clusters[organizationId] {
+		if cluster.ClusterId == clusterId {
+			return cluster, nil
+		}
+	}
+	return nil, derrors.NewNotFoundError("cluster not found").WithParams(organizationId, clusterId)
+}
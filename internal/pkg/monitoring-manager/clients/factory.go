@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Factories of metrics collector clients
+
+package clients
+
+import (
+	"sync"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-app-cluster-api-go"
+)
+
+// CollectorClientFactory provides the metrics collector client of an app
+// cluster address. Clients are shared and must not be closed by their users.
+type CollectorClientFactory interface {
+	Get(address string) (grpc_app_cluster_api_go.MetricsCollectorClient, derrors.Error)
+}
+
+// MemoryClientFactory returns clients registered in memory, for tests
+type MemoryClientFactory struct {
+	lock    sync.Mutex
+	clients map[string]grpc_app_cluster_api_go.MetricsCollectorClient
+}
+
+// NewMemoryClientFactory creates a factory without clients
+func NewMemoryClientFactory() *MemoryClientFactory {
+	return &MemoryClientFactory{clients: make(map[string]grpc_app_cluster_api_go.MetricsCollectorClient)}
+}
+
+// Add registers the client of an address
+func (f *MemoryClientFactory) Add(address string, client grpc_app_cluster_api_go.MetricsCollectorClient) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.clients[address] = client
+}
+
+func (f *MemoryClientFactory) Get(address string) (grpc_app_cluster_api_go.MetricsCollectorClient, derrors.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	client, found := f.clients[address]
+	if !found {
+		return nil, derrors.NewUnavailableError("no client for address").WithParams(address)
+	}
+	return client, nil
+}
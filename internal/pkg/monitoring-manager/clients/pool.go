@@ -0,0 +1,176 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Pool of app cluster clients, shared by all the requests to a cluster
+
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultIdleTimeout is the time an unused connection is kept open
+	DefaultIdleTimeout = 10 * time.Minute
+	// DefaultKeepalive is the time between pings on active connections.
+	// app-cluster-api uses the gRPC default enforcement policy, which
+	// closes connections pinging more often than every 5 minutes.
+	DefaultKeepalive = 5 * time.Minute
+	// Time to wait for a ping response before closing the connection
+	keepaliveTimeout = 20 * time.Second
+)
+
+// pooledClient is a client with the last time it was requested
+type pooledClient struct {
+	client   *MetricsCollectorClient
+	lastUsed time.Time
+}
+
+// ClientPool keeps a MetricsCollectorClient per address, so requests to a
+// cluster share a connection instead of dialing a new one every time.
+// Connections are checked with keepalive pings, closed after being idle
+// for a while and reconnected without backoff when they are failing.
+// Clients of the pool must not be closed by their users.
+type ClientPool struct {
+	params      *AppClusterConnectParams
+	idleTimeout time.Duration
+	options     []grpc.DialOption
+	// dial creates the client of an address
+	dial func(address string, params *AppClusterConnectParams, options ...grpc.DialOption) (*MetricsCollectorClient, derrors.Error)
+
+	lock    sync.Mutex
+	clients map[string]*pooledClient
+}
+
+// NewClientPool creates a pool of clients connecting with the given parameters
+func NewClientPool(params *AppClusterConnectParams, idleTimeout time.Duration, keepaliveTime time.Duration) *ClientPool {
+	return &ClientPool{
+		params:      params,
+		idleTimeout: idleTimeout,
+		options: []grpc.DialOption{grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    keepaliveTime,
+			Timeout: keepaliveTimeout,
+		})},
+		dial:    NewMetricsCollectorClient,
+		clients: make(map[string]*pooledClient),
+	}
+}
+
+// Get returns the client of an address, dialing it if there is none
+func (p *ClientPool) Get(address string) (grpc_app_cluster_api_go.MetricsCollectorClient, derrors.Error) {
+	if client := p.pooled(address); client != nil {
+		return client, nil
+	}
+
+	// Dial without holding the lock, so requests to other clusters
+	// are not blocked
+	client, derr := p.dial(address, p.params, p.options...)
+	if derr != nil {
+		return nil, derr
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pooled, found := p.clients[address]; found && pooled.client.conn.GetState() != connectivity.Shutdown {
+		// Dialed concurrently by another request
+		_ = client.Close()
+		pooled.lastUsed = time.Now()
+		return pooled.client, nil
+	}
+	p.clients[address] = &pooledClient{client: client, lastUsed: time.Now()}
+	return client, nil
+}
+
+// pooled returns the pooled client of an address, or nil if there is no
+// open one. A failing connection is kept, as other requests may be using
+// it, but it reconnects without waiting for its backoff.
+func (p *ClientPool) pooled(address string) *MetricsCollectorClient {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pooled, found := p.clients[address]
+	if !found {
+		return nil
+	}
+	switch state := pooled.client.conn.GetState(); state {
+	case connectivity.Shutdown:
+		delete(p.clients, address)
+		return nil
+	case connectivity.TransientFailure:
+		log.Debug().Str("address", address).Str("state", state.String()).Msg("reconnecting app cluster client")
+		pooled.client.conn.ResetConnectBackoff()
+	}
+	pooled.lastUsed = time.Now()
+	return pooled.client
+}
+
+// Run closes idle connections until the context is done
+func (p *ClientPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.evictIdle(now)
+		}
+	}
+}
+
+// evictIdle closes the connections not used since idleTimeout before now
+func (p *ClientPool) evictIdle(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for address, pooled := range p.clients {
+		if now.Sub(pooled.lastUsed) >= p.idleTimeout {
+			log.Debug().Str("address", address).Msg("closing idle app cluster client")
+			_ = pooled.client.Close()
+			delete(p.clients, address)
+		}
+	}
+}
+
+// Size returns the number of pooled clients
+func (p *ClientPool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.clients)
+}
+
+// Close closes every connection of the pool
+func (p *ClientPool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var lastErr error
+	for address, pooled := range p.clients {
+		if err := pooled.client.Close(); err != nil {
+			lastErr = err
+		}
+		delete(p.clients, address)
+	}
+	return lastErr
+}
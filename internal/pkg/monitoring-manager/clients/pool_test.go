@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Client pool tests
+
+package clients
+
+import (
+	"context"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var _ = ginkgo.Describe("client pool", func() {
+
+	var pool *ClientPool
+
+	ginkgo.BeforeEach(func() {
+		// Connections are not established until used
+		params := &AppClusterConnectParams{AppClusterPort: 1}
+		pool = NewClientPool(params, time.Minute, DefaultKeepalive)
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = pool.Close()
+	})
+
+	ginkgo.It("should share the client of an address", func() {
+		first, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+		second, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(second).To(gomega.BeIdenticalTo(first))
+
+		other, derr := pool.Get("127.0.0.1")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(other).ToNot(gomega.BeIdenticalTo(first))
+		gomega.Expect(pool.Size()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should redial closed connections", func() {
+		first, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(first.(*MetricsCollectorClient).Close()).To(gomega.Succeed())
+
+		second, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(second).ToNot(gomega.BeIdenticalTo(first))
+		gomega.Expect(pool.Size()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should keep failing connections open", func() {
+		first, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		// Nothing listens on the port, so a request makes the connection fail
+		conn := first.(*MetricsCollectorClient).conn
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		for state := conn.GetState(); state != connectivity.TransientFailure; state = conn.GetState() {
+			gomega.Expect(conn.WaitForStateChange(ctx, state)).To(gomega.BeTrue())
+		}
+
+		second, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(second).To(gomega.BeIdenticalTo(first))
+		gomega.Expect(conn.GetState()).ToNot(gomega.Equal(connectivity.Shutdown))
+	})
+
+	ginkgo.It("should close idle connections", func() {
+		_, derr := pool.Get("localhost")
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		pool.evictIdle(time.Now())
+		gomega.Expect(pool.Size()).To(gomega.Equal(1))
+		pool.evictIdle(time.Now().Add(time.Minute))
+		gomega.Expect(pool.Size()).To(gomega.Equal(0))
+	})
+})
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Aggregation of container stats at the levels selected by the request
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-organization-go"
+)
+
+// defaultAggregationLevels group the stats by service instance if the request selects no level
+var defaultAggregationLevels = []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE}
+
+// hierarchyRanks orders the levels of the application hierarchy, from the finest to the coarsest.
+// Clusters are orthogonal to it.
+var hierarchyRanks = map[grpc_monitoring_go.AggregationLevel]int{
+	grpc_monitoring_go.AggregationLevel_CONTAINER:              0,
+	grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE:       1,
+	grpc_monitoring_go.AggregationLevel_SERVICE_GROUP_INSTANCE: 2,
+	grpc_monitoring_go.AggregationLevel_APP_INSTANCE:           3,
+	grpc_monitoring_go.AggregationLevel_ORGANIZATION:           4,
+}
+
+// aggregation groups container stats by a combination of levels: the finest level of the application
+// hierarchy selected, and the cluster if selected. A service instance also identifies its service group
+// and app instances, so combining levels of the hierarchy is the same as selecting the finest one.
+// Containers are told apart by their cluster.
+type aggregation struct {
+	rank      int
+	byCluster bool
+}
+
+// newAggregation creates the aggregation of the given levels, or of the default ones if none
+func newAggregation(levels []grpc_monitoring_go.AggregationLevel) aggregation {
+	if len(levels) == 0 {
+		levels = defaultAggregationLevels
+	}
+	result := aggregation{rank: hierarchyRanks[grpc_monitoring_go.AggregationLevel_ORGANIZATION]}
+	for _, level := range levels {
+		if level == grpc_monitoring_go.AggregationLevel_CLUSTER {
+			result.byCluster = true
+		} else if rank, found := hierarchyRanks[level]; found && rank < result.rank {
+			result.rank = rank
+		}
+	}
+	if result.rank == hierarchyRanks[grpc_monitoring_go.AggregationLevel_CONTAINER] {
+		result.byCluster = true
+	}
+	return result
+}
+
+// includes checks whether the groups are identified by a level of the hierarchy
+func (a aggregation) includes(level grpc_monitoring_go.AggregationLevel) bool {
+	return a.rank <= hierarchyRanks[level]
+}
+
+// key identifies the group of a container of a cluster
+func (a aggregation) key(cluster *grpc_infrastructure_go.Cluster, containerStats *grpc_monitoring_go.ContainerStats) string {
+	parts := make([]string, 0, 4)
+	if a.byCluster {
+		parts = append(parts, cluster.ClusterId)
+	}
+	switch {
+	case a.includes(grpc_monitoring_go.AggregationLevel_CONTAINER):
+		parts = append(parts, containerStats.Namespace, containerStats.Pod, containerStats.Container)
+	case a.includes(grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE):
+		parts = append(parts, containerStats.ServiceInstanceId)
+	case a.includes(grpc_monitoring_go.AggregationLevel_SERVICE_GROUP_INSTANCE):
+		parts = append(parts, containerStats.ServiceGroupInstanceId)
+	case a.includes(grpc_monitoring_go.AggregationLevel_APP_INSTANCE):
+		parts = append(parts, containerStats.AppInstanceId)
+	}
+	return strings.Join(parts, "/")
+}
+
+// newGroup creates the empty stats of the group of a container, with the fields that identify it
+func (a aggregation) newGroup(organization *grpc_organization_go.Organization, cluster *grpc_infrastructure_go.Cluster, containerStats *grpc_monitoring_go.ContainerStats) *grpc_monitoring_go.OrganizationApplicationStats {
+	stats := &grpc_monitoring_go.OrganizationApplicationStats{
+		OrganizationId:   organization.OrganizationId,
+		OrganizationName: organization.Name,
+	}
+	if a.byCluster {
+		stats.ClusterId = cluster.ClusterId
+		stats.ClusterName = cluster.Name
+	}
+	if a.includes(grpc_monitoring_go.AggregationLevel_APP_INSTANCE) {
+		stats.AppInstanceId = containerStats.AppInstanceId
+		stats.AppInstanceName = containerStats.AppInstanceName
+	}
+	if a.includes(grpc_monitoring_go.AggregationLevel_SERVICE_GROUP_INSTANCE) {
+		stats.ServiceGroupInstanceId = containerStats.ServiceGroupInstanceId
+		stats.ServiceGroupInstanceName = containerStats.ServiceGroupInstanceName
+	}
+	if a.includes(grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE) {
+		stats.ServiceInstanceId = containerStats.ServiceInstanceId
+		stats.ServiceInstanceName = containerStats.ServiceInstanceName
+	}
+	if a.includes(grpc_monitoring_go.AggregationLevel_CONTAINER) {
+		stats.Namespace = containerStats.Namespace
+		stats.Pod = containerStats.Pod
+		stats.Container = containerStats.Container
+	}
+	return stats
+}
+
+// aggregateStats adds up the container stats of every cluster of an organization by the given levels.
+// Every level adds up the same container stats, so the sums and counts of the groups of a level add up
+// to those of any coarser level. Groups are sorted by the ids that identify them.
+func aggregateStats(organization *grpc_organization_go.Organization, clustersStats []*clusterContainerStats, levels []grpc_monitoring_go.AggregationLevel) []*grpc_monitoring_go.OrganizationApplicationStats {
+	aggregation := newAggregation(levels)
+	statsByKey := make(map[string]*grpc_monitoring_go.OrganizationApplicationStats, 0)
+	usageByKey := make(map[string]*resourceUsage, 0)
+	for _, clusterStats := range clustersStats {
+		for _, containerStats := range clusterStats.containerStats {
+			key := aggregation.key(clusterStats.cluster, containerStats)
+			stats, found := statsByKey[key]
+			if !found {
+				stats = aggregation.newGroup(organization, clusterStats.cluster, containerStats)
+				statsByKey[key] = stats
+				usageByKey[key] = &resourceUsage{}
+			}
+			addContainerStats(stats, containerStats)
+			usageByKey[key].add(containerStats)
+		}
+	}
+
+	keys := make([]string, 0, len(statsByKey))
+	for key := range statsByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	groupStats := make([]*grpc_monitoring_go.OrganizationApplicationStats, 0, len(keys))
+	for _, key := range keys {
+		usageByKey[key].setUtilization(statsByKey[key])
+		groupStats = append(groupStats, statsByKey[key])
+	}
+	return groupStats
+}
+
+// addContainerStats adds the stats of a container to those of its group
+func addContainerStats(stats *grpc_monitoring_go.OrganizationApplicationStats, containerStats *grpc_monitoring_go.ContainerStats) {
+	stats.ContainerCount++
+	stats.RestartCount += containerStats.RestartCount
+	stats.CpuMillicore += containerStats.CpuMillicore
+	stats.MemoryByte += containerStats.MemoryByte
+	stats.StorageByte += containerStats.StorageByte
+	stats.NetworkReceiveBytePerSec += containerStats.NetworkReceiveBytePerSec
+	stats.NetworkTransmitBytePerSec += containerStats.NetworkTransmitBytePerSec
+	stats.NetworkReceiveDropPerSec += containerStats.NetworkReceiveDropPerSec
+	stats.NetworkTransmitDropPerSec += containerStats.NetworkTransmitDropPerSec
+	stats.CpuRequestMillicore += containerStats.CpuRequestMillicore
+	stats.CpuLimitMillicore += containerStats.CpuLimitMillicore
+	stats.MemoryRequestByte += containerStats.MemoryRequestByte
+	stats.MemoryLimitByte += containerStats.MemoryLimitByte
+}
+
+// resourceUsage accumulates the usage of a group of containers with respect to
+// their requests and limits. The utilization of the group is the usage of the
+// containers that have a request (or limit) divided by the sum of those
+// requests (or limits). As each container reports usage / reference, we
+// recover its usage by multiplying with the reference, without having to know
+// the units the usage itself was reported in.
+type resourceUsage struct {
+	cpuRequestUsage    float64
+	cpuLimitUsage      float64
+	memoryRequestUsage float64
+	memoryLimitUsage   float64
+}
+
+func (u *resourceUsage) add(stats *grpc_monitoring_go.ContainerStats) {
+	u.cpuRequestUsage += stats.CpuRequestUtilization * stats.CpuRequestMillicore
+	u.cpuLimitUsage += stats.CpuLimitUtilization * stats.CpuLimitMillicore
+	u.memoryRequestUsage += stats.MemoryRequestUtilization * stats.MemoryRequestByte
+	u.memoryLimitUsage += stats.MemoryLimitUtilization * stats.MemoryLimitByte
+}
+
+func (u *resourceUsage) setUtilization(stats *grpc_monitoring_go.OrganizationApplicationStats) {
+	stats.CpuRequestUtilization = utilization(u.cpuRequestUsage, stats.CpuRequestMillicore)
+	stats.CpuLimitUtilization = utilization(u.cpuLimitUsage, stats.CpuLimitMillicore)
+	stats.MemoryRequestUtilization = utilization(u.memoryRequestUsage, stats.MemoryRequestByte)
+	stats.MemoryLimitUtilization = utilization(u.memoryLimitUsage, stats.MemoryLimitByte)
+}
+
+func utilization(usage float64, reference float64) float64 {
+	if reference <= 0 {
+		return 0
+	}
+	return usage / reference
+}
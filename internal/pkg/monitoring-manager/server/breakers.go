@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Prometheus metrics with the state of the circuit breakers of the clusters
+
+package server
+
+import (
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	breakerStateDesc = prometheus.NewDesc(
+		"monitoring_manager_cluster_breaker_state",
+		"State of the circuit breaker of an application cluster: 0 closed, 1 half-open, 2 open. Open clusters are skipped.",
+		[]string{"cluster_id"}, nil)
+	breakerFailuresDesc = prometheus.NewDesc(
+		"monitoring_manager_cluster_breaker_consecutive_failures",
+		"Consecutive failed requests to an application cluster.",
+		[]string{"cluster_id"}, nil)
+	breakerOpenedDesc = prometheus.NewDesc(
+		"monitoring_manager_cluster_breaker_opened_timestamp_seconds",
+		"Last time the circuit breaker of an application cluster opened.",
+		[]string{"cluster_id"}, nil)
+)
+
+// breakerCollector exposes the state of the cluster breakers when scraped
+type breakerCollector struct {
+	breakers *breaker.Registry
+}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+	ch <- breakerFailuresDesc
+	ch <- breakerOpenedDesc
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.breakers.Statuses() {
+		ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, float64(status.State), status.Name)
+		ch <- prometheus.MustNewConstMetric(breakerFailuresDesc, prometheus.GaugeValue, float64(status.ConsecutiveFailures), status.Name)
+		if !status.OpenedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(breakerOpenedDesc, prometheus.GaugeValue, float64(status.OpenedAt.UnixNano())/1e9, status.Name)
+		}
+	}
+}
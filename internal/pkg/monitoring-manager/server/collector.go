@@ -0,0 +1,288 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Background collection of the container stats of every cluster
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultCollectionParallelism is the number of clusters collected at once
+	DefaultCollectionParallelism = 8
+	// Snapshots are served for this many collection intervals, so a single
+	// failed collection doesn't drop the stats of a cluster
+	snapshotIntervals = 2
+)
+
+// clusterSnapshot holds the latest collection of a cluster
+type clusterSnapshot struct {
+	cluster *grpc_infrastructure_go.Cluster
+	// Container stats of the latest successful collection, and its time
+	containerStats []*grpc_monitoring_go.ContainerStats
+	collectedAt    time.Time
+	// Status of the latest collection
+	status *grpc_monitoring_go.ClusterQueryStatus
+}
+
+// organizationSnapshot holds the latest collections of the clusters of an organization
+type organizationSnapshot struct {
+	organization *grpc_organization_go.Organization
+	// Clusters in the order of the directory
+	clusterIds []string
+	clusters   map[string]*clusterSnapshot
+}
+
+// SnapshotStore keeps the latest container stats collected from every
+// cluster, so requests are answered without querying the clusters.
+type SnapshotStore struct {
+	// Time the stats of a successful collection are served
+	maxAge time.Duration
+	now    func() time.Time
+
+	lock          sync.Mutex
+	organizations map[string]*organizationSnapshot
+}
+
+// NewSnapshotStore creates an empty store serving collections for up to maxAge
+func NewSnapshotStore(maxAge time.Duration) *SnapshotStore {
+	return &SnapshotStore{
+		maxAge:        maxAge,
+		now:           time.Now,
+		organizations: make(map[string]*organizationSnapshot),
+	}
+}
+
+// setClusters sets the clusters of an organization, removing the snapshots of clusters it no longer has
+func (s *SnapshotStore) setClusters(organization *grpc_organization_go.Organization, clusters []*grpc_infrastructure_go.Cluster) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous := s.organizations[organization.OrganizationId]
+	snapshot := &organizationSnapshot{
+		organization: organization,
+		clusterIds:   make([]string, 0, len(clusters)),
+		clusters:     make(map[string]*clusterSnapshot, len(clusters)),
+	}
+	for _, cluster := range clusters {
+		snapshot.clusterIds = append(snapshot.clusterIds, cluster.ClusterId)
+		if previous != nil && previous.clusters[cluster.ClusterId] != nil {
+			clusterSnapshot := *previous.clusters[cluster.ClusterId]
+			clusterSnapshot.cluster = cluster
+			snapshot.clusters[cluster.ClusterId] = &clusterSnapshot
+		}
+	}
+	s.organizations[organization.OrganizationId] = snapshot
+}
+
+// removeOrganizationsExcept removes the snapshots of the organizations that no longer exist
+func (s *SnapshotStore) removeOrganizationsExcept(organizations []*grpc_organization_go.Organization) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing := make(map[string]bool, len(organizations))
+	for _, organization := range organizations {
+		existing[organization.OrganizationId] = true
+	}
+	for organizationId := range s.organizations {
+		if !existing[organizationId] {
+			delete(s.organizations, organizationId)
+		}
+	}
+}
+
+// update stores the result of the collection of a cluster. The stats of a failed collection are kept.
+func (s *SnapshotStore) update(stats *clusterContainerStats, collectedAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	organization, found := s.organizations[stats.cluster.OrganizationId]
+	if !found {
+		return
+	}
+	snapshot, found := organization.clusters[stats.cluster.ClusterId]
+	if !found {
+		snapshot = &clusterSnapshot{cluster: stats.cluster}
+		organization.clusters[stats.cluster.ClusterId] = snapshot
+	}
+	snapshot.status = stats.status
+	if !stats.status.Failed && !stats.status.Skipped {
+		snapshot.containerStats = stats.containerStats
+		snapshot.collectedAt = collectedAt
+	}
+}
+
+// organizationStats returns the latest container stats of every cluster of an organization, only for the
+// given app instances if any. Clusters are reported as queried, with the time of their collection, while
+// their stats are recent enough; otherwise with the status of their latest collection, as failed if that
+// collection succeeded but is older than maxAge. It returns false if the organization has not been
+// collected yet.
+func (s *SnapshotStore) organizationStats(organizationId string, appInstanceIds []string) (*grpc_organization_go.Organization, []*clusterContainerStats, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	organization, found := s.organizations[organizationId]
+	if !found {
+		return nil, nil, false
+	}
+
+	now := s.now()
+	clustersStats := make([]*clusterContainerStats, 0, len(organization.clusterIds))
+	for _, clusterId := range organization.clusterIds {
+		snapshot, found := organization.clusters[clusterId]
+		if !found {
+			// Not collected yet, the organization is answered live
+			return nil, nil, false
+		}
+		stats := &clusterContainerStats{cluster: snapshot.cluster, status: snapshot.status}
+		if !snapshot.collectedAt.IsZero() && now.Sub(snapshot.collectedAt) <= s.maxAge {
+			stats.status = &grpc_monitoring_go.ClusterQueryStatus{
+				ClusterId:   snapshot.cluster.ClusterId,
+				ClusterName: snapshot.cluster.Name,
+				Timestamp:   snapshot.collectedAt.UnixNano() / 1000000,
+			}
+			stats.containerStats = filterContainerStats(snapshot.containerStats, appInstanceIds)
+		} else if !snapshot.status.Failed && !snapshot.status.Skipped {
+			// The collection of the cluster is not running, don't report it as queried without stats
+			stats.status = &grpc_monitoring_go.ClusterQueryStatus{
+				ClusterId:   snapshot.cluster.ClusterId,
+				ClusterName: snapshot.cluster.Name,
+				Failed:      true,
+				Error:       fmt.Sprintf("snapshot older than maxAge (%s)", s.maxAge),
+			}
+		}
+		clustersStats = append(clustersStats, stats)
+	}
+	return organization.organization, clustersStats, true
+}
+
+// Collector periodically collects the container stats of every cluster of
+// every organization into a snapshot store. Each round starts the
+// collections of the clusters at random times within the jitter, so they
+// are not all queried at once, and runs a limited number of them at a time.
+type Collector struct {
+	manager     *Manager
+	store       *SnapshotStore
+	interval    time.Duration
+	parallelism int
+	jitter      time.Duration
+}
+
+// NewCollector creates a collector storing in the snapshot store of a manager
+func NewCollector(manager *Manager, interval time.Duration, parallelism int, jitter time.Duration) *Collector {
+	return &Collector{
+		manager:     manager,
+		store:       manager.snapshots,
+		interval:    interval,
+		parallelism: parallelism,
+		jitter:      jitter,
+	}
+}
+
+// Run collects every interval until the context is cancelled
+func (c *Collector) Run(ctx context.Context) {
+	for {
+		start := time.Now()
+		c.collect(ctx)
+		log.Debug().Str("duration", time.Since(start).String()).Msg("collected container stats of every cluster")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// collect runs a collection round of every cluster
+func (c *Collector) collect(ctx context.Context) {
+	listCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	organizations, derr := c.manager.directory.ListOrganizations(listCtx)
+	cancel()
+	if derr != nil {
+		log.Error().Str("err", derr.DebugReport()).Err(derr).Msg("could not list organizations to collect")
+		return
+	}
+	c.store.removeOrganizationsExcept(organizations)
+
+	slots := make(chan struct{}, c.parallelism)
+	var collections sync.WaitGroup
+	for _, organization := range organizations {
+		listCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+		clusterList, derr := c.manager.directory.ListClusters(listCtx, organization.OrganizationId)
+		cancel()
+		if derr != nil {
+			log.Error().Str("organizationId", organization.OrganizationId).Str("err", derr.DebugReport()).Err(derr).
+				Msg("could not list clusters to collect")
+			continue
+		}
+		c.store.setClusters(organization, clusterList.Clusters)
+
+		for _, cluster := range clusterList.Clusters {
+			collections.Add(1)
+			go func(cluster *grpc_infrastructure_go.Cluster) {
+				defer collections.Done()
+				if !c.wait(ctx, slots) {
+					return
+				}
+				defer func() { <-slots }()
+				c.collectCluster(ctx, cluster)
+			}(cluster)
+		}
+	}
+	collections.Wait()
+}
+
+// wait waits a random time within the jitter and then for a free slot. It returns false if the context is
+// cancelled before.
+func (c *Collector) wait(ctx context.Context, slots chan struct{}) bool {
+	if c.jitter > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Duration(rand.Int63n(int64(c.jitter)))):
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case slots <- struct{}{}:
+		return true
+	}
+}
+
+// collectCluster collects the container stats of every app instance of a cluster
+func (c *Collector) collectCluster(ctx context.Context, cluster *grpc_infrastructure_go.Cluster) {
+	statsFuture := make(chan *clusterContainerStats, 1)
+	c.manager.getClusterContainerStats(cluster, nil, ctx, statsFuture)
+	stats := <-statsFuture
+	if ctx.Err() != nil {
+		// Shutting down, keep the previous collection
+		return
+	}
+	c.store.update(stats, c.store.now())
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Background collection tests
+
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/clients"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("background collection", func() {
+
+	var directory *clients.MemoryDirectory
+	var collectors map[string]*fakeCollector
+	var manager Manager
+	var collector *Collector
+	var now time.Time
+
+	ginkgo.BeforeEach(func() {
+		collectors = map[string]*fakeCollector{
+			"cluster-1": {stats: []*grpc_monitoring_go.ContainerStats{
+				containerStats("app-1", "service-1", 100, 1000),
+				containerStats("app-2", "service-2", 10, 100),
+			}},
+			"cluster-2": {stats: []*grpc_monitoring_go.ContainerStats{
+				containerStats("app-1", "service-3", 100, 2000),
+			}},
+		}
+
+		directory = clients.NewMemoryDirectory()
+		factory := clients.NewMemoryClientFactory()
+		for ix, organizationId := range []string{testOrganizationId, "org-2"} {
+			clusterId := []string{"cluster-1", "cluster-2"}[ix]
+			hostname := clusterId + ".example.com"
+			factory.Add(hostname, collectors[clusterId])
+			directory.AddOrganization(&grpc_organization_go.Organization{OrganizationId: organizationId, Name: organizationId + " name"}, &grpc_infrastructure_go.Cluster{
+				OrganizationId:             organizationId,
+				ClusterId:                  clusterId,
+				Name:                       clusterId + " name",
+				Hostname:                   hostname,
+				MillicoresConversionFactor: 2,
+			})
+		}
+
+		var derr error
+		manager, derr = NewManager(directory, factory, breaker.NewRegistry(10, time.Minute), breaker.Retry{Attempts: 1}, time.Minute)
+		gomega.Expect(derr).To(gomega.Succeed())
+		manager.clusterTimeout = 200 * time.Millisecond
+
+		now = time.Unix(1500000000, 0)
+		manager.snapshots = NewSnapshotStore(time.Minute)
+		manager.snapshots.now = func() time.Time { return now }
+		collector = NewCollector(&manager, time.Minute, 1, 0)
+	})
+
+	getStats := func(organizationId string) *grpc_monitoring_go.OrganizationApplicationStatsResponse {
+		response, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+			OrganizationId: organizationId,
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		return response
+	}
+
+	ginkgo.It("should answer from the collected snapshots", func() {
+		collector.collect(context.Background())
+		gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+		gomega.Expect(atomic.LoadInt32(&collectors["cluster-2"].calls)).To(gomega.Equal(int32(1)))
+
+		response := getStats(testOrganizationId)
+		stats := statsByServiceInstance(response)
+		gomega.Expect(stats).To(gomega.HaveLen(2))
+		gomega.Expect(stats["service-1"].CpuMillicore).To(gomega.Equal(200.0))
+		gomega.Expect(stats["service-1"].OrganizationName).To(gomega.Equal(testOrganizationId + " name"))
+		gomega.Expect(response.Timestamp).To(gomega.Equal(int64(1500000000000)))
+		gomega.Expect(response.Clusters).To(gomega.HaveLen(1))
+		gomega.Expect(response.Clusters[0].Timestamp).To(gomega.Equal(int64(1500000000000)))
+		gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+
+		// Filtered from the snapshot as well
+		response, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+			OrganizationId: testOrganizationId,
+			AppInstanceId:  []string{"app-2"},
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(statsByServiceInstance(response)).To(gomega.HaveLen(1))
+		gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+
+		// A second collection doesn't double the stats
+		collector.collect(context.Background())
+		gomega.Expect(statsByServiceInstance(getStats(testOrganizationId))["service-1"].CpuMillicore).To(gomega.Equal(200.0))
+	})
+
+	ginkgo.It("should query organizations not collected yet", func() {
+		stats := statsByServiceInstance(getStats("org-2"))
+		gomega.Expect(stats).To(gomega.HaveLen(1))
+		gomega.Expect(atomic.LoadInt32(&collectors["cluster-2"].calls)).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("should keep serving the stats of a failed collection for a while", func() {
+		collector.collect(context.Background())
+		collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+		now = now.Add(30 * time.Second)
+		collector.collect(context.Background())
+
+		response := getStats(testOrganizationId)
+		gomega.Expect(statsByServiceInstance(response)).To(gomega.HaveLen(2))
+		gomega.Expect(response.Clusters[0].Failed).To(gomega.BeFalse())
+		gomega.Expect(response.Clusters[0].Timestamp).To(gomega.Equal(int64(1500000000000)))
+
+		now = now.Add(time.Minute)
+		response = getStats(testOrganizationId)
+		gomega.Expect(response.ServiceInstanceStats).To(gomega.BeEmpty())
+		gomega.Expect(response.Clusters[0].Failed).To(gomega.BeTrue())
+		gomega.Expect(response.Clusters[0].Error).To(gomega.ContainSubstring("cluster down"))
+	})
+
+	ginkgo.It("should report clusters as failed when their snapshot is too old", func() {
+		collector.collect(context.Background())
+		now = now.Add(2 * time.Minute)
+
+		response := getStats(testOrganizationId)
+		gomega.Expect(response.ServiceInstanceStats).To(gomega.BeEmpty())
+		gomega.Expect(response.Clusters).To(gomega.HaveLen(1))
+		gomega.Expect(response.Clusters[0].Failed).To(gomega.BeTrue())
+		gomega.Expect(response.Clusters[0].Error).To(gomega.ContainSubstring("snapshot older than maxAge"))
+		gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("should collect until cancelled", func() {
+		collector.interval = 10 * time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			collector.Run(ctx)
+			close(done)
+		}()
+		gomega.Eventually(func() int32 {
+			return atomic.LoadInt32(&collectors["cluster-1"].calls)
+		}).Should(gomega.BeNumerically(">=", 2))
+		cancel()
+		gomega.Eventually(done).Should(gomega.BeClosed())
+	})
+})
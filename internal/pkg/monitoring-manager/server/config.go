@@ -29,6 +29,8 @@ import (
 type Config struct {
 	// GrpcPort where the API service will listen requests.
 	Port int
+	// MetricsPort where the Prometheus metrics of the service are served. Disabled if 0.
+	MetricsPort int
 	// SystemModelAddress is the address with host:port of the system model component.
 	SystemModelAddress string
 	// EdgeInventoryProxyAddress with host:port of the edge inventory proxy.
@@ -45,8 +47,49 @@ type Config struct {
 	CACertPath string
 	// ClientCertPath Client Cert Path.
 	ClientCertPath string
-	// CacheTTL is the default duration for cache entries.
+	// ServerCertPath is the directory with the certificate of the gRPC server. The server uses plain text if empty.
+	ServerCertPath string
+	// ClientCACertPath is the CA that signs the certificates clients must present. Clients are not verified if empty.
+	ClientCACertPath string
+	// AppClusterIdleTimeout is the time unused app cluster connections are kept open.
+	AppClusterIdleTimeout time.Duration
+	// AppClusterKeepalive is the time between pings on active app cluster connections.
+	AppClusterKeepalive time.Duration
+	// ClusterHostnameTTL is the time the hostname of a cluster is cached.
+	ClusterHostnameTTL time.Duration
+	// ClusterBreakerFailures is the number of consecutive failures that stops the requests to a cluster.
+	ClusterBreakerFailures int
+	// ClusterBreakerOpenTimeout is the time requests to a failing cluster are stopped before probing it again.
+	ClusterBreakerOpenTimeout time.Duration
+	// ClusterReadAttempts is the maximum number of attempts of a read from a cluster that can't be reached.
+	ClusterReadAttempts int
+	// CollectionInterval is the time between background collections of the container stats of every cluster.
+	// Stats are only collected on request if 0.
+	CollectionInterval time.Duration
+	// CollectionParallelism is the number of clusters collected at once.
+	CollectionParallelism int
+	// CollectionJitter is the maximum random delay of the collection of each cluster.
+	CollectionJitter time.Duration
+	// UsageStorePath is the file of the usage history store. Usage is not recorded if empty.
+	UsageStorePath string
+	// UsageSampleInterval is the time between samples of the usage of every organization.
+	UsageSampleInterval time.Duration
+	// UsageHourlyRetention is the time usage is kept by hour before it is rolled up by day.
+	UsageHourlyRetention time.Duration
+	// UsageRetention is the time usage is kept.
+	UsageRetention time.Duration
+	// PricingPath is the JSON file with the prices of the resource usage. Costs are not reported if empty.
+	PricingPath string
+	// CacheTTL is the duration of the cached organization application stats.
 	CacheTTL time.Duration
+	// ClusterSummaryCacheTTL is the duration of the cached cluster summaries.
+	ClusterSummaryCacheTTL time.Duration
+	// ClusterStatsCacheTTL is the duration of the cached cluster statistics.
+	ClusterStatsCacheTTL time.Duration
+	// CacheMaxStale is the time expired cache entries are served while they are refreshed.
+	CacheMaxStale time.Duration
+	// ShutdownTimeout is the time given to drain in-flight requests on shutdown.
+	ShutdownTimeout time.Duration
 }
 
 // Validate the configuration.
@@ -54,6 +97,9 @@ func (conf *Config) Validate() derrors.Error {
 	if conf.Port <= 0 {
 		return derrors.NewInvalidArgumentError("port must be specified")
 	}
+	if conf.MetricsPort < 0 {
+		return derrors.NewInvalidArgumentError("metricsPort must not be negative")
+	}
 	if conf.SystemModelAddress == "" {
 		return derrors.NewInvalidArgumentError("systemModelAddress is required")
 	}
@@ -69,6 +115,67 @@ func (conf *Config) Validate() derrors.Error {
 	if conf.ClientCertPath == "" {
 		return derrors.NewInvalidArgumentError("clientCertPath is required")
 	}
+	if conf.ClientCACertPath != "" && conf.ServerCertPath == "" {
+		return derrors.NewInvalidArgumentError("clientCACertPath requires serverCertPath")
+	}
+	if conf.AppClusterIdleTimeout <= 0 {
+		return derrors.NewInvalidArgumentError("appClusterIdleTimeout must be positive")
+	}
+	if conf.AppClusterKeepalive <= 0 {
+		return derrors.NewInvalidArgumentError("appClusterKeepalive must be positive")
+	}
+	if conf.ClusterHostnameTTL <= 0 {
+		return derrors.NewInvalidArgumentError("clusterHostnameTTL must be positive")
+	}
+	if conf.ClusterBreakerFailures <= 0 {
+		return derrors.NewInvalidArgumentError("clusterBreakerFailures must be positive")
+	}
+	if conf.ClusterBreakerOpenTimeout <= 0 {
+		return derrors.NewInvalidArgumentError("clusterBreakerOpenTimeout must be positive")
+	}
+	if conf.ClusterReadAttempts <= 0 {
+		return derrors.NewInvalidArgumentError("clusterReadAttempts must be positive")
+	}
+	if conf.CollectionInterval < 0 {
+		return derrors.NewInvalidArgumentError("collectionInterval must not be negative")
+	}
+	if conf.CollectionInterval > 0 {
+		if conf.CollectionParallelism <= 0 {
+			return derrors.NewInvalidArgumentError("collectionParallelism must be positive")
+		}
+		if conf.CollectionJitter < 0 || conf.CollectionJitter > conf.CollectionInterval {
+			return derrors.NewInvalidArgumentError("collectionJitter must be between 0 and collectionInterval")
+		}
+	}
+	if conf.UsageStorePath != "" {
+		if conf.UsageSampleInterval <= 0 {
+			return derrors.NewInvalidArgumentError("usageSampleInterval must be positive")
+		}
+		if conf.UsageHourlyRetention <= 0 {
+			return derrors.NewInvalidArgumentError("usageHourlyRetention must be positive")
+		}
+		if conf.UsageRetention < conf.UsageHourlyRetention {
+			return derrors.NewInvalidArgumentError("usageRetention must not be shorter than usageHourlyRetention")
+		}
+	}
+	if conf.PricingPath != "" && conf.UsageStorePath == "" {
+		return derrors.NewInvalidArgumentError("pricingPath requires usageStorePath")
+	}
+	if conf.CacheTTL <= 0 {
+		return derrors.NewInvalidArgumentError("cacheTTL must be positive")
+	}
+	if conf.ClusterSummaryCacheTTL <= 0 {
+		return derrors.NewInvalidArgumentError("clusterSummaryCacheTTL must be positive")
+	}
+	if conf.ClusterStatsCacheTTL <= 0 {
+		return derrors.NewInvalidArgumentError("clusterStatsCacheTTL must be positive")
+	}
+	if conf.CacheMaxStale < 0 {
+		return derrors.NewInvalidArgumentError("cacheMaxStale must not be negative")
+	}
+	if conf.ShutdownTimeout <= 0 {
+		return derrors.NewInvalidArgumentError("shutdownTimeout must be positive")
+	}
 	return nil
 }
 
@@ -76,10 +183,19 @@ func (conf *Config) Validate() derrors.Error {
 func (conf *Config) Print() {
 	log.Info().Str("app", version.AppVersion).Str("commit", version.Commit).Msg("version")
 	log.Info().Int("port", conf.Port).Msg("gRPC port")
+	log.Info().Int("port", conf.MetricsPort).Msg("metrics port")
 	log.Info().Str("URL", conf.SystemModelAddress).Msg("systemModelAddress")
 	log.Info().Str("URL", conf.EdgeInventoryProxyAddress).Msg("edgeInventoryProxyAddress")
 	log.Info().Str("prefix", conf.AppClusterPrefix).Msg("appClusterPrefix")
 	log.Info().Int("port", conf.AppClusterPort).Msg("appClusterPort")
 	log.Info().Bool("tls", conf.UseTLS).Bool("skipServerCertValidation", conf.SkipServerCertValidation).Str("cert", conf.CACertPath).Str("cert", conf.ClientCertPath).Msg("TLS parameters")
+	log.Info().Str("idleTimeout", conf.AppClusterIdleTimeout.String()).Str("keepalive", conf.AppClusterKeepalive.String()).Str("hostnameTTL", conf.ClusterHostnameTTL.String()).Msg("app cluster connections")
+	log.Info().Int("failures", conf.ClusterBreakerFailures).Str("openTimeout", conf.ClusterBreakerOpenTimeout.String()).Int("readAttempts", conf.ClusterReadAttempts).Msg("app cluster circuit breakers")
+	log.Info().Str("cert", conf.ServerCertPath).Str("clientCA", conf.ClientCACertPath).Msg("server TLS parameters")
+	log.Info().Str("timeout", conf.ShutdownTimeout.String()).Msg("shutdown")
+	log.Info().Str("interval", conf.CollectionInterval.String()).Int("parallelism", conf.CollectionParallelism).Str("jitter", conf.CollectionJitter.String()).Msg("background collection")
+	log.Info().Str("path", conf.UsageStorePath).Str("interval", conf.UsageSampleInterval.String()).Str("hourlyRetention", conf.UsageHourlyRetention.String()).Str("retention", conf.UsageRetention.String()).Msg("usage history")
+	log.Info().Str("path", conf.PricingPath).Msg("pricing")
 	log.Info().Dur("CacheTTL", conf.CacheTTL).Msg("selected TTL for the stats cache in milliseconds")
+	log.Info().Str("summaryTTL", conf.ClusterSummaryCacheTTL.String()).Str("statsTTL", conf.ClusterStatsCacheTTL.String()).Str("maxStale", conf.CacheMaxStale.String()).Msg("cluster caches")
 }
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cost allocation reports
+
+package server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/monitoring/internal/pkg/cost"
+)
+
+// GetCostReport prices the resource usage of an organization over a period, by service instance, by service
+// group instance, by app instance and in total. The base cost of the clusters is split by usage share between
+// every app instance, even if the report is restricted to some of them. Usage is kept by hour, so the period
+// is aligned to the hour, for the usage and the base cost alike. Once rolled up, usage is kept by day, and
+// the days of a period are only priced if they start within it. The base cost is charged for the clusters
+// the organization has when the report is requested, over the whole period.
+func (m *Manager) GetCostReport(ctx context.Context, request *grpc_monitoring_go.CostReportRequest) (*grpc_monitoring_go.CostReport, error) {
+	if m.usageStore == nil || m.pricing == nil {
+		return nil, derrors.NewFailedPreconditionError("cost reports are not enabled")
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	clusterList, derr := m.directory.ListClusters(listCtx, request.OrganizationId)
+	if derr != nil {
+		return nil, derr
+	}
+	clusterIds := make([]string, 0, len(clusterList.Clusters))
+	for _, cluster := range clusterList.Clusters {
+		clusterIds = append(clusterIds, cluster.ClusterId)
+	}
+
+	// The store reports the hours starting within the period
+	from := ceilHour(time.Unix(request.FromTimestamp, 0))
+	to := ceilHour(time.Unix(request.ToTimestamp, 0))
+	totals, derr := m.usageStore.Report(request.OrganizationId, from, to, nil)
+	if derr != nil {
+		return nil, derr
+	}
+	// Base costs are not charged for the future
+	baseTo := to
+	if now := time.Now(); baseTo.After(now) {
+		baseTo = now
+	}
+	hours := 0.0
+	if baseTo.After(from) {
+		hours = baseTo.Sub(from).Hours()
+	}
+	allocation := cost.Allocate(m.pricing, clusterIds, totals, hours)
+
+	report := &grpc_monitoring_go.CostReport{
+		OrganizationId:        request.OrganizationId,
+		FromTimestamp:         from.Unix(),
+		ToTimestamp:           to.Unix(),
+		Currency:              m.pricing.Currency,
+		ServiceInstances:      make([]*grpc_monitoring_go.ResourceCost, 0, len(allocation.ServiceInstances)),
+		ServiceGroupInstances: make([]*grpc_monitoring_go.ResourceCost, 0),
+		AppInstances:          make([]*grpc_monitoring_go.ResourceCost, 0),
+	}
+	selected := make(map[string]bool, len(request.AppInstanceId))
+	for _, appInstanceId := range request.AppInstanceId {
+		selected[appInstanceId] = true
+	}
+	total := &cost.Cost{}
+	serviceGroupInstances := make(map[string]*cost.Cost)
+	// Costs are sorted by app instance
+	var appInstance *cost.Cost
+	for _, serviceInstance := range allocation.ServiceInstances {
+		if len(selected) > 0 && !selected[serviceInstance.AppInstanceId] {
+			continue
+		}
+		report.ServiceInstances = append(report.ServiceInstances, resourceCost(serviceInstance))
+
+		if appInstance == nil || appInstance.AppInstanceId != serviceInstance.AppInstanceId {
+			if appInstance != nil {
+				report.AppInstances = append(report.AppInstances, resourceCost(appInstance))
+			}
+			appInstance = &cost.Cost{
+				AppInstanceId:   serviceInstance.AppInstanceId,
+				AppInstanceName: serviceInstance.AppInstanceName,
+			}
+		}
+		appInstance.Add(serviceInstance)
+
+		groupId := serviceInstance.AppInstanceId + "/" + serviceInstance.ServiceGroupInstanceId
+		serviceGroupInstance, found := serviceGroupInstances[groupId]
+		if !found {
+			serviceGroupInstance = &cost.Cost{
+				AppInstanceId:            serviceInstance.AppInstanceId,
+				AppInstanceName:          serviceInstance.AppInstanceName,
+				ServiceGroupInstanceId:   serviceInstance.ServiceGroupInstanceId,
+				ServiceGroupInstanceName: serviceInstance.ServiceGroupInstanceName,
+			}
+			serviceGroupInstances[groupId] = serviceGroupInstance
+		}
+		serviceGroupInstance.Add(serviceInstance)
+
+		total.Add(serviceInstance)
+	}
+	if appInstance != nil {
+		report.AppInstances = append(report.AppInstances, resourceCost(appInstance))
+	}
+	for _, serviceGroupInstance := range serviceGroupInstances {
+		report.ServiceGroupInstances = append(report.ServiceGroupInstances, resourceCost(serviceGroupInstance))
+	}
+	sort.Slice(report.ServiceGroupInstances, func(i, j int) bool {
+		a, b := report.ServiceGroupInstances[i], report.ServiceGroupInstances[j]
+		if a.AppInstanceId != b.AppInstanceId {
+			return a.AppInstanceId < b.AppInstanceId
+		}
+		return a.ServiceGroupInstanceId < b.ServiceGroupInstanceId
+	})
+	report.Total = resourceCost(total)
+	for _, unallocated := range allocation.Unallocated {
+		report.UnallocatedCost += unallocated
+	}
+
+	return report, nil
+}
+
+// ceilHour returns the start of the first hour not before a time
+func ceilHour(t time.Time) time.Time {
+	hour := t.Truncate(time.Hour)
+	if hour.Before(t) {
+		return hour.Add(time.Hour)
+	}
+	return hour
+}
+
+func resourceCost(c *cost.Cost) *grpc_monitoring_go.ResourceCost {
+	return &grpc_monitoring_go.ResourceCost{
+		AppInstanceId:            c.AppInstanceId,
+		AppInstanceName:          c.AppInstanceName,
+		ServiceGroupInstanceId:   c.ServiceGroupInstanceId,
+		ServiceGroupInstanceName: c.ServiceGroupInstanceName,
+		ServiceInstanceId:        c.ServiceInstanceId,
+		ServiceInstanceName:      c.ServiceInstanceName,
+		CpuCost:                  c.CpuCost,
+		MemoryCost:               c.MemoryCost,
+		StorageCost:              c.StorageCost,
+		BaseCost:                 c.BaseCost,
+		Cost:                     c.Total(),
+	}
+}
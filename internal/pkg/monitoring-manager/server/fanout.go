@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// PromQL queries on all the clusters of an organization
+
+package server
+
+import (
+	"context"
+
+	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/rs/zerolog/log"
+)
+
+// Labels identifying the cluster of every series of a fan-out query
+const (
+	clusterIdLabel   = "cluster_id"
+	clusterNameLabel = "cluster_name"
+	// Prefix of the original values of the cluster labels of a series
+	exportedLabelPrefix = "exported_"
+)
+
+// clusterQueryResult is the result of a query on a single cluster
+type clusterQueryResult struct {
+	cluster  *grpc_infrastructure_go.Cluster
+	response *grpc_monitoring_go.QueryResponse
+	err      error
+	// The breaker of the cluster was open
+	skipped bool
+}
+
+// QueryOrganization runs a query on every cluster of an organization, or on those with all the requested
+// cluster labels, and merges the results. Every series is labelled with the id and name of its cluster.
+// Clusters that fail, or are skipped because their breaker is open, are reported in the response and left out
+// of the result.
+func (m *Manager) QueryOrganization(ctx context.Context, request *grpc_monitoring_go.OrganizationQueryRequest) (*grpc_monitoring_go.OrganizationQueryResponse, error) {
+	_, clusterList, derr := m.getOrganizationClusters(ctx, request.OrganizationId)
+	if derr != nil {
+		return nil, derr
+	}
+
+	resultFutures := make([]chan *clusterQueryResult, 0, len(clusterList.Clusters))
+	for _, cluster := range clusterList.Clusters {
+		if !hasLabels(cluster, request.ClusterLabels) {
+			continue
+		}
+		resultFuture := make(chan *clusterQueryResult, 1)
+		resultFutures = append(resultFutures, resultFuture)
+		go m.queryCluster(cluster, request, ctx, resultFuture)
+	}
+
+	results := make([]*clusterQueryResult, 0, len(resultFutures))
+	for _, resultFuture := range resultFutures {
+		results = append(results, <-resultFuture)
+	}
+	return mergeQueryResults(request.Type, results), nil
+}
+
+// queryCluster runs the query of an organization on one of its clusters
+func (m *Manager) queryCluster(cluster *grpc_infrastructure_go.Cluster, request *grpc_monitoring_go.OrganizationQueryRequest, ctx context.Context, resultFuture chan *clusterQueryResult) {
+	clusterRequest := &grpc_monitoring_go.QueryRequest{
+		OrganizationId: cluster.OrganizationId,
+		ClusterId:      cluster.ClusterId,
+		Type:           request.Type,
+		Query:          request.Query,
+		Range:          request.Range,
+	}
+	result := &clusterQueryResult{cluster: cluster}
+	if m.breakers.Get(cluster.ClusterId).Rejecting() {
+		result.skipped = true
+		resultFuture <- result
+		return
+	}
+	result.err = m.callCluster(ctx, cluster.OrganizationId, cluster.ClusterId, func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error {
+		var err error
+		result.response, err = client.Query(ctx, clusterRequest)
+		return err
+	})
+	if result.err != nil {
+		log.Warn().
+			Str("organizationId", cluster.OrganizationId).
+			Str("clusterId", cluster.ClusterId).
+			Err(result.err).
+			Msg("query failed on cluster. The result will not include this cluster.")
+	}
+	resultFuture <- result
+}
+
+// hasLabels returns whether a cluster has all the given labels
+func hasLabels(cluster *grpc_infrastructure_go.Cluster, labels map[string]string) bool {
+	for name, value := range labels {
+		clusterValue, found := cluster.Labels[name]
+		if !found || clusterValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeQueryResults joins the series of the results of every cluster in a single response. Vectors and
+// matrices keep their type; as scalars and strings can't be labelled, the value of each cluster becomes a
+// sample of a vector.
+func mergeQueryResults(queryType grpc_monitoring_go.QueryType, results []*clusterQueryResult) *grpc_monitoring_go.OrganizationQueryResponse {
+	merged := &grpc_monitoring_go.QueryResponse_PrometheusResponse{
+		ResultType: grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR,
+		Result:     make([]*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue, 0),
+	}
+	// Same query on every cluster, so only misbehaving clusters answer with another type than the first one
+	for _, result := range results {
+		if !result.skipped && result.err == nil {
+			merged.ResultType = mergedResultType(result.response)
+			break
+		}
+	}
+
+	clusters := make([]*grpc_monitoring_go.ClusterQueryStatus, 0, len(results))
+	for _, result := range results {
+		status := &grpc_monitoring_go.ClusterQueryStatus{
+			ClusterId:   result.cluster.ClusterId,
+			ClusterName: result.cluster.Name,
+		}
+		clusters = append(clusters, status)
+		if result.skipped {
+			status.Skipped = true
+			status.Error = "circuit breaker of the cluster is open"
+			continue
+		}
+		if result.err != nil {
+			status.Failed = true
+			status.Error = result.err.Error()
+			continue
+		}
+
+		prometheusResult := result.response.GetPrometheusResult()
+		if resultType := mergedResultType(result.response); resultType != merged.ResultType {
+			status.Failed = true
+			status.Error = "result type " + resultType.String() + " does not match the other clusters"
+			continue
+		}
+		for _, series := range prometheusResult.GetResult() {
+			merged.Result = append(merged.Result, &grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue{
+				Metric: withClusterLabels(series.GetMetric(), result.cluster),
+				Value:  series.GetValue(),
+			})
+		}
+	}
+
+	return &grpc_monitoring_go.OrganizationQueryResponse{
+		Result: &grpc_monitoring_go.QueryResponse{
+			Type:   queryType,
+			Result: &grpc_monitoring_go.QueryResponse_PrometheusResult{PrometheusResult: merged},
+		},
+		Clusters: clusters,
+	}
+}
+
+// mergedResultType is the type a cluster result has once merged
+func mergedResultType(response *grpc_monitoring_go.QueryResponse) grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultType {
+	if response.GetPrometheusResult().GetResultType() == grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX {
+		return grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX
+	}
+	return grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR
+}
+
+// withClusterLabels returns a copy of the labels of a series with those of its cluster. As Prometheus does
+// with target labels, a value the series already has for a cluster label is kept with an "exported_" prefix.
+func withClusterLabels(labels map[string]string, cluster *grpc_infrastructure_go.Cluster) map[string]string {
+	result := make(map[string]string, len(labels)+2)
+	for name, value := range labels {
+		result[name] = value
+	}
+	clusterLabels := map[string]string{
+		clusterIdLabel:   cluster.ClusterId,
+		clusterNameLabel: cluster.Name,
+	}
+	for name, value := range clusterLabels {
+		if exported, found := result[name]; found {
+			result[exportedLabelPrefix+name] = exported
+		}
+		result[name] = value
+	}
+	return result
+}
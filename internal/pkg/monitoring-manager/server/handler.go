@@ -22,27 +22,59 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-monitoring-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/nalej/monitoring/internal/pkg/entities"
-	"github.com/patrickmn/go-cache"
+	"github.com/nalej/monitoring/internal/pkg/refresh"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Response header with the age in seconds of a cached response, like the
+// HTTP Age header. monitoring-api returns it as the Age header.
+const ageHeader = "age"
+
+// CacheConfig has the TTL of the cached responses of each method. Expired
+// responses are served for up to MaxStale while they are refreshed.
+type CacheConfig struct {
+	OrganizationApplicationStatsTTL time.Duration
+	ClusterSummaryTTL               time.Duration
+	ClusterStatsTTL                 time.Duration
+	MaxStale                        time.Duration
+}
+
 type Handler struct {
 	manager Manager
-	cache   *cache.Cache
+	// Cached responses by method
+	statsCache        *refresh.Cache
+	clusterSummaries  *refresh.Cache
+	clusterStatsCache *refresh.Cache
 }
 
-func NewHandler(m Manager, cacheTTL time.Duration) (*Handler, derrors.Error) {
+// NewHandler creates the handler; the loads of its cached responses stop
+// when ctx is cancelled.
+func NewHandler(ctx context.Context, m Manager, cacheConfig CacheConfig) (*Handler, derrors.Error) {
 	return &Handler{
-		manager: m,
-		cache:   cache.New(cacheTTL, cacheTTL*2),
+		manager:           m,
+		statsCache:        refresh.New(ctx, cacheConfig.OrganizationApplicationStatsTTL, cacheConfig.MaxStale, refresh.DefaultLoadTimeout),
+		clusterSummaries:  refresh.New(ctx, cacheConfig.ClusterSummaryTTL, cacheConfig.MaxStale, refresh.DefaultLoadTimeout),
+		clusterStatsCache: refresh.New(ctx, cacheConfig.ClusterStatsTTL, cacheConfig.MaxStale, refresh.DefaultLoadTimeout),
 	}, nil
 }
 
+// setAge reports the age of a cached response in the response headers
+func setAge(ctx context.Context, age time.Duration) {
+	// Only fails outside of a gRPC call, when there is nobody to tell
+	_ = grpc.SetHeader(ctx, metadata.Pairs(ageHeader, strconv.FormatInt(int64(age/time.Second), 10)))
+}
+
 // Retrieve a summary of high level cluster resource availability
 func (h *Handler) GetClusterSummary(ctx context.Context, request *grpc_monitoring_go.ClusterSummaryRequest) (*grpc_monitoring_go.ClusterSummary, error) {
 	log.Debug().
@@ -61,7 +93,10 @@ func (h *Handler) GetClusterSummary(ctx context.Context, request *grpc_monitorin
 		return nil, derr
 	}
 
-	res, err := h.manager.GetClusterSummary(ctx, request)
+	cacheKey := fmt.Sprintf("%s/%s/%d", request.GetOrganizationId(), request.GetClusterId(), request.GetRangeMinutes())
+	res, age, err := h.clusterSummaries.Get(ctx, cacheKey, func(ctx context.Context) (interface{}, error) {
+		return h.manager.GetClusterSummary(ctx, request)
+	})
 	if err != nil {
 		log.Error().
 			Str("err", conversions.ToDerror(err).DebugReport()).
@@ -69,6 +104,36 @@ func (h *Handler) GetClusterSummary(ctx context.Context, request *grpc_monitorin
 			Msg("error retrieving cluster summary")
 		return nil, err
 	}
+	setAge(ctx, age)
+
+	return res.(*grpc_monitoring_go.ClusterSummary), nil
+}
+
+// Retrieve the summary of every cluster of an organization, and their totals
+func (h *Handler) GetOrganizationClusterSummary(ctx context.Context, request *grpc_monitoring_go.OrganizationClusterSummaryRequest) (*grpc_monitoring_go.OrganizationClusterSummary, error) {
+	log.Debug().
+		Str("organization_id", request.GetOrganizationId()).
+		Int32("avg", request.GetRangeMinutes()).
+		Msg("received organization cluster summary request")
+
+	// Validate
+	derr := entities.ValidateOrganizationClusterSummaryRequest(request)
+	if derr != nil {
+		log.Error().
+			Str("err", derr.DebugReport()).
+			Err(derr).
+			Msg("invalid request")
+		return nil, derr
+	}
+
+	res, err := h.manager.GetOrganizationClusterSummary(ctx, request)
+	if err != nil {
+		log.Error().
+			Str("err", conversions.ToDerror(err).DebugReport()).
+			Err(err).
+			Msg("error retrieving organization cluster summary")
+		return nil, err
+	}
 
 	return res, nil
 }
@@ -91,7 +156,9 @@ func (h *Handler) GetClusterStats(ctx context.Context, request *grpc_monitoring_
 		return nil, derr
 	}
 
-	res, err := h.manager.GetClusterStats(ctx, request)
+	res, age, err := h.clusterStatsCache.Get(ctx, clusterStatsCacheKey(request), func(ctx context.Context) (interface{}, error) {
+		return h.manager.GetClusterStats(ctx, request)
+	})
 	if err != nil {
 		log.Error().
 			Str("err", conversions.ToDerror(err).DebugReport()).
@@ -99,8 +166,19 @@ func (h *Handler) GetClusterStats(ctx context.Context, request *grpc_monitoring_
 			Msg("error retrieving cluster statistics")
 		return nil, err
 	}
+	setAge(ctx, age)
 
-	return res, nil
+	return res.(*grpc_monitoring_go.ClusterStats), nil
+}
+
+// clusterStatsCacheKey identifies the statistics of a cluster, restricted to some fields
+func clusterStatsCacheKey(request *grpc_monitoring_go.ClusterStatsRequest) string {
+	fields := make([]string, 0, len(request.GetFields()))
+	for _, field := range request.GetFields() {
+		fields = append(fields, field.String())
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("%s/%s/%d/%s", request.GetOrganizationId(), request.GetClusterId(), request.GetRangeMinutes(), strings.Join(fields, ","))
 }
 
 // Execute a query directly on the monitoring storage backend
@@ -135,6 +213,38 @@ func (h *Handler) Query(ctx context.Context, request *grpc_monitoring_go.QueryRe
 	return res, nil
 }
 
+// Execute a query on every cluster of an organization, or on those with the requested labels
+func (h *Handler) QueryOrganization(ctx context.Context, request *grpc_monitoring_go.OrganizationQueryRequest) (*grpc_monitoring_go.OrganizationQueryResponse, error) {
+	log.Debug().
+		Str("organization_id", request.GetOrganizationId()).
+		Interface("cluster_labels", request.GetClusterLabels()).
+		Str("type", request.GetType().String()).
+		Str("query", request.GetQuery()).
+		Msg("received organization query request")
+
+	// Validate
+	derr := entities.ValidateOrganizationQueryRequest(request)
+	if derr != nil {
+		log.Error().
+			Str("err", derr.DebugReport()).
+			Err(derr).
+			Msg("invalid request")
+		return nil, derr
+	}
+
+	// Execute
+	res, err := h.manager.QueryOrganization(ctx, request)
+	if err != nil {
+		log.Error().
+			Str("err", conversions.ToDerror(err).DebugReport()).
+			Err(err).
+			Msg("error executing organization query")
+		return nil, err
+	}
+
+	return res, nil
+}
+
 func (h *Handler) GetOrganizationApplicationStats(ctx context.Context, request *grpc_monitoring_go.OrganizationApplicationStatsRequest) (*grpc_monitoring_go.OrganizationApplicationStatsResponse, error) {
 	log.Debug().
 		Interface("request", request).
@@ -149,22 +259,119 @@ func (h *Handler) GetOrganizationApplicationStats(ctx context.Context, request *
 			Msg("invalid request")
 		return nil, derr
 	}
-	// Execute
-	cacheKey := "GetOrganizationApplicationStats" + request.OrganizationId
-	response, found := h.cache.Get(cacheKey)
-	if !found {
-		log.Debug().Interface("request", request).Msg("cache miss")
-		res, err := h.manager.GetOrganizationApplicationStats(ctx, request)
-		if err != nil {
-			log.Error().
-				Str("err", conversions.ToDerror(err).DebugReport()).
-				Err(err).
-				Msg("error executing GetOrganizationApplicationStats")
-			return nil, err
-		}
-		h.cache.SetDefault(cacheKey, res)
-		response = res
+	// Execute. Identical requests share the cached response, refreshed in the background.
+	response, age, err := h.statsCache.Get(ctx, organizationApplicationStatsCacheKey(request), func(ctx context.Context) (interface{}, error) {
+		log.Debug().Interface("request", request).Msg("loading organization application stats")
+		return h.manager.GetOrganizationApplicationStats(ctx, request)
+	})
+	if err != nil {
+		log.Error().
+			Str("err", conversions.ToDerror(err).DebugReport()).
+			Err(err).
+			Msg("error executing GetOrganizationApplicationStats")
+		return nil, err
 	}
+	setAge(ctx, age)
 
 	return response.(*grpc_monitoring_go.OrganizationApplicationStatsResponse), nil
 }
+
+// organizationApplicationStatsCacheKey identifies the stats of an organization, restricted to some app instances
+// and aggregated by some levels
+func organizationApplicationStatsCacheKey(request *grpc_monitoring_go.OrganizationApplicationStatsRequest) string {
+	appInstanceIds := append([]string(nil), request.AppInstanceId...)
+	sort.Strings(appInstanceIds)
+	levels := make([]string, 0, len(request.GroupBy))
+	for _, level := range request.GroupBy {
+		levels = append(levels, level.String())
+	}
+	sort.Strings(levels)
+	return request.OrganizationId + "/" + strings.Join(appInstanceIds, ",") + "/" + strings.Join(levels, ",")
+}
+
+// ListUnhealthyServiceInstances retrieves the service instances of an organization with failing containers
+func (h *Handler) ListUnhealthyServiceInstances(ctx context.Context, request *grpc_monitoring_go.OrganizationApplicationStatsRequest) (*grpc_monitoring_go.UnhealthyServiceInstanceList, error) {
+	log.Debug().
+		Interface("request", request).
+		Msg("received ListUnhealthyServiceInstances request")
+
+	// Validate
+	derr := entities.ValidateOrganizationApplicationStatsRequest(request)
+	if derr != nil {
+		log.Error().
+			Str("err", derr.DebugReport()).
+			Err(derr).
+			Msg("invalid request")
+		return nil, derr
+	}
+
+	// Execute
+	res, err := h.manager.ListUnhealthyServiceInstances(ctx, request)
+	if err != nil {
+		log.Error().
+			Str("err", conversions.ToDerror(err).DebugReport()).
+			Err(err).
+			Msg("error executing ListUnhealthyServiceInstances")
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetUsageReport retrieves the resource usage of an organization over a period
+func (h *Handler) GetUsageReport(ctx context.Context, request *grpc_monitoring_go.UsageReportRequest) (*grpc_monitoring_go.UsageReport, error) {
+	log.Debug().
+		Interface("request", request).
+		Msg("received GetUsageReport request")
+
+	// Validate
+	derr := entities.ValidateUsageReportRequest(request)
+	if derr != nil {
+		log.Error().
+			Str("err", derr.DebugReport()).
+			Err(derr).
+			Msg("invalid request")
+		return nil, derr
+	}
+
+	// Execute
+	res, err := h.manager.GetUsageReport(ctx, request)
+	if err != nil {
+		log.Error().
+			Str("err", conversions.ToDerror(err).DebugReport()).
+			Err(err).
+			Msg("error executing GetUsageReport")
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetCostReport retrieves the cost of the resource usage of an organization over a period
+func (h *Handler) GetCostReport(ctx context.Context, request *grpc_monitoring_go.CostReportRequest) (*grpc_monitoring_go.CostReport, error) {
+	log.Debug().
+		Interface("request", request).
+		Msg("received GetCostReport request")
+
+	// Validate
+	derr := entities.ValidateCostReportRequest(request)
+	if derr != nil {
+		log.Error().
+			Str("err", derr.DebugReport()).
+			Err(derr).
+			Msg("invalid request")
+		return nil, derr
+	}
+
+	// Execute
+	res, err := h.manager.GetCostReport(ctx, request)
+	if err != nil {
+		log.Error().
+			Str("err", conversions.ToDerror(err).DebugReport()).
+			Err(err).
+			Msg("error executing GetCostReport")
+		return nil, err
+	}
+
+	return res, nil
+}
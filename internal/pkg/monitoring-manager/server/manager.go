@@ -22,12 +22,17 @@ import (
 	"context"
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/nalej/monitoring/internal/pkg/cost"
 	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/clients"
+	"github.com/nalej/monitoring/internal/pkg/usage"
+	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog/log"
 	"time"
 
 	"github.com/nalej/derrors"
 
+	"github.com/nalej/grpc-app-cluster-api-go"
 	"github.com/nalej/grpc-infrastructure-go"
 	"github.com/nalej/grpc-monitoring-go"
 )
@@ -37,54 +42,91 @@ const (
 )
 
 type Manager struct {
-	clustersClient      *grpc_infrastructure_go.ClustersClient
-	organizationsClient *grpc_organization_go.OrganizationsClient
-
-	params *clients.AppClusterConnectParams
+	// Organizations and their clusters
+	directory clients.ClusterDirectory
+	// Clients of the app clusters, by address
+	collectors clients.CollectorClientFactory
+	// Hostnames of the clusters, by organization and cluster id
+	hostnames *cache.Cache
+	// Circuit breakers of the clusters, by cluster id
+	breakers *breaker.Registry
+	// Retry policy of the reads from the clusters
+	retry breaker.Retry
+	// Timeout of each request to a cluster
+	clusterTimeout time.Duration
+	// Latest container stats of the clusters, if they are collected in the background
+	snapshots *SnapshotStore
+	// History of the resource usage, if it is recorded
+	usageStore *usage.Store
+	// Prices of the resource usage, if costs are reported
+	pricing *cost.Pricing
 }
 
-func (m *Manager) getOrganizationsClient() grpc_organization_go.OrganizationsClient {
-	return *m.organizationsClient
-}
+// Create a new query manager. Cluster hostnames are cached for hostnameTTL; reads from the clusters go
+// through their breakers and are retried with the given policy.
+func NewManager(directory clients.ClusterDirectory, collectors clients.CollectorClientFactory, breakers *breaker.Registry, retry breaker.Retry, hostnameTTL time.Duration) (Manager, derrors.Error) {
+	manager := Manager{
+		directory:      directory,
+		collectors:     collectors,
+		hostnames:      cache.New(hostnameTTL, hostnameTTL*2),
+		breakers:       breakers,
+		retry:          retry,
+		clusterTimeout: defaultTimeout,
+	}
 
-func (m *Manager) getClustersClient() grpc_infrastructure_go.ClustersClient {
-	return *m.clustersClient
+	return manager, nil
 }
 
-// Create a new query manager.
-func NewManager(clustersClient *grpc_infrastructure_go.ClustersClient, organizationsClient *grpc_organization_go.OrganizationsClient, params *clients.AppClusterConnectParams) (Manager, derrors.Error) {
-	manager := Manager{
-		clustersClient:      clustersClient,
-		organizationsClient: organizationsClient,
-		params:              params,
+// getMetricsCollectorClient returns the shared client of a cluster. It must not be closed.
+func (m *Manager) getMetricsCollectorClient(ctx context.Context, organizationId, clusterId string) (grpc_app_cluster_api_go.MetricsCollectorClient, derrors.Error) {
+	hostname, derr := m.getClusterHostname(ctx, organizationId, clusterId)
+	if derr != nil {
+		return nil, derr
 	}
 
-	return manager, nil
+	return m.collectors.Get(hostname)
 }
 
-func (m *Manager) getMetricsCollectorClient(organizationId, clusterId string) (*clients.MetricsCollectorClient, derrors.Error) {
-	getClusterRequest := &grpc_infrastructure_go.ClusterId{
-		OrganizationId: organizationId,
-		ClusterId:      clusterId,
+// getClusterHostname resolves the hostname of a cluster with the directory
+func (m *Manager) getClusterHostname(ctx context.Context, organizationId, clusterId string) (string, derrors.Error) {
+	cacheKey := organizationId + "/" + clusterId
+	if hostname, found := m.hostnames.Get(cacheKey); found {
+		return hostname.(string), nil
 	}
 
-	cluster, err := m.getClustersClient().GetCluster(context.Background(), getClusterRequest)
-	if err != nil || cluster == nil {
-		return nil, derrors.NewUnavailableError("unable to retrieve cluster", err)
+	cluster, derr := m.directory.GetCluster(ctx, organizationId, clusterId)
+	if derr != nil {
+		return "", derr
 	}
 
-	return clients.NewMetricsCollectorClient(cluster.GetHostname(), m.params)
+	m.hostnames.SetDefault(cacheKey, cluster.GetHostname())
+	return cluster.GetHostname(), nil
 }
 
-// Retrieve a summary of high level cluster resource availability
-func (m *Manager) GetClusterSummary(ctx context.Context, request *grpc_monitoring_go.ClusterSummaryRequest) (*grpc_monitoring_go.ClusterSummary, error) {
-	client, derr := m.getMetricsCollectorClient(request.GetOrganizationId(), request.GetClusterId())
+// callCluster executes an idempotent read on a cluster. Calls are rejected right away while the breaker of
+// the cluster is open, and retried when the cluster can't be reached. Each attempt is limited to the cluster
+// timeout.
+func (m *Manager) callCluster(ctx context.Context, organizationId, clusterId string, call func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error) error {
+	client, derr := m.getMetricsCollectorClient(ctx, organizationId, clusterId)
 	if derr != nil {
-		return nil, derr
+		return derr
 	}
-	defer client.Close()
 
-	res, err := client.GetClusterSummary(ctx, request)
+	return m.breakers.Get(clusterId).Call(ctx, m.retry, func(ctx context.Context) error {
+		callCtx, cancel := context.WithTimeout(ctx, m.clusterTimeout)
+		defer cancel()
+		return call(callCtx, client)
+	})
+}
+
+// Retrieve a summary of high level cluster resource availability
+func (m *Manager) GetClusterSummary(ctx context.Context, request *grpc_monitoring_go.ClusterSummaryRequest) (*grpc_monitoring_go.ClusterSummary, error) {
+	var res *grpc_monitoring_go.ClusterSummary
+	err := m.callCluster(ctx, request.GetOrganizationId(), request.GetClusterId(), func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error {
+		var err error
+		res, err = client.GetClusterSummary(ctx, request)
+		return err
+	})
 	if err != nil {
 		return nil, derrors.NewUnavailableError("error executing GetClusterSummary on cluster", err)
 	}
@@ -94,13 +136,12 @@ func (m *Manager) GetClusterSummary(ctx context.Context, request *grpc_monitorin
 
 // Retrieve statistics on cluster with respect to platform resources
 func (m *Manager) GetClusterStats(ctx context.Context, request *grpc_monitoring_go.ClusterStatsRequest) (*grpc_monitoring_go.ClusterStats, error) {
-	client, derr := m.getMetricsCollectorClient(request.GetOrganizationId(), request.GetClusterId())
-	if derr != nil {
-		return nil, derr
-	}
-	defer client.Close()
-
-	res, err := client.GetClusterStats(ctx, request)
+	var res *grpc_monitoring_go.ClusterStats
+	err := m.callCluster(ctx, request.GetOrganizationId(), request.GetClusterId(), func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error {
+		var err error
+		res, err = client.GetClusterStats(ctx, request)
+		return err
+	})
 	if err != nil {
 		return nil, derrors.NewUnavailableError("error executing GetClusterStats on cluster", err)
 	}
@@ -110,13 +151,12 @@ func (m *Manager) GetClusterStats(ctx context.Context, request *grpc_monitoring_
 
 // Execute a query directly on the monitoring storage backend
 func (m *Manager) Query(ctx context.Context, request *grpc_monitoring_go.QueryRequest) (*grpc_monitoring_go.QueryResponse, error) {
-	client, derr := m.getMetricsCollectorClient(request.GetOrganizationId(), request.GetClusterId())
-	if derr != nil {
-		return nil, derr
-	}
-	defer client.Close()
-
-	res, err := client.Query(ctx, request)
+	var res *grpc_monitoring_go.QueryResponse
+	err := m.callCluster(ctx, request.GetOrganizationId(), request.GetClusterId(), func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error {
+		var err error
+		res, err = client.Query(ctx, request)
+		return err
+	})
 	if err != nil {
 		return nil, derrors.NewUnavailableError("error executing Query on cluster", err)
 	}
@@ -124,108 +164,191 @@ func (m *Manager) Query(ctx context.Context, request *grpc_monitoring_go.QueryRe
 	return res, nil
 }
 
+// GetOrganizationApplicationStats aggregates the container stats of every cluster of an organization by the
+// levels of the request, by service instance if none. The timestamp of the response is the time of the oldest
+// stats included.
 func (m *Manager) GetOrganizationApplicationStats(ctx context.Context, request *grpc_monitoring_go.OrganizationApplicationStatsRequest) (*grpc_monitoring_go.OrganizationApplicationStatsResponse, error) {
+	organization, clustersStats, derr := m.organizationContainerStats(ctx, request.OrganizationId, request.AppInstanceId)
+	if derr != nil {
+		return nil, derr
+	}
+
+	groupBy := request.GroupBy
+	if len(groupBy) == 0 {
+		groupBy = defaultAggregationLevels
+	}
+
+	orgAppStats := &grpc_monitoring_go.OrganizationApplicationStatsResponse{
+		ServiceInstanceStats: aggregateStats(organization, clustersStats, groupBy),
+		GroupBy:              groupBy,
+		Timestamp:            oldestTimestamp(clustersStats),
+		Clusters:             clusterStatuses(clustersStats),
+	}
+
+	return orgAppStats, nil
+}
+
+// organizationContainerStats retrieves the container stats of every cluster of an organization, only for the
+// given app instances if any. They are taken from the snapshots when collected in the background.
+func (m *Manager) organizationContainerStats(ctx context.Context, organizationId string, appInstanceIds []string) (*grpc_organization_go.Organization, []*clusterContainerStats, derrors.Error) {
+	if m.snapshots != nil {
+		if organization, clustersStats, found := m.snapshots.organizationStats(organizationId, appInstanceIds); found {
+			return organization, clustersStats, nil
+		}
+		log.Debug().Str("organizationId", organizationId).Msg("organization not collected yet, querying its clusters")
+	}
+
+	organization, clusterList, derr := m.getOrganizationClusters(ctx, organizationId)
+	if derr != nil {
+		return nil, nil, derr
+	}
+	return organization, m.requestContainerStatsToClusters(clusterList, organization, appInstanceIds, ctx), nil
+}
+
+// oldestTimestamp returns the time of the oldest stats of the clusters that were queried, or now if none was
+func oldestTimestamp(clustersStats []*clusterContainerStats) int64 {
+	oldest := time.Now().UnixNano() / 1000000
+	for _, clusterStats := range clustersStats {
+		if timestamp := clusterStats.status.GetTimestamp(); timestamp > 0 && timestamp < oldest {
+			oldest = timestamp
+		}
+	}
+	return oldest
+}
+
+// getOrganizationClusters retrieves an organization and the list of its clusters from the directory
+func (m *Manager) getOrganizationClusters(ctx context.Context, organizationId string) (*grpc_organization_go.Organization, *grpc_infrastructure_go.ClusterList, derrors.Error) {
 	getOrganizationCtx, getOrganizationCancel := context.WithTimeout(ctx, defaultTimeout)
 	defer getOrganizationCancel()
-	organization, err := m.getOrganizationsClient().GetOrganization(getOrganizationCtx, &grpc_organization_go.OrganizationId{OrganizationId: request.OrganizationId})
-	if err != nil {
-		return nil, derrors.NewFailedPreconditionError("could not get organization", err)
+	organization, derr := m.directory.GetOrganization(getOrganizationCtx, organizationId)
+	if derr != nil {
+		return nil, nil, derr
 	}
 
 	listClustersCtx, listclustersCancel := context.WithTimeout(ctx, defaultTimeout)
 	defer listclustersCancel()
-	clusterList, err := m.getClustersClient().ListClusters(listClustersCtx, &grpc_organization_go.OrganizationId{OrganizationId: request.OrganizationId})
-	if err != nil {
-		return nil, derrors.NewFailedPreconditionError("could not geet cluster list", err)
+	clusterList, derr := m.directory.ListClusters(listClustersCtx, organizationId)
+	if derr != nil {
+		return nil, nil, derr
 	}
 
-	orgContainerStats := m.requestContainerStatsToClusters(clusterList, organization, ctx)
-
-	serviceInstanceStats := m.aggregateStatsByServiceInstanceId(orgContainerStats, request, organization.Name)
-
-	orgAppStats := &grpc_monitoring_go.OrganizationApplicationStatsResponse{
-		ServiceInstanceStats: serviceInstanceStats,
-		Timestamp:            time.Now().UnixNano() / 1000000,
-	}
+	return organization, clusterList, nil
+}
 
-	return orgAppStats, nil
+// clusterContainerStats holds the container stats retrieved from a single cluster, and whether it could be
+// queried. The container stats are empty if it couldn't.
+type clusterContainerStats struct {
+	cluster        *grpc_infrastructure_go.Cluster
+	status         *grpc_monitoring_go.ClusterQueryStatus
+	containerStats []*grpc_monitoring_go.ContainerStats
 }
 
-func (m *Manager) requestContainerStatsToClusters(clusterList *grpc_infrastructure_go.ClusterList, organization *grpc_organization_go.Organization, ctx context.Context) []*grpc_monitoring_go.ContainerStats {
-	containerStatsFutures := make([]chan *grpc_monitoring_go.ContainerStatsResponse, 0, len(clusterList.Clusters))
+// requestContainerStatsToClusters retrieves the container stats of every cluster of an organization, only
+// for the given app instances if any
+func (m *Manager) requestContainerStatsToClusters(clusterList *grpc_infrastructure_go.ClusterList, organization *grpc_organization_go.Organization, appInstanceIds []string, ctx context.Context) []*clusterContainerStats {
+	containerStatsFutures := make([]chan *clusterContainerStats, 0, len(clusterList.Clusters))
 	for _, cluster := range clusterList.Clusters {
-		metricsCollector, derr := m.getMetricsCollectorClient(organization.OrganizationId, cluster.ClusterId)
-		if derr != nil {
-			log.Error().
-				Str("organizationId", organization.OrganizationId).
-				Str("clusterId", cluster.ClusterId).
-				Err(derr).
-				Msg("could not create metrics-collector client. The aggregation will not include this cluster stats.")
-			continue
-		}
-		statsFuture := make(chan *grpc_monitoring_go.ContainerStatsResponse)
+		statsFuture := make(chan *clusterContainerStats, 1)
 		containerStatsFutures = append(containerStatsFutures, statsFuture)
-		go getClusterContainerStats(cluster, metricsCollector, ctx, statsFuture)
+		go m.getClusterContainerStats(cluster, appInstanceIds, ctx, statsFuture)
 	}
-	orgContainerStats := make([]*grpc_monitoring_go.ContainerStats, 0)
+	orgContainerStats := make([]*clusterContainerStats, 0, len(containerStatsFutures))
 	for _, statsFuture := range containerStatsFutures {
-		containerStatsResponse := <-statsFuture
-		if containerStatsResponse != nil {
-			orgContainerStats = append(orgContainerStats, containerStatsResponse.ContainerStats...)
-		}
+		orgContainerStats = append(orgContainerStats, <-statsFuture)
 	}
 	return orgContainerStats
 }
 
-func getClusterContainerStats(cluster *grpc_infrastructure_go.Cluster, metricsCollector *clients.MetricsCollectorClient, ctx context.Context, statsFuture chan *grpc_monitoring_go.ContainerStatsResponse) {
-	getContainerStatsCtx, getContainerStatsCancel := context.WithTimeout(ctx, defaultTimeout)
-	defer getContainerStatsCancel()
-	clusterContainerStats, err := metricsCollector.GetContainerStats(getContainerStatsCtx, &grpc_common_go.Empty{})
+// clusterStatuses returns whether each cluster could be queried
+func clusterStatuses(clustersStats []*clusterContainerStats) []*grpc_monitoring_go.ClusterQueryStatus {
+	statuses := make([]*grpc_monitoring_go.ClusterQueryStatus, 0, len(clustersStats))
+	for _, clusterStats := range clustersStats {
+		statuses = append(statuses, clusterStats.status)
+	}
+	return statuses
+}
+
+// getClusterContainerStats retrieves the container stats of a cluster. Clusters whose breaker is rejecting
+// calls are skipped.
+func (m *Manager) getClusterContainerStats(cluster *grpc_infrastructure_go.Cluster, appInstanceIds []string, ctx context.Context, statsFuture chan *clusterContainerStats) {
+	result := &clusterContainerStats{
+		cluster: cluster,
+		status: &grpc_monitoring_go.ClusterQueryStatus{
+			ClusterId:   cluster.ClusterId,
+			ClusterName: cluster.Name,
+		},
+	}
+
+	if m.breakers.Get(cluster.ClusterId).Rejecting() {
+		log.Warn().
+			Str("organizationId", cluster.OrganizationId).
+			Str("clusterId", cluster.ClusterId).
+			Msg("circuit breaker of the cluster is open. The aggregation will not include this cluster stats.")
+		result.status.Skipped = true
+		result.status.Error = "circuit breaker of the cluster is open"
+		statsFuture <- result
+		return
+	}
+
+	var response *grpc_monitoring_go.ContainerStatsResponse
+	err := m.callCluster(ctx, cluster.OrganizationId, cluster.ClusterId, func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error {
+		var err error
+		response, err = queryContainerStats(ctx, client, appInstanceIds)
+		return err
+	})
 	if err != nil {
 		log.Error().
 			Str("organizationId", cluster.OrganizationId).
 			Str("clusterId", cluster.ClusterId).
 			Err(err).
-			Msg("metrics-collector responded with an error when querying for stats. The aggregation will not include this cluster stats.")
-		statsFuture <- nil
+			Msg("could not query the metrics-collector for stats. The aggregation will not include this cluster stats.")
+		result.status.Failed = true
+		result.status.Error = err.Error()
+		statsFuture <- result
 		return
 	}
 	// Adjust millicores metric with the cluster conversion factor
-	for _, containerStat := range clusterContainerStats.ContainerStats {
+	for _, containerStat := range response.ContainerStats {
 		containerStat.CpuMillicore = containerStat.GetCpuMillicore() * cluster.MillicoresConversionFactor
 	}
-	statsFuture <- clusterContainerStats
-}
-
-func (m *Manager) aggregateStatsByServiceInstanceId(orgContainerStats []*grpc_monitoring_go.ContainerStats, request *grpc_monitoring_go.OrganizationApplicationStatsRequest, organizationName string) []*grpc_monitoring_go.OrganizationApplicationStats {
-	statsMapByServiceInstanceId := make(map[string]*grpc_monitoring_go.OrganizationApplicationStats, 0)
-	for _, containerStats := range orgContainerStats {
-		stats, found := statsMapByServiceInstanceId[containerStats.ServiceInstanceId]
-		if !found {
-			// Include
-			statsMapByServiceInstanceId[containerStats.ServiceInstanceId] = &grpc_monitoring_go.OrganizationApplicationStats{
-				OrganizationId:           request.OrganizationId,
-				OrganizationName:         organizationName,
-				AppInstanceId:            containerStats.AppInstanceId,
-				AppInstanceName:          containerStats.AppInstanceName,
-				ServiceGroupInstanceId:   containerStats.ServiceGroupInstanceId,
-				ServiceGroupInstanceName: containerStats.ServiceGroupInstanceName,
-				ServiceInstanceId:        containerStats.ServiceInstanceId,
-				ServiceInstanceName:      containerStats.ServiceInstanceName,
-				CpuMillicore:             containerStats.CpuMillicore,
-				MemoryByte:               containerStats.MemoryByte,
-				StorageByte:              containerStats.StorageByte,
-			}
-		} else {
-			// Aggregate
-			stats.CpuMillicore += containerStats.CpuMillicore
-			stats.MemoryByte += containerStats.MemoryByte
-			stats.StorageByte += containerStats.StorageByte
-		}
+	result.containerStats = response.ContainerStats
+	result.status.Timestamp = time.Now().UnixNano() / 1000000
+	statsFuture <- result
+}
+
+// queryContainerStats retrieves the container stats of a cluster. A single app instance is filtered by the
+// metrics collector, so the stats of other applications are not even queried; several app instances are
+// filtered here.
+func queryContainerStats(ctx context.Context, metricsCollector grpc_app_cluster_api_go.MetricsCollectorClient, appInstanceIds []string) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	switch len(appInstanceIds) {
+	case 0:
+		return metricsCollector.GetContainerStats(ctx, &grpc_common_go.Empty{})
+	case 1:
+		return metricsCollector.ListContainerStats(ctx, &grpc_monitoring_go.ContainerStatsRequest{AppInstanceId: appInstanceIds[0]})
+	}
+
+	response, err := metricsCollector.GetContainerStats(ctx, &grpc_common_go.Empty{})
+	if err != nil {
+		return nil, err
 	}
-	serviceInstanceStats := make([]*grpc_monitoring_go.OrganizationApplicationStats, 0, len(statsMapByServiceInstanceId))
-	for _, value := range statsMapByServiceInstanceId {
-		serviceInstanceStats = append(serviceInstanceStats, value)
+	response.ContainerStats = filterContainerStats(response.ContainerStats, appInstanceIds)
+	return response, nil
+}
+
+// filterContainerStats returns the container stats of the given app instances, or all of them if none
+func filterContainerStats(containerStats []*grpc_monitoring_go.ContainerStats, appInstanceIds []string) []*grpc_monitoring_go.ContainerStats {
+	if len(appInstanceIds) == 0 {
+		return containerStats
+	}
+	selected := make(map[string]bool, len(appInstanceIds))
+	for _, appInstanceId := range appInstanceIds {
+		selected[appInstanceId] = true
+	}
+	filtered := make([]*grpc_monitoring_go.ContainerStats, 0, len(containerStats))
+	for _, stats := range containerStats {
+		if selected[stats.AppInstanceId] {
+			filtered = append(filtered, stats)
+		}
 	}
-	return serviceInstanceStats
+	return filtered
 }
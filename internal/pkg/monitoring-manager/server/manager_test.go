@@ -0,0 +1,677 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cluster monitoring manager tests, with in-memory clusters
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/clients"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testOrganizationId = "org-1"
+
+var testCacheConfig = CacheConfig{
+	OrganizationApplicationStatsTTL: time.Minute,
+	ClusterSummaryTTL:               time.Minute,
+	ClusterStatsTTL:                 time.Minute,
+	MaxStale:                        time.Minute,
+}
+
+// fakeCollector is the metrics collector of an in-memory cluster
+type fakeCollector struct {
+	grpc_app_cluster_api_go.MetricsCollectorClient
+	stats   []*grpc_monitoring_go.ContainerStats
+	summary *grpc_monitoring_go.ClusterSummary
+	query   *grpc_monitoring_go.QueryResponse
+	err     error
+	delay   time.Duration
+	calls   int32
+	// App instance of the last filtered request
+	lock          sync.Mutex
+	appInstanceId string
+}
+
+func (c *fakeCollector) GetContainerStats(ctx context.Context, _ *grpc_common_go.Empty, _ ...grpc.CallOption) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	return c.respond(ctx, "")
+}
+
+func (c *fakeCollector) ListContainerStats(ctx context.Context, in *grpc_monitoring_go.ContainerStatsRequest, _ ...grpc.CallOption) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	c.lock.Lock()
+	c.appInstanceId = in.AppInstanceId
+	c.lock.Unlock()
+	return c.respond(ctx, in.AppInstanceId)
+}
+
+// lastAppInstanceId returns the app instance of the last filtered request
+func (c *fakeCollector) lastAppInstanceId() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.appInstanceId
+}
+
+func (c *fakeCollector) GetClusterSummary(ctx context.Context, in *grpc_monitoring_go.ClusterSummaryRequest, _ ...grpc.CallOption) (*grpc_monitoring_go.ClusterSummary, error) {
+	if _, err := c.respond(ctx, ""); err != nil {
+		return nil, err
+	}
+	summary := proto.Clone(c.summary).(*grpc_monitoring_go.ClusterSummary)
+	summary.OrganizationId = in.OrganizationId
+	summary.ClusterId = in.ClusterId
+	return summary, nil
+}
+
+func (c *fakeCollector) Query(ctx context.Context, in *grpc_monitoring_go.QueryRequest, _ ...grpc.CallOption) (*grpc_monitoring_go.QueryResponse, error) {
+	if _, err := c.respond(ctx, ""); err != nil {
+		return nil, err
+	}
+	return proto.Clone(c.query).(*grpc_monitoring_go.QueryResponse), nil
+}
+
+func (c *fakeCollector) respond(ctx context.Context, appInstanceId string) (*grpc_monitoring_go.ContainerStatsResponse, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if c.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		case <-time.After(c.delay):
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	// Responses are modified by the manager, like real ones
+	response := &grpc_monitoring_go.ContainerStatsResponse{}
+	for _, stats := range c.stats {
+		if appInstanceId == "" || stats.AppInstanceId == appInstanceId {
+			response.ContainerStats = append(response.ContainerStats, proto.Clone(stats).(*grpc_monitoring_go.ContainerStats))
+		}
+	}
+	return response, nil
+}
+
+func containerStats(appInstanceId string, serviceInstanceId string, cpu float64, memory float64) *grpc_monitoring_go.ContainerStats {
+	return &grpc_monitoring_go.ContainerStats{
+		AppInstanceId:     appInstanceId,
+		ServiceInstanceId: serviceInstanceId,
+		CpuMillicore:      cpu,
+		MemoryByte:        memory,
+	}
+}
+
+func clusterSummary(cpuTotal int64, cpuAvailable int64, memoryTotal int64, memoryAvailable int64) *grpc_monitoring_go.ClusterSummary {
+	summary := newClusterSummary("", "")
+	summary.CpuMillicores = &grpc_monitoring_go.ClusterStat{Total: cpuTotal, Available: cpuAvailable}
+	summary.MemoryBytes = &grpc_monitoring_go.ClusterStat{Total: memoryTotal, Available: memoryAvailable}
+	summary.Network.ReceiveBytePerSec = 10
+	return summary
+}
+
+func queryResponse(resultType grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultType, series ...*grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue) *grpc_monitoring_go.QueryResponse {
+	return &grpc_monitoring_go.QueryResponse{
+		Type: grpc_monitoring_go.QueryType_PROMETHEUS,
+		Result: &grpc_monitoring_go.QueryResponse_PrometheusResult{PrometheusResult: &grpc_monitoring_go.QueryResponse_PrometheusResponse{
+			ResultType: resultType,
+			Result:     series,
+		}},
+	}
+}
+
+func querySeries(metric map[string]string, values ...float64) *grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue {
+	series := &grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue{Metric: metric}
+	for ix, value := range values {
+		series.Value = append(series.Value, &grpc_monitoring_go.QueryResponse_PrometheusResponse_ResultValue_Value{
+			Timestamp: &timestamp.Timestamp{Seconds: int64(1000 + ix)},
+			Value:     fmt.Sprintf("%g", value),
+		})
+	}
+	return series
+}
+
+func statsByServiceInstance(response *grpc_monitoring_go.OrganizationApplicationStatsResponse) map[string]*grpc_monitoring_go.OrganizationApplicationStats {
+	result := make(map[string]*grpc_monitoring_go.OrganizationApplicationStats)
+	for _, stats := range response.ServiceInstanceStats {
+		result[stats.ServiceInstanceId] = stats
+	}
+	return result
+}
+
+var _ = ginkgo.Describe("cluster monitoring manager", func() {
+
+	var directory *clients.MemoryDirectory
+	var factory *clients.MemoryClientFactory
+	var collectors map[string]*fakeCollector
+	var breakers *breaker.Registry
+	var manager Manager
+
+	ginkgo.BeforeEach(func() {
+		collectors = map[string]*fakeCollector{
+			"cluster-1": {stats: []*grpc_monitoring_go.ContainerStats{
+				containerStats("app-1", "service-1", 100, 1000),
+				containerStats("app-1", "service-1", 50, 500),
+				containerStats("app-2", "service-2", 10, 100),
+			}, summary: clusterSummary(4000, 1000, 8000, 2000),
+				query: queryResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR,
+					querySeries(map[string]string{"pod": "pod-1"}, 3),
+					querySeries(map[string]string{"pod": "pod-2"}, 0))},
+			"cluster-2": {stats: []*grpc_monitoring_go.ContainerStats{
+				containerStats("app-1", "service-3", 100, 2000),
+			}, summary: clusterSummary(2000, 500, 4000, 3000),
+				query: queryResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR,
+					querySeries(map[string]string{"pod": "pod-1", "cluster_id": "remote"}, 1))},
+		}
+
+		directory = clients.NewMemoryDirectory()
+		factory = clients.NewMemoryClientFactory()
+		clusters := make([]*grpc_infrastructure_go.Cluster, 0, len(collectors))
+		for _, clusterId := range []string{"cluster-1", "cluster-2"} {
+			hostname := clusterId + ".example.com"
+			clusters = append(clusters, &grpc_infrastructure_go.Cluster{
+				OrganizationId:             testOrganizationId,
+				ClusterId:                  clusterId,
+				Name:                       clusterId + " name",
+				Hostname:                   hostname,
+				MillicoresConversionFactor: 1,
+				Labels:                     map[string]string{"region": "eu", "name": clusterId},
+			})
+			factory.Add(hostname, collectors[clusterId])
+		}
+		// cluster-2 nodes are twice as fast as the reference
+		clusters[1].MillicoresConversionFactor = 2
+		directory.AddOrganization(&grpc_organization_go.Organization{OrganizationId: testOrganizationId, Name: "Org"}, clusters...)
+
+		var derr error
+		breakers = breaker.NewRegistry(2, time.Minute)
+		manager, derr = NewManager(directory, factory, breakers, breaker.Retry{Attempts: 1}, time.Minute)
+		gomega.Expect(derr).To(gomega.Succeed())
+		manager.clusterTimeout = 200 * time.Millisecond
+	})
+
+	getStats := func(appInstanceIds ...string) map[string]*grpc_monitoring_go.OrganizationApplicationStats {
+		response, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+			OrganizationId: testOrganizationId,
+			AppInstanceId:  appInstanceIds,
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		return statsByServiceInstance(response)
+	}
+
+	ginkgo.Context("GetOrganizationApplicationStats", func() {
+		ginkgo.It("should aggregate the containers of every cluster by service instance", func() {
+			stats := getStats()
+			gomega.Expect(stats).To(gomega.HaveLen(3))
+			gomega.Expect(stats["service-1"].CpuMillicore).To(gomega.Equal(150.0))
+			gomega.Expect(stats["service-1"].MemoryByte).To(gomega.Equal(1500.0))
+			gomega.Expect(stats["service-1"].OrganizationName).To(gomega.Equal("Org"))
+			gomega.Expect(stats["service-2"].AppInstanceId).To(gomega.Equal("app-2"))
+			// Normalized with the conversion factor of the cluster
+			gomega.Expect(stats["service-3"].CpuMillicore).To(gomega.Equal(200.0))
+			gomega.Expect(stats["service-3"].MemoryByte).To(gomega.Equal(2000.0))
+		})
+
+		ginkgo.It("should skip failing clusters", func() {
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			stats := getStats()
+			gomega.Expect(stats).To(gomega.HaveLen(1))
+			gomega.Expect(stats).To(gomega.HaveKey("service-3"))
+		})
+
+		ginkgo.It("should report the status of each cluster", func() {
+			request := &grpc_monitoring_go.OrganizationApplicationStatsRequest{OrganizationId: testOrganizationId}
+			response, err := manager.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.Clusters).To(gomega.HaveLen(2))
+			for _, status := range response.Clusters {
+				gomega.Expect(status.Failed).To(gomega.BeFalse())
+				gomega.Expect(status.Skipped).To(gomega.BeFalse())
+			}
+
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			response, err = manager.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.Clusters[0].ClusterId).To(gomega.Equal("cluster-1"))
+			gomega.Expect(response.Clusters[0].ClusterName).To(gomega.Equal("cluster-1 name"))
+			gomega.Expect(response.Clusters[0].Failed).To(gomega.BeTrue())
+			gomega.Expect(response.Clusters[0].Error).To(gomega.ContainSubstring("cluster down"))
+			gomega.Expect(response.Clusters[1].Failed).To(gomega.BeFalse())
+
+			// The breaker opens with the second failure
+			_, err = manager.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			response, err = manager.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.Clusters[0].Skipped).To(gomega.BeTrue())
+			gomega.Expect(response.Clusters[0].Failed).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should not wait for slow clusters", func() {
+			collectors["cluster-2"].delay = 5 * time.Second
+			start := time.Now()
+			stats := getStats()
+			gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", 2*time.Second))
+			gomega.Expect(stats).To(gomega.HaveLen(2))
+			gomega.Expect(stats).ToNot(gomega.HaveKey("service-3"))
+		})
+
+		ginkgo.It("should skip clusters without client", func() {
+			factory = clients.NewMemoryClientFactory()
+			factory.Add("cluster-2.example.com", collectors["cluster-2"])
+			manager.collectors = factory
+			stats := getStats()
+			gomega.Expect(stats).To(gomega.HaveLen(1))
+			gomega.Expect(stats).To(gomega.HaveKey("service-3"))
+		})
+
+		ginkgo.It("should only request a single app instance to the clusters", func() {
+			stats := getStats("app-2")
+			gomega.Expect(stats).To(gomega.HaveLen(1))
+			gomega.Expect(stats).To(gomega.HaveKey("service-2"))
+			gomega.Expect(collectors["cluster-1"].lastAppInstanceId()).To(gomega.Equal("app-2"))
+		})
+
+		ginkgo.It("should filter several app instances", func() {
+			collectors["cluster-2"].stats = append(collectors["cluster-2"].stats, containerStats("app-3", "service-4", 1, 1))
+			stats := getStats("app-2", "app-3")
+			gomega.Expect(stats).To(gomega.HaveLen(2))
+			gomega.Expect(stats).To(gomega.HaveKey("service-2"))
+			gomega.Expect(stats).To(gomega.HaveKey("service-4"))
+		})
+
+		ginkgo.It("should aggregate by the selected levels", func() {
+			response, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: testOrganizationId,
+				GroupBy:        []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_APP_INSTANCE, grpc_monitoring_go.AggregationLevel_CLUSTER},
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.GroupBy).To(gomega.HaveLen(2))
+			stats := response.ServiceInstanceStats
+			gomega.Expect(stats).To(gomega.HaveLen(3))
+			gomega.Expect(stats[0].ClusterId).To(gomega.Equal("cluster-1"))
+			gomega.Expect(stats[0].ClusterName).To(gomega.Equal("cluster-1 name"))
+			gomega.Expect(stats[0].AppInstanceId).To(gomega.Equal("app-1"))
+			gomega.Expect(stats[0].ServiceInstanceId).To(gomega.BeEmpty())
+			gomega.Expect(stats[0].CpuMillicore).To(gomega.Equal(150.0))
+			gomega.Expect(stats[0].ContainerCount).To(gomega.Equal(int32(2)))
+			gomega.Expect(stats[1].AppInstanceId).To(gomega.Equal("app-2"))
+			gomega.Expect(stats[2].ClusterId).To(gomega.Equal("cluster-2"))
+			gomega.Expect(stats[2].AppInstanceId).To(gomega.Equal("app-1"))
+			gomega.Expect(stats[2].CpuMillicore).To(gomega.Equal(200.0))
+		})
+
+		ginkgo.It("should add up to the same totals at every level", func() {
+			for ix, stats := range collectors["cluster-1"].stats {
+				stats.Pod = fmt.Sprintf("pod-%d", ix)
+				stats.Container = "main"
+			}
+			collectors["cluster-2"].stats[0].Pod = "pod-0"
+			collectors["cluster-2"].stats[0].Container = "main"
+
+			expected := map[grpc_monitoring_go.AggregationLevel]int{
+				grpc_monitoring_go.AggregationLevel_CONTAINER:              4,
+				grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE:       3,
+				grpc_monitoring_go.AggregationLevel_SERVICE_GROUP_INSTANCE: 1,
+				grpc_monitoring_go.AggregationLevel_APP_INSTANCE:           2,
+				grpc_monitoring_go.AggregationLevel_CLUSTER:                2,
+				grpc_monitoring_go.AggregationLevel_ORGANIZATION:           1,
+			}
+			for level, groups := range expected {
+				response, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+					OrganizationId: testOrganizationId,
+					GroupBy:        []grpc_monitoring_go.AggregationLevel{level},
+				})
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(response.ServiceInstanceStats).To(gomega.HaveLen(groups), level.String())
+				cpu, memory, containers := 0.0, 0.0, int32(0)
+				for _, stats := range response.ServiceInstanceStats {
+					gomega.Expect(stats.OrganizationId).To(gomega.Equal(testOrganizationId))
+					cpu += stats.CpuMillicore
+					memory += stats.MemoryByte
+					containers += stats.ContainerCount
+				}
+				gomega.Expect(cpu).To(gomega.Equal(360.0), level.String())
+				gomega.Expect(memory).To(gomega.Equal(3600.0), level.String())
+				gomega.Expect(containers).To(gomega.Equal(int32(4)), level.String())
+			}
+		})
+
+		ginkgo.It("should tell containers apart by their cluster", func() {
+			for ix, stats := range collectors["cluster-1"].stats {
+				stats.Pod = fmt.Sprintf("pod-%d", ix)
+				stats.Container = "main"
+			}
+			// Same pod and container on another cluster
+			collectors["cluster-2"].stats[0].Pod = "pod-0"
+			collectors["cluster-2"].stats[0].Container = "main"
+
+			response, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: testOrganizationId,
+				GroupBy:        []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_CONTAINER},
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			stats := response.ServiceInstanceStats
+			gomega.Expect(stats).To(gomega.HaveLen(4))
+			gomega.Expect(stats[0].ClusterId).To(gomega.Equal("cluster-1"))
+			gomega.Expect(stats[0].Pod).To(gomega.Equal("pod-0"))
+			gomega.Expect(stats[0].ServiceInstanceId).To(gomega.Equal("service-1"))
+			gomega.Expect(stats[0].ContainerCount).To(gomega.Equal(int32(1)))
+			gomega.Expect(stats[3].ClusterId).To(gomega.Equal("cluster-2"))
+			gomega.Expect(stats[3].Pod).To(gomega.Equal("pod-0"))
+			gomega.Expect(stats[3].ServiceInstanceId).To(gomega.Equal("service-3"))
+		})
+
+		ginkgo.It("should fail for unknown organizations", func() {
+			_, err := manager.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: "unknown",
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	})
+
+	ginkgo.Context("GetOrganizationClusterSummary", func() {
+		getSummary := func() *grpc_monitoring_go.OrganizationClusterSummary {
+			summary, err := manager.GetOrganizationClusterSummary(context.Background(), &grpc_monitoring_go.OrganizationClusterSummaryRequest{
+				OrganizationId: testOrganizationId,
+				RangeMinutes:   5,
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			return summary
+		}
+
+		ginkgo.It("should add up the normalized summaries of every cluster", func() {
+			summary := getSummary()
+			gomega.Expect(summary.OrganizationId).To(gomega.Equal(testOrganizationId))
+			gomega.Expect(summary.Total.CpuMillicores.Total).To(gomega.Equal(int64(8000)))
+			gomega.Expect(summary.Total.CpuMillicores.Available).To(gomega.Equal(int64(2000)))
+			gomega.Expect(summary.Total.MemoryBytes.Total).To(gomega.Equal(int64(12000)))
+			gomega.Expect(summary.Total.MemoryBytes.Available).To(gomega.Equal(int64(5000)))
+			gomega.Expect(summary.Total.Network.ReceiveBytePerSec).To(gomega.Equal(int64(20)))
+
+			gomega.Expect(summary.Clusters).To(gomega.HaveLen(2))
+			gomega.Expect(summary.Clusters[1].ClusterId).To(gomega.Equal("cluster-2"))
+			gomega.Expect(summary.Clusters[1].ClusterName).To(gomega.Equal("cluster-2 name"))
+			gomega.Expect(summary.Clusters[1].Missing).To(gomega.BeFalse())
+			gomega.Expect(summary.Clusters[1].Summary.CpuMillicores.Total).To(gomega.Equal(int64(4000)))
+			// The responses of the clusters are not modified
+			gomega.Expect(collectors["cluster-2"].summary.CpuMillicores.Total).To(gomega.Equal(int64(2000)))
+		})
+
+		ginkgo.It("should flag missing clusters", func() {
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			summary := getSummary()
+			gomega.Expect(summary.Total.CpuMillicores.Total).To(gomega.Equal(int64(4000)))
+			gomega.Expect(summary.Clusters).To(gomega.HaveLen(2))
+			gomega.Expect(summary.Clusters[0].Missing).To(gomega.BeTrue())
+			gomega.Expect(summary.Clusters[0].Error).To(gomega.ContainSubstring("cluster down"))
+			gomega.Expect(summary.Clusters[0].Summary).To(gomega.BeNil())
+			gomega.Expect(summary.Clusters[1].Missing).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should report the values clusters could not retrieve", func() {
+			collectors["cluster-2"].summary.Errors = map[string]string{"memory_total": "query failed"}
+			summary := getSummary()
+			gomega.Expect(summary.Total.Errors).To(gomega.Equal(map[string]string{"cluster-2/memory_total": "query failed"}))
+		})
+	})
+
+	ginkgo.Context("QueryOrganization", func() {
+		query := func(clusterLabels map[string]string) *grpc_monitoring_go.OrganizationQueryResponse {
+			response, err := manager.QueryOrganization(context.Background(), &grpc_monitoring_go.OrganizationQueryRequest{
+				OrganizationId: testOrganizationId,
+				ClusterLabels:  clusterLabels,
+				Type:           grpc_monitoring_go.QueryType_PROMETHEUS,
+				Query:          "sum by (pod) (kube_pod_container_status_restarts_total)",
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			return response
+		}
+
+		seriesMetrics := func(response *grpc_monitoring_go.OrganizationQueryResponse) []map[string]string {
+			metrics := make([]map[string]string, 0)
+			for _, series := range response.Result.GetPrometheusResult().GetResult() {
+				metrics = append(metrics, series.Metric)
+			}
+			return metrics
+		}
+
+		ginkgo.It("should merge the series of every cluster with their cluster labels", func() {
+			response := query(nil)
+			gomega.Expect(response.Result.GetPrometheusResult().GetResultType()).To(gomega.Equal(grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR))
+			gomega.Expect(seriesMetrics(response)).To(gomega.Equal([]map[string]string{
+				{"pod": "pod-1", "cluster_id": "cluster-1", "cluster_name": "cluster-1 name"},
+				{"pod": "pod-2", "cluster_id": "cluster-1", "cluster_name": "cluster-1 name"},
+				// Cluster labels of the series are kept as exported labels
+				{"pod": "pod-1", "cluster_id": "cluster-2", "exported_cluster_id": "remote", "cluster_name": "cluster-2 name"},
+			}))
+			gomega.Expect(response.Clusters).To(gomega.HaveLen(2))
+			gomega.Expect(response.Clusters[0].Failed).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should only query the clusters with the requested labels", func() {
+			response := query(map[string]string{"region": "eu", "name": "cluster-2"})
+			gomega.Expect(response.Clusters).To(gomega.HaveLen(1))
+			gomega.Expect(response.Clusters[0].ClusterId).To(gomega.Equal("cluster-2"))
+			gomega.Expect(seriesMetrics(response)).To(gomega.HaveLen(1))
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.BeZero())
+
+			gomega.Expect(query(map[string]string{"region": "us"}).Clusters).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should report the clusters that fail", func() {
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			response := query(nil)
+			gomega.Expect(seriesMetrics(response)).To(gomega.HaveLen(1))
+			gomega.Expect(response.Clusters[0].Failed).To(gomega.BeTrue())
+			gomega.Expect(response.Clusters[0].Error).To(gomega.ContainSubstring("cluster down"))
+			gomega.Expect(response.Clusters[1].Failed).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should merge matrices", func() {
+			for _, collector := range collectors {
+				collector.query.GetPrometheusResult().ResultType = grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX
+			}
+			collectors["cluster-2"].query = queryResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX,
+				querySeries(map[string]string{"pod": "pod-3"}, 1, 2, 3))
+			response := query(nil)
+			result := response.Result.GetPrometheusResult()
+			gomega.Expect(result.GetResultType()).To(gomega.Equal(grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX))
+			gomega.Expect(result.GetResult()).To(gomega.HaveLen(3))
+			gomega.Expect(result.GetResult()[2].Value).To(gomega.HaveLen(3))
+		})
+
+		ginkgo.It("should turn the scalars of the clusters into a vector", func() {
+			collectors["cluster-1"].query = queryResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_SCALAR, querySeries(nil, 1))
+			collectors["cluster-2"].query = queryResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_SCALAR, querySeries(nil, 2))
+			response := query(nil)
+			gomega.Expect(response.Result.GetPrometheusResult().GetResultType()).To(gomega.Equal(grpc_monitoring_go.QueryResponse_PrometheusResponse_VECTOR))
+			gomega.Expect(seriesMetrics(response)).To(gomega.Equal([]map[string]string{
+				{"cluster_id": "cluster-1", "cluster_name": "cluster-1 name"},
+				{"cluster_id": "cluster-2", "cluster_name": "cluster-2 name"},
+			}))
+		})
+
+		ginkgo.It("should skip the clusters with an open breaker", func() {
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			query(nil)
+			query(nil)
+			response := query(nil)
+			gomega.Expect(response.Clusters[0].Skipped).To(gomega.BeTrue())
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(2)))
+			gomega.Expect(seriesMetrics(response)).To(gomega.HaveLen(1))
+		})
+
+		ginkgo.It("should report clusters with a different result type", func() {
+			collectors["cluster-2"].query = queryResponse(grpc_monitoring_go.QueryResponse_PrometheusResponse_MATRIX, querySeries(nil, 2))
+			response := query(nil)
+			gomega.Expect(seriesMetrics(response)).To(gomega.HaveLen(2))
+			gomega.Expect(response.Clusters[1].Failed).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.Context("circuit breakers", func() {
+		ginkgo.It("should stop querying clusters that keep failing", func() {
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			getStats()
+			getStats()
+			gomega.Expect(breakers.Get("cluster-1").Status().State).To(gomega.Equal(breaker.Open))
+			gomega.Expect(breakers.Get("cluster-2").Status().State).To(gomega.Equal(breaker.Closed))
+
+			stats := getStats()
+			gomega.Expect(stats).To(gomega.HaveKey("service-3"))
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(2)))
+
+			_, err := manager.GetClusterSummary(context.Background(), &grpc_monitoring_go.ClusterSummaryRequest{
+				OrganizationId: testOrganizationId,
+				ClusterId:      "cluster-1",
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should count slow clusters as failing", func() {
+			collectors["cluster-2"].delay = 5 * time.Second
+			getStats()
+			getStats()
+			gomega.Expect(breakers.Get("cluster-2").Status().State).To(gomega.Equal(breaker.Open))
+		})
+
+		ginkgo.It("should retry clusters that can't be reached", func() {
+			manager.retry = breaker.Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+			collectors["cluster-1"].err = status.Error(codes.Unavailable, "cluster down")
+			getStats()
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(2)))
+
+			// Other errors are not retried
+			collectors["cluster-2"].err = status.Error(codes.Internal, "query failed")
+			getStats()
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-2"].calls)).To(gomega.Equal(int32(2)))
+			gomega.Expect(breakers.Get("cluster-2").Status().State).To(gomega.Equal(breaker.Closed))
+		})
+	})
+
+	ginkgo.Context("handler cache", func() {
+		ginkgo.It("should reuse the stats of an organization", func() {
+			handler, derr := NewHandler(context.Background(), manager, testCacheConfig)
+			gomega.Expect(derr).To(gomega.Succeed())
+			request := &grpc_monitoring_go.OrganizationApplicationStatsRequest{OrganizationId: testOrganizationId}
+
+			first, err := handler.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			second, err := handler.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(second).To(gomega.BeIdenticalTo(first))
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+
+			// Other app instances are cached separately
+			_, err = handler.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: testOrganizationId,
+				AppInstanceId:  []string{"app-1"},
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(2)))
+
+			// And so are other aggregation levels
+			grouped, err := handler.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: testOrganizationId,
+				GroupBy:        []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel_ORGANIZATION},
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(grouped.ServiceInstanceStats).To(gomega.HaveLen(1))
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(3)))
+		})
+
+		ginkgo.It("should reject unknown aggregation levels", func() {
+			handler, derr := NewHandler(context.Background(), manager, testCacheConfig)
+			gomega.Expect(derr).To(gomega.Succeed())
+			_, err := handler.GetOrganizationApplicationStats(context.Background(), &grpc_monitoring_go.OrganizationApplicationStatsRequest{
+				OrganizationId: testOrganizationId,
+				GroupBy:        []grpc_monitoring_go.AggregationLevel{grpc_monitoring_go.AggregationLevel(100)},
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should not cache failures", func() {
+			handler, derr := NewHandler(context.Background(), manager, testCacheConfig)
+			gomega.Expect(derr).To(gomega.Succeed())
+			request := &grpc_monitoring_go.OrganizationApplicationStatsRequest{OrganizationId: "org-2"}
+
+			_, err := handler.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			directory.AddOrganization(&grpc_organization_go.Organization{OrganizationId: "org-2"})
+			response, err := handler.GetOrganizationApplicationStats(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.ServiceInstanceStats).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should coalesce concurrent requests", func() {
+			handler, derr := NewHandler(context.Background(), manager, testCacheConfig)
+			gomega.Expect(derr).To(gomega.Succeed())
+			collectors["cluster-1"].delay = 100 * time.Millisecond
+			request := &grpc_monitoring_go.OrganizationApplicationStatsRequest{OrganizationId: testOrganizationId}
+
+			responses := make(chan *grpc_monitoring_go.OrganizationApplicationStatsResponse, 10)
+			for i := 0; i < 10; i++ {
+				go func() {
+					defer ginkgo.GinkgoRecover()
+					response, err := handler.GetOrganizationApplicationStats(context.Background(), request)
+					gomega.Expect(err).To(gomega.Succeed())
+					responses <- response
+				}()
+			}
+			first := <-responses
+			for i := 1; i < 10; i++ {
+				gomega.Eventually(responses).Should(gomega.Receive(gomega.BeIdenticalTo(first)))
+			}
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+		})
+
+		ginkgo.It("should cache cluster summaries by cluster and range", func() {
+			handler, derr := NewHandler(context.Background(), manager, testCacheConfig)
+			gomega.Expect(derr).To(gomega.Succeed())
+			request := &grpc_monitoring_go.ClusterSummaryRequest{OrganizationId: testOrganizationId, ClusterId: "cluster-1", RangeMinutes: 5}
+
+			first, err := handler.GetClusterSummary(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			second, err := handler.GetClusterSummary(context.Background(), request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(second).To(gomega.BeIdenticalTo(first))
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(1)))
+
+			_, err = handler.GetClusterSummary(context.Background(), &grpc_monitoring_go.ClusterSummaryRequest{OrganizationId: testOrganizationId, ClusterId: "cluster-1", RangeMinutes: 10})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(atomic.LoadInt32(&collectors["cluster-1"].calls)).To(gomega.Equal(int32(2)))
+		})
+	})
+})
@@ -19,9 +19,16 @@ package server
 import (
 	"fmt"
 	grpc_organization_go "github.com/nalej/grpc-organization-go"
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/nalej/monitoring/internal/pkg/certs"
+	"github.com/nalej/monitoring/internal/pkg/cost"
+	"github.com/nalej/monitoring/internal/pkg/health"
+	"github.com/nalej/monitoring/internal/pkg/lifecycle"
 	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/clients"
 	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/server/asset"
+	"github.com/nalej/monitoring/internal/pkg/usage"
 	"net"
+	"net/http"
 
 	"github.com/nalej/derrors"
 
@@ -30,8 +37,11 @@ import (
 	"github.com/nalej/grpc-inventory-go"
 	"github.com/nalej/grpc-monitoring-go"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -53,32 +63,62 @@ func NewService(conf *Config) (*Service, derrors.Error) {
 	}, nil
 }
 
-// Run the service, launch the REST service handler.
+// Run the service, launch the gRPC handler and wait for termination.
 func (s *Service) Run() derrors.Error {
+	service := lifecycle.New(s.Configuration.ShutdownTimeout)
+
 	// Create system model connection
 	smConn, err := grpc.Dial(s.Configuration.SystemModelAddress, grpc.WithInsecure())
 	if err != nil {
 		return derrors.NewUnavailableError("cannot create connection with the system model", err)
 	}
+	service.AddCloser("system-model", smConn)
 
 	// Create Edge Inventory Proxy connection
 	eipConn, err := grpc.Dial(s.Configuration.EdgeInventoryProxyAddress, grpc.WithInsecure())
 	if err != nil {
+		service.Shutdown()
 		return derrors.NewUnavailableError("cannot create connection with the edge inventory proxy", err)
 	}
+	service.AddCloser("edge-inventory-proxy", eipConn)
 
-	// Create clients
-	clustersClient := grpc_infrastructure_go.NewClustersClient(smConn)
-	organizationsClient := grpc_organization_go.NewOrganizationsClient(smConn)
-	assetsClient := grpc_inventory_go.NewAssetsClient(smConn)
-	controllersClient := grpc_inventory_go.NewControllersClient(smConn)
-	eipClient := grpc_edge_inventory_proxy_go.NewEdgeControllerProxyClient(eipConn)
+	// Circuit breakers of the application clusters
+	breakers := breaker.NewRegistry(s.Configuration.ClusterBreakerFailures, s.Configuration.ClusterBreakerOpenTimeout)
+
+	server, derr := s.newServer(smConn, eipConn, breakers, service)
+	if derr != nil {
+		service.Shutdown()
+		return derr
+	}
+
+	if s.Configuration.MetricsPort > 0 {
+		derr = s.serveMetrics(breakers, service)
+		if derr != nil {
+			service.Shutdown()
+			return derr
+		}
+	}
 
 	// Start listening
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.Port))
 	if err != nil {
+		service.Shutdown()
 		return derrors.NewUnavailableError("failed to listen", err)
 	}
+	service.ServeGRPC("monitoring-manager", server, lis)
+
+	return service.Wait()
+}
+
+// newServer creates the gRPC server with the monitoring handlers and the
+// health checks of their dependencies.
+func (s *Service) newServer(smConn *grpc.ClientConn, eipConn *grpc.ClientConn, breakers *breaker.Registry, service *lifecycle.Lifecycle) (*grpc.Server, derrors.Error) {
+	// Create clients
+	clustersClient := grpc_infrastructure_go.NewClustersClient(smConn)
+	organizationsClient := grpc_organization_go.NewOrganizationsClient(smConn)
+	assetsClient := grpc_inventory_go.NewAssetsClient(smConn)
+	controllersClient := grpc_inventory_go.NewControllersClient(smConn)
+	eipClient := grpc_edge_inventory_proxy_go.NewEdgeControllerProxyClient(eipConn)
 
 	// Create managers and handler
 	params := &clients.AppClusterConnectParams{
@@ -90,33 +130,109 @@ func (s *Service) Run() derrors.Error {
 		SkipServerCertValidation: s.Configuration.SkipServerCertValidation,
 	}
 
-	// Cluster monitoring
-	clusterManager, derr := NewManager(&clustersClient, &organizationsClient, params)
+	// Cluster monitoring. Connections to the app clusters are shared and
+	// closed once the server has stopped.
+	clientPool := clients.NewClientPool(params, s.Configuration.AppClusterIdleTimeout, s.Configuration.AppClusterKeepalive)
+	service.Go("app-cluster-clients", clientPool.Run)
+	service.AddCloser("app-cluster-clients", clientPool)
+	directory := clients.NewSystemModelDirectory(clustersClient, organizationsClient)
+	retry := breaker.DefaultRetry()
+	retry.Attempts = s.Configuration.ClusterReadAttempts
+	clusterManager, derr := NewManager(directory, clientPool, breakers, retry, s.Configuration.ClusterHostnameTTL)
 	if derr != nil {
-		return derr
+		return nil, derr
+	}
+	if s.Configuration.CollectionInterval > 0 {
+		// Answer from the latest stats collected in the background
+		clusterManager.snapshots = NewSnapshotStore(snapshotIntervals * s.Configuration.CollectionInterval)
+		collector := NewCollector(&clusterManager, s.Configuration.CollectionInterval, s.Configuration.CollectionParallelism, s.Configuration.CollectionJitter)
+		service.Go("collector", collector.Run)
+	}
+	if s.Configuration.UsageStorePath != "" {
+		// Record the usage history, closing the store once the recorder has stopped
+		usageStore, derr := usage.Open(s.Configuration.UsageStorePath)
+		if derr != nil {
+			return nil, derr
+		}
+		service.AddCloser("usage-store", usageStore)
+		clusterManager.usageStore = usageStore
+		if s.Configuration.PricingPath != "" {
+			clusterManager.pricing, derr = cost.LoadPricing(s.Configuration.PricingPath)
+			if derr != nil {
+				return nil, derr
+			}
+		}
+		recorder := NewUsageRecorder(&clusterManager, s.Configuration.UsageSampleInterval, s.Configuration.UsageHourlyRetention, s.Configuration.UsageRetention)
+		service.Go("usage-recorder", recorder.Run)
 	}
-	clusterHandler, derr := NewHandler(clusterManager, s.Configuration.CacheTTL)
+	clusterHandler, derr := NewHandler(service.Context(), clusterManager, CacheConfig{
+		OrganizationApplicationStatsTTL: s.Configuration.CacheTTL,
+		ClusterSummaryTTL:               s.Configuration.ClusterSummaryCacheTTL,
+		ClusterStatsTTL:                 s.Configuration.ClusterStatsCacheTTL,
+		MaxStale:                        s.Configuration.CacheMaxStale,
+	})
 	if derr != nil {
-		return derr
+		return nil, derr
 	}
 
 	// Asset monitoring
 	assetManager, derr := asset.NewManager(eipClient, assetsClient, controllersClient)
 	if derr != nil {
-		return derr
+		return nil, derr
 	}
 	assetHandler, derr := asset.NewHandler(assetManager)
+	if derr != nil {
+		return nil, derr
+	}
 
-	// Create server and register handler
-	server := grpc.NewServer()
+	// Create server and register handler. In-flight requests, and the
+	// fan-outs to the application clusters, are drained on shutdown and
+	// only cancelled when the shutdown deadline passes.
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(service.UnaryServerInterceptor())}
+	if s.Configuration.ServerCertPath != "" {
+		tlsConfig, derr := certs.ServerTLSConfig(s.Configuration.ServerCertPath, s.Configuration.ClientCACertPath)
+		if derr != nil {
+			return nil, derr
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
 	grpc_monitoring_go.RegisterMonitoringManagerServer(server, clusterHandler)
 	grpc_monitoring_go.RegisterAssetMonitoringServer(server, assetHandler)
 
+	// Cluster monitoring needs the system model; asset monitoring the
+	// edge inventory proxy as well
+	systemModel := health.Dependency{Name: "system-model", Check: health.ConnectionCheck(smConn)}
+	edgeInventoryProxy := health.Dependency{Name: "edge-inventory-proxy", Check: health.ConnectionCheck(eipConn)}
+	checker := health.NewChecker(health.DefaultInterval, health.DefaultTimeout)
+	checker.AddService(health.MonitoringManagerService, systemModel)
+	checker.AddService(health.AssetMonitoringService, systemModel, edgeInventoryProxy)
+	checker.Register(server)
+	service.Go("health", checker.Run)
+
 	reflection.Register(server)
-	log.Info().Int("port", s.Configuration.Port).Msg("Launching gRPC server")
-	if err := server.Serve(lis); err != nil {
-		return derrors.NewUnavailableError("failed to serve", err)
+
+	return server, nil
+}
+
+// serveMetrics serves the "/metrics" endpoint with the state of the
+// circuit breakers of the application clusters.
+func (s *Service) serveMetrics(breakers *breaker.Registry, service *lifecycle.Lifecycle) derrors.Error {
+	// Only our own metrics, not the default internal measurements
+	registry := prometheus.NewRegistry()
+	err := registry.Register(&breakerCollector{breakers: breakers})
+	if err != nil {
+		return derrors.NewInternalError("unable to register breaker metrics with prometheus", err)
 	}
 
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.MetricsPort))
+	if err != nil {
+		return derrors.NewUnavailableError("failed to listen", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	service.ServeHTTP("monitoring-manager-metrics", &http.Server{Handler: mux}, lis)
+
 	return nil
 }
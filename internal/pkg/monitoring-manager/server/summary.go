@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Resource summary of all the clusters of an organization
+
+package server
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/rs/zerolog/log"
+)
+
+// GetOrganizationClusterSummary retrieves the summary of every cluster of an organization concurrently and
+// adds them up. CPU is normalized with the conversion factor of each cluster, both in the totals and in the
+// per-cluster breakdown. Clusters that can't be queried are flagged as missing and left out of the totals.
+func (m *Manager) GetOrganizationClusterSummary(ctx context.Context, request *grpc_monitoring_go.OrganizationClusterSummaryRequest) (*grpc_monitoring_go.OrganizationClusterSummary, error) {
+	organization, clusterList, derr := m.getOrganizationClusters(ctx, request.OrganizationId)
+	if derr != nil {
+		return nil, derr
+	}
+
+	summaryFutures := make([]chan *grpc_monitoring_go.ClusterSummaryEntry, 0, len(clusterList.Clusters))
+	for _, cluster := range clusterList.Clusters {
+		summaryFuture := make(chan *grpc_monitoring_go.ClusterSummaryEntry, 1)
+		summaryFutures = append(summaryFutures, summaryFuture)
+		go m.getClusterSummaryEntry(cluster, request.RangeMinutes, ctx, summaryFuture)
+	}
+
+	total := newClusterSummary(organization.OrganizationId, "")
+	entries := make([]*grpc_monitoring_go.ClusterSummaryEntry, 0, len(summaryFutures))
+	for _, summaryFuture := range summaryFutures {
+		entry := <-summaryFuture
+		if !entry.Missing {
+			addClusterSummary(total, entry.Summary)
+		}
+		entries = append(entries, entry)
+	}
+
+	return &grpc_monitoring_go.OrganizationClusterSummary{
+		OrganizationId: organization.OrganizationId,
+		Total:          total,
+		Clusters:       entries,
+		Timestamp:      time.Now().UnixNano() / 1000000,
+	}, nil
+}
+
+// getClusterSummaryEntry retrieves the normalized summary of a cluster, flagging the cluster as missing if
+// it can't be queried
+func (m *Manager) getClusterSummaryEntry(cluster *grpc_infrastructure_go.Cluster, rangeMinutes int32, ctx context.Context, summaryFuture chan *grpc_monitoring_go.ClusterSummaryEntry) {
+	entry := &grpc_monitoring_go.ClusterSummaryEntry{
+		ClusterId:   cluster.ClusterId,
+		ClusterName: cluster.Name,
+	}
+
+	request := &grpc_monitoring_go.ClusterSummaryRequest{
+		OrganizationId: cluster.OrganizationId,
+		ClusterId:      cluster.ClusterId,
+		RangeMinutes:   rangeMinutes,
+	}
+	var summary *grpc_monitoring_go.ClusterSummary
+	err := m.callCluster(ctx, cluster.OrganizationId, cluster.ClusterId, func(ctx context.Context, client grpc_app_cluster_api_go.MetricsCollectorClient) error {
+		var err error
+		summary, err = client.GetClusterSummary(ctx, request)
+		return err
+	})
+	if err != nil {
+		log.Error().
+			Str("organizationId", cluster.OrganizationId).
+			Str("clusterId", cluster.ClusterId).
+			Err(err).
+			Msg("could not query the metrics-collector for the cluster summary. The summary will not include this cluster.")
+		entry.Missing = true
+		entry.Error = err.Error()
+		summaryFuture <- entry
+		return
+	}
+
+	entry.Summary = normalizeClusterSummary(summary, cluster.MillicoresConversionFactor)
+	summaryFuture <- entry
+}
+
+// newClusterSummary creates an empty summary
+func newClusterSummary(organizationId string, clusterId string) *grpc_monitoring_go.ClusterSummary {
+	return &grpc_monitoring_go.ClusterSummary{
+		OrganizationId:     organizationId,
+		ClusterId:          clusterId,
+		CpuMillicores:      &grpc_monitoring_go.ClusterStat{},
+		MemoryBytes:        &grpc_monitoring_go.ClusterStat{},
+		StorageBytes:       &grpc_monitoring_go.ClusterStat{},
+		UsableStorageBytes: &grpc_monitoring_go.ClusterStat{},
+		Network:            &grpc_monitoring_go.ClusterNetworkStat{},
+	}
+}
+
+// normalizeClusterSummary returns a copy of the summary of a cluster with its CPU in reference millicores
+func normalizeClusterSummary(summary *grpc_monitoring_go.ClusterSummary, millicoresConversionFactor float64) *grpc_monitoring_go.ClusterSummary {
+	normalized := proto.Clone(summary).(*grpc_monitoring_go.ClusterSummary)
+	if cpu := normalized.GetCpuMillicores(); cpu != nil {
+		cpu.Total = int64(math.Round(float64(cpu.Total) * millicoresConversionFactor))
+		cpu.Available = int64(math.Round(float64(cpu.Available) * millicoresConversionFactor))
+	}
+	return normalized
+}
+
+// addClusterSummary adds the values of the summary of a cluster to a total. Values the cluster could not
+// retrieve are reported in the errors of the total by cluster.
+func addClusterSummary(total *grpc_monitoring_go.ClusterSummary, summary *grpc_monitoring_go.ClusterSummary) {
+	addClusterStat(total.CpuMillicores, summary.GetCpuMillicores())
+	addClusterStat(total.MemoryBytes, summary.GetMemoryBytes())
+	addClusterStat(total.StorageBytes, summary.GetStorageBytes())
+	addClusterStat(total.UsableStorageBytes, summary.GetUsableStorageBytes())
+
+	network := summary.GetNetwork()
+	total.Network.ReceiveBytePerSec += network.GetReceiveBytePerSec()
+	total.Network.TransmitBytePerSec += network.GetTransmitBytePerSec()
+	total.Network.ReceiveDropPerSec += network.GetReceiveDropPerSec()
+	total.Network.TransmitDropPerSec += network.GetTransmitDropPerSec()
+
+	for key, message := range summary.GetErrors() {
+		if total.Errors == nil {
+			total.Errors = make(map[string]string)
+		}
+		total.Errors[summary.GetClusterId()+"/"+key] = message
+	}
+}
+
+func addClusterStat(total *grpc_monitoring_go.ClusterStat, stat *grpc_monitoring_go.ClusterStat) {
+	total.Total += stat.GetTotal()
+	total.Available += stat.GetAvailable()
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Unhealthy service instances based on the container health signals
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/nalej/grpc-monitoring-go"
+)
+
+// Waiting reasons that are part of a regular container start
+var startupWaitingReasons = map[string]bool{
+	"ContainerCreating": true,
+	"PodInitializing":   true,
+}
+
+// Termination reasons that indicate the container failed
+var failedTerminationReasons = map[string]bool{
+	"OOMKilled":          true,
+	"Error":              true,
+	"ContainerCannotRun": true,
+	"DeadlineExceeded":   true,
+}
+
+// ListUnhealthyServiceInstances retrieves the service instances of an organization, in all its clusters,
+// with containers that are waiting for anything other than a regular start or that failed the last time
+// they terminated
+func (m *Manager) ListUnhealthyServiceInstances(ctx context.Context, request *grpc_monitoring_go.OrganizationApplicationStatsRequest) (*grpc_monitoring_go.UnhealthyServiceInstanceList, error) {
+	organization, clustersStats, derr := m.organizationContainerStats(ctx, request.OrganizationId, request.AppInstanceId)
+	if derr != nil {
+		return nil, derr
+	}
+
+	unhealthyByClusterServiceInstance := make(map[string]*grpc_monitoring_go.UnhealthyServiceInstance, 0)
+	for _, clusterStats := range clustersStats {
+		for _, containerStats := range clusterStats.containerStats {
+			reasons := unhealthyReasons(containerStats)
+			if len(reasons) == 0 {
+				continue
+			}
+
+			key := clusterStats.cluster.ClusterId + "/" + containerStats.ServiceInstanceId
+			unhealthy, found := unhealthyByClusterServiceInstance[key]
+			if !found {
+				unhealthy = &grpc_monitoring_go.UnhealthyServiceInstance{
+					OrganizationId:           organization.OrganizationId,
+					OrganizationName:         organization.Name,
+					ClusterId:                clusterStats.cluster.ClusterId,
+					ClusterName:              clusterStats.cluster.Name,
+					AppInstanceId:            containerStats.AppInstanceId,
+					AppInstanceName:          containerStats.AppInstanceName,
+					ServiceGroupInstanceId:   containerStats.ServiceGroupInstanceId,
+					ServiceGroupInstanceName: containerStats.ServiceGroupInstanceName,
+					ServiceInstanceId:        containerStats.ServiceInstanceId,
+					ServiceInstanceName:      containerStats.ServiceInstanceName,
+				}
+				unhealthyByClusterServiceInstance[key] = unhealthy
+			}
+			unhealthy.RestartCount += containerStats.RestartCount
+			for _, reason := range reasons {
+				unhealthy.Reasons = append(unhealthy.Reasons, fmt.Sprintf("%s/%s: %s", containerStats.Pod, containerStats.Container, reason))
+			}
+		}
+	}
+
+	serviceInstances := make([]*grpc_monitoring_go.UnhealthyServiceInstance, 0, len(unhealthyByClusterServiceInstance))
+	for _, unhealthy := range unhealthyByClusterServiceInstance {
+		serviceInstances = append(serviceInstances, unhealthy)
+	}
+	// Most restarted first, those are the ones to look at
+	sort.Slice(serviceInstances, func(i, j int) bool {
+		return serviceInstances[i].RestartCount > serviceInstances[j].RestartCount
+	})
+
+	return &grpc_monitoring_go.UnhealthyServiceInstanceList{
+		ServiceInstances: serviceInstances,
+	}, nil
+}
+
+// unhealthyReasons returns why a container is considered unhealthy, if it is
+func unhealthyReasons(containerStats *grpc_monitoring_go.ContainerStats) []string {
+	reasons := make([]string, 0)
+	waitingReason := containerStats.GetWaitingReason()
+	if waitingReason != "" && !startupWaitingReasons[waitingReason] {
+		reasons = append(reasons, waitingReason)
+	}
+	terminationReason := containerStats.GetLastTerminationReason()
+	if failedTerminationReasons[terminationReason] {
+		reasons = append(reasons, fmt.Sprintf("last terminated with %s after %d restarts", terminationReason, containerStats.GetRestartCount()))
+	}
+	return reasons
+}
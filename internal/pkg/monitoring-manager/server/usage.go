@@ -0,0 +1,226 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Recording and reporting of the resource usage history
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/monitoring/internal/pkg/usage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultUsageSampleInterval is the time between samples of the usage of every organization
+	DefaultUsageSampleInterval = time.Minute
+	// Samples account for the time since the previous one up to this many intervals, so usage is not
+	// billed over the time the service was down
+	maxSampleIntervals = 2
+)
+
+// usageAggregationLevels keep the usage of each service instance on every cluster apart, as clusters are
+// priced separately
+var usageAggregationLevels = []grpc_monitoring_go.AggregationLevel{
+	grpc_monitoring_go.AggregationLevel_SERVICE_INSTANCE,
+	grpc_monitoring_go.AggregationLevel_CLUSTER,
+}
+
+// UsageRecorder periodically samples the application stats of every
+// organization, and integrates them into the usage totals of a store
+type UsageRecorder struct {
+	manager         *Manager
+	store           *usage.Store
+	interval        time.Duration
+	hourlyRetention time.Duration
+	retention       time.Duration
+	now             func() time.Time
+	// Time of the previous sample and roll-up
+	lastSample time.Time
+	lastRollup time.Time
+}
+
+// NewUsageRecorder creates a recorder storing in the usage store of a manager, rolling up the totals older
+// than hourlyRetention into daily ones and removing those older than retention
+func NewUsageRecorder(manager *Manager, interval time.Duration, hourlyRetention time.Duration, retention time.Duration) *UsageRecorder {
+	return &UsageRecorder{
+		manager:         manager,
+		store:           manager.usageStore,
+		interval:        interval,
+		hourlyRetention: hourlyRetention,
+		retention:       retention,
+		now:             time.Now,
+	}
+}
+
+// Run samples every interval until the context is cancelled
+func (r *UsageRecorder) Run(ctx context.Context) {
+	for {
+		r.record(ctx)
+		r.rollup()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// record samples the usage of every organization. Clusters that can't be queried add no usage.
+func (r *UsageRecorder) record(ctx context.Context) {
+	now := r.now()
+	from := now.Add(-r.interval)
+	if !r.lastSample.IsZero() && now.Sub(r.lastSample) <= maxSampleIntervals*r.interval {
+		from = r.lastSample
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	organizations, derr := r.manager.directory.ListOrganizations(listCtx)
+	cancel()
+	if derr != nil {
+		log.Error().Str("err", derr.DebugReport()).Err(derr).Msg("could not list organizations to record their usage")
+		return
+	}
+
+	for _, organization := range organizations {
+		if ctx.Err() != nil {
+			// Shutting down, the clusters can't be queried
+			return
+		}
+		_, clustersStats, derr := r.manager.organizationContainerStats(ctx, organization.OrganizationId, nil)
+		if derr != nil {
+			log.Error().Str("organizationId", organization.OrganizationId).Str("err", derr.DebugReport()).Err(derr).
+				Msg("could not retrieve the usage of an organization")
+			continue
+		}
+		derr = r.store.Add(organization.OrganizationId, from, now, organizationUsages(organization, clustersStats))
+		if derr != nil {
+			log.Error().Str("organizationId", organization.OrganizationId).Str("err", derr.DebugReport()).Err(derr).
+				Msg("could not record the usage of an organization")
+		}
+	}
+	r.lastSample = now
+}
+
+// organizationUsages returns the usage of every service instance of an organization on each of its clusters
+func organizationUsages(organization *grpc_organization_go.Organization, clustersStats []*clusterContainerStats) []usage.Usage {
+	stats := aggregateStats(organization, clustersStats, usageAggregationLevels)
+	usages := make([]usage.Usage, 0, len(stats))
+	for _, serviceInstanceStats := range stats {
+		usages = append(usages, usage.Usage{
+			ClusterId:                serviceInstanceStats.ClusterId,
+			AppInstanceId:            serviceInstanceStats.AppInstanceId,
+			AppInstanceName:          serviceInstanceStats.AppInstanceName,
+			ServiceGroupInstanceId:   serviceInstanceStats.ServiceGroupInstanceId,
+			ServiceGroupInstanceName: serviceInstanceStats.ServiceGroupInstanceName,
+			ServiceInstanceId:        serviceInstanceStats.ServiceInstanceId,
+			ServiceInstanceName:      serviceInstanceStats.ServiceInstanceName,
+			CpuMillicore:             serviceInstanceStats.CpuMillicore,
+			MemoryByte:               serviceInstanceStats.MemoryByte,
+			StorageByte:              serviceInstanceStats.StorageByte,
+		})
+	}
+	return usages
+}
+
+// rollup rolls up the usage totals once per hour
+func (r *UsageRecorder) rollup() {
+	now := r.now()
+	if now.Sub(r.lastRollup) < time.Hour {
+		return
+	}
+	derr := r.store.Rollup(now, r.hourlyRetention, r.retention)
+	if derr != nil {
+		log.Error().Str("err", derr.DebugReport()).Err(derr).Msg("could not roll up usage")
+		return
+	}
+	r.lastRollup = now
+}
+
+// GetUsageReport retrieves the resource usage of an organization over a period, by service instance, by
+// app instance and in total
+func (m *Manager) GetUsageReport(_ context.Context, request *grpc_monitoring_go.UsageReportRequest) (*grpc_monitoring_go.UsageReport, error) {
+	if m.usageStore == nil {
+		return nil, derrors.NewFailedPreconditionError("usage history is not enabled")
+	}
+	if request.FromTimestamp == 0 || request.ToTimestamp == 0 {
+		return nil, derrors.NewInvalidArgumentError("from_timestamp and to_timestamp must be set")
+	}
+	if request.ToTimestamp <= request.FromTimestamp {
+		return nil, derrors.NewInvalidArgumentError("to_timestamp must be after from_timestamp").
+			WithParams(request.FromTimestamp, request.ToTimestamp)
+	}
+
+	totals, derr := m.usageStore.Report(request.OrganizationId, time.Unix(request.FromTimestamp, 0), time.Unix(request.ToTimestamp, 0), request.AppInstanceId)
+	if derr != nil {
+		return nil, derr
+	}
+
+	report := &grpc_monitoring_go.UsageReport{
+		OrganizationId:   request.OrganizationId,
+		FromTimestamp:    request.FromTimestamp,
+		ToTimestamp:      request.ToTimestamp,
+		ServiceInstances: make([]*grpc_monitoring_go.ResourceUsage, 0, len(totals)),
+		AppInstances:     make([]*grpc_monitoring_go.ResourceUsage, 0),
+		Total:            &grpc_monitoring_go.ResourceUsage{},
+	}
+	// Totals are sorted by app instance and service instance, with one per cluster
+	var appInstance *grpc_monitoring_go.ResourceUsage
+	var serviceInstance *grpc_monitoring_go.ResourceUsage
+	for _, total := range totals {
+		clusterUsage := &grpc_monitoring_go.ResourceUsage{
+			CpuCoreHours:  total.CpuCoreHours(),
+			MemoryGbHours: total.MemoryGbHours(),
+			StorageGbDays: total.StorageGbDays(),
+		}
+		if appInstance == nil || appInstance.AppInstanceId != total.AppInstanceId {
+			appInstance = &grpc_monitoring_go.ResourceUsage{
+				AppInstanceId:   total.AppInstanceId,
+				AppInstanceName: total.AppInstanceName,
+			}
+			report.AppInstances = append(report.AppInstances, appInstance)
+			serviceInstance = nil
+		}
+		if serviceInstance == nil || serviceInstance.ServiceInstanceId != total.ServiceInstanceId {
+			serviceInstance = &grpc_monitoring_go.ResourceUsage{
+				AppInstanceId:            total.AppInstanceId,
+				AppInstanceName:          total.AppInstanceName,
+				ServiceGroupInstanceId:   total.ServiceGroupInstanceId,
+				ServiceGroupInstanceName: total.ServiceGroupInstanceName,
+				ServiceInstanceId:        total.ServiceInstanceId,
+				ServiceInstanceName:      total.ServiceInstanceName,
+			}
+			report.ServiceInstances = append(report.ServiceInstances, serviceInstance)
+		}
+		addResourceUsage(serviceInstance, clusterUsage)
+		addResourceUsage(appInstance, clusterUsage)
+		addResourceUsage(report.Total, clusterUsage)
+	}
+
+	return report, nil
+}
+
+func addResourceUsage(total *grpc_monitoring_go.ResourceUsage, other *grpc_monitoring_go.ResourceUsage) {
+	total.CpuCoreHours += other.CpuCoreHours
+	total.MemoryGbHours += other.MemoryGbHours
+	total.StorageGbDays += other.StorageGbDays
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Usage history tests
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-monitoring-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/monitoring/internal/pkg/breaker"
+	"github.com/nalej/monitoring/internal/pkg/cost"
+	"github.com/nalej/monitoring/internal/pkg/monitoring-manager/clients"
+	"github.com/nalej/monitoring/internal/pkg/usage"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("usage history", func() {
+
+	var dir string
+	var collector *fakeCollector
+	var manager Manager
+	var recorder *UsageRecorder
+	var now time.Time
+	start := time.Date(2019, 10, 1, 10, 5, 0, 0, time.UTC)
+
+	ginkgo.BeforeEach(func() {
+		// CPU in cores / 1000, doubled by the conversion factor of the cluster
+		web := containerStats("app-1", "service-1", 0.0005, usage.GB)
+		web.StorageByte = 10 * usage.GB
+		collector = &fakeCollector{stats: []*grpc_monitoring_go.ContainerStats{
+			web,
+			containerStats("app-1", "service-2", 0.00025, 0),
+			containerStats("app-2", "service-3", 0.001, 0),
+		}}
+
+		directory := clients.NewMemoryDirectory()
+		factory := clients.NewMemoryClientFactory()
+		factory.Add("cluster-1.example.com", collector)
+		directory.AddOrganization(&grpc_organization_go.Organization{OrganizationId: testOrganizationId, Name: "Org"}, &grpc_infrastructure_go.Cluster{
+			OrganizationId:             testOrganizationId,
+			ClusterId:                  "cluster-1",
+			Hostname:                   "cluster-1.example.com",
+			MillicoresConversionFactor: 2,
+		})
+
+		var derr error
+		manager, derr = NewManager(directory, factory, breaker.NewRegistry(10, time.Minute), breaker.Retry{Attempts: 1}, time.Minute)
+		gomega.Expect(derr).To(gomega.Succeed())
+		manager.clusterTimeout = 200 * time.Millisecond
+
+		var err error
+		dir, err = ioutil.TempDir("", "usage")
+		gomega.Expect(err).To(gomega.Succeed())
+		manager.usageStore, derr = usage.Open(filepath.Join(dir, "usage.db"))
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		now = start
+		recorder = NewUsageRecorder(&manager, time.Minute, usage.DefaultHourlyRetention, usage.DefaultRetention)
+		recorder.now = func() time.Time { return now }
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(manager.usageStore.Close()).To(gomega.Succeed())
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	getReport := func(appInstanceIds ...string) *grpc_monitoring_go.UsageReport {
+		report, err := manager.GetUsageReport(context.Background(), &grpc_monitoring_go.UsageReportRequest{
+			OrganizationId: testOrganizationId,
+			FromTimestamp:  start.Truncate(time.Hour).Unix(),
+			ToTimestamp:    start.Truncate(time.Hour).Add(time.Hour).Unix(),
+			AppInstanceId:  appInstanceIds,
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		return report
+	}
+
+	ginkgo.It("should report the usage recorded over time", func() {
+		recorder.record(context.Background())
+		now = now.Add(time.Minute)
+		recorder.record(context.Background())
+		// Usage is not recorded for the time the samples were missed
+		now = now.Add(10 * time.Minute)
+		recorder.record(context.Background())
+
+		report := getReport()
+		gomega.Expect(report.ServiceInstances).To(gomega.HaveLen(3))
+		web := report.ServiceInstances[0]
+		gomega.Expect(web.ServiceInstanceId).To(gomega.Equal("service-1"))
+		// A normalized core for three minutes
+		gomega.Expect(web.CpuCoreHours).To(gomega.BeNumerically("~", 0.05, 1e-9))
+		gomega.Expect(web.MemoryGbHours).To(gomega.BeNumerically("~", 0.05, 1e-9))
+		gomega.Expect(web.StorageGbDays).To(gomega.BeNumerically("~", 0.5/24, 1e-9))
+
+		gomega.Expect(report.AppInstances).To(gomega.HaveLen(2))
+		gomega.Expect(report.AppInstances[0].AppInstanceId).To(gomega.Equal("app-1"))
+		gomega.Expect(report.AppInstances[0].CpuCoreHours).To(gomega.BeNumerically("~", 0.075, 1e-9))
+		gomega.Expect(report.AppInstances[1].CpuCoreHours).To(gomega.BeNumerically("~", 0.1, 1e-9))
+		gomega.Expect(report.Total.CpuCoreHours).To(gomega.BeNumerically("~", 0.175, 1e-9))
+
+		report = getReport("app-2")
+		gomega.Expect(report.ServiceInstances).To(gomega.HaveLen(1))
+		gomega.Expect(report.Total.CpuCoreHours).To(gomega.BeNumerically("~", 0.1, 1e-9))
+	})
+
+	ginkgo.It("should report the cost of the usage", func() {
+		manager.pricing = &cost.Pricing{Currency: "EUR", Default: cost.Prices{MillicoreHour: 0.001, BaseHour: 1}}
+		recorder.record(context.Background())
+		now = now.Add(time.Minute)
+		recorder.record(context.Background())
+		now = now.Add(time.Minute)
+		recorder.record(context.Background())
+
+		getCostReport := func(appInstanceIds ...string) *grpc_monitoring_go.CostReport {
+			report, err := manager.GetCostReport(context.Background(), &grpc_monitoring_go.CostReportRequest{
+				OrganizationId: testOrganizationId,
+				FromTimestamp:  start.Truncate(time.Hour).Unix(),
+				ToTimestamp:    start.Truncate(time.Hour).Add(time.Hour).Unix(),
+				AppInstanceId:  appInstanceIds,
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			return report
+		}
+
+		report := getCostReport()
+		gomega.Expect(report.Currency).To(gomega.Equal("EUR"))
+		gomega.Expect(report.ServiceInstances).To(gomega.HaveLen(3))
+		// A normalized core for three minutes
+		gomega.Expect(report.ServiceInstances[0].CpuCost).To(gomega.BeNumerically("~", 0.05, 1e-9))
+		// The base cost of the hour is split by the share of the CPU cost
+		gomega.Expect(report.ServiceInstances[0].BaseCost).To(gomega.BeNumerically("~", 0.05/0.175, 1e-9))
+		gomega.Expect(report.ServiceGroupInstances).To(gomega.HaveLen(2))
+		gomega.Expect(report.AppInstances).To(gomega.HaveLen(2))
+		gomega.Expect(report.AppInstances[0].Cost).To(gomega.BeNumerically("~", 0.075+0.075/0.175, 1e-9))
+		gomega.Expect(report.Total.Cost).To(gomega.BeNumerically("~", 1.175, 1e-9))
+		gomega.Expect(report.UnallocatedCost).To(gomega.BeZero())
+
+		// The base cost is still shared with every app instance
+		report = getCostReport("app-2")
+		gomega.Expect(report.ServiceInstances).To(gomega.HaveLen(1))
+		gomega.Expect(report.Total.Cost).To(gomega.BeNumerically("~", 0.1+0.1/0.175, 1e-9))
+
+		// Periods are aligned to the hour for the usage and the base cost
+		report, err := manager.GetCostReport(context.Background(), &grpc_monitoring_go.CostReportRequest{
+			OrganizationId: testOrganizationId,
+			FromTimestamp:  start.Unix(),
+			ToTimestamp:    start.Add(time.Hour).Unix(),
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(report.FromTimestamp).To(gomega.Equal(start.Truncate(time.Hour).Add(time.Hour).Unix()))
+		gomega.Expect(report.ToTimestamp).To(gomega.Equal(start.Truncate(time.Hour).Add(2 * time.Hour).Unix()))
+		gomega.Expect(report.ServiceInstances).To(gomega.BeEmpty())
+		gomega.Expect(report.UnallocatedCost).To(gomega.BeNumerically("~", 1, 1e-9))
+	})
+
+	ginkgo.It("should not record usage of clusters that can't be queried", func() {
+		collector.err = status.Error(codes.Unavailable, "cluster down")
+		recorder.record(context.Background())
+		gomega.Expect(getReport().ServiceInstances).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should reject invalid periods", func() {
+		from := start.Truncate(time.Hour).Unix()
+		for _, period := range [][2]int64{{0, from}, {from, 0}, {from, from}, {from + 3600, from}} {
+			_, err := manager.GetUsageReport(context.Background(), &grpc_monitoring_go.UsageReportRequest{
+				OrganizationId: testOrganizationId,
+				FromTimestamp:  period[0],
+				ToTimestamp:    period[1],
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.(derrors.Error).Type()).To(gomega.Equal(derrors.InvalidArgument))
+		}
+	})
+
+	ginkgo.It("should fail if usage is not recorded or priced", func() {
+		withoutHistory := manager
+		withoutHistory.usageStore = nil
+		_, err := withoutHistory.GetUsageReport(context.Background(), &grpc_monitoring_go.UsageReportRequest{OrganizationId: testOrganizationId})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, err = manager.GetCostReport(context.Background(), &grpc_monitoring_go.CostReportRequest{OrganizationId: testOrganizationId})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cache refreshing its values in the background and coalescing concurrent loads
+
+package refresh
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxStale is the time values are served after expiring while they are refreshed
+	DefaultMaxStale = 5 * time.Minute
+	// DefaultLoadTimeout is the maximum duration of a load
+	DefaultLoadTimeout = time.Minute
+	// Values are refreshed once they reach this fraction of their TTL
+	refreshFraction = 0.75
+)
+
+// Loader loads the value of a key
+type Loader func(ctx context.Context) (interface{}, error)
+
+// entry is a loaded value
+type entry struct {
+	value    interface{}
+	loadedAt time.Time
+}
+
+// load is a load in progress, shared by every request of its key
+type load struct {
+	done     chan struct{}
+	value    interface{}
+	loadedAt time.Time
+	err      error
+}
+
+// Cache keeps the values of a set of keys. Values are refreshed in the
+// background before they expire, and served stale for up to maxStale after
+// expiring while a refresh runs, so callers rarely wait for a load. Only one
+// load of a key runs at a time; concurrent requests of a key that is not
+// cached wait for the same load. Failed loads are not cached.
+type Cache struct {
+	// Context of every load, cancelled when the service stops
+	ctx          context.Context
+	ttl          time.Duration
+	maxStale     time.Duration
+	refreshAfter time.Duration
+	loadTimeout  time.Duration
+	now          func() time.Time
+
+	lock      sync.Mutex
+	entries   map[string]*entry
+	loads     map[string]*load
+	lastPurge time.Time
+}
+
+// New creates a cache of values that expire after ttl and may be served for
+// maxStale afterwards. Loads run with a context derived from ctx, limited to
+// loadTimeout, so they stop when ctx is cancelled.
+func New(ctx context.Context, ttl time.Duration, maxStale time.Duration, loadTimeout time.Duration) *Cache {
+	return &Cache{
+		ctx:          ctx,
+		ttl:          ttl,
+		maxStale:     maxStale,
+		refreshAfter: time.Duration(float64(ttl) * refreshFraction),
+		loadTimeout:  loadTimeout,
+		now:          time.Now,
+		entries:      make(map[string]*entry),
+		loads:        make(map[string]*load),
+	}
+}
+
+// Get returns the value of a key and its age, loading it with loader if it
+// is not cached or is too stale. A refresh is started in the background
+// when the cached value is close to expiring or expired.
+func (c *Cache) Get(ctx context.Context, key string, loader Loader) (interface{}, time.Duration, error) {
+	c.lock.Lock()
+	if cached, found := c.entries[key]; found {
+		age := c.now().Sub(cached.loadedAt)
+		if age < c.ttl+c.maxStale {
+			if age >= c.refreshAfter {
+				c.startLoad(key, loader)
+			}
+			c.lock.Unlock()
+			return cached.value, age, nil
+		}
+	}
+	pending := c.startLoad(key, loader)
+	c.lock.Unlock()
+
+	select {
+	case <-pending.done:
+		if pending.err != nil {
+			return nil, 0, pending.err
+		}
+		return pending.value, c.now().Sub(pending.loadedAt), nil
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// Len returns the number of cached values, including stale ones
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// startLoad loads a key unless it is already being loaded. The load is not
+// bound to the request that started it, as other requests may be waiting
+// for it, but to the context of the cache. Must be called with the lock held.
+func (c *Cache) startLoad(key string, loader Loader) *load {
+	if pending, found := c.loads[key]; found {
+		return pending
+	}
+
+	pending := &load{done: make(chan struct{})}
+	c.loads[key] = pending
+	go func() {
+		ctx, cancel := context.WithTimeout(c.ctx, c.loadTimeout)
+		defer cancel()
+		value, err := loader(ctx)
+
+		c.lock.Lock()
+		delete(c.loads, key)
+		pending.value, pending.err, pending.loadedAt = value, err, c.now()
+		if err == nil {
+			c.entries[key] = &entry{value: value, loadedAt: pending.loadedAt}
+		}
+		c.purge(pending.loadedAt)
+		c.lock.Unlock()
+		close(pending.done)
+	}()
+	return pending
+}
+
+// purge removes the values that can no longer be served, at most once per
+// TTL. Must be called with the lock held.
+func (c *Cache) purge(now time.Time) {
+	if now.Sub(c.lastPurge) < c.ttl {
+		return
+	}
+	c.lastPurge = now
+	for key, cached := range c.entries {
+		if now.Sub(cached.loadedAt) >= c.ttl+c.maxStale {
+			delete(c.entries, key)
+		}
+	}
+}
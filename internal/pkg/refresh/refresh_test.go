@@ -0,0 +1,211 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Refreshing cache tests
+
+package refresh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// countingLoader returns the number of times it was called, once released
+type countingLoader struct {
+	calls   int32
+	release chan struct{}
+	err     error
+}
+
+func newCountingLoader() *countingLoader {
+	loader := &countingLoader{release: make(chan struct{})}
+	close(loader.release)
+	return loader
+}
+
+func (l *countingLoader) load(ctx context.Context) (interface{}, error) {
+	calls := atomic.AddInt32(&l.calls, 1)
+	<-l.release
+	if l.err != nil {
+		return nil, l.err
+	}
+	return int(calls), nil
+}
+
+func (l *countingLoader) count() int32 {
+	return atomic.LoadInt32(&l.calls)
+}
+
+var _ = ginkgo.Describe("refreshing cache", func() {
+
+	var now time.Time
+	var nowLock sync.Mutex
+	var cache *Cache
+	var loader *countingLoader
+
+	setNow := func(t time.Time) {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		now = t
+	}
+
+	ginkgo.BeforeEach(func() {
+		setNow(time.Unix(1000, 0))
+		cache = New(context.Background(), time.Minute, time.Minute, time.Second)
+		cache.now = func() time.Time {
+			nowLock.Lock()
+			defer nowLock.Unlock()
+			return now
+		}
+		loader = newCountingLoader()
+	})
+
+	get := func() (interface{}, time.Duration) {
+		value, age, err := cache.Get(context.Background(), "key", loader.load)
+		gomega.Expect(err).To(gomega.Succeed())
+		return value, age
+	}
+
+	ginkgo.It("should load missing values and serve them while fresh", func() {
+		value, age := get()
+		gomega.Expect(value).To(gomega.Equal(1))
+		gomega.Expect(age).To(gomega.BeZero())
+
+		setNow(now.Add(30 * time.Second))
+		value, age = get()
+		gomega.Expect(value).To(gomega.Equal(1))
+		gomega.Expect(age).To(gomega.Equal(30 * time.Second))
+		gomega.Expect(loader.count()).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("should coalesce concurrent loads", func() {
+		loader.release = make(chan struct{})
+		results := make(chan interface{}, 10)
+		for i := 0; i < 10; i++ {
+			go func() {
+				defer ginkgo.GinkgoRecover()
+				value, _ := get()
+				results <- value
+			}()
+		}
+		gomega.Eventually(loader.count).Should(gomega.Equal(int32(1)))
+		close(loader.release)
+		for i := 0; i < 10; i++ {
+			gomega.Eventually(results).Should(gomega.Receive(gomega.Equal(1)))
+		}
+		gomega.Expect(loader.count()).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("should refresh values in the background before they expire", func() {
+		get()
+		setNow(now.Add(50 * time.Second))
+		value, age := get()
+		gomega.Expect(value).To(gomega.Equal(1))
+		gomega.Expect(age).To(gomega.Equal(50 * time.Second))
+		gomega.Eventually(func() interface{} {
+			value, _ := get()
+			return value
+		}).Should(gomega.Equal(2))
+	})
+
+	ginkgo.It("should serve stale values while refreshing", func() {
+		get()
+		loader.release = make(chan struct{})
+		setNow(now.Add(90 * time.Second))
+		value, age := get()
+		gomega.Expect(value).To(gomega.Equal(1))
+		gomega.Expect(age).To(gomega.Equal(90 * time.Second))
+		// A single refresh runs
+		gomega.Eventually(loader.count).Should(gomega.Equal(int32(2)))
+		get()
+		gomega.Consistently(loader.count).Should(gomega.Equal(int32(2)))
+		close(loader.release)
+	})
+
+	ginkgo.It("should wait for values too stale to serve", func() {
+		get()
+		setNow(now.Add(2 * time.Minute))
+		value, age := get()
+		gomega.Expect(value).To(gomega.Equal(2))
+		gomega.Expect(age).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should keep serving stale values when the refresh fails", func() {
+		get()
+		loader.err = errors.New("cluster down")
+		setNow(now.Add(90 * time.Second))
+		get()
+		gomega.Eventually(loader.count).Should(gomega.Equal(int32(2)))
+		value, _ := get()
+		gomega.Expect(value).To(gomega.Equal(1))
+
+		setNow(now.Add(time.Minute))
+		_, _, err := cache.Get(context.Background(), "key", loader.load)
+		gomega.Expect(err).To(gomega.MatchError("cluster down"))
+	})
+
+	ginkgo.It("should not cache failures", func() {
+		loader.err = errors.New("cluster down")
+		_, _, err := cache.Get(context.Background(), "key", loader.load)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		loader.err = nil
+		value, _ := get()
+		gomega.Expect(value).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should stop waiting when the request is cancelled", func() {
+		loader.release = make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := cache.Get(ctx, "key", loader.load)
+		gomega.Expect(err).To(gomega.Equal(context.Canceled))
+
+		// The load goes on for other requests
+		close(loader.release)
+		gomega.Eventually(cache.Len).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should cancel loads when the cache context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cache = New(ctx, time.Minute, time.Minute, time.Minute)
+		blocking := func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		result := make(chan error, 1)
+		go func() {
+			_, _, err := cache.Get(context.Background(), "key", blocking)
+			result <- err
+		}()
+		cancel()
+		gomega.Eventually(result).Should(gomega.Receive(gomega.Equal(context.Canceled)))
+	})
+
+	ginkgo.It("should purge values that can no longer be served", func() {
+		get()
+		_, _, err := cache.Get(context.Background(), "other", loader.load)
+		gomega.Expect(err).To(gomega.Succeed())
+		setNow(now.Add(3 * time.Minute))
+		get()
+		gomega.Expect(cache.Len()).To(gomega.Equal(1))
+	})
+})
@@ -155,8 +155,9 @@ func (s *Service) startMetrics(httpListener net.Listener, errChan chan<- error)
 	}
 	go watcher.Run(errChan)
 
-	// Create server with metrics handler
+	// Create server with metrics and health handlers
 	http.Handle("/metrics", handler)
+	http.HandleFunc("/healthz", healthzHandler(watcher))
 	httpServer := &http.Server{}
 
 	// Start HTTP server
@@ -173,3 +174,15 @@ func (s *Service) startMetrics(httpListener net.Listener, errChan chan<- error)
 
 	return httpServer, nil
 }
+
+// healthzHandler reports the service is healthy while the watcher keeps
+// the label values up to date.
+func healthzHandler(watcher *Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := watcher.Healthy(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
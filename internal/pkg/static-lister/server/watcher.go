@@ -27,7 +27,9 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"os"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,8 +41,16 @@ type Watcher struct {
 	gauge     *prometheus.GaugeVec
 
 	currentLabels []string
+
+	// State reported by Healthy
+	stateLock sync.Mutex
+	running   bool
+	lastErr   error
 }
 
+// Watcher has not started watching or has stopped without error
+var errNotWatching = errors.New("label file is not being watched")
+
 func NewWatcher(labelFile string, gauge *prometheus.GaugeVec) (*Watcher, error) {
 	w := &Watcher{
 		labelFile:     labelFile,
@@ -62,6 +72,7 @@ func (w *Watcher) Run(errChan chan<- error) {
 	notifier, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Error().Err(err).Msg("error initializing fsnotify")
+		w.setState(false, err)
 		errChan <- err
 		return
 	}
@@ -70,15 +81,18 @@ func (w *Watcher) Run(errChan chan<- error) {
 	err = notifier.Add(w.labelFile)
 	if err != nil {
 		log.Error().Err(err).Str("file", w.labelFile).Msg("error watching file")
+		w.setState(false, err)
 		errChan <- err
 		return
 	}
+	w.setState(true, nil)
 
 	for {
 		select {
 		case event, ok := <-notifier.Events:
 			if !ok {
 				log.Warn().Msg("notifier event channel closed; stopping watcher")
+				w.setState(false, nil)
 				errChan <- nil
 				return
 			}
@@ -91,6 +105,7 @@ func (w *Watcher) Run(errChan chan<- error) {
 				err := notifier.Add(w.labelFile)
 				if err != nil {
 					log.Error().Err(err).Str("file", w.labelFile).Msg("error watching file")
+					w.setState(false, err)
 					errChan <- err
 					return
 				}
@@ -101,12 +116,14 @@ func (w *Watcher) Run(errChan chan<- error) {
 			err := w.updateLabels()
 			if err != nil {
 				log.Error().Err(err).Msg("error updating labels")
+				w.setState(false, err)
 				errChan <- err
 				return
 			}
 		case err, ok := <-notifier.Errors:
 			if !ok {
 				log.Warn().Msg("notifier error channel closed; stopping watcher")
+				w.setState(false, nil)
 				errChan <- nil
 				return
 			}
@@ -115,6 +132,28 @@ func (w *Watcher) Run(errChan chan<- error) {
 	}
 }
 
+// Healthy returns nil while the label file is watched, or the reason it is not.
+func (w *Watcher) Healthy() error {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+
+	if w.lastErr != nil {
+		return w.lastErr
+	}
+	if !w.running {
+		return errNotWatching
+	}
+	return nil
+}
+
+func (w *Watcher) setState(running bool, err error) {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+
+	w.running = running
+	w.lastErr = err
+}
+
 func (w *Watcher) updateLabels() error {
 	log.Debug().Msg("updating labels")
 
@@ -0,0 +1,361 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Persistent history of the resource usage of service instances
+
+package usage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// GB is the unit of the memory and storage totals, like the Gi of Kubernetes
+	GB = 1 << 30
+	// Day is the resolution of the usage totals once rolled up
+	Day = 24 * time.Hour
+	// DefaultHourlyRetention is the time usage is kept with an hourly resolution
+	DefaultHourlyRetention = 7 * Day
+	// DefaultRetention is the time usage is kept at all
+	DefaultRetention = 400 * Day
+	// The CPU of the stats is recorded as cores / 1000 (see the application-stats
+	// rules in prometheus.prometheusrules.yaml); this converts it to cores.
+	cpuStatCoresFactor = 1000
+)
+
+var (
+	// Totals by hour, and by day once rolled up
+	hourlyBucket = []byte("hourly")
+	dailyBucket  = []byte("daily")
+)
+
+// Usage of the resources of a service instance on a cluster at a point in time
+type Usage struct {
+	ClusterId                string
+	AppInstanceId            string
+	AppInstanceName          string
+	ServiceGroupInstanceId   string
+	ServiceGroupInstanceName string
+	ServiceInstanceId        string
+	ServiceInstanceName      string
+	// CPU as in the application stats, in cores / 1000
+	CpuMillicore float64
+	MemoryByte   float64
+	StorageByte  float64
+}
+
+// Total usage of the resources of a service instance on a cluster over a period
+type Total struct {
+	ClusterId                string  `json:"cluster_id"`
+	AppInstanceId            string  `json:"app_instance_id"`
+	AppInstanceName          string  `json:"app_instance_name"`
+	ServiceGroupInstanceId   string  `json:"service_group_instance_id"`
+	ServiceGroupInstanceName string  `json:"service_group_instance_name"`
+	ServiceInstanceId        string  `json:"service_instance_id"`
+	ServiceInstanceName      string  `json:"service_instance_name"`
+	CpuCoreSeconds           float64 `json:"cpu_core_seconds"`
+	MemoryByteSeconds        float64 `json:"memory_byte_seconds"`
+	StorageByteSeconds       float64 `json:"storage_byte_seconds"`
+}
+
+// CpuCoreHours returns the CPU usage in core-hours
+func (t *Total) CpuCoreHours() float64 {
+	return t.CpuCoreSeconds / time.Hour.Seconds()
+}
+
+// MemoryGbHours returns the memory usage in GB-hours
+func (t *Total) MemoryGbHours() float64 {
+	return t.MemoryByteSeconds / GB / time.Hour.Seconds()
+}
+
+// StorageGbDays returns the storage usage in GB-days
+func (t *Total) StorageGbDays() float64 {
+	return t.StorageByteSeconds / GB / Day.Seconds()
+}
+
+// add adds another total, taking its names as the latest ones
+func (t *Total) add(other *Total) {
+	t.AppInstanceName = other.AppInstanceName
+	t.ServiceGroupInstanceId = other.ServiceGroupInstanceId
+	t.ServiceGroupInstanceName = other.ServiceGroupInstanceName
+	t.ServiceInstanceName = other.ServiceInstanceName
+	t.CpuCoreSeconds += other.CpuCoreSeconds
+	t.MemoryByteSeconds += other.MemoryByteSeconds
+	t.StorageByteSeconds += other.StorageByteSeconds
+}
+
+// Store keeps the usage totals of every service instance in an embedded
+// database, by hour and, once rolled up, by day. Totals are keyed by
+// organization, start of the period, cluster, app instance and service
+// instance, so the totals of an organization over a period are a range of
+// keys.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the store in a file, creating it if needed. The file is locked
+// while the store is open, so only one process can record usage in it.
+func Open(path string) (*Store, derrors.Error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, derrors.NewInternalError("unable to create the directory of the usage store", err)
+	}
+	// Fails instead of waiting forever if another process has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, derrors.NewUnavailableError("unable to open the usage store", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{hourlyBucket, dailyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, derrors.NewInternalError("unable to initialize the usage store", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add integrates the usage of the service instances of an organization over
+// a period into the hourly totals, as if it was constant during the period
+func (s *Store) Add(organizationId string, from time.Time, to time.Time, usages []Usage) derrors.Error {
+	if !from.Before(to) || len(usages) == 0 {
+		return nil
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hourlyBucket)
+		// Split the period at the start of every hour
+		for start := from; start.Before(to); {
+			hour := start.UTC().Truncate(time.Hour)
+			end := hour.Add(time.Hour)
+			if end.After(to) {
+				end = to
+			}
+			seconds := end.Sub(start).Seconds()
+			for _, usage := range usages {
+				total := &Total{
+					ClusterId:                usage.ClusterId,
+					AppInstanceId:            usage.AppInstanceId,
+					AppInstanceName:          usage.AppInstanceName,
+					ServiceGroupInstanceId:   usage.ServiceGroupInstanceId,
+					ServiceGroupInstanceName: usage.ServiceGroupInstanceName,
+					ServiceInstanceId:        usage.ServiceInstanceId,
+					ServiceInstanceName:      usage.ServiceInstanceName,
+					CpuCoreSeconds:           usage.CpuMillicore * cpuStatCoresFactor * seconds,
+					MemoryByteSeconds:        usage.MemoryByte * seconds,
+					StorageByteSeconds:       usage.StorageByte * seconds,
+				}
+				err := addTotal(bucket, encodeKey(organizationId, hour, total), total)
+				if err != nil {
+					return err
+				}
+			}
+			start = end
+		}
+		return nil
+	})
+	if err != nil {
+		return derrors.NewInternalError("unable to store usage", err)
+	}
+	return nil
+}
+
+// Report returns the total usage of every service instance of an
+// organization on each cluster over a period, only of the given app
+// instances if any, sorted by app instance, service instance and cluster. Totals are included if
+// their hour, or their day once rolled up, starts within the period.
+func (s *Store) Report(organizationId string, from time.Time, to time.Time, appInstanceIds []string) ([]*Total, derrors.Error) {
+	selected := make(map[string]bool, len(appInstanceIds))
+	for _, appInstanceId := range appInstanceIds {
+		selected[appInstanceId] = true
+	}
+
+	totals := make(map[string]*Total)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{dailyBucket, hourlyBucket} {
+			cursor := tx.Bucket(name).Cursor()
+			prefix := keyPrefix(organizationId)
+			end := encodeTime(prefix, to)
+			for key, value := cursor.Seek(encodeTime(prefix, from)); key != nil && bytes.Compare(key, end) < 0; key, value = cursor.Next() {
+				total := &Total{}
+				if err := json.Unmarshal(value, total); err != nil {
+					return err
+				}
+				if len(selected) > 0 && !selected[total.AppInstanceId] {
+					continue
+				}
+				id := total.AppInstanceId + "/" + total.ServiceInstanceId + "/" + total.ClusterId
+				if existing, found := totals[id]; found {
+					existing.add(total)
+				} else {
+					totals[id] = total
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, derrors.NewInternalError("unable to read usage", err)
+	}
+
+	result := make([]*Total, 0, len(totals))
+	for _, total := range totals {
+		result = append(result, total)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AppInstanceId != result[j].AppInstanceId {
+			return result[i].AppInstanceId < result[j].AppInstanceId
+		}
+		if result[i].ServiceInstanceId != result[j].ServiceInstanceId {
+			return result[i].ServiceInstanceId < result[j].ServiceInstanceId
+		}
+		return result[i].ClusterId < result[j].ClusterId
+	})
+	return result, nil
+}
+
+// Rollup merges the hourly totals of the days that ended hourlyRetention
+// ago into daily totals, and removes the daily totals of the days that
+// ended retention ago
+func (s *Store) Rollup(now time.Time, hourlyRetention time.Duration, retention time.Duration) derrors.Error {
+	hourlyLimit := now.Add(-hourlyRetention).UTC().Truncate(Day)
+	dailyLimit := now.Add(-retention).UTC().Truncate(Day)
+
+	rolledUp := 0
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		hourly := tx.Bucket(hourlyBucket)
+		daily := tx.Bucket(dailyBucket)
+
+		// Keys are collected first, as deleting moves the cursor
+		expired := make([][]byte, 0)
+		err := hourly.ForEach(func(key, value []byte) error {
+			organizationId, start, ok := decodeKey(key)
+			if !ok || !start.Before(hourlyLimit) {
+				return nil
+			}
+			total := &Total{}
+			if err := json.Unmarshal(value, total); err != nil {
+				return err
+			}
+			expired = append(expired, key)
+			return addTotal(daily, encodeKey(organizationId, start.Truncate(Day), total), total)
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := hourly.Delete(key); err != nil {
+				return err
+			}
+		}
+		rolledUp = len(expired)
+
+		expired = expired[:0]
+		err = daily.ForEach(func(key, _ []byte) error {
+			if _, start, ok := decodeKey(key); ok && start.Before(dailyLimit) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := daily.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	if err != nil {
+		return derrors.NewInternalError("unable to roll up usage", err)
+	}
+	log.Debug().Int("rolledUp", rolledUp).Int("removed", removed).Msg("usage rolled up")
+	return nil
+}
+
+// addTotal adds a total to the one stored with a key, if any
+func addTotal(bucket *bolt.Bucket, key []byte, total *Total) error {
+	if value := bucket.Get(key); value != nil {
+		existing := &Total{}
+		if err := json.Unmarshal(value, existing); err != nil {
+			return err
+		}
+		existing.add(total)
+		total = existing
+	}
+	value, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
+
+// Keys are the organization id, a zero byte, the start of the period in
+// big-endian Unix seconds, and the cluster, app instance and service
+// instance ids separated by zero bytes, so they sort by organization and then by time
+
+func keyPrefix(organizationId string) []byte {
+	return append([]byte(organizationId), 0)
+}
+
+func encodeTime(prefix []byte, t time.Time) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], uint64(t.Unix()))
+	return key
+}
+
+func encodeKey(organizationId string, start time.Time, total *Total) []byte {
+	key := encodeTime(keyPrefix(organizationId), start)
+	key = append(key, 0)
+	key = append(key, total.ClusterId...)
+	key = append(key, 0)
+	key = append(key, total.AppInstanceId...)
+	key = append(key, 0)
+	return append(key, total.ServiceInstanceId...)
+}
+
+func decodeKey(key []byte) (string, time.Time, bool) {
+	separator := bytes.IndexByte(key, 0)
+	if separator < 0 || len(key) < separator+9 {
+		return "", time.Time{}, false
+	}
+	seconds := binary.BigEndian.Uint64(key[separator+1 : separator+9])
+	return string(key[:separator]), time.Unix(int64(seconds), 0).UTC(), true
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Usage store tests
+
+package usage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("usage store", func() {
+
+	var dir string
+	var store *Store
+	start := time.Date(2019, 10, 1, 10, 30, 0, 0, time.UTC)
+
+	web := Usage{
+		ClusterId:         "cluster-1",
+		AppInstanceId:     "app-1",
+		AppInstanceName:   "shop",
+		ServiceInstanceId: "service-1",
+		// Half a core, 1GB of memory, 10GB of storage
+		CpuMillicore: 0.0005,
+		MemoryByte:   GB,
+		StorageByte:  10 * GB,
+	}
+	db := Usage{
+		ClusterId:         "cluster-1",
+		AppInstanceId:     "app-2",
+		ServiceInstanceId: "service-2",
+		CpuMillicore:      0.001,
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "usage")
+		gomega.Expect(err).To(gomega.Succeed())
+		var derr error
+		store, derr = Open(filepath.Join(dir, "usage", "usage.db"))
+		gomega.Expect(derr).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(store.Close()).To(gomega.Succeed())
+		gomega.Expect(os.RemoveAll(dir)).To(gomega.Succeed())
+	})
+
+	report := func(from time.Time, to time.Time, appInstanceIds ...string) []*Total {
+		totals, derr := store.Report("org-1", from, to, appInstanceIds)
+		gomega.Expect(derr).To(gomega.Succeed())
+		return totals
+	}
+
+	ginkgo.It("should integrate usage over time", func() {
+		// Two hours, across three hourly periods
+		for t := start; t.Before(start.Add(2 * time.Hour)); t = t.Add(time.Minute) {
+			gomega.Expect(store.Add("org-1", t, t.Add(time.Minute), []Usage{web, db})).To(gomega.Succeed())
+		}
+		gomega.Expect(store.Add("org-2", start, start.Add(time.Hour), []Usage{web})).To(gomega.Succeed())
+
+		totals := report(start.Truncate(time.Hour), start.Add(3*time.Hour))
+		gomega.Expect(totals).To(gomega.HaveLen(2))
+		gomega.Expect(totals[0].ServiceInstanceId).To(gomega.Equal("service-1"))
+		gomega.Expect(totals[0].AppInstanceName).To(gomega.Equal("shop"))
+		gomega.Expect(totals[0].CpuCoreHours()).To(gomega.BeNumerically("~", 1, 1e-9))
+		gomega.Expect(totals[0].MemoryGbHours()).To(gomega.BeNumerically("~", 2, 1e-9))
+		gomega.Expect(totals[0].StorageGbDays()).To(gomega.BeNumerically("~", 20.0/24, 1e-9))
+		gomega.Expect(totals[1].CpuCoreHours()).To(gomega.BeNumerically("~", 2, 1e-9))
+
+		// Only the hours starting within the period
+		totals = report(start.Truncate(time.Hour).Add(time.Hour), start.Add(time.Hour))
+		gomega.Expect(totals[0].CpuCoreHours()).To(gomega.BeNumerically("~", 0.5, 1e-9))
+
+		totals = report(start.Truncate(time.Hour), start.Add(3*time.Hour), "app-2")
+		gomega.Expect(totals).To(gomega.HaveLen(1))
+		gomega.Expect(totals[0].AppInstanceId).To(gomega.Equal("app-2"))
+
+		gomega.Expect(report(start.Add(24*time.Hour), start.Add(48*time.Hour))).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should measure CPU in the cores of nalej_servinst_cpu_core", func() {
+		// Recorded as 0.00025 for a quarter of a core
+		quarter := web
+		quarter.CpuMillicore = 0.00025
+		gomega.Expect(store.Add("org-1", start, start.Add(4*time.Hour), []Usage{quarter})).To(gomega.Succeed())
+		totals := report(start.Truncate(time.Hour), start.Add(5*time.Hour))
+		gomega.Expect(totals[0].CpuCoreSeconds).To(gomega.BeNumerically("~", 3600, 1e-6))
+		gomega.Expect(totals[0].CpuCoreHours()).To(gomega.BeNumerically("~", 1, 1e-9))
+	})
+
+	ginkgo.It("should split periods at the start of each hour", func() {
+		gomega.Expect(store.Add("org-1", start, start.Add(time.Hour), []Usage{db})).To(gomega.Succeed())
+		firstHour := report(start.Truncate(time.Hour), start.Truncate(time.Hour).Add(time.Hour))
+		gomega.Expect(firstHour[0].CpuCoreSeconds).To(gomega.Equal(1800.0))
+	})
+
+	ginkgo.It("should keep the usage of each cluster apart", func() {
+		remote := web
+		remote.ClusterId = "cluster-2"
+		gomega.Expect(store.Add("org-1", start, start.Add(time.Minute), []Usage{web, remote})).To(gomega.Succeed())
+		totals := report(start.Truncate(time.Hour), start.Add(time.Hour))
+		gomega.Expect(totals).To(gomega.HaveLen(2))
+		gomega.Expect(totals[0].ClusterId).To(gomega.Equal("cluster-1"))
+		gomega.Expect(totals[1].ClusterId).To(gomega.Equal("cluster-2"))
+		gomega.Expect(totals[1].ServiceInstanceId).To(gomega.Equal("service-1"))
+		gomega.Expect(totals[1].CpuCoreSeconds).To(gomega.Equal(30.0))
+	})
+
+	ginkgo.It("should roll up hourly totals into daily ones", func() {
+		for hour := 0; hour < 48; hour++ {
+			from := start.Truncate(Day).Add(time.Duration(hour) * time.Hour)
+			gomega.Expect(store.Add("org-1", from, from.Add(time.Hour), []Usage{db})).To(gomega.Succeed())
+		}
+		before := report(start.Truncate(Day), start.Add(3*Day))
+
+		// The first day is rolled up
+		now := start.Truncate(Day).Add(Day + 12*time.Hour)
+		gomega.Expect(store.Rollup(now, 12*time.Hour, 30*Day)).To(gomega.Succeed())
+		after := report(start.Truncate(Day), start.Add(3*Day))
+		gomega.Expect(after[0].CpuCoreSeconds).To(gomega.Equal(before[0].CpuCoreSeconds))
+		// With a daily resolution
+		gomega.Expect(report(start.Truncate(Day), start.Truncate(Day).Add(Day))[0].CpuCoreHours()).To(gomega.BeNumerically("~", 24, 1e-9))
+		gomega.Expect(report(start.Truncate(Day).Add(time.Hour), start.Truncate(Day).Add(Day))).To(gomega.BeEmpty())
+
+		// Rolling up again changes nothing
+		gomega.Expect(store.Rollup(now, 12*time.Hour, 30*Day)).To(gomega.Succeed())
+		gomega.Expect(report(start.Truncate(Day), start.Add(3*Day))[0].CpuCoreSeconds).To(gomega.Equal(before[0].CpuCoreSeconds))
+
+		// Expired days are removed
+		gomega.Expect(store.Rollup(now.Add(30*Day), 12*time.Hour, 30*Day)).To(gomega.Succeed())
+		gomega.Expect(report(start.Truncate(Day), start.Add(3*Day))[0].CpuCoreHours()).To(gomega.BeNumerically("~", 24, 1e-9))
+	})
+
+	ginkgo.It("should keep the usage when reopened", func() {
+		gomega.Expect(store.Add("org-1", start, start.Add(time.Hour), []Usage{web})).To(gomega.Succeed())
+		gomega.Expect(store.Close()).To(gomega.Succeed())
+		var derr error
+		store, derr = Open(filepath.Join(dir, "usage", "usage.db"))
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(report(start.Truncate(time.Hour), start.Add(time.Hour))).To(gomega.HaveLen(1))
+	})
+})
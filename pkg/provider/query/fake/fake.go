@@ -78,3 +78,8 @@ func (p *Provider) ExecuteTemplate(ctx context.Context, name query.TemplateName,
 
 	return res, nil
 }
+
+// Ping always succeeds
+func (p *Provider) Ping(ctx context.Context) derrors.Error {
+	return nil
+}
@@ -20,6 +20,7 @@ package prometheus
 
 import (
 	"context"
+	"time"
 
 	"github.com/nalej/derrors"
 
@@ -31,6 +32,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// Query without dependencies on any series, used to check availability
+const pingQuery = "vector(1)"
+
 type Provider struct {
 	api       v1.API
 	templates query.TemplateMap
@@ -113,3 +117,13 @@ func (p *Provider) ExecuteTemplate(ctx context.Context, name query.TemplateName,
 
 	return val, nil
 }
+
+// Ping executes a trivial query to check Prometheus can be reached and
+// its query engine works.
+func (p *Provider) Ping(ctx context.Context) derrors.Error {
+	_, err := p.api.Query(ctx, pingQuery, time.Now())
+	if err != nil {
+		return derrors.NewUnavailableError("prometheus not available", err)
+	}
+	return nil
+}
@@ -192,6 +192,9 @@ var queryResults = map[string]map[v1.Range][]byte{
 	"scalar(sum(avg_over_time(node_filesystem_free_bytes[600s])))": {
 		v1.Range{}: []byte(`{"resultType":"scalar","result":[1554037344.922,"294341394022.4"]}`),
 	},
+	"scalar(sum(irate(node_network_receive_bytes_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[2m])))": {
+		v1.Range{}: []byte(`{"resultType":"scalar","result":[1554037344.922,"52431.7"]}`),
+	},
 	"scalar(irate(services_created_total[2m]) * 60)": {
 		v1.Range{}: []byte(`{"resultType":"scalar","result":[1554037344.922,"8"]}`),
 	},
@@ -524,6 +527,14 @@ var _ = ginkgo.Describe("prometheus", func() {
 			).To(gomega.Equal(int64(294341394022)))
 		})
 
+		ginkgo.It("should execute network template", func() {
+			gomega.Expect(
+				provider.ExecuteTemplate(context.Background(),
+					query.TemplateName_NetworkReceive,
+					nil),
+			).To(gomega.Equal(int64(52431)))
+		})
+
 		ginkgo.It("should execute counter template", func() {
 			tname, err := query.GetPlatformTemplateName(query.MetricCreated)
 			gomega.Expect(err).To(gomega.Succeed())
@@ -94,6 +94,42 @@ scalar(max(avg_over_time(node_filesystem_size[{{ .AvgSeconds }}s])))
 {{- else -}}
 scalar(max(node_filesystem_size))
 {{- end -}}
+`,
+
+	// Network throughput and packet drops are summed over all physical
+	// node interfaces, skipping loopback and the virtual interfaces
+	// created for pods and overlay networks, which would otherwise
+	// count the same traffic twice. Results are per second.
+	query.TemplateName_NetworkReceive: `
+{{- if (gt .AvgSeconds 120) -}}
+scalar(sum(rate(node_network_receive_bytes_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[{{ .AvgSeconds }}s])))
+{{- else -}}
+scalar(sum(irate(node_network_receive_bytes_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[2m])))
+{{- end -}}
+`,
+
+	query.TemplateName_NetworkTransmit: `
+{{- if (gt .AvgSeconds 120) -}}
+scalar(sum(rate(node_network_transmit_bytes_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[{{ .AvgSeconds }}s])))
+{{- else -}}
+scalar(sum(irate(node_network_transmit_bytes_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[2m])))
+{{- end -}}
+`,
+
+	query.TemplateName_NetworkReceiveDrops: `
+{{- if (gt .AvgSeconds 120) -}}
+scalar(sum(rate(node_network_receive_drop_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[{{ .AvgSeconds }}s])))
+{{- else -}}
+scalar(sum(irate(node_network_receive_drop_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[2m])))
+{{- end -}}
+`,
+
+	query.TemplateName_NetworkTransmitDrops: `
+{{- if (gt .AvgSeconds 120) -}}
+scalar(sum(rate(node_network_transmit_drop_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[{{ .AvgSeconds }}s])))
+{{- else -}}
+scalar(sum(irate(node_network_transmit_drop_total{device!~'lo|veth.+|docker.+|cali.+|flannel.+|cni.+|zt.+'}[2m])))
+{{- end -}}
 `,
 
 	// For counters, we return the increase over the requested period,
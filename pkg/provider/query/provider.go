@@ -40,6 +40,8 @@ type Provider interface {
 	// averaged. This function executes such a template using the
 	// provider
 	ExecuteTemplate(ctx context.Context, name TemplateName, vars *TemplateVars) (int64, derrors.Error)
+	// Check that the backend of the provider can execute queries
+	Ping(ctx context.Context) derrors.Error
 }
 
 // Types to indicate what a provider supports
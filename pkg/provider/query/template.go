@@ -47,6 +47,11 @@ const (
 	TemplateName_Storage       TemplateName = "storage"
 	TemplateName_UsableStorage TemplateName = "usablestorage"
 
+	TemplateName_NetworkReceive       TemplateName = "networkreceive"
+	TemplateName_NetworkTransmit      TemplateName = "networktransmit"
+	TemplateName_NetworkReceiveDrops  TemplateName = "networkreceivedrops"
+	TemplateName_NetworkTransmitDrops TemplateName = "networktransmitdrops"
+
 	TemplateName_PlatformStatsCounter TemplateName = "platformcounter"
 	TemplateName_PlatformStatsGauge   TemplateName = "platformgauge"
 )